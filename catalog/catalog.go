@@ -2,10 +2,10 @@ package catalog
 
 import (
 	"context"
-	"fmt"
 	"github.com/Gufran/flightpath/log"
 	"github.com/Gufran/flightpath/metrics"
 	"github.com/hashicorp/consul/api"
+	"sort"
 	"time"
 )
 
@@ -15,11 +15,54 @@ const FlightPathTag = "in-flightpath"
 
 type ServiceFinder interface {
 	Services(*api.QueryOptions) (map[string][]string, *api.QueryMeta, error)
-	Service(string, string, *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error)
+	HealthService(string, string, bool, *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+	HealthState(string, *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error)
+	Namespaces(*api.QueryOptions) ([]string, *api.QueryMeta, error)
+}
+
+// consulFinder lists the services from the catalog
+// and the service instances from the health API.
+type consulFinder struct {
+	catalog *api.Catalog
+	health  *api.Health
+	raw     *api.Raw
+}
+
+func (f *consulFinder) Services(q *api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
+	return f.catalog.Services(q)
+}
+
+func (f *consulFinder) HealthService(name, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	return f.health.Service(name, tag, passingOnly, q)
+}
+
+func (f *consulFinder) HealthState(state string, q *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error) {
+	return f.health.State(state, q)
+}
+
+// Namespaces lists the consul enterprise namespaces. The
+// consul API version in use does not have a client for the
+// endpoint so the response is decoded here.
+func (f *consulFinder) Namespaces(q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	var out []struct {
+		Name string
+	}
+
+	meta, err := f.raw.Query("/v1/namespaces", &out, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	for _, ns := range out {
+		names = append(names, ns.Name)
+	}
+	return names, meta, nil
 }
 
 type CertFinder interface {
 	ConnectCALeaf(string, *api.QueryOptions) (*api.LeafCert, *api.QueryMeta, error)
+	ConnectCARoots(*api.QueryOptions) (*api.CARootList, *api.QueryMeta, error)
 }
 
 // Catalog interacts with consul and keeps a list
@@ -34,14 +77,37 @@ type Catalog struct {
 func NewCatalog(ctx context.Context, client *api.Client) *Catalog {
 	return &Catalog{
 		ctx:     ctx,
-		catalog: client.Catalog(),
+		catalog: &consulFinder{catalog: client.Catalog(), health: client.Health(), raw: client.Raw()},
 		connect: client.Agent(),
 	}
 }
 
 // DiscoverClusters delivers the state-of-the-world list
-// of clusters as available in the consul catalog.
-func (c *Catalog) DiscoverClusters(clusters chan<- ClusterInfo, cleanup chan<- string) {
+// of clusters as available in the consul catalog. Only the
+// services matched by the selector are discovered, in every
+// namespace of the selector.
+func (c *Catalog) DiscoverClusters(selector *Selector, config *PipelineConfig, clusters chan<- ClusterInfo, cleanup chan<- string) {
+	p := newPipeline(c.catalog, selector, config, clusters, cleanup)
+	go p.run(c.ctx)
+
+	switch {
+	case len(selector.Namespaces) == 0:
+		c.discoverNamespace(c.ctx, p, "")
+
+	case selector.AllNamespaces():
+		c.watchNamespaces(p)
+
+	default:
+		for _, namespace := range selector.Namespaces {
+			go c.discoverNamespace(c.ctx, p, namespace)
+		}
+		<-c.ctx.Done()
+	}
+}
+
+// watchNamespaces discovers the clusters in every namespace
+// and follows the namespaces as they are created and deleted.
+func (c *Catalog) watchNamespaces(p *pipeline) {
 	qopts := &api.QueryOptions{
 		AllowStale:        false,
 		RequireConsistent: true,
@@ -49,93 +115,55 @@ func (c *Catalog) DiscoverClusters(clusters chan<- ClusterInfo, cleanup chan<- s
 		WaitTime:          30 * time.Second,
 	}
 
-	activeWatchers := map[string]func(){}
+	w := newWatch(c.ctx, "namespaces")
+	defer w.close()
+
+	activeNamespaces := map[string]func(){}
 
 	for {
-		metrics.Incr("catalog.discovery.clusters.loop", nil)
+		metrics.Incr("catalog.discovery.namespaces.loop", nil)
 		select {
 		case <-c.ctx.Done():
-			logger.Info("cluster discovery loop has shut down")
+			logger.Info("namespace discovery loop has shut down")
 			return
 
 		default:
-			services, meta, err := c.catalog.Services(qopts.WithContext(c.ctx))
+			namespaces, meta, err := c.catalog.Namespaces(qopts.WithContext(c.ctx))
 			if err != nil {
-				metrics.Incr("catalog.discovery.clusters.error.fetch", nil)
-				logger.WithError(err).Error("failed to fetch list of services from consul catalog")
-				time.Sleep(3 * time.Second)
-				break
-			}
-
-			if meta.LastIndex <= qopts.WaitIndex {
-				metrics.Incr("catalog.discovery.clusters.noop", nil)
+				metrics.Incr("catalog.discovery.namespaces.error.fetch", nil)
+				logger.WithError(err).Error("failed to fetch list of namespaces from consul")
+				w.fail(err)
 				break
 			}
 
-			qopts.WaitIndex = meta.LastIndex
-
-			candidates := map[string]bool{}
-			for name, tags := range services {
-				for _, tag := range tags {
-					if tag == FlightPathTag {
-						candidates[name] = true
-						logger.WithField("service", name).Info("found discovery candidate service")
-						break
-					}
-				}
-			}
-
-			metrics.GaugeI("catalog.discovery.clusters.candidate", len(candidates), nil)
-
-			// Remove all services where there is a corresponding
-			// connect proxy registered in catalog
-			candidates, err = c.filterConnectTargets(candidates)
-			if err != nil {
-				metrics.Incr("catalog.discovery.clusters.error.filter_connect", nil)
-				logger.WithError(err).Error("failed to filter connect target services")
-				time.Sleep(3 * time.Second)
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.discovery.namespaces.noop", nil)
 				break
 			}
 
-			metrics.GaugeI("catalog.discovery.clusters.targets", len(candidates), nil)
-			logger.WithField("total_candidates", len(candidates)).
-				WithField("candidates", candidates).
-				Debug("candidate list is ready")
-
-			metrics.GaugeI("catalog.discovery.clusters.watchers", len(activeWatchers), nil)
-			logger.WithField("watchers", mapToSlice(activeWatchers)).
-				Debug("watcher state")
-
-			// Find services that dont' have an active watcher
-			// and start a watcher for them.
-			for name, isSidecar := range candidates {
-				if _, ok := activeWatchers[name]; !ok {
-					metrics.Incr("catalog.discovery.clusters.watcher.new", []string{"service:" + name})
-					logger.WithField("service", name).Info("starting watcher for service")
+			known := map[string]bool{}
+			for _, namespace := range namespaces {
+				known[namespace] = true
+				if _, ok := activeNamespaces[namespace]; !ok {
+					logger.WithField("namespace", namespace).Info("starting cluster discovery in namespace")
 
 					ctx, cancel := context.WithCancel(c.ctx)
-					activeWatchers[name] = cancel
-					go c.watchService(ctx, name, isSidecar, clusters)
+					activeNamespaces[namespace] = cancel
+					go c.discoverNamespace(ctx, p, namespace)
 				}
 			}
 
-			// Find services that have an active watcher but
-			// are no longer available in catalog and stop
-			// their watcher
-			for name, stop := range activeWatchers {
-				if _, ok := candidates[name]; !ok {
-					metrics.Incr("catalog.discovery.clusters.watcher.closing", []string{"service:" + name})
-					logger.WithField("service", name).Info("stopping watcher for service")
-
-					// Notify the cleanup channel asynchronously so that we
-					// don't end up blocking if the other side is not
-					// able to consume the channel fast enough
-					go func(n string) { cleanup <- n }(name)
-
+			for namespace, stop := range activeNamespaces {
+				if !known[namespace] {
+					logger.WithField("namespace", namespace).Info("stopping cluster discovery in namespace")
 					stop()
-					delete(activeWatchers, name)
+					delete(activeNamespaces, namespace)
 				}
 			}
+
+			metrics.GaugeI("catalog.discovery.namespaces.count", len(activeNamespaces), nil)
+			logger.WithField("namespaces", mapToSlice(activeNamespaces)).
+				Debug("namespace state")
 		}
 	}
 }
@@ -145,10 +173,16 @@ func mapToSlice(m map[string]func()) []string {
 	for n := range m {
 		r = append(r, n)
 	}
+	sort.Strings(r)
 	return r
 }
 
-func (c *Catalog) watchService(ctx context.Context, name string, isSidecar bool, clusters chan<- ClusterInfo) {
+// discoverNamespace watches the list of services in the
+// namespace and hands it over to the pipeline, along with
+// the changes to the health checks in every datacenter. An
+// empty namespace leaves the queries in the namespace of
+// the consul token.
+func (c *Catalog) discoverNamespace(ctx context.Context, p *pipeline, namespace string) {
 	qopts := &api.QueryOptions{
 		AllowStale:        false,
 		RequireConsistent: true,
@@ -156,63 +190,226 @@ func (c *Catalog) watchService(ctx context.Context, name string, isSidecar bool,
 		WaitTime:          30 * time.Second,
 	}
 
-	tags := []string{
-		"service:" + name,
-		fmt.Sprintf("is_sidecar:%v", isSidecar),
+	var tags []string
+	if namespace != "" {
+		ctx = WithNamespace(ctx, namespace)
+		tags = []string{"namespace:" + namespace}
+	}
+
+	w := newWatch(ctx, watchName("services", namespace, ""))
+	defer w.close()
+
+	for _, dc := range append([]string{""}, p.selector.Datacenters...) {
+		go c.watchHealth(ctx, p, namespace, dc)
+	}
+
+	for _, dc := range p.selector.Datacenters {
+		go c.watchDatacenter(ctx, p, namespace, dc)
 	}
 
 	for {
-		metrics.Incr("catalog.discovery.service.loop", tags)
+		metrics.Incr("catalog.discovery.clusters.loop", tags)
 		select {
 		case <-ctx.Done():
-			logger.WithField("service", name).Infof("service watcher loop has shut down")
+			// The namespace is gone while Flightpath keeps running,
+			// the clusters in the namespace must be removed.
+			if c.ctx.Err() == nil {
+				p.sync(c.ctx, namespace, nil)
+			}
+
+			logger.WithField("namespace", namespace).Info("cluster discovery loop has shut down")
 			return
 
 		default:
-			nodes, meta, err := c.catalog.Service(name, "", qopts.WithContext(c.ctx))
+			services, meta, err := c.catalog.Services(qopts.WithContext(ctx))
 			if err != nil {
-				metrics.Incr("catalog.discovery.service.error.fetch", tags)
-				logger.WithError(err).WithField("service", name).Error("failed to fetch service definition")
-				time.Sleep(3 * time.Second)
+				metrics.Incr("catalog.discovery.clusters.error.fetch", tags)
+				logger.WithError(err).WithField("namespace", namespace).Error("failed to fetch list of services from consul catalog")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.discovery.clusters.noop", tags)
 				break
 			}
 
-			if meta.LastIndex <= qopts.WaitIndex {
-				metrics.Incr("catalog.discovery.service.noop", tags)
+			p.sync(ctx, namespace, services)
+		}
+	}
+}
+
+// watchDatacenter watches the list of services in the namespace
+// of a remote datacenter. The services of the namespace are taken
+// from the local catalog, the remote list only tells when one of
+// their instances in the datacenter changes.
+func (c *Catalog) watchDatacenter(ctx context.Context, p *pipeline, namespace, dc string) {
+	qopts := &api.QueryOptions{
+		Datacenter:        dc,
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(ctx, watchName("services", namespace, dc))
+	defer w.close()
+
+	tags := []string{"dc:" + dc}
+	if namespace != "" {
+		tags = append(tags, "namespace:"+namespace)
+	}
+
+	// The services are fetched when they are discovered,
+	// only the later changes are of interest.
+	synced := false
+
+	for {
+		metrics.Incr("catalog.discovery.clusters.loop", tags)
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			_, meta, err := c.catalog.Services(qopts.WithContext(ctx))
+			if err != nil {
+				metrics.Incr("catalog.discovery.clusters.error.fetch", tags)
+				logger.WithError(err).WithField("namespace", namespace).WithField("dc", dc).Error("failed to fetch list of services from consul catalog")
+				w.fail(err)
 				break
 			}
 
-			qopts.WaitIndex = meta.LastIndex
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.discovery.clusters.noop", tags)
+				break
+			}
 
-			metrics.Incr("catalog.discovery.service.updated", tags)
-			clusters <- &Cluster{
-				name:      name,
-				isConnect: isSidecar,
-				services:  filterUnhealthyNodes(nodes),
+			if synced {
+				p.touch(namespace)
 			}
+			synced = true
 		}
 	}
 }
 
-func allChecksPassing(checks api.HealthChecks) bool {
-	for _, check := range checks {
-		if check.Status != api.HealthPassing {
-			return false
+// watchHealth watches all health checks in the namespace and
+// the datacenter, and notifies the pipeline about the checks
+// that changed. A single blocking query follows the health of
+// every service instead of one query per service.
+func (c *Catalog) watchHealth(ctx context.Context, p *pipeline, namespace, dc string) {
+	qopts := &api.QueryOptions{
+		Datacenter:        dc,
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(ctx, watchName("health", namespace, dc))
+	defer w.close()
+
+	var tags []string
+	if namespace != "" {
+		tags = append(tags, "namespace:"+namespace)
+	}
+	if dc != "" {
+		tags = append(tags, "dc:"+dc)
+	}
+
+	var previous map[string]*api.HealthCheck
+
+	for {
+		metrics.Incr("catalog.discovery.health.loop", tags)
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			checks, meta, err := c.catalog.HealthState(api.HealthAny, qopts.WithContext(ctx))
+			if err != nil {
+				metrics.Incr("catalog.discovery.health.error.fetch", tags)
+				logger.WithError(err).WithField("namespace", namespace).WithField("dc", dc).Error("failed to fetch health checks")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.discovery.health.noop", tags)
+				break
+			}
+
+			current := make(map[string]*api.HealthCheck, len(checks))
+			for _, check := range checks {
+				current[check.Node+"/"+check.CheckID] = check
+			}
+
+			// The services are fetched when they are discovered,
+			// only the later changes are of interest.
+			if previous != nil {
+				changed := changedChecks(previous, current)
+				metrics.GaugeI("catalog.discovery.health.changes", len(changed), tags)
+				p.notify(namespace, changed)
+			}
+			previous = current
 		}
 	}
-	return true
 }
 
-func filterUnhealthyNodes(services []*api.CatalogService) []*api.CatalogService {
+// catalogServices flattens the health API entries into
+// catalog services. The checks of the node and of the
+// service instance are both kept on the result.
+func catalogServices(entries []*api.ServiceEntry) []*api.CatalogService {
 	var result []*api.CatalogService
-	for _, service := range services {
-		if allChecksPassing(service.Checks) {
-			result = append(result, service)
+	for _, entry := range entries {
+		if entry.Node == nil || entry.Service == nil {
+			continue
 		}
+
+		result = append(result, &api.CatalogService{
+			ID:                       entry.Node.ID,
+			Node:                     entry.Node.Node,
+			Address:                  entry.Node.Address,
+			Datacenter:               entry.Node.Datacenter,
+			TaggedAddresses:          entry.Node.TaggedAddresses,
+			NodeMeta:                 entry.Node.Meta,
+			ServiceID:                entry.Service.ID,
+			ServiceName:              entry.Service.Service,
+			ServiceAddress:           entry.Service.Address,
+			ServiceTaggedAddresses:   entry.Service.TaggedAddresses,
+			ServiceTags:              entry.Service.Tags,
+			ServiceMeta:              entry.Service.Meta,
+			ServicePort:              entry.Service.Port,
+			ServiceEnableTagOverride: entry.Service.EnableTagOverride,
+			ServiceProxy:             entry.Service.Proxy,
+			CreateIndex:              entry.Service.CreateIndex,
+			ModifyIndex:              entry.Service.ModifyIndex,
+			Checks:                   entry.Checks,
+			ServiceWeights: api.Weights{
+				Passing: entry.Service.Weights.Passing,
+				Warning: entry.Service.Weights.Warning,
+			},
+		})
 	}
 	return result
 }
 
+// healthStatus aggregates the node and service checks into
+// one of passing, warning, critical or maintenance. Checks
+// in warning state count as passing if allowWarning is set.
+func healthStatus(checks api.HealthChecks, allowWarning bool) string {
+	status := checks.AggregatedStatus()
+	switch status {
+	case "":
+		// A check with unknown status
+		return api.HealthCritical
+	case api.HealthWarning:
+		if allowWarning {
+			return api.HealthPassing
+		}
+	}
+	return status
+}
+
 func isSidecarProxy(srvc *api.CatalogService) bool {
 	if srvc.ServiceProxy == nil {
 		return false
@@ -224,42 +421,3 @@ func isSidecarProxy(srvc *api.CatalogService) bool {
 
 	return true
 }
-
-func (c *Catalog) filterConnectTargets(candidates map[string]bool) (map[string]bool, error) {
-	qopts := &api.QueryOptions{
-		AllowStale:        false,
-		RequireConsistent: true,
-	}
-
-	results := make(map[string]bool, len(candidates))
-	for service := range candidates {
-		results[service] = false
-	}
-
-	for name := range candidates {
-		services, _, err := c.catalog.Service(name, "", qopts.WithContext(c.ctx))
-		if err != nil {
-			return nil, err
-		}
-
-		// interrogating just one service instance is sufficient
-		// to make out whether or not there is a sidecar proxy
-		// running for the service.
-		svc := services[0]
-		if isSidecarProxy(svc) {
-			// If the service is a sidecar proxy then we
-			// dont' want to watch the target service since
-			// the target may not be able to receive traffic.
-			// In this case we simply remove the target name
-			// from results list.
-			logger.WithField("service", svc.ServiceName).
-				WithField("sidecar_destination", svc.ServiceProxy.DestinationServiceName).
-				Info("sidecar selected for cluster discovery")
-
-			results[svc.ServiceName] = true
-			delete(results, svc.ServiceProxy.DestinationServiceName)
-		}
-	}
-
-	return results, nil
-}
@@ -2,8 +2,10 @@ package catalog
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/consul/api"
+	"sync"
 	"testing"
 )
 
@@ -16,20 +18,39 @@ type ServicesResult struct {
 }
 
 type ServiceResult struct {
-	services []*api.CatalogService
-	meta     *api.QueryMeta
-	err      error
+	entries []*api.ServiceEntry
+	meta    *api.QueryMeta
+	err     error
+}
+
+type HealthStateResult struct {
+	checks api.HealthChecks
+	meta   *api.QueryMeta
+	err    error
+}
+
+type NamespacesResult struct {
+	namespaces []string
+	meta       *api.QueryMeta
+	err        error
 }
 
 type ServiceFinderMock struct {
+	mx            sync.Mutex
 	ctx           context.Context
 	t             *testing.T
-	servicesStack []ServicesResult
+	servicesStack map[string][]ServicesResult
 	serviceStack  map[string][]ServiceResult
+	nsStack       []NamespacesResult
+	healthStack   map[string][]HealthStateResult
 	blockOnFinish bool
 }
 
-func NewServiceFinderMock(ctx context.Context, t *testing.T, service map[string][]ServiceResult, services []ServicesResult, blocking bool) *ServiceFinderMock {
+// NewServiceFinderMock returns a finder that answers with the
+// stacked results. The results of the Services method are keyed
+// by namespace, an empty key is used for queries without one, and
+// queries for a remote datacenter use "<namespace>@<datacenter>".
+func NewServiceFinderMock(ctx context.Context, t *testing.T, service map[string][]ServiceResult, services map[string][]ServicesResult, blocking bool) *ServiceFinderMock {
 	return &ServiceFinderMock{
 		ctx:           ctx,
 		t:             t,
@@ -39,9 +60,33 @@ func NewServiceFinderMock(ctx context.Context, t *testing.T, service map[string]
 	}
 }
 
+// WithHealthState stacks the results of the HealthState method,
+// keyed the same way as the results of HealthService. Without
+// results the method blocks or fails like the other methods.
+func (m *ServiceFinderMock) WithHealthState(checks map[string][]HealthStateResult) *ServiceFinderMock {
+	m.healthStack = checks
+	return m
+}
+
+// WithNamespaces stacks the results of the Namespaces method
+func (m *ServiceFinderMock) WithNamespaces(namespaces []NamespacesResult) *ServiceFinderMock {
+	m.nsStack = namespaces
+	return m
+}
+
 func (m *ServiceFinderMock) AssertFulfilled() bool {
-	if len(m.servicesStack) > 0 {
-		m.t.Errorf("expecting %d more calls to Services method", len(m.serviceStack))
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for namespace, s := range m.servicesStack {
+		if len(s) > 0 {
+			m.t.Errorf("expecting %d more calls to Services method in namespace %q", len(s), namespace)
+			return false
+		}
+	}
+
+	if len(m.nsStack) > 0 {
+		m.t.Errorf("expecting %d more calls to Namespaces method", len(m.nsStack))
 		return false
 	}
 
@@ -52,15 +97,36 @@ func (m *ServiceFinderMock) AssertFulfilled() bool {
 	fulfilled := true
 	for name, s := range m.serviceStack {
 		if len(s) > 0 {
-			m.t.Errorf("expecting %d more calls to Service(%s)", len(s), name)
+			m.t.Errorf("expecting %d more calls to HealthService(%s)", len(s), name)
 			fulfilled = false
 		}
 	}
 	return fulfilled
 }
 
+// PendingServices is the number of HealthService results
+// that are not consumed yet.
+func (m *ServiceFinderMock) PendingServices() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	pending := 0
+	for _, s := range m.serviceStack {
+		pending += len(s)
+	}
+	return pending
+}
+
 func (m *ServiceFinderMock) Services(q *api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
-	if len(m.servicesStack) == 0 {
+	namespace := namespaceFromContext(q.Context())
+	if q.Datacenter != "" {
+		namespace += "@" + q.Datacenter
+	}
+
+	m.mx.Lock()
+	s := m.servicesStack[namespace]
+	if len(s) == 0 {
+		m.mx.Unlock()
 		if m.blockOnFinish {
 			<-m.ctx.Done()
 			return nil, &api.QueryMeta{
@@ -73,20 +139,85 @@ func (m *ServiceFinderMock) Services(q *api.QueryOptions) (map[string][]string,
 	}
 
 	var result ServicesResult
-	result, m.servicesStack = m.servicesStack[0], m.servicesStack[1:]
+	result, m.servicesStack[namespace] = s[0], s[1:]
+	m.mx.Unlock()
 	return result.services, result.meta, result.err
 }
 
-func (m *ServiceFinderMock) Service(name string, tag string, q *api.QueryOptions) ([]*api.CatalogService, *api.QueryMeta, error) {
-	s, ok := m.serviceStack[name]
+func (m *ServiceFinderMock) HealthState(state string, q *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error) {
+	key := ClusterName(namespaceFromContext(q.Context()), state)
+	if q.Datacenter != "" {
+		key += "@" + q.Datacenter
+	}
+
+	m.mx.Lock()
+	s := m.healthStack[key]
+	if len(s) == 0 {
+		m.mx.Unlock()
+		if m.blockOnFinish {
+			<-m.ctx.Done()
+			return nil, &api.QueryMeta{
+				LastIndex: q.WaitIndex,
+			}, nil
+		}
+
+		m.t.Errorf("unexpected call to HealthState(%s). No more expectations", key)
+		return nil, nil, fmt.Errorf("unexpected function call")
+	}
+
+	var result HealthStateResult
+	result, m.healthStack[key] = s[0], s[1:]
+	m.mx.Unlock()
+	return result.checks, result.meta, result.err
+}
+
+func (m *ServiceFinderMock) Namespaces(q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	m.mx.Lock()
+	if len(m.nsStack) == 0 {
+		m.mx.Unlock()
+		if m.blockOnFinish {
+			<-m.ctx.Done()
+			return nil, &api.QueryMeta{
+				LastIndex: q.WaitIndex,
+			}, nil
+		}
+
+		m.t.Errorf("unexpected call to Namespaces. No more expectations")
+		return nil, nil, fmt.Errorf("unexpected function call")
+	}
+
+	var result NamespacesResult
+	result, m.nsStack = m.nsStack[0], m.nsStack[1:]
+	m.mx.Unlock()
+	return result.namespaces, result.meta, result.err
+}
+
+// HealthService returns the results stacked for the service
+// name. Queries in a namespace use the results stacked for
+// "<namespace>/<name>" and queries for a remote datacenter
+// use the results stacked for "<name>@<datacenter>". Filtered
+// queries use the results stacked for "<name>?<filter>".
+func (m *ServiceFinderMock) HealthService(name string, tag string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	key := ClusterName(namespaceFromContext(q.Context()), name)
+	if q.Datacenter != "" {
+		key += "@" + q.Datacenter
+	}
+	if q.Filter != "" {
+		key += "?" + q.Filter
+	}
+
+	m.mx.Lock()
+	s, ok := m.serviceStack[key]
 	if !ok {
-		m.t.Errorf("unexpected Service call with service name %q and tag %q", name, tag)
+		m.t.Errorf("unexpected HealthService call with service name %q and tag %q", key, tag)
 	}
 
 	// TODO: tag is not taken in account, implement support for
 	//   also matching the tag along with the service name
 
 	if len(s) == 0 {
+		m.mx.Unlock()
+
 		if m.blockOnFinish {
 			<-m.ctx.Done()
 			return nil, &api.QueryMeta{
@@ -94,14 +225,15 @@ func (m *ServiceFinderMock) Service(name string, tag string, q *api.QueryOptions
 			}, nil
 		}
 
-		m.t.Error("unexpected call to Service, no more expectations")
+		m.t.Error("unexpected call to HealthService, no more expectations")
 		return nil, nil, fmt.Errorf("unexpected function call")
 	}
 
 	var result ServiceResult
 	result, s = s[0], s[1:]
-	m.serviceStack[name] = s
-	return result.services, result.meta, result.err
+	m.serviceStack[key] = s
+	m.mx.Unlock()
+	return result.entries, result.meta, result.err
 }
 
 type ConnectCALeafResult struct {
@@ -119,12 +251,28 @@ func NewCertFinderMock(ctx context.Context, t *testing.T, stack map[string][]Con
 	}
 }
 
+type ConnectCARootsResult struct {
+	roots *api.CARootList
+	meta  *api.QueryMeta
+	err   error
+}
+
+func NewCARootsFinderMock(ctx context.Context, t *testing.T, roots []ConnectCARootsResult, blocking bool) CertFinder {
+	return &MockCertFinder{
+		ctx:           ctx,
+		t:             t,
+		rootsStack:    roots,
+		blockOnFinish: blocking,
+	}
+}
+
 var _ CertFinder = &MockCertFinder{}
 
 type MockCertFinder struct {
 	t             *testing.T
 	ctx           context.Context
 	stack         map[string][]ConnectCALeafResult
+	rootsStack    []ConnectCARootsResult
 	blockOnFinish bool
 }
 
@@ -154,3 +302,199 @@ func (m *MockCertFinder) ConnectCALeaf(name string, q *api.QueryOptions) (*api.L
 
 	return result.cert, result.meta, result.err
 }
+
+func (m *MockCertFinder) ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+	if len(m.rootsStack) == 0 {
+		if m.blockOnFinish {
+			<-m.ctx.Done()
+			return nil, &api.QueryMeta{
+				LastIndex: q.WaitIndex,
+			}, nil
+		}
+
+		m.t.Error("unexpected call to ConnectCARoots, no more expectations")
+		return nil, nil, fmt.Errorf("unexpected function call")
+	}
+
+	var result ConnectCARootsResult
+	result, m.rootsStack = m.rootsStack[0], m.rootsStack[1:]
+	return result.roots, result.meta, result.err
+}
+
+type ListResult struct {
+	pairs api.KVPairs
+	meta  *api.QueryMeta
+	err   error
+}
+
+func NewRouteFinderMock(ctx context.Context, t *testing.T, stack []ListResult, blocking bool) RouteFinder {
+	return &MockRouteFinder{
+		ctx:           ctx,
+		t:             t,
+		stack:         stack,
+		blockOnFinish: blocking,
+	}
+}
+
+var _ RouteFinder = &MockRouteFinder{}
+
+type MockRouteFinder struct {
+	t             *testing.T
+	ctx           context.Context
+	stack         []ListResult
+	blockOnFinish bool
+}
+
+func (m *MockRouteFinder) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	if len(m.stack) == 0 {
+		if m.blockOnFinish {
+			<-m.ctx.Done()
+			return nil, &api.QueryMeta{
+				LastIndex: q.WaitIndex,
+			}, nil
+		}
+
+		m.t.Errorf("unexpected call to List with prefix %q. No more expectations", prefix)
+		return nil, nil, fmt.Errorf("unexpected function call")
+	}
+
+	var result ListResult
+	result, m.stack = m.stack[0], m.stack[1:]
+	return result.pairs, result.meta, result.err
+}
+
+type GetResult struct {
+	pair *api.KVPair
+	meta *api.QueryMeta
+	err  error
+}
+
+func NewPolicyFinderMock(ctx context.Context, t *testing.T, stack []GetResult, blocking bool) PolicyFinder {
+	return &MockPolicyFinder{
+		ctx:           ctx,
+		t:             t,
+		stack:         stack,
+		blockOnFinish: blocking,
+	}
+}
+
+var _ PolicyFinder = &MockPolicyFinder{}
+
+type MockPolicyFinder struct {
+	t             *testing.T
+	ctx           context.Context
+	stack         []GetResult
+	blockOnFinish bool
+}
+
+func (m *MockPolicyFinder) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	if len(m.stack) == 0 {
+		if m.blockOnFinish {
+			<-m.ctx.Done()
+			return nil, &api.QueryMeta{
+				LastIndex: q.WaitIndex,
+			}, nil
+		}
+
+		m.t.Errorf("unexpected call to Get with key %q. No more expectations", key)
+		return nil, nil, fmt.Errorf("unexpected function call")
+	}
+
+	var result GetResult
+	result, m.stack = m.stack[0], m.stack[1:]
+	return result.pair, result.meta, result.err
+}
+
+type ConfigEntryResult struct {
+	entries []api.ConfigEntry
+	meta    *api.QueryMeta
+	err     error
+}
+
+func NewConfigEntryFinderMock(ctx context.Context, t *testing.T, stacks map[string][]ConfigEntryResult) ConfigEntryFinder {
+	return &MockConfigEntryFinder{
+		ctx:    ctx,
+		t:      t,
+		stacks: stacks,
+	}
+}
+
+var _ ConfigEntryFinder = &MockConfigEntryFinder{}
+
+// MockConfigEntryFinder answers the queries of every kind from
+// its own stack and blocks once the stack of the kind is empty.
+// Queries in a namespace use the stack of "<namespace>/<kind>".
+type MockConfigEntryFinder struct {
+	mx     sync.Mutex
+	t      *testing.T
+	ctx    context.Context
+	stacks map[string][]ConfigEntryResult
+}
+
+func (m *MockConfigEntryFinder) List(kind string, q *api.QueryOptions) ([]api.ConfigEntry, *api.QueryMeta, error) {
+	key := ClusterName(namespaceFromContext(q.Context()), kind)
+
+	m.mx.Lock()
+	stack := m.stacks[key]
+	if len(stack) == 0 {
+		m.mx.Unlock()
+		<-q.Context().Done()
+		return nil, &api.QueryMeta{
+			LastIndex: q.WaitIndex,
+		}, nil
+	}
+
+	var result ConfigEntryResult
+	result, m.stacks[key] = stack[0], stack[1:]
+	m.mx.Unlock()
+
+	return result.entries, result.meta, result.err
+}
+
+type IngressResult struct {
+	body string
+	meta *api.QueryMeta
+	err  error
+}
+
+func NewIngressFinderMock(ctx context.Context, t *testing.T, stack []IngressResult) IngressFinder {
+	return &MockIngressFinder{
+		ctx:   ctx,
+		t:     t,
+		stack: stack,
+	}
+}
+
+var _ IngressFinder = &MockIngressFinder{}
+
+// MockIngressFinder decodes the JSON body of the next result
+// into the response and blocks once the stack is empty.
+type MockIngressFinder struct {
+	t     *testing.T
+	ctx   context.Context
+	stack []IngressResult
+}
+
+func (m *MockIngressFinder) Query(endpoint string, out interface{}, q *api.QueryOptions) (*api.QueryMeta, error) {
+	if endpoint != "/v1/config/"+IngressGatewayKind {
+		m.t.Errorf("unexpected endpoint %s", endpoint)
+	}
+
+	if len(m.stack) == 0 {
+		<-m.ctx.Done()
+		return &api.QueryMeta{
+			LastIndex: q.WaitIndex,
+		}, nil
+	}
+
+	var result IngressResult
+	result, m.stack = m.stack[0], m.stack[1:]
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	if err := json.Unmarshal([]byte(result.body), out); err != nil {
+		m.t.Fatalf("invalid test response. %s", err)
+	}
+	return result.meta, nil
+}
@@ -1,9 +1,11 @@
 package catalog
 
 import (
+	"context"
 	"github.com/google/go-cmp/cmp"
 	"github.com/hashicorp/consul/api"
 	"testing"
+	"time"
 )
 
 func TestMapToSlice(t *testing.T) {
@@ -32,155 +34,340 @@ func TestMapToSlice(t *testing.T) {
 	}
 }
 
-func TestAllChecksPassing(t *testing.T) {
+func TestIsSidecarProxy(t *testing.T) {
 	tests := []struct {
-		checks api.HealthChecks
-		result bool
+		service *api.CatalogService
+		result  bool
 	}{
 		{
-			checks: api.HealthChecks{
-				{Status: api.HealthCritical},
-			},
+			service: &api.CatalogService{},
 			result: false,
 		},
 		{
-			checks: api.HealthChecks{
-				{Status: api.HealthMaint},
+			service: &api.CatalogService{
+				ServiceProxy: &api.AgentServiceConnectProxyConfig{
+					DestinationServiceName: "",
+				},
 			},
 			result: false,
 		},
+		{
+			service: &api.CatalogService{
+				ServiceProxy: &api.AgentServiceConnectProxyConfig{
+					DestinationServiceName: "destination-service-name",
+				},
+			},
+			result: true,
+		},
+	}
+
+	for idx, test := range tests {
+		result := isSidecarProxy(test.service)
+		if result != test.result {
+			t.Errorf("case %d: result(%v) != expected(%v)", idx, result, test.result)
+		}
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	tests := []struct {
+		checks       api.HealthChecks
+		allowWarning bool
+		result       string
+	}{
+		{
+			checks: nil,
+			result: api.HealthPassing,
+		},
 		{
 			checks: api.HealthChecks{
+				{Status: api.HealthPassing},
 				{Status: api.HealthWarning},
 			},
-			result: false,
+			result: api.HealthWarning,
 		},
 		{
 			checks: api.HealthChecks{
 				{Status: api.HealthPassing},
+				{Status: api.HealthWarning},
 			},
-			result: true,
+			allowWarning: true,
+			result:       api.HealthPassing,
 		},
 		{
 			checks: api.HealthChecks{
-				{Status: api.HealthPassing},
 				{Status: api.HealthWarning},
 				{Status: api.HealthCritical},
 			},
-			result: false,
+			allowWarning: true,
+			result:       api.HealthCritical,
 		},
 		{
 			checks: api.HealthChecks{
-				{Status: api.HealthPassing},
-				{Status: api.HealthPassing},
-				{Status: api.HealthCritical},
+				{CheckID: "serfHealth", Status: api.HealthPassing},
+				{CheckID: api.ServiceMaintPrefix + "web-1", Status: api.HealthCritical},
 			},
-			result: false,
+			result: api.HealthMaint,
 		},
 		{
 			checks: api.HealthChecks{
-				{Status: api.HealthPassing},
-				{Status: api.HealthPassing},
-				{Status: api.HealthPassing},
+				{CheckID: api.NodeMaint, Status: api.HealthCritical},
 			},
-			result: true,
+			result: api.HealthMaint,
+		},
+		{
+			checks: api.HealthChecks{
+				{Status: "unknown"},
+			},
+			result: api.HealthCritical,
 		},
 	}
 
 	for idx, test := range tests {
-		result := allChecksPassing(test.checks)
+		result := healthStatus(test.checks, test.allowWarning)
 		if result != test.result {
 			t.Errorf("case %d: result(%v) != expected(%v)", idx, result, test.result)
 		}
 	}
 }
 
-func TestFilterUnhealthyNodes(t *testing.T) {
-	tests := []struct {
-		services []*api.CatalogService
-		result   []*api.CatalogService
-	}{
+func TestCatalogServices(t *testing.T) {
+	entries := []*api.ServiceEntry{
 		{
-			services: []*api.CatalogService{
-				{
-					Checks: api.HealthChecks{
-						{Status: api.HealthWarning},
-					},
-				},
+			Node: &api.Node{ID: "node-id", Node: "node-1", Address: "10.0.0.1", Datacenter: "dc1"},
+			Service: &api.AgentService{
+				ID:          "web-1",
+				Service:     "web",
+				Tags:        []string{"in-flightpath"},
+				Meta:        map[string]string{"flightpath-route-main": "example.com"},
+				Port:        8080,
+				Weights:     api.AgentWeights{Passing: 10, Warning: 1},
+				CreateIndex: 12,
+			},
+			Checks: api.HealthChecks{
+				{CheckID: "serfHealth", Status: api.HealthCritical},
+				{CheckID: "service:web-1", ServiceID: "web-1", Status: api.HealthPassing},
 			},
-			result: nil,
 		},
 		{
-			services: []*api.CatalogService{
-				{
-					ID: "healthy-service",
-					Checks: api.HealthChecks{
-						{Status: api.HealthPassing},
-					},
-				},
-				{
-					ID: "warning-service",
-					Checks: api.HealthChecks{
-						{Status: api.HealthWarning},
-					},
-				},
-				{
-					ID: "critical-service",
-					Checks: api.HealthChecks{
-						{Status: api.HealthCritical},
-					},
-				},
-			},
-			result: []*api.CatalogService{
-				{
-					ID: "healthy-service",
-					Checks: api.HealthChecks{
-						{Status: api.HealthPassing},
-					},
-				},
+			Node: &api.Node{Node: "node-2"},
+		},
+	}
+
+	expect := []*api.CatalogService{
+		{
+			ID:             "node-id",
+			Node:           "node-1",
+			Address:        "10.0.0.1",
+			Datacenter:     "dc1",
+			ServiceID:      "web-1",
+			ServiceName:    "web",
+			ServiceTags:    []string{"in-flightpath"},
+			ServiceMeta:    map[string]string{"flightpath-route-main": "example.com"},
+			ServicePort:    8080,
+			ServiceWeights: api.Weights{Passing: 10, Warning: 1},
+			CreateIndex:    12,
+			Checks: api.HealthChecks{
+				{CheckID: "serfHealth", Status: api.HealthCritical},
+				{CheckID: "service:web-1", ServiceID: "web-1", Status: api.HealthPassing},
 			},
 		},
 	}
 
-	for idx, test := range tests {
-		result := filterUnhealthyNodes(test.services)
-		if !cmp.Equal(result, test.result) {
-			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.result))
+	result := catalogServices(entries)
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected result. %s", cmp.Diff(result, expect))
+	}
+}
+
+func TestCatalog_DiscoverClustersNamespaces(t *testing.T) {
+	entry := func(id string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: id, Node: "node-" + id, Datacenter: "dc1"},
+			Service: &api.AgentService{ID: id, Service: "web"},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+
+	instances := func(id string) []ServiceResult {
+		return []ServiceResult{
+			{entries: []*api.ServiceEntry{entry(id)}, meta: &api.QueryMeta{LastIndex: 1}},
+		}
+	}
+
+	services := func() []ServicesResult {
+		return []ServicesResult{
+			{
+				services: map[string][]string{"web": {FlightPathTag}},
+				meta:     &api.QueryMeta{LastIndex: 1},
+			},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"team-a/web": instances("web-a"),
+		"team-b/web": instances("web-b"),
+	}, map[string][]ServicesResult{
+		"team-a": services(),
+		"team-b": services(),
+	}, true).WithNamespaces([]NamespacesResult{
+		{namespaces: []string{"team-a", "team-b"}, meta: &api.QueryMeta{LastIndex: 1}},
+	})
+
+	catalog := &Catalog{
+		ctx:     ctx,
+		catalog: finder,
+	}
+
+	selector := NewSelector()
+	selector.Namespaces = []string{AllNamespaces}
+
+	clusters := make(chan ClusterInfo)
+	done := make(chan struct{})
+
+	go func() {
+		catalog.DiscoverClusters(selector, &PipelineConfig{Workers: 2}, clusters, make(chan string))
+		done <- struct{}{}
+	}()
+
+	result := map[string][]string{}
+	for i := 0; i < 2; i++ {
+		cluster := <-clusters
+		for _, e := range cluster.Endpoints() {
+			result[cluster.Name()] = append(result[cluster.Name()], e.Name())
 		}
+		result[cluster.Name()] = append(result[cluster.Name()], cluster.SpiffeIDs("abc.consul")...)
 	}
+
+	expect := map[string][]string{
+		"team-a/web": {"web-a", "spiffe://abc.consul/ns/team-a/dc/dc1/svc/web"},
+		"team-b/web": {"web-b", "spiffe://abc.consul/ns/team-b/dc/dc1/svc/web"},
+	}
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected clusters. %s", cmp.Diff(result, expect))
+	}
+
+	cancel()
+	<-done
+	finder.AssertFulfilled()
 }
 
-func TestIsSidecarProxy(t *testing.T) {
-	tests := []struct {
-		service *api.CatalogService
-		result  bool
-	}{
-		{
-			service: &api.CatalogService{},
-			result: false,
+func TestCatalog_DiscoverClusters(t *testing.T) {
+	entry := func(id, service string, proxy *api.AgentServiceConnectProxyConfig) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: id, Node: "node-1", Datacenter: "dc1"},
+			Service: &api.AgentService{ID: id, Service: service, Proxy: proxy},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+
+	result := func(entries ...*api.ServiceEntry) ServiceResult {
+		return ServiceResult{entries: entries, meta: &api.QueryMeta{LastIndex: 1}}
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web": {
+			result(entry("web-1", "web", nil), entry("web-2", "web", nil)),
 		},
-		{
-			service: &api.CatalogService{
-				ServiceProxy: &api.AgentServiceConnectProxyConfig{
-					DestinationServiceName: "",
-				},
-			},
-			result: false,
+		"web-sidecar-proxy": {
+			result(entry("web-1-proxy", "web-sidecar-proxy", &api.AgentServiceConnectProxyConfig{DestinationServiceName: "web", DestinationServiceID: "web-1"})),
 		},
-		{
-			service: &api.CatalogService{
-				ServiceProxy: &api.AgentServiceConnectProxyConfig{
-					DestinationServiceName: "destination-service-name",
+		"api": {
+			result(entry("api-1", "api", nil)),
+		},
+	}, map[string][]ServicesResult{
+		"": {
+			{
+				services: map[string][]string{
+					"web":               {FlightPathTag},
+					"web-sidecar-proxy": {FlightPathTag},
+					"api":               {FlightPathTag},
+					"db":                {"internal"},
 				},
+				meta: &api.QueryMeta{LastIndex: 1},
 			},
-			result: true,
 		},
+	}, true)
+
+	catalog := &Catalog{
+		ctx:     ctx,
+		catalog: finder,
 	}
 
-	for idx, test := range tests {
-		result := isSidecarProxy(test.service)
-		if result != test.result {
-			t.Errorf("case %d: result(%v) != expected(%v)", idx, result, test.result)
+	clusters := make(chan ClusterInfo)
+	cleanup := make(chan string)
+	done := make(chan struct{})
+
+	go func() {
+		catalog.DiscoverClusters(NewSelector(), &PipelineConfig{Workers: 1}, clusters, cleanup)
+		done <- struct{}{}
+	}()
+
+	// The destination of the sidecar may be published before
+	// the sidecar is fetched, the instance behind the sidecar
+	// must leave the destination cluster afterwards.
+	state := map[string]int{}
+	expect := map[string]int{"web": 1, "web-sidecar-proxy": 1, "api": 1}
+	timeout := time.After(5 * time.Second)
+	for !cmp.Equal(state, expect) || finder.PendingServices() > 0 {
+		select {
+		case cluster := <-clusters:
+			state[cluster.Name()] = len(cluster.Endpoints())
+		case name := <-cleanup:
+			delete(state, name)
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("unexpected clusters. %s", cmp.Diff(state, expect))
 		}
 	}
+
+	cancel()
+	<-done
+	finder.AssertFulfilled()
+}
+
+func TestCatalog_WatchDatacenter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	finder := NewServiceFinderMock(ctx, t, nil, map[string][]ServicesResult{
+		"@dc2": {
+			{meta: &api.QueryMeta{LastIndex: 1}},
+			{meta: &api.QueryMeta{LastIndex: 2}},
+		},
+	}, true)
+
+	p := newPipeline(finder, NewSelector(), &PipelineConfig{}, nil, nil)
+	p.services[serviceKey{name: "web"}] = &serviceState{}
+	p.services[serviceKey{namespace: "team-a", name: "web"}] = &serviceState{}
+
+	catalog := &Catalog{
+		ctx:     ctx,
+		catalog: finder,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		catalog.watchDatacenter(ctx, p, "", "dc2")
+		close(done)
+	}()
+
+	// A new instance in the remote datacenter moves the index
+	// of the list without any change to the local catalog.
+	timeout := time.After(5 * time.Second)
+	for p.queue.Len() == 0 {
+		select {
+		case <-time.After(time.Millisecond):
+		case <-timeout:
+			t.Fatalf("expected the services to be queued")
+		}
+	}
+
+	cancel()
+	<-done
+
+	if keys := drain(p.queue); !cmp.Equal(keys, []string{"web"}) {
+		t.Errorf("expected the services of the namespace to be queued, got %v", keys)
+	}
+	finder.AssertFulfilled()
 }
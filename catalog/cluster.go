@@ -1,17 +1,25 @@
 package catalog
 
 import (
-	"crypto/sha1"
 	"fmt"
 	"github.com/hashicorp/consul/api"
 	"github.com/mitchellh/mapstructure"
 	"sort"
+	"strconv"
 	"strings"
 )
 
 const (
 	ConnectZoneName = "connect.consul"
 	ServiceZoneName = "service.consul"
+
+	// SubsetSeparator separates the name of the subset
+	// from the name of the cluster, e.g. web:v2
+	SubsetSeparator = ":"
+
+	// SubsetExclusion prefixes the subset name of the cluster
+	// that leaves out the instances of a subset, e.g. web:!v2
+	SubsetExclusion = "!"
 )
 
 // ClusterInfo represents a collection of service instances
@@ -19,18 +27,75 @@ const (
 // only one type of service.
 type ClusterInfo interface {
 	Name() string
+	Namespace() string
+	Service() string
+	SubsetName() string
+	Subset(name string, subset ResolverSubset) ClusterInfo
+	MetaSubsets(key string) []ClusterInfo
+	Excluding(name string, subset ClusterInfo) ClusterInfo
 	Endpoints() []Endpoint
 	IsConnectEnabled() bool
-	Hash() string
 	Settings() (*ClusterSettings, error)
+	SpiffeIDs(trustDomain string) []string
+	Tags() []string
 }
 
 var _ ClusterInfo = &Cluster{}
 
 type Cluster struct {
-	name      string
-	isConnect bool
-	services  []*api.CatalogService
+	name         string
+	namespace    string
+	partition    string
+	isConnect    bool
+	allowWarning bool
+	services     []*api.CatalogService
+
+	// destination is the service behind the sidecar
+	// proxies of a connect enabled cluster.
+	destination string
+
+	// priorities maps the datacenter of the service
+	// instances to its failover priority.
+	priorities map[string]int
+
+	// subset is the name of the service-resolver subset, or
+	// the value of the subset meta key, when the cluster holds
+	// only the instances of the subset.
+	subset string
+
+	// members are the instances that consul selected with the
+	// filter of each service-resolver subset, keyed by the name
+	// of the subset and then by the instance key.
+	members map[string]map[string]bool
+
+	// routing are the parsed flightpath-route meta attributes
+	// of every instance, see parseRoutes.
+	routing map[*api.CatalogService]map[string][]MetaRoute
+}
+
+// NewCluster returns the cluster of the service instances.
+// The priorities map the datacenter of the instances to its
+// failover priority, the local datacenter has priority 0.
+func NewCluster(namespace, name string, services []*api.CatalogService, priorities map[string]int) *Cluster {
+	c := &Cluster{
+		name:       name,
+		namespace:  namespace,
+		services:   services,
+		priorities: priorities,
+	}
+	c.parseRoutes()
+	return c
+}
+
+// parseRoutes reads the routes of every instance once, when
+// the cluster is built, so that the endpoints built for every
+// snapshot do not parse them again and an invalid route is
+// only reported when the cluster changes.
+func (c *Cluster) parseRoutes() {
+	c.routing = make(map[*api.CatalogService]map[string][]MetaRoute, len(c.services))
+	for _, service := range c.services {
+		c.routing[service] = getRoutingInfo(service)
+	}
 }
 
 type ClusterSettings struct {
@@ -49,12 +114,12 @@ type ClusterSettings struct {
 	RetryBackoffMax     int64  `mapstructure:"flightpath-retry-backoff_max_interval"`
 }
 
-// TODO: right now we don't care about new or old cluster
-//   settings. If these settings change across deployments
-//   we'll just pick the latest one and work with that.
-//   An upcoming version will support creating multiple
-//   clusters per service e.g. canary, strand, etc
-//   which will stick with their own cluster settings.
+// Settings are read from the meta attributes of the newest
+// instance in the cluster. Deployments that need settings of
+// their own, e.g. a canary, are split into subset clusters by
+// MetaSubsets and every subset reads its own instances. The
+// rest of the instances read theirs in the cluster returned
+// by Excluding.
 func (c *Cluster) Settings() (*ClusterSettings, error) {
 	var (
 		settings        = map[string]string{}
@@ -122,42 +187,147 @@ func (cs *ClusterSettings) Canonicalize() {
 	}
 }
 
-func Hash(l []ClusterInfo) string {
-	var ids []string
-	for _, s := range l {
-		ids = append(ids, s.Hash())
+// Name is the service name, prefixed with the
+// namespace when the service was discovered in one.
+func (c *Cluster) Name() string {
+	name := ClusterName(c.namespace, c.name)
+	if c.subset != "" {
+		name += SubsetSeparator + c.subset
 	}
-	sort.Strings(ids)
-	cid := strings.Join(ids, "")
+	return name
+}
 
-	return fmt.Sprintf("%x", sha1.Sum([]byte(cid)))[:10]
+// Namespace is the consul enterprise namespace of the
+// service, empty when namespaces are not in use.
+func (c *Cluster) Namespace() string {
+	return c.namespace
 }
 
-func (c *Cluster) Hash() string {
-	var ids []string
+// Service is the name of the logical service that the cluster
+// belongs to. The connect cluster of the sidecar proxies and the
+// cluster of the instances without a sidecar belong to the same
+// service while the service is migrated to connect.
+func (c *Cluster) Service() string {
+	if c.destination != "" {
+		return ClusterName(c.namespace, c.destination)
+	}
+	return ClusterName(c.namespace, c.name)
+}
+
+// SubsetName is the name of the service-resolver subset
+// of the cluster, empty for the cluster of all instances.
+func (c *Cluster) SubsetName() string {
+	return c.subset
+}
+
+// Subset returns the cluster of the instances that belong to
+// the subset. It belongs to the same service as the cluster.
+// A subset with a filter holds the instances that consul found
+// with the filter, none until they have been fetched.
+func (c *Cluster) Subset(name string, subset ResolverSubset) ClusterInfo {
+	var services []*api.CatalogService
 	for _, s := range c.services {
-		ids = append(ids, s.ID)
+		if subset.OnlyPassing && s.Checks.AggregatedStatus() != api.HealthPassing {
+			continue
+		}
+
+		if subset.Filter != "" && !c.members[name][instanceKey(s.Datacenter, s.Node, s.ServiceID)] {
+			continue
+		}
+
+		services = append(services, s)
 	}
-	sort.Strings(ids)
-	cid := strings.Join(ids, "")
 
-	return fmt.Sprintf("%x", sha1.Sum([]byte(cid)))[:10]
+	return c.subsetOf(name, services)
 }
 
-func (c *Cluster) Name() string {
-	return c.name
+// MetaSubsets groups the instances of the cluster by the value
+// of the meta key into one subset cluster per value, e.g. web:v1
+// and web:v2 for the key version. Instances without the key are
+// only in the cluster. A value with the subset separator, or that
+// starts with the subset exclusion, can not name a cluster and is
+// ignored.
+func (c *Cluster) MetaSubsets(key string) []ClusterInfo {
+	groups := map[string][]*api.CatalogService{}
+	for _, s := range c.services {
+		value := s.ServiceMeta[key]
+		if value == "" {
+			continue
+		}
+
+		if strings.Contains(value, SubsetSeparator) || strings.HasPrefix(value, SubsetExclusion) {
+			logger.WithField("cluster", c.Name()).
+				WithField("instance", s.ServiceID).
+				WithField("subset", value).
+				Warn("ignoring subset with invalid name")
+			continue
+		}
+
+		groups[value] = append(groups[value], s)
+	}
+
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []ClusterInfo
+	for _, name := range names {
+		result = append(result, c.subsetOf(name, groups[name]))
+	}
+	return result
+}
+
+// Excluding returns the cluster of the instances that are not in
+// the subset cluster, named after the subset with the exclusion
+// prefix, e.g. web:!v2 holds the instances of web that are not in
+// web:v2. Without a subset cluster it holds every instance.
+func (c *Cluster) Excluding(name string, subset ClusterInfo) ClusterInfo {
+	excluded := map[*api.CatalogService]bool{}
+	if other, ok := subset.(*Cluster); ok && other != nil {
+		for _, s := range other.services {
+			excluded[s] = true
+		}
+	}
+
+	var services []*api.CatalogService
+	for _, s := range c.services {
+		if !excluded[s] {
+			services = append(services, s)
+		}
+	}
+
+	return c.subsetOf(SubsetExclusion+name, services)
+}
+
+func (c *Cluster) subsetOf(name string, services []*api.CatalogService) *Cluster {
+	result := *c
+	result.subset = name
+	result.services = services
+	return &result
 }
 
 func (c *Cluster) Endpoints() []Endpoint {
 	var results []Endpoint
 	for _, service := range c.services {
-		routing := getRoutingInfo(service)
+		routing := c.routing[service]
+		if routing == nil {
+			routing = map[string][]MetaRoute{}
+		}
+
 		results = append(results, Endpoint{
 			name:        service.ID,
 			serviceName: service.ServiceName,
 			isConnect:   c.IsConnectEnabled(),
 			addr:        service.Address,
 			port:        service.ServicePort,
+			createIndex: service.CreateIndex,
+			health:      healthStatus(service.Checks, c.allowWarning),
+			weight:      serviceWeight(service),
+			nodeMeta:    service.NodeMeta,
+			datacenter:  service.Datacenter,
+			dcPriority:  c.priorities[service.Datacenter],
 			routing:     routing,
 		})
 	}
@@ -165,13 +335,97 @@ func (c *Cluster) Endpoints() []Endpoint {
 	return results
 }
 
-func getRoutingInfo(service *api.CatalogService) map[string][]string {
-	results := map[string][]string{}
+// serviceWeight picks the weight registered for the
+// current health of the service instance. Consul defaults
+// both weights to 1, so does an instance without weights.
+func serviceWeight(service *api.CatalogService) int {
+	weight := service.ServiceWeights.Passing
+	if service.Checks.AggregatedStatus() == api.HealthWarning {
+		weight = service.ServiceWeights.Warning
+	}
+
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// MetaRoute is a path on a domain that the service
+// claims with a flightpath-route meta attribute.
+type MetaRoute struct {
+	Path string
+
+	// Datacenter pins the route to the instances
+	// in one datacenter when it is not empty.
+	Datacenter string
+
+	// Subset pins the route to the instances of a subset
+	// and Canary sends a share of its traffic to one.
+	Subset string
+	Canary *CanaryRoute
+
+	// Match holds the conditions on the method, headers
+	// and query parameters of the requests on the route.
+	Match RequestMatch
+}
+
+// CanaryRoute sends a percentage of the traffic of a route to a
+// subset of the service, and every request with the header when
+// Header is set. Either of them can be left out.
+type CanaryRoute struct {
+	Subset string
+	Weight uint32
+	Header *HeaderMatch
+}
+
+// String describes the canary in a stable form, e.g.
+// `v2 10% header:x-canary=true`
+func (c *CanaryRoute) String() string {
+	if c == nil {
+		return ""
+	}
+
+	parts := []string{c.Subset}
+	if c.Weight > 0 {
+		parts = append(parts, fmt.Sprintf("%d%%", c.Weight))
+	}
+
+	if c.Header != nil {
+		parts = append(parts, c.Header.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// getRoutingInfo parses the flightpath-route meta attributes.
+// The value is a domain, a path or both, optionally followed
+// by options separated with semicolon, e.g.
+//
+//	example.com/api;dc=dc2
+//	example.com/api;canary=v2;canary-weight=10;canary-header=x-canary=true
+//	example.com/api;method=GET|HEAD;header=x-team=web;!header=x-debug;query=v~=^2
+//
+// A semicolon that is part of the path or of an option is
+// escaped with a backslash, e.g. /a\;b or header=x-id~=^a\;b$,
+// and a backslash itself is written as \\.
+func getRoutingInfo(service *api.CatalogService) map[string][]MetaRoute {
+	results := map[string][]MetaRoute{}
 	for k, v := range service.ServiceMeta {
 		if !strings.HasPrefix(k, "flightpath-route") {
 			continue
 		}
 
+		parts := splitRouteValue(v)
+		v = parts[0]
+
+		route, err := parseRouteOptions(parts[1:])
+		if err != nil {
+			logger.WithError(err).
+				WithField("service", service.ServiceName).
+				WithField("key", k).
+				Error("ignoring route with invalid options")
+			continue
+		}
+
 		domain := "*"
 		uriMatch := "/"
 		if strings.HasPrefix(v, "/") {
@@ -189,15 +443,181 @@ func getRoutingInfo(service *api.CatalogService) map[string][]string {
 		}
 
 		if _, ok := results[domain]; !ok {
-			results[domain] = []string{}
+			results[domain] = []MetaRoute{}
 		}
 
-		results[domain] = append(results[domain], uriMatch)
+		route.Path = uriMatch
+		results[domain] = append(results[domain], route)
 	}
 
 	return results
 }
 
+// splitRouteValue splits the route value on the semicolons
+// that are not escaped and removes the escaping backslashes.
+func splitRouteValue(value string) []string {
+	var parts []string
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && (value[i+1] == ';' || value[i+1] == '\\'):
+			i++
+			current.WriteByte(value[i])
+		case value[i] == ';':
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	return append(parts, current.String())
+}
+
+func parseRouteOptions(options []string) (MetaRoute, error) {
+	var route MetaRoute
+	var canary CanaryRoute
+	var hasCanary bool
+
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+
+		idx := strings.Index(option, "=")
+		if idx == -1 {
+			return route, fmt.Errorf("option %q is not in key=value form", option)
+		}
+
+		key, value := option[:idx], option[idx+1:]
+		switch key {
+		case "dc":
+			route.Datacenter = value
+		case "subset", "canary":
+			if value == "" || strings.Contains(value, SubsetSeparator) || strings.HasPrefix(value, SubsetExclusion) {
+				return route, fmt.Errorf("option %q needs a subset name without %q that does not start with %q", key, SubsetSeparator, SubsetExclusion)
+			}
+
+			if key == "subset" {
+				route.Subset = value
+			} else {
+				canary.Subset = value
+			}
+		case "canary-weight":
+			weight, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || weight < 1 || weight > 100 {
+				return route, fmt.Errorf("canary-weight %q is not a percentage between 1 and 100", value)
+			}
+			canary.Weight = uint32(weight)
+			hasCanary = true
+		case "canary-header":
+			header, err := parseHeaderMatch(value, false)
+			if err != nil {
+				return route, fmt.Errorf("option %q is invalid. %s", key, err)
+			}
+			canary.Header = &header
+			hasCanary = true
+		case "method":
+			if len(route.Match.Methods) > 0 {
+				return route, fmt.Errorf("option %q is set more than once", key)
+			}
+
+			methods, err := parseMethods(value)
+			if err != nil {
+				return route, fmt.Errorf("option %q is invalid. %s", key, err)
+			}
+			route.Match.Methods = methods
+		case "header", "!header":
+			header, err := parseHeaderMatch(value, key == "!header")
+			if err != nil {
+				return route, fmt.Errorf("option %q is invalid. %s", key, err)
+			}
+			route.Match.Headers = append(route.Match.Headers, header)
+		case "query":
+			query, err := parseQueryMatch(value)
+			if err != nil {
+				return route, fmt.Errorf("option %q is invalid. %s", key, err)
+			}
+			route.Match.Query = append(route.Match.Query, query)
+		default:
+			return route, fmt.Errorf("option %q is not supported", key)
+		}
+	}
+
+	switch {
+	case hasCanary && canary.Subset == "":
+		return route, fmt.Errorf("options canary-weight and canary-header need the canary option")
+	case canary.Subset != "" && !hasCanary:
+		return route, fmt.Errorf("canary %q needs the canary-weight or canary-header option", canary.Subset)
+	case route.Subset != "" && canary.Subset != "":
+		return route, fmt.Errorf("options subset and canary can not be combined")
+	case route.Datacenter != "" && (route.Subset != "" || canary.Subset != ""):
+		return route, fmt.Errorf("option dc can not be combined with subset or canary")
+	}
+
+	if canary.Subset != "" {
+		route.Canary = &canary
+	}
+	return route, nil
+}
+
 func (c *Cluster) IsConnectEnabled() bool {
 	return c.isConnect
 }
+
+// SpiffeIDs returns the SPIFFE identities that the service
+// instances in this cluster present on their connect leaf
+// certificates. Sidecar proxies present the identity of
+// their destination service.
+func (c *Cluster) SpiffeIDs(trustDomain string) []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, s := range c.services {
+		target := s.ServiceName
+		if isSidecarProxy(s) {
+			target = s.ServiceProxy.DestinationServiceName
+		}
+
+		id := SpiffeID(trustDomain, c.partition, c.namespace, s.Datacenter, target)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Strings(ids)
+	return ids
+}
+
+// Tags returns the unique tags across all
+// service instances in this cluster.
+func (c *Cluster) Tags() []string {
+	seen := map[string]bool{}
+	var tags []string
+	for _, s := range c.services {
+		for _, tag := range s.ServiceTags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// SpiffeID builds the URI SAN that consul connect
+// sets on the leaf certificate of a service. Consul
+// leaves out the admin partition when it is the default
+// one, and an empty namespace is the default namespace.
+func SpiffeID(trustDomain, partition, namespace, datacenter, service string) string {
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	if partition == "" || partition == "default" {
+		return fmt.Sprintf("spiffe://%s/ns/%s/dc/%s/svc/%s", trustDomain, namespace, datacenter, service)
+	}
+	return fmt.Sprintf("spiffe://%s/ap/%s/ns/%s/dc/%s/svc/%s", trustDomain, partition, namespace, datacenter, service)
+}
@@ -7,94 +7,10 @@ import (
 	"testing"
 )
 
-func TestHash(t *testing.T) {
-	tests := []struct {
-		clusters []ClusterInfo
-		hash     string
-	}{
-		{
-			hash: "c08f6090b8",
-			clusters: []ClusterInfo{
-				&Cluster{
-					services: []*api.CatalogService{
-						{ID: "one"},
-						{ID: "two"},
-						{ID: "three"},
-						{ID: "four"},
-					},
-				},
-				&Cluster{
-					services: []*api.CatalogService{
-						{ID: "one"},
-						{ID: "two"},
-					},
-				},
-				&Cluster{
-					services: []*api.CatalogService{
-						{ID: "three"},
-						{ID: "four"},
-					},
-				},
-			},
-		},
-	}
-
-	for idx, test := range tests {
-		result := Hash(test.clusters)
-		if result != test.hash {
-			t.Errorf("case %d: unexpected hash %q, expected %q", idx, result, test.hash)
-		}
-	}
-}
-
-func TestCluster_Hash(t *testing.T) {
-	tests := []struct {
-		cluster *Cluster
-		hash    string
-	}{
-		{
-			cluster: &Cluster{
-				services: []*api.CatalogService{
-					{ID: "one"},
-					{ID: "two"},
-					{ID: "three"},
-					{ID: "four"},
-				},
-			},
-			hash: "fcb13b7761",
-		},
-		{
-			cluster: &Cluster{
-				services: []*api.CatalogService{
-					{ID: "one"},
-					{ID: "two"},
-				},
-			},
-			hash: "30ae97492c",
-		},
-		{
-			cluster: &Cluster{
-				services: []*api.CatalogService{
-					{ID: "one"},
-					{ID: "four"},
-				},
-			},
-			hash: "257c7fd00c",
-		},
-	}
-
-	for idx, test := range tests {
-		result := test.cluster.Hash()
-		if result != test.hash {
-			t.Errorf("case %d: unexpected cluster hash %q, expected %q", idx, result, test.hash)
-		}
-	}
-}
-
 func TestGetRoutingInfo(t *testing.T) {
 	tests := []struct {
 		service api.CatalogService
-		expect  map[string][]string
+		expect  map[string][]MetaRoute
 	}{
 		{
 			service: api.CatalogService{
@@ -102,9 +18,9 @@ func TestGetRoutingInfo(t *testing.T) {
 					"flightpath-route-1": "/only-uri",
 				},
 			},
-			expect: map[string][]string{
+			expect: map[string][]MetaRoute{
 				"*": {
-					"/only-uri",
+					{Path: "/only-uri"},
 				},
 			},
 		},
@@ -114,9 +30,9 @@ func TestGetRoutingInfo(t *testing.T) {
 					"flightpath-route-1": "some-domain",
 				},
 			},
-			expect: map[string][]string{
+			expect: map[string][]MetaRoute{
 				"some-domain": {
-					"/",
+					{Path: "/"},
 				},
 			},
 		},
@@ -129,12 +45,12 @@ func TestGetRoutingInfo(t *testing.T) {
 					"flightpath-route-4": "/uri-two/subresource",
 				},
 			},
-			expect: map[string][]string{
+			expect: map[string][]MetaRoute{
 				"*": {
-					"/uri-one",
-					"/uri-prefix-one/*",
-					"/uri-two",
-					"/uri-two/subresource",
+					{Path: "/uri-one"},
+					{Path: "/uri-prefix-one/*"},
+					{Path: "/uri-two"},
+					{Path: "/uri-two/subresource"},
 				},
 			},
 		},
@@ -151,22 +67,50 @@ func TestGetRoutingInfo(t *testing.T) {
 					"flightpath-route-8": "/prefix/*",
 				},
 			},
-			expect: map[string][]string{
+			expect: map[string][]MetaRoute{
 				"*": {
-					"/*",
-					"/prefix/*",
+					{Path: "/*"},
+					{Path: "/prefix/*"},
 				},
 				"some-domain": {
-					"/uri-one",
-					"/uri-prefix-one/*",
+					{Path: "/uri-one"},
+					{Path: "/uri-prefix-one/*"},
 				},
 				"other-domain": {
-					"/uri-two",
-					"/uri-two/subresource",
+					{Path: "/uri-two"},
+					{Path: "/uri-two/subresource"},
 				},
 				"another-domain": {
-					"/",
-					"/*",
+					{Path: "/"},
+					{Path: "/*"},
+				},
+			},
+		},
+		{
+			service: api.CatalogService{
+				ServiceMeta: map[string]string{
+					"flightpath-route-1": "some-domain/api;dc=dc2",
+					"flightpath-route-2": "/local",
+					"flightpath-route-3": "/invalid;dc",
+					"flightpath-route-4": "/unknown;color=blue",
+					"flightpath-route-5": "some-domain/admin/;method=POST;header=x-admin",
+					"flightpath-route-6": "/broken;header=x-admin~=(",
+					"flightpath-route-7": `some-domain/a\;b;header=x-id~=^a\;b\\d$`,
+				},
+			},
+			expect: map[string][]MetaRoute{
+				"some-domain": {
+					{Path: "/api", Datacenter: "dc2"},
+					{Path: "/admin/", Match: RequestMatch{
+						Methods: []string{"POST"},
+						Headers: []HeaderMatch{{Name: "x-admin", Present: true}},
+					}},
+					{Path: "/a;b", Match: RequestMatch{
+						Headers: []HeaderMatch{{Name: "x-id", Regex: `^a;b\d$`}},
+					}},
+				},
+				"*": {
+					{Path: "/local"},
 				},
 			},
 		},
@@ -174,6 +118,10 @@ func TestGetRoutingInfo(t *testing.T) {
 
 	for idx, test := range tests {
 		result := getRoutingInfo(&test.service)
+		if len(result) != len(test.expect) {
+			t.Errorf("Case %d: expected %d domains, got %d", idx, len(test.expect), len(result))
+		}
+
 		for k, v := range test.expect {
 			if slice, ok := result[k]; !ok {
 				t.Errorf("Case %d: Key %s is not present in map", idx, k)
@@ -211,6 +159,8 @@ func TestCluster_Endpoints(t *testing.T) {
 						ServiceMeta: map[string]string{
 							"flightpath-route-two": "/path-prefix/",
 						},
+						ServiceWeights: api.Weights{Passing: 5, Warning: 1},
+						NodeMeta:       map[string]string{"zone": "us-east-1a"},
 					},
 				},
 			},
@@ -221,12 +171,14 @@ func TestCluster_Endpoints(t *testing.T) {
 					isConnect:   false,
 					addr:        "1.1",
 					port:        11,
-					routing: map[string][]string{
+					health:      "passing",
+					weight:      1,
+					routing: map[string][]MetaRoute{
 						"just-domain": {
-							"/",
+							{Path: "/"},
 						},
 						"domain": {
-							"/fixed-path",
+							{Path: "/fixed-path"},
 						},
 					},
 				},
@@ -236,9 +188,12 @@ func TestCluster_Endpoints(t *testing.T) {
 					isConnect:   false,
 					addr:        "1.2",
 					port:        12,
-					routing: map[string][]string{
+					health:      "passing",
+					weight:      5,
+					nodeMeta:    map[string]string{"zone": "us-east-1a"},
+					routing: map[string][]MetaRoute{
 						"*": {
-							"/path-prefix/",
+							{Path: "/path-prefix/"},
 						},
 					},
 				},
@@ -271,7 +226,9 @@ func TestCluster_Endpoints(t *testing.T) {
 					isConnect:   true,
 					addr:        "2.1",
 					port:        21,
-					routing:     map[string][]string{},
+					health:      "passing",
+					weight:      1,
+					routing:     map[string][]MetaRoute{},
 				},
 				{
 					name:        "case-2-id-2",
@@ -279,18 +236,39 @@ func TestCluster_Endpoints(t *testing.T) {
 					isConnect:   true,
 					addr:        "2.2",
 					port:        22,
-					routing:     map[string][]string{},
+					health:      "passing",
+					weight:      1,
+					routing:     map[string][]MetaRoute{},
 				},
 			},
 		},
 	}
 
 	for idx, test := range tests {
+		test.cluster.parseRoutes()
 		result := test.cluster.Endpoints()
 		assert.ElementsMatch(t, result, test.expect, "Case %d", idx)
 	}
 }
 
+func TestCluster_EndpointsParsedOnce(t *testing.T) {
+	service := &api.CatalogService{
+		ID:          "web-1",
+		ServiceMeta: map[string]string{"flightpath-route-1": "example.com/api"},
+	}
+	cluster := NewCluster("", "web", []*api.CatalogService{service}, map[string]int{})
+
+	// The routes are read when the cluster is built
+	service.ServiceMeta["flightpath-route-1"] = "example.com/other"
+
+	for i := 0; i < 2; i++ {
+		routing := cluster.Endpoints()[0].RoutingInfo()
+		if len(routing["example.com"]) != 1 || routing["example.com"][0].Path != "/api" {
+			t.Errorf("expected the routes parsed with the cluster, got %+v", routing)
+		}
+	}
+}
+
 func TestDecodeClusterSettings(t *testing.T) {
 	tests := []struct {
 		cluster *Cluster
@@ -396,3 +374,433 @@ func TestDecodeClusterSettings(t *testing.T) {
 		}
 	}
 }
+
+func TestCluster_SpiffeIDs(t *testing.T) {
+	tests := []struct {
+		cluster *Cluster
+		expect  []string
+	}{
+		{
+			cluster: &Cluster{
+				services: []*api.CatalogService{
+					{ServiceName: "web", Datacenter: "dc1"},
+					{ServiceName: "web", Datacenter: "dc1"},
+				},
+			},
+			expect: []string{"spiffe://abc.consul/ns/default/dc/dc1/svc/web"},
+		},
+		{
+			cluster: &Cluster{
+				isConnect: true,
+				services: []*api.CatalogService{
+					{
+						ServiceName: "web-sidecar-proxy",
+						Datacenter:  "dc2",
+						ServiceProxy: &api.AgentServiceConnectProxyConfig{
+							DestinationServiceName: "web",
+						},
+					},
+					{
+						ServiceName: "web-sidecar-proxy",
+						Datacenter:  "dc1",
+						ServiceProxy: &api.AgentServiceConnectProxyConfig{
+							DestinationServiceName: "web",
+						},
+					},
+				},
+			},
+			expect: []string{
+				"spiffe://abc.consul/ns/default/dc/dc1/svc/web",
+				"spiffe://abc.consul/ns/default/dc/dc2/svc/web",
+			},
+		},
+		{
+			cluster: &Cluster{
+				namespace: "team-a",
+				services: []*api.CatalogService{
+					{ServiceName: "web", Datacenter: "dc1"},
+				},
+			},
+			expect: []string{"spiffe://abc.consul/ns/team-a/dc/dc1/svc/web"},
+		},
+		{
+			cluster: &Cluster{
+				namespace: "team-a",
+				partition: "edge",
+				services: []*api.CatalogService{
+					{ServiceName: "web", Datacenter: "dc1"},
+				},
+			},
+			expect: []string{"spiffe://abc.consul/ap/edge/ns/team-a/dc/dc1/svc/web"},
+		},
+		{
+			cluster: &Cluster{
+				partition: "default",
+				services: []*api.CatalogService{
+					{ServiceName: "web", Datacenter: "dc1"},
+				},
+			},
+			expect: []string{"spiffe://abc.consul/ns/default/dc/dc1/svc/web"},
+		},
+	}
+
+	for idx, test := range tests {
+		result := test.cluster.SpiffeIDs("abc.consul")
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestCluster_Tags(t *testing.T) {
+	cluster := &Cluster{
+		services: []*api.CatalogService{
+			{ServiceName: "web", ServiceTags: []string{"in-flightpath:public", "v2"}},
+			{ServiceName: "web", ServiceTags: []string{"in-flightpath:internal", "in-flightpath:public"}},
+			{ServiceName: "web"},
+		},
+	}
+
+	expect := []string{"in-flightpath:internal", "in-flightpath:public", "v2"}
+	result := cluster.Tags()
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected tags. %s", cmp.Diff(result, expect))
+	}
+}
+
+func TestServiceWeight(t *testing.T) {
+	tests := []struct {
+		service *api.CatalogService
+		expect  int
+	}{
+		{
+			service: &api.CatalogService{},
+			expect:  1,
+		},
+		{
+			service: &api.CatalogService{
+				ServiceWeights: api.Weights{Passing: 10, Warning: 2},
+				Checks:         api.HealthChecks{{Status: api.HealthPassing}},
+			},
+			expect: 10,
+		},
+		{
+			service: &api.CatalogService{
+				ServiceWeights: api.Weights{Passing: 10, Warning: 2},
+				Checks:         api.HealthChecks{{Status: api.HealthPassing}, {Status: api.HealthWarning}},
+			},
+			expect: 2,
+		},
+		{
+			service: &api.CatalogService{
+				ServiceWeights: api.Weights{Passing: 10, Warning: 0},
+				Checks:         api.HealthChecks{{Status: api.HealthWarning}},
+			},
+			expect: 1,
+		},
+	}
+
+	for idx, test := range tests {
+		result := serviceWeight(test.service)
+		if result != test.expect {
+			t.Errorf("case %d: expected %d, got %d", idx, test.expect, result)
+		}
+	}
+}
+
+func TestCluster_Subset(t *testing.T) {
+	cluster := &Cluster{
+		name: "web",
+		services: []*api.CatalogService{
+			{ServiceID: "web-1", Node: "node-1", ServiceMeta: map[string]string{"version": "v1"}},
+			{ServiceID: "web-2", Node: "node-2", ServiceMeta: map[string]string{"version": "v2"}},
+			{
+				ServiceID:   "web-3",
+				Node:        "node-3",
+				ServiceMeta: map[string]string{"version": "v2"},
+				Checks:      api.HealthChecks{{Status: api.HealthWarning}},
+			},
+		},
+		members: map[string]map[string]bool{
+			"v2": {
+				instanceKey("", "node-2", "web-2"): true,
+				instanceKey("", "node-3", "web-3"): true,
+			},
+		},
+	}
+
+	tests := []struct {
+		subset ResolverSubset
+		expect []string
+	}{
+		{
+			subset: ResolverSubset{Filter: "Service.Meta.version == v2"},
+			expect: []string{"web-2", "web-3"},
+		},
+		{
+			subset: ResolverSubset{Filter: "Service.Meta.version == v2", OnlyPassing: true},
+			expect: []string{"web-2"},
+		},
+		{
+			subset: ResolverSubset{},
+			expect: []string{"web-1", "web-2", "web-3"},
+		},
+	}
+
+	for idx, test := range tests {
+		result := cluster.Subset("v2", test.subset)
+		if result.Name() != "web:v2" || result.Service() != "web" || result.SubsetName() != "v2" {
+			t.Errorf("case %d: unexpected subset cluster %s of %s", idx, result.Name(), result.Service())
+		}
+
+		var ids []string
+		for _, s := range result.(*Cluster).services {
+			ids = append(ids, s.ServiceID)
+		}
+
+		if !cmp.Equal(ids, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(ids, test.expect))
+		}
+	}
+
+	if cluster.Name() != "web" || len(cluster.services) != 3 {
+		t.Errorf("expected the cluster to be left as it is, got %s with %d instances", cluster.Name(), len(cluster.services))
+	}
+}
+
+func TestCluster_MetaSubsets(t *testing.T) {
+	cluster := &Cluster{
+		name:      "web",
+		namespace: "team",
+		services: []*api.CatalogService{
+			{ServiceID: "web-1", ServiceMeta: map[string]string{"version": "v1"}},
+			{ServiceID: "web-2", ServiceMeta: map[string]string{"version": "v2"}},
+			{ServiceID: "web-3", ServiceMeta: map[string]string{"version": "v2"}},
+			{ServiceID: "web-4"},
+			{ServiceID: "web-5", ServiceMeta: map[string]string{"version": "v3:beta"}},
+			{ServiceID: "web-6", ServiceMeta: map[string]string{"version": "!v2"}},
+		},
+	}
+
+	expect := map[string][]string{
+		"team/web:v1": {"web-1"},
+		"team/web:v2": {"web-2", "web-3"},
+	}
+
+	result := cluster.MetaSubsets("version")
+	if len(result) != len(expect) {
+		t.Fatalf("expected %d subsets, got %d", len(expect), len(result))
+	}
+
+	for _, subset := range result {
+		if subset.Service() != "team/web" {
+			t.Errorf("expected subset %s to belong to team/web, got %s", subset.Name(), subset.Service())
+		}
+
+		var ids []string
+		for _, s := range subset.(*Cluster).services {
+			ids = append(ids, s.ServiceID)
+		}
+
+		if !cmp.Equal(ids, expect[subset.Name()]) {
+			t.Errorf("subset %s: %s", subset.Name(), cmp.Diff(ids, expect[subset.Name()]))
+		}
+	}
+
+	if len(cluster.MetaSubsets("color")) != 0 {
+		t.Errorf("expected no subsets for a key that is not set")
+	}
+}
+
+func TestCluster_Excluding(t *testing.T) {
+	cluster := &Cluster{
+		name: "web",
+		services: []*api.CatalogService{
+			{ServiceID: "web-1", ServiceMeta: map[string]string{"version": "v1"}},
+			{ServiceID: "web-2", ServiceMeta: map[string]string{"version": "v2"}},
+			{ServiceID: "web-3"},
+		},
+	}
+
+	tests := []struct {
+		subset ClusterInfo
+		expect []string
+	}{
+		{subset: cluster.MetaSubsets("version")[1], expect: []string{"web-1", "web-3"}},
+		{subset: nil, expect: []string{"web-1", "web-2", "web-3"}},
+	}
+
+	for idx, test := range tests {
+		result := cluster.Excluding("v2", test.subset)
+		if result.Name() != "web:!v2" || result.Service() != "web" {
+			t.Errorf("case %d: unexpected cluster %s of service %s", idx, result.Name(), result.Service())
+		}
+
+		var ids []string
+		for _, s := range result.(*Cluster).services {
+			ids = append(ids, s.ServiceID)
+		}
+
+		if !cmp.Equal(ids, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(ids, test.expect))
+		}
+	}
+}
+
+func TestParseRouteOptions(t *testing.T) {
+	tests := []struct {
+		options []string
+		expect  MetaRoute
+		err     string
+	}{
+		{
+			options: []string{"subset=v2"},
+			expect:  MetaRoute{Subset: "v2"},
+		},
+		{
+			options: []string{"canary=v2", "canary-weight=10"},
+			expect:  MetaRoute{Canary: &CanaryRoute{Subset: "v2", Weight: 10}},
+		},
+		{
+			options: []string{"canary=v2", "canary-header=x-canary=true"},
+			expect: MetaRoute{Canary: &CanaryRoute{
+				Subset: "v2",
+				Header: &HeaderMatch{Name: "x-canary", Exact: "true"},
+			}},
+		},
+		{
+			options: []string{"canary-header=x-canary", "canary=v2", "canary-weight=100"},
+			expect: MetaRoute{Canary: &CanaryRoute{
+				Subset: "v2",
+				Weight: 100,
+				Header: &HeaderMatch{Name: "x-canary", Present: true},
+			}},
+		},
+		{
+			options: []string{"canary=v2"},
+			err:     `canary "v2" needs the canary-weight or canary-header option`,
+		},
+		{
+			options: []string{"canary-weight=10"},
+			err:     "options canary-weight and canary-header need the canary option",
+		},
+		{
+			options: []string{"canary=v2", "canary-weight=0"},
+			err:     `canary-weight "0" is not a percentage between 1 and 100`,
+		},
+		{
+			options: []string{"canary=v2", "canary-weight=ten"},
+			err:     `canary-weight "ten" is not a percentage between 1 and 100`,
+		},
+		{
+			options: []string{"canary=v2", "canary-header=x-canary="},
+			err:     `option "canary-header" is invalid. header "x-canary" has no value after "="`,
+		},
+		{
+			options: []string{"canary=v2", "canary-header==true"},
+			err:     `option "canary-header" is invalid. header "=true" has no name`,
+		},
+		{
+			options: []string{"subset=v1", "canary=v2", "canary-weight=10"},
+			err:     "options subset and canary can not be combined",
+		},
+		{
+			options: []string{"subset=v1", "dc=dc2"},
+			err:     "option dc can not be combined with subset or canary",
+		},
+		{
+			options: []string{"subset="},
+			err:     `option "subset" needs a subset name without ":" that does not start with "!"`,
+		},
+		{
+			options: []string{"canary=!v2", "canary-weight=10"},
+			err:     `option "canary" needs a subset name without ":" that does not start with "!"`,
+		},
+		{
+			options: []string{"method=get|HEAD", "header=x-team=web", "!header=x-debug", "header=user-agent~=.*bot.*", "header=x-env^=prod", "header=host$=.com"},
+			expect: MetaRoute{Match: RequestMatch{
+				Methods: []string{"GET", "HEAD"},
+				Headers: []HeaderMatch{
+					{Name: "x-team", Exact: "web"},
+					{Name: "x-debug", Present: true, Invert: true},
+					{Name: "user-agent", Regex: ".*bot.*"},
+					{Name: "x-env", Prefix: "prod"},
+					{Name: "host", Suffix: ".com"},
+				},
+			}},
+		},
+		{
+			options: []string{"query=debug", "query=v=2", "query=page~=^[0-9]+$", "query=redirect=a=b"},
+			expect: MetaRoute{Match: RequestMatch{
+				Query: []QueryMatch{
+					{Name: "debug", Present: true},
+					{Name: "v", Exact: "2"},
+					{Name: "page", Regex: "^[0-9]+$"},
+					{Name: "redirect", Exact: "a=b"},
+				},
+			}},
+		},
+		{
+			options: []string{"canary=v2", "canary-header=x-user~=^(alice|bob)$"},
+			expect: MetaRoute{Canary: &CanaryRoute{
+				Subset: "v2",
+				Header: &HeaderMatch{Name: "x-user", Regex: "^(alice|bob)$"},
+			}},
+		},
+		{
+			options: []string{"method=GET", "method=POST"},
+			err:     `option "method" is set more than once`,
+		},
+		{
+			options: []string{"method=GET|"},
+			err:     `option "method" is invalid. "" is not a valid HTTP method`,
+		},
+		{
+			options: []string{"method=GET POST"},
+			err:     `option "method" is invalid. "GET POST" is not a valid HTTP method`,
+		},
+		{
+			options: []string{"header=x-team="},
+			err:     `option "header" is invalid. header "x-team" has no value after "="`,
+		},
+		{
+			options: []string{"header=x team=web"},
+			err:     `option "header" is invalid. "x team" is not a valid header name`,
+		},
+		{
+			options: []string{"header=x-user~=(alice"},
+			err:     "option \"header\" is invalid. regex \"(alice\" of header \"x-user\" is invalid. error parsing regexp: missing closing ): `(alice`",
+		},
+		{
+			options: []string{"query==2"},
+			err:     `option "query" is invalid. query parameter "=2" has no name`,
+		},
+		{
+			options: []string{"query=v^=2"},
+			err:     `option "query" is invalid. query parameter "v" can not be matched with "^="`,
+		},
+		{
+			options: []string{"query=v~=[0-9"},
+			err:     "option \"query\" is invalid. regex \"[0-9\" of query parameter \"v\" is invalid. error parsing regexp: missing closing ]: `[0-9`",
+		},
+	}
+
+	for idx, test := range tests {
+		result, err := parseRouteOptions(test.options)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("case %d: expected error %q, got %v", idx, test.err, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+			continue
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
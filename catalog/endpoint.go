@@ -10,7 +10,13 @@ type Endpoint struct {
 	isConnect   bool
 	addr        string
 	port        int
-	routing     map[string][]string
+	createIndex uint64
+	health      string
+	weight      int
+	nodeMeta    map[string]string
+	datacenter  string
+	dcPriority  int
+	routing     map[string][]MetaRoute
 }
 
 func (e *Endpoint) Name() string {
@@ -32,6 +38,51 @@ func (e *Endpoint) Port() int {
 	return e.port
 }
 
-func (e *Endpoint) RoutingInfo() map[string][]string {
+// CreateIndex is the raft index at which the service
+// instance was registered in consul catalog.
+func (e *Endpoint) CreateIndex() uint64 {
+	return e.createIndex
+}
+
+// Health is the aggregated status of the node and service
+// checks, one of passing, warning, critical or maintenance.
+func (e *Endpoint) Health() string {
+	return e.health
+}
+
+// Weight is the load balancing weight registered
+// in consul for the current health of the instance.
+func (e *Endpoint) Weight() int {
+	return e.weight
+}
+
+// NodeMeta is the metadata of the consul node
+// where the service instance is registered.
+func (e *Endpoint) NodeMeta() map[string]string {
+	return e.nodeMeta
+}
+
+// Datacenter is the consul datacenter of the instance
+func (e *Endpoint) Datacenter() string {
+	return e.datacenter
+}
+
+// DatacenterPriority is 0 for the instances in the local
+// datacenter, remote datacenters have higher values in
+// their failover order.
+func (e *Endpoint) DatacenterPriority() int {
+	return e.dcPriority
+}
+
+// WithDatacenterPriority returns a copy of the endpoint with
+// another failover priority, e.g. for the failover targets of
+// a service-resolver.
+func (e *Endpoint) WithDatacenterPriority(priority int) Endpoint {
+	result := *e
+	result.dcPriority = priority
+	return result
+}
+
+func (e *Endpoint) RoutingInfo() map[string][]MetaRoute {
 	return e.routing
 }
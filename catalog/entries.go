@@ -0,0 +1,611 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"github.com/Gufran/flightpath/metrics"
+	"github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// configEntryKinds are the kinds of consul config
+// entries that shape the routes of the services.
+var configEntryKinds = []string{
+	api.ServiceRouter,
+	api.ServiceSplitter,
+	api.ServiceResolver,
+}
+
+type ConfigEntryFinder interface {
+	List(string, *api.QueryOptions) ([]api.ConfigEntry, *api.QueryMeta, error)
+}
+
+// NamespaceFinder lists the consul enterprise namespaces
+type NamespaceFinder interface {
+	Namespaces(*api.QueryOptions) ([]string, *api.QueryMeta, error)
+}
+
+// ConfigEntries are the config entries of the services that
+// consul uses to route the traffic in the mesh, keyed by the
+// cluster name of the service they belong to.
+type ConfigEntries struct {
+	Routers   map[string]*ServiceRouter
+	Splitters map[string]*ServiceSplitter
+	Resolvers map[string]*ServiceResolver
+}
+
+func NewConfigEntries() *ConfigEntries {
+	return &ConfigEntries{
+		Routers:   map[string]*ServiceRouter{},
+		Splitters: map[string]*ServiceSplitter{},
+		Resolvers: map[string]*ServiceResolver{},
+	}
+}
+
+// Router returns the service-router of the service or nil
+func (c *ConfigEntries) Router(service string) *ServiceRouter {
+	if c == nil {
+		return nil
+	}
+	return c.Routers[service]
+}
+
+// Splitter returns the service-splitter of the service or nil
+func (c *ConfigEntries) Splitter(service string) *ServiceSplitter {
+	if c == nil {
+		return nil
+	}
+	return c.Splitters[service]
+}
+
+// ServiceRouter is a service-router config entry. The routes
+// are evaluated in order and the first match wins, requests
+// that do not match any route are sent to the service itself.
+type ServiceRouter struct {
+	Service string
+	Routes  []RouterRoute
+}
+
+// RouterRoute sends the requests that match the path and
+// the conditions to the destination service.
+type RouterRoute struct {
+	// At most one of PathExact, PathPrefix and PathRegex
+	// is set. Without a path the route matches every path
+	// that is routed to the service.
+	PathExact  string
+	PathPrefix string
+	PathRegex  string
+
+	Match RequestMatch
+
+	// Service is the cluster name of the destination and
+	// Subset is the service-resolver subset to use.
+	Service string
+	Subset  string
+
+	PrefixRewrite         string
+	Timeout               time.Duration
+	NumRetries            uint32
+	RetryOnConnectFailure bool
+	RetryOnStatusCodes    []uint32
+}
+
+// HasRetries reports whether the route overrides the
+// retry policy of the service.
+func (r *RouterRoute) HasRetries() bool {
+	return r.NumRetries > 0 || r.RetryOnConnectFailure || len(r.RetryOnStatusCodes) > 0
+}
+
+// ServiceSplitter is a service-splitter config entry. The
+// traffic routed to the service is split between the services
+// of the splits in proportion to their weight.
+type ServiceSplitter struct {
+	Service string
+	Splits  []Split
+}
+
+// Split is a share of the traffic of a service. The weight
+// is a percentage, the weights of all splits add up to 100.
+type Split struct {
+	Weight  float32
+	Service string
+	Subset  string
+}
+
+// Resolver returns the service-resolver of the service or nil
+func (c *ConfigEntries) Resolver(service string) *ServiceResolver {
+	if c == nil {
+		return nil
+	}
+	return c.Resolvers[service]
+}
+
+// ServiceResolver is a service-resolver config entry. It divides
+// the instances of the service into subsets, redirects the traffic
+// to another service or datacenter, or declares where the traffic
+// goes when the instances of the service are not healthy.
+type ServiceResolver struct {
+	Service       string
+	DefaultSubset string
+	Subsets       map[string]ResolverSubset
+	Redirect      *ResolverTarget
+
+	// Failover is keyed by the name of the subset,
+	// "*" applies to every subset without its own.
+	Failover       map[string]ResolverFailover
+	ConnectTimeout time.Duration
+}
+
+// ResolverSubset selects the instances of the service that
+// match the filter. The filter is a consul filter expression
+// evaluated by consul, see SubsetFilters. OnlyPassing leaves
+// out the instances with health checks in warning state.
+type ResolverSubset struct {
+	Filter      string
+	OnlyPassing bool
+}
+
+// ResolverTarget is the service, subset and datacenter
+// that the traffic of a service is redirected to.
+type ResolverTarget struct {
+	Service    string
+	Subset     string
+	Datacenter string
+}
+
+// ResolverFailover is the service, subset and datacenters that
+// receive the traffic when no instance of the subset is healthy.
+type ResolverFailover struct {
+	Service     string
+	Subset      string
+	Datacenters []string
+}
+
+type ConfigEntryStorage struct {
+	ctx        context.Context
+	finder     ConfigEntryFinder
+	nsFinder   NamespaceFinder
+	namespaces []string
+	subsets    *SubsetFilters
+}
+
+// NewConfigEntryStorage reads the config entries in the
+// namespaces. An empty list reads the entries from the
+// namespace of the consul token and AllNamespaces reads
+// them from every namespace. The filters of the resolver
+// subsets are kept up to date in subsets.
+func NewConfigEntryStorage(ctx context.Context, client *api.Client, namespaces []string, subsets *SubsetFilters) *ConfigEntryStorage {
+	return &ConfigEntryStorage{
+		ctx:        ctx,
+		finder:     client.ConfigEntries(),
+		nsFinder:   &consulFinder{raw: client.Raw()},
+		namespaces: namespaces,
+		subsets:    subsets,
+	}
+}
+
+// configEntryUpdate is the latest list of the
+// config entries of one kind in a namespace.
+type configEntryUpdate struct {
+	kind      string
+	namespace string
+	entries   []api.ConfigEntry
+
+	// ctx is the context of the watch that sent the update,
+	// the updates of a stopped watch are dropped.
+	ctx context.Context
+}
+
+// WatchConfigEntries delivers all config entries every time
+// an entry changes. Entries that can not be translated are
+// reported on errs and left out, they do not prevent other
+// entries from being delivered.
+func (s *ConfigEntryStorage) WatchConfigEntries(entries chan<- *ConfigEntries, errs chan<- error) {
+	namespaces := s.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	updates := make(chan configEntryUpdate)
+	if hasAllNamespaces(namespaces) {
+		go s.watchNamespaces(updates)
+	} else {
+		for _, namespace := range namespaces {
+			for _, kind := range configEntryKinds {
+				go s.watchKind(s.ctx, kind, namespace, updates)
+			}
+		}
+	}
+
+	state := map[string]map[string][]api.ConfigEntry{}
+
+	// reported is the modify index at which every invalid entry
+	// was reported, so that an entry is reported once per change
+	// instead of every time any other entry changes.
+	reported := map[string]uint64{}
+	for {
+		select {
+		case <-s.ctx.Done():
+			logger.Info("config entry watcher loop has shut down")
+			return
+
+		case update := <-updates:
+			if update.ctx.Err() != nil {
+				continue
+			}
+
+			if state[update.kind] == nil {
+				state[update.kind] = map[string][]api.ConfigEntry{}
+			}
+			state[update.kind][update.namespace] = update.entries
+
+			invalid := map[string]uint64{}
+			failed := func(kind, namespace string, entry api.ConfigEntry, err error) {
+				key := kind + "/" + ClusterName(namespace, entry.GetName())
+				invalid[key] = entry.GetModifyIndex()
+				if idx, ok := reported[key]; ok && idx == entry.GetModifyIndex() {
+					return
+				}
+
+				metrics.Incr("catalog.config_entries.error.decode", []string{"kind:" + kind})
+				s.report(errs, err)
+			}
+
+			result := NewConfigEntries()
+			for namespace, list := range state[api.ServiceRouter] {
+				for _, entry := range list {
+					router, err := newServiceRouter(namespace, entry)
+					if err != nil {
+						failed(api.ServiceRouter, namespace, entry, err)
+						continue
+					}
+					result.Routers[router.Service] = router
+				}
+			}
+
+			for namespace, list := range state[api.ServiceSplitter] {
+				for _, entry := range list {
+					splitter, err := newServiceSplitter(namespace, entry)
+					if err != nil {
+						failed(api.ServiceSplitter, namespace, entry, err)
+						continue
+					}
+					result.Splitters[splitter.Service] = splitter
+				}
+			}
+
+			for namespace, list := range state[api.ServiceResolver] {
+				for _, entry := range list {
+					resolver, err := newServiceResolver(namespace, entry)
+					if err != nil {
+						failed(api.ServiceResolver, namespace, entry, err)
+						continue
+					}
+					result.Resolvers[resolver.Service] = resolver
+				}
+			}
+			reported = invalid
+
+			metrics.GaugeI("catalog.config_entries.count", len(result.Routers), []string{"kind:" + api.ServiceRouter})
+			metrics.GaugeI("catalog.config_entries.count", len(result.Splitters), []string{"kind:" + api.ServiceSplitter})
+			metrics.GaugeI("catalog.config_entries.count", len(result.Resolvers), []string{"kind:" + api.ServiceResolver})
+
+			if s.subsets != nil {
+				s.subsets.Set(result.Resolvers)
+			}
+
+			select {
+			case entries <- result:
+			case <-s.ctx.Done():
+			}
+		}
+	}
+}
+
+// watchNamespaces follows the config entries in every namespace
+// as the namespaces are created and deleted. The entries of a
+// deleted namespace are removed.
+func (s *ConfigEntryStorage) watchNamespaces(updates chan<- configEntryUpdate) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(s.ctx, "config_entries/namespaces")
+	defer w.close()
+
+	active := map[string]func(){}
+	tags := []string{"kind:namespaces"}
+	for {
+		metrics.Incr("catalog.config_entries.loop", tags)
+		select {
+		case <-s.ctx.Done():
+			return
+
+		default:
+			namespaces, meta, err := s.nsFinder.Namespaces(qopts.WithContext(s.ctx))
+			if err != nil {
+				metrics.Incr("catalog.config_entries.error.fetch", tags)
+				logger.WithError(err).Error("failed to fetch list of namespaces from consul")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.config_entries.noop", tags)
+				break
+			}
+
+			known := map[string]bool{}
+			for _, namespace := range namespaces {
+				known[namespace] = true
+				if _, ok := active[namespace]; ok {
+					continue
+				}
+
+				logger.WithField("namespace", namespace).Info("reading config entries in namespace")
+				ctx, cancel := context.WithCancel(s.ctx)
+				active[namespace] = cancel
+				for _, kind := range configEntryKinds {
+					go s.watchKind(ctx, kind, namespace, updates)
+				}
+			}
+
+			for namespace, stop := range active {
+				if known[namespace] {
+					continue
+				}
+
+				logger.WithField("namespace", namespace).Info("namespace is deleted. removing its config entries")
+				stop()
+				delete(active, namespace)
+
+				for _, kind := range configEntryKinds {
+					select {
+					case updates <- configEntryUpdate{kind: kind, namespace: namespace, ctx: s.ctx}:
+					case <-s.ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// watchKind follows the list of config entries of
+// one kind in the namespace.
+func (s *ConfigEntryStorage) watchKind(ctx context.Context, kind, namespace string, updates chan<- configEntryUpdate) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	if namespace != "" {
+		ctx = WithNamespace(ctx, namespace)
+	}
+
+	w := newWatch(ctx, watchName(kind, namespace, ""))
+	defer w.close()
+
+	tags := []string{"kind:" + kind}
+	for {
+		metrics.Incr("catalog.config_entries.loop", tags)
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			list, meta, err := s.finder.List(kind, qopts.WithContext(ctx))
+			if err != nil {
+				metrics.Incr("catalog.config_entries.error.fetch", tags)
+				logger.WithError(err).
+					WithField("kind", kind).
+					WithField("namespace", namespace).
+					Error("failed to fetch config entries from consul")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.config_entries.noop", tags)
+				break
+			}
+
+			metrics.Incr("catalog.config_entries.updated", tags)
+
+			select {
+			case updates <- configEntryUpdate{kind: kind, namespace: namespace, entries: list, ctx: ctx}:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (s *ConfigEntryStorage) report(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-s.ctx.Done():
+	}
+}
+
+// destination is the cluster name of a service referenced by
+// a config entry. The service defaults to the service of the
+// entry and the namespace to the namespace of the entry.
+func destination(namespace, owner, service, destNamespace string) string {
+	if service == "" {
+		service = owner
+	}
+	if destNamespace != "" {
+		namespace = destNamespace
+	}
+	return ClusterName(namespace, service)
+}
+
+func newServiceRouter(namespace string, entry api.ConfigEntry) (*ServiceRouter, error) {
+	e, ok := entry.(*api.ServiceRouterConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("config entry %q of kind %q is not a service-router", entry.GetName(), entry.GetKind())
+	}
+
+	router := &ServiceRouter{
+		Service: ClusterName(namespace, e.Name),
+	}
+
+	for idx, r := range e.Routes {
+		route := RouterRoute{
+			Service: ClusterName(namespace, e.Name),
+		}
+
+		if r.Match != nil && r.Match.HTTP != nil {
+			http := r.Match.HTTP
+
+			paths := 0
+			for _, p := range []string{http.PathExact, http.PathPrefix, http.PathRegex} {
+				if p != "" {
+					paths++
+				}
+			}
+			if paths > 1 {
+				return nil, fmt.Errorf("route %d of service-router %q matches on more than one of PathExact, PathPrefix and PathRegex", idx, e.Name)
+			}
+
+			route.PathExact = http.PathExact
+			route.PathPrefix = http.PathPrefix
+			route.PathRegex = http.PathRegex
+			route.Match.Methods = http.Methods
+
+			for _, h := range http.Header {
+				route.Match.Headers = append(route.Match.Headers, HeaderMatch{
+					Name:    h.Name,
+					Present: h.Present,
+					Exact:   h.Exact,
+					Prefix:  h.Prefix,
+					Suffix:  h.Suffix,
+					Regex:   h.Regex,
+					Invert:  h.Invert,
+				})
+			}
+
+			for _, q := range http.QueryParam {
+				route.Match.Query = append(route.Match.Query, QueryMatch{
+					Name:    q.Name,
+					Present: q.Present,
+					Exact:   q.Exact,
+					Regex:   q.Regex,
+				})
+			}
+		}
+
+		if d := r.Destination; d != nil {
+			route.Service = destination(namespace, e.Name, d.Service, d.Namespace)
+			route.Subset = d.ServiceSubset
+			route.PrefixRewrite = d.PrefixRewrite
+			route.Timeout = d.RequestTimeout
+			route.NumRetries = d.NumRetries
+			route.RetryOnConnectFailure = d.RetryOnConnectFailure
+			route.RetryOnStatusCodes = d.RetryOnStatusCodes
+		}
+
+		router.Routes = append(router.Routes, route)
+	}
+
+	return router, nil
+}
+
+func newServiceSplitter(namespace string, entry api.ConfigEntry) (*ServiceSplitter, error) {
+	e, ok := entry.(*api.ServiceSplitterConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("config entry %q of kind %q is not a service-splitter", entry.GetName(), entry.GetKind())
+	}
+
+	splitter := &ServiceSplitter{
+		Service: ClusterName(namespace, e.Name),
+	}
+
+	var total float32
+	for _, s := range e.Splits {
+		if s.Weight < 0 {
+			return nil, fmt.Errorf("service-splitter %q has a negative weight %.2f", e.Name, s.Weight)
+		}
+
+		total += s.Weight
+		splitter.Splits = append(splitter.Splits, Split{
+			Weight:  s.Weight,
+			Service: destination(namespace, e.Name, s.Service, s.Namespace),
+			Subset:  s.ServiceSubset,
+		})
+	}
+
+	// Consul enforces the same rule, weights are
+	// rounded to two decimals before they are added.
+	if total < 99.99 || total > 100.01 {
+		return nil, fmt.Errorf("weights of service-splitter %q add up to %.2f instead of 100", e.Name, total)
+	}
+
+	return splitter, nil
+}
+
+func newServiceResolver(namespace string, entry api.ConfigEntry) (*ServiceResolver, error) {
+	e, ok := entry.(*api.ServiceResolverConfigEntry)
+	if !ok {
+		return nil, fmt.Errorf("config entry %q of kind %q is not a service-resolver", entry.GetName(), entry.GetKind())
+	}
+
+	resolver := &ServiceResolver{
+		Service:        ClusterName(namespace, e.Name),
+		DefaultSubset:  e.DefaultSubset,
+		Subsets:        map[string]ResolverSubset{},
+		Failover:       map[string]ResolverFailover{},
+		ConnectTimeout: e.ConnectTimeout,
+	}
+
+	for name, subset := range e.Subsets {
+		if strings.Contains(name, SubsetSeparator) {
+			return nil, fmt.Errorf("subset %q of service-resolver %q must not contain %q", name, e.Name, SubsetSeparator)
+		}
+
+		resolver.Subsets[name] = ResolverSubset{
+			Filter:      subset.Filter,
+			OnlyPassing: subset.OnlyPassing,
+		}
+	}
+
+	if e.DefaultSubset != "" {
+		if _, ok := resolver.Subsets[e.DefaultSubset]; !ok {
+			return nil, fmt.Errorf("default subset %q of service-resolver %q is not defined", e.DefaultSubset, e.Name)
+		}
+	}
+
+	if r := e.Redirect; r != nil {
+		resolver.Redirect = &ResolverTarget{
+			Service:    destination(namespace, e.Name, r.Service, r.Namespace),
+			Subset:     r.ServiceSubset,
+			Datacenter: r.Datacenter,
+		}
+	}
+
+	for name, f := range e.Failover {
+		if name != "*" {
+			if _, ok := resolver.Subsets[name]; !ok {
+				return nil, fmt.Errorf("failover of service-resolver %q refers to the undefined subset %q", e.Name, name)
+			}
+		}
+
+		if f.Service == "" && f.ServiceSubset == "" && f.Namespace == "" && len(f.Datacenters) == 0 {
+			return nil, fmt.Errorf("failover %q of service-resolver %q does not name a target", name, e.Name)
+		}
+
+		resolver.Failover[name] = ResolverFailover{
+			Service:     destination(namespace, e.Name, f.Service, f.Namespace),
+			Subset:      f.ServiceSubset,
+			Datacenters: f.Datacenters,
+		}
+	}
+
+	return resolver, nil
+}
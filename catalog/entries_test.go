@@ -0,0 +1,503 @@
+package catalog
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/consul/api"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNewServiceRouter(t *testing.T) {
+	tests := []struct {
+		namespace string
+		entry     api.ConfigEntry
+		expect    *ServiceRouter
+		err       bool
+	}{
+		{
+			entry: &api.ServiceRouterConfigEntry{
+				Kind: api.ServiceRouter,
+				Name: "web",
+				Routes: []api.ServiceRoute{
+					{
+						Match: &api.ServiceRouteMatch{
+							HTTP: &api.ServiceRouteHTTPMatch{
+								PathPrefix: "/admin",
+								Header:     []api.ServiceRouteHTTPMatchHeader{{Name: "x-debug", Present: true}},
+								QueryParam: []api.ServiceRouteHTTPMatchQueryParam{{Name: "v", Exact: "2"}},
+								Methods:    []string{"GET"},
+							},
+						},
+						Destination: &api.ServiceRouteDestination{
+							Service:        "admin",
+							PrefixRewrite:  "/",
+							RequestTimeout: 5 * time.Second,
+							NumRetries:     2,
+						},
+					},
+					{
+						Match: &api.ServiceRouteMatch{
+							HTTP: &api.ServiceRouteHTTPMatch{PathExact: "/health"},
+						},
+					},
+				},
+			},
+			expect: &ServiceRouter{
+				Service: "web",
+				Routes: []RouterRoute{
+					{
+						PathPrefix: "/admin",
+						Match: RequestMatch{
+							Methods: []string{"GET"},
+							Headers: []HeaderMatch{{Name: "x-debug", Present: true}},
+							Query:   []QueryMatch{{Name: "v", Exact: "2"}},
+						},
+						Service:       "admin",
+						PrefixRewrite: "/",
+						Timeout:       5 * time.Second,
+						NumRetries:    2,
+					},
+					{
+						PathExact: "/health",
+						Service:   "web",
+					},
+				},
+			},
+		},
+		{
+			// destination defaults to the namespace of the entry
+			namespace: "team-a",
+			entry: &api.ServiceRouterConfigEntry{
+				Kind: api.ServiceRouter,
+				Name: "web",
+				Routes: []api.ServiceRoute{
+					{Destination: &api.ServiceRouteDestination{Service: "api"}},
+					{Destination: &api.ServiceRouteDestination{Service: "api", Namespace: "team-b"}},
+				},
+			},
+			expect: &ServiceRouter{
+				Service: "team-a/web",
+				Routes: []RouterRoute{
+					{Service: "team-a/api"},
+					{Service: "team-b/api"},
+				},
+			},
+		},
+		{
+			entry: &api.ServiceRouterConfigEntry{
+				Kind: api.ServiceRouter,
+				Name: "web",
+				Routes: []api.ServiceRoute{
+					{
+						Match: &api.ServiceRouteMatch{
+							HTTP: &api.ServiceRouteHTTPMatch{PathExact: "/a", PathPrefix: "/b"},
+						},
+					},
+				},
+			},
+			err: true,
+		},
+		{
+			entry: &api.ServiceSplitterConfigEntry{Kind: api.ServiceSplitter, Name: "web"},
+			err:   true,
+		},
+	}
+
+	for idx, test := range tests {
+		result, err := newServiceRouter(test.namespace, test.entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got none", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestNewServiceSplitter(t *testing.T) {
+	tests := []struct {
+		entry  api.ConfigEntry
+		expect *ServiceSplitter
+		err    bool
+	}{
+		{
+			entry: &api.ServiceSplitterConfigEntry{
+				Kind: api.ServiceSplitter,
+				Name: "web",
+				Splits: []api.ServiceSplit{
+					{Weight: 90},
+					{Weight: 10, Service: "web-v2", ServiceSubset: "canary"},
+				},
+			},
+			expect: &ServiceSplitter{
+				Service: "web",
+				Splits: []Split{
+					{Weight: 90, Service: "web"},
+					{Weight: 10, Service: "web-v2", Subset: "canary"},
+				},
+			},
+		},
+		{
+			entry: &api.ServiceSplitterConfigEntry{
+				Kind: api.ServiceSplitter,
+				Name: "web",
+				Splits: []api.ServiceSplit{
+					{Weight: 33.33, Service: "a"},
+					{Weight: 33.33, Service: "b"},
+					{Weight: 33.34, Service: "c"},
+				},
+			},
+			expect: &ServiceSplitter{
+				Service: "web",
+				Splits: []Split{
+					{Weight: 33.33, Service: "a"},
+					{Weight: 33.33, Service: "b"},
+					{Weight: 33.34, Service: "c"},
+				},
+			},
+		},
+		{
+			entry: &api.ServiceSplitterConfigEntry{
+				Kind:   api.ServiceSplitter,
+				Name:   "web",
+				Splits: []api.ServiceSplit{{Weight: 50}},
+			},
+			err: true,
+		},
+		{
+			entry: &api.ServiceSplitterConfigEntry{
+				Kind:   api.ServiceSplitter,
+				Name:   "web",
+				Splits: []api.ServiceSplit{{Weight: 110}, {Weight: -10, Service: "api"}},
+			},
+			err: true,
+		},
+	}
+
+	for idx, test := range tests {
+		result, err := newServiceSplitter("", test.entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got none", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestConfigEntryStorage_WatchConfigEntries(t *testing.T) {
+	stacks := map[string][]ConfigEntryResult{
+		api.ServiceRouter: {
+			{
+				entries: []api.ConfigEntry{
+					&api.ServiceRouterConfigEntry{Kind: api.ServiceRouter, Name: "web"},
+				},
+				meta: &api.QueryMeta{LastIndex: 2},
+			},
+		},
+		api.ServiceSplitter: {
+			{
+				entries: []api.ConfigEntry{
+					&api.ServiceSplitterConfigEntry{Kind: api.ServiceSplitter, Name: "broken"},
+				},
+				meta: &api.QueryMeta{LastIndex: 3},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &ConfigEntryStorage{
+		ctx:    ctx,
+		finder: NewConfigEntryFinderMock(ctx, t, stacks),
+	}
+
+	entries := make(chan *ConfigEntries)
+	errs := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchConfigEntries(entries, errs)
+		done <- struct{}{}
+	}()
+
+	var result *ConfigEntries
+	var failures int
+	for result == nil || failures == 0 || len(result.Routers) == 0 {
+		select {
+		case result = <-entries:
+		case <-errs:
+			failures++
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the config entries")
+		}
+	}
+
+	if result.Router("web") == nil {
+		t.Errorf("expected the service-router of web, got %+v", result.Routers)
+	}
+
+	if result.Splitter("broken") != nil {
+		t.Errorf("expected the invalid service-splitter to be left out")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestConfigEntryStorage_ReportOnce(t *testing.T) {
+	router := func(names ...string) []api.ConfigEntry {
+		var entries []api.ConfigEntry
+		for _, name := range names {
+			entries = append(entries, &api.ServiceRouterConfigEntry{Kind: api.ServiceRouter, Name: name})
+		}
+		return entries
+	}
+
+	broken := func(index uint64) []api.ConfigEntry {
+		return []api.ConfigEntry{
+			&api.ServiceSplitterConfigEntry{Kind: api.ServiceSplitter, Name: "broken", ModifyIndex: index},
+		}
+	}
+
+	stacks := map[string][]ConfigEntryResult{
+		api.ServiceRouter: {
+			{entries: router("web"), meta: &api.QueryMeta{LastIndex: 2}},
+			{entries: router("web", "api"), meta: &api.QueryMeta{LastIndex: 4}},
+			{entries: router("web", "api", "db"), meta: &api.QueryMeta{LastIndex: 6}},
+		},
+		api.ServiceSplitter: {
+			{entries: broken(3), meta: &api.QueryMeta{LastIndex: 3}},
+			{entries: broken(3), meta: &api.QueryMeta{LastIndex: 5}},
+			{entries: broken(7), meta: &api.QueryMeta{LastIndex: 7}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &ConfigEntryStorage{
+		ctx:    ctx,
+		finder: NewConfigEntryFinderMock(ctx, t, stacks),
+	}
+
+	entries := make(chan *ConfigEntries)
+	errs := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchConfigEntries(entries, errs)
+		done <- struct{}{}
+	}()
+
+	// The entry is reported once for every modify index, the
+	// updates of the other entries do not report it again
+	failures := 0
+	idle := time.After(200 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case <-entries:
+		case <-errs:
+			failures++
+		case <-idle:
+			waiting = false
+		}
+	}
+
+	if failures != 2 {
+		t.Errorf("expected the invalid entry to be reported 2 times, got %d", failures)
+	}
+
+	cancel()
+	<-done
+}
+
+// namespaceFinderFunc lists the namespaces with the function
+type namespaceFinderFunc func(*api.QueryOptions) ([]string, *api.QueryMeta, error)
+
+func (f namespaceFinderFunc) Namespaces(q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	return f(q)
+}
+
+func TestConfigEntryStorage_AllNamespaces(t *testing.T) {
+	router := func(name string) []api.ConfigEntry {
+		return []api.ConfigEntry{&api.ServiceRouterConfigEntry{Kind: api.ServiceRouter, Name: name}}
+	}
+
+	stacks := map[string][]ConfigEntryResult{
+		"team-a/" + api.ServiceRouter: {
+			{entries: router("web"), meta: &api.QueryMeta{LastIndex: 2}},
+		},
+		"team-b/" + api.ServiceRouter: {
+			{entries: router("api"), meta: &api.QueryMeta{LastIndex: 3}},
+		},
+	}
+
+	// team-a is deleted once the test closes remove
+	remove := make(chan struct{})
+	namespaces := namespaceFinderFunc(func(q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+		switch q.WaitIndex {
+		case 0:
+			return []string{"team-a", "team-b"}, &api.QueryMeta{LastIndex: 1}, nil
+		case 1:
+			select {
+			case <-remove:
+				return []string{"team-b"}, &api.QueryMeta{LastIndex: 2}, nil
+			case <-q.Context().Done():
+			}
+		default:
+			<-q.Context().Done()
+		}
+		return nil, &api.QueryMeta{LastIndex: q.WaitIndex}, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &ConfigEntryStorage{
+		ctx:        ctx,
+		finder:     NewConfigEntryFinderMock(ctx, t, stacks),
+		nsFinder:   namespaces,
+		namespaces: []string{AllNamespaces},
+	}
+
+	entries := make(chan *ConfigEntries)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchConfigEntries(entries, make(chan error))
+		done <- struct{}{}
+	}()
+
+	wait := func(expect []string) {
+		var routers []string
+		deadline := time.After(time.Second)
+		for !cmp.Equal(routers, expect) {
+			select {
+			case result := <-entries:
+				routers = nil
+				for name := range result.Routers {
+					routers = append(routers, name)
+				}
+				sort.Strings(routers)
+			case <-deadline:
+				t.Fatalf("timed out waiting for the config entries. %s", cmp.Diff(routers, expect))
+			}
+		}
+	}
+
+	// The entries are keyed like the clusters of the namespace
+	wait([]string{"team-a/web", "team-b/api"})
+
+	// and the entries of a deleted namespace are removed
+	close(remove)
+	wait([]string{"team-b/api"})
+
+	cancel()
+	<-done
+}
+
+func TestNewServiceResolver(t *testing.T) {
+	tests := []struct {
+		entry  api.ConfigEntry
+		expect *ServiceResolver
+		err    bool
+	}{
+		{
+			entry: &api.ServiceResolverConfigEntry{
+				Kind:          api.ServiceResolver,
+				Name:          "web",
+				DefaultSubset: "v1",
+				Subsets: map[string]api.ServiceResolverSubset{
+					"v1": {Filter: "Service.Meta.version == v1"},
+					"v2": {Filter: "Service.Meta.version == v2", OnlyPassing: true},
+				},
+				Failover: map[string]api.ServiceResolverFailover{
+					"*": {Datacenters: []string{"dc2", "dc3"}},
+				},
+				ConnectTimeout: 3 * time.Second,
+			},
+			expect: &ServiceResolver{
+				Service:       "web",
+				DefaultSubset: "v1",
+				Subsets: map[string]ResolverSubset{
+					"v1": {Filter: "Service.Meta.version == v1"},
+					"v2": {Filter: "Service.Meta.version == v2", OnlyPassing: true},
+				},
+				Failover: map[string]ResolverFailover{
+					"*": {Service: "web", Datacenters: []string{"dc2", "dc3"}},
+				},
+				ConnectTimeout: 3 * time.Second,
+			},
+		},
+		{
+			entry: &api.ServiceResolverConfigEntry{
+				Kind:     api.ServiceResolver,
+				Name:     "web",
+				Redirect: &api.ServiceResolverRedirect{Datacenter: "dc2"},
+			},
+			expect: &ServiceResolver{
+				Service:  "web",
+				Subsets:  map[string]ResolverSubset{},
+				Redirect: &ResolverTarget{Service: "web", Datacenter: "dc2"},
+				Failover: map[string]ResolverFailover{},
+			},
+		},
+		{
+			entry: &api.ServiceResolverConfigEntry{
+				Kind:          api.ServiceResolver,
+				Name:          "web",
+				DefaultSubset: "v3",
+			},
+			err: true,
+		},
+		{
+			entry: &api.ServiceResolverConfigEntry{
+				Kind:     api.ServiceResolver,
+				Name:     "web",
+				Failover: map[string]api.ServiceResolverFailover{"v1": {Service: "api"}},
+			},
+			err: true,
+		},
+		{
+			entry: &api.ServiceResolverConfigEntry{
+				Kind:    api.ServiceResolver,
+				Name:    "web",
+				Subsets: map[string]api.ServiceResolverSubset{"v:1": {}},
+			},
+			err: true,
+		},
+	}
+
+	for idx, test := range tests {
+		result, err := newServiceResolver("", test.entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got none", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+			continue
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"github.com/Gufran/flightpath/metrics"
+	"github.com/hashicorp/consul/api"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// IngressGatewayKind is the kind of the ingress-gateway config
+	// entries. The consul api client can not decode the entries of
+	// this kind, they are read from the HTTP API directly.
+	IngressGatewayKind = "ingress-gateway"
+
+	IngressProtocolHTTP = "http"
+	IngressProtocolTCP  = "tcp"
+
+	// AllIngressGateways imports every ingress-gateway entry
+	AllIngressGateways = "*"
+
+	// IngressWildcardService exposes every service
+	// on an http listener on its default hosts.
+	IngressWildcardService = "*"
+)
+
+type IngressFinder interface {
+	Query(string, interface{}, *api.QueryOptions) (*api.QueryMeta, error)
+}
+
+// IngressGateway is an ingress-gateway config entry. Its listeners
+// are served by Flightpath next to the routes of the services.
+type IngressGateway struct {
+	Name        string
+	CreateIndex uint64
+	Listeners   []IngressListener
+}
+
+// IngressListener accepts the traffic of the services on a port.
+// A tcp listener has exactly one service.
+type IngressListener struct {
+	Port     int
+	Protocol string
+	TLS      bool
+	Services []IngressService
+}
+
+// IngressService is the cluster name of a service and the hosts
+// it receives the traffic on. The service "*" stands for every
+// service on its default hosts.
+type IngressService struct {
+	Service string
+	Hosts   []string
+}
+
+// ingressGatewayEntry is the JSON representation
+// of an ingress-gateway entry in the consul API.
+type ingressGatewayEntry struct {
+	Kind        string
+	Name        string
+	Namespace   string
+	CreateIndex uint64
+	TLS         struct {
+		Enabled bool
+	}
+	Listeners []struct {
+		Port     int
+		Protocol string
+		TLS      *struct {
+			Enabled bool
+		}
+		Services []struct {
+			Name      string
+			Namespace string
+			Hosts     []string
+		}
+	}
+}
+
+type IngressStorage struct {
+	ctx        context.Context
+	finder     IngressFinder
+	namespaces []string
+	names      map[string]bool
+}
+
+// NewIngressStorage reads the ingress-gateway entries with one
+// of the names, or all of them when the names contain "*".
+func NewIngressStorage(ctx context.Context, client *api.Client, namespaces, names []string) *IngressStorage {
+	s := &IngressStorage{
+		ctx:        ctx,
+		finder:     client.Raw(),
+		namespaces: namespaces,
+		names:      map[string]bool{},
+	}
+
+	for _, name := range names {
+		s.names[name] = true
+	}
+	return s
+}
+
+// WatchIngressGateways delivers the imported gateways every time
+// an entry changes. Entries that can not be translated are
+// reported on errs and left out.
+func (s *IngressStorage) WatchIngressGateways(gateways chan<- []*IngressGateway, errs chan<- error) {
+	namespaces := s.namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+
+	type update struct {
+		namespace string
+		entries   []ingressGatewayEntry
+	}
+
+	updates := make(chan update)
+	for _, namespace := range namespaces {
+		if namespace == AllNamespaces {
+			logger.Warn("ingress gateways can not be read from all namespaces. reading them from the namespace of the consul token")
+			namespace = ""
+		}
+
+		go s.watch(namespace, func(entries []ingressGatewayEntry) bool {
+			select {
+			case updates <- update{namespace: namespace, entries: entries}:
+				return true
+			case <-s.ctx.Done():
+				return false
+			}
+		})
+	}
+
+	state := map[string][]ingressGatewayEntry{}
+	for {
+		select {
+		case <-s.ctx.Done():
+			logger.Info("ingress gateway watcher loop has shut down")
+			return
+
+		case u := <-updates:
+			state[u.namespace] = u.entries
+
+			var result []*IngressGateway
+			for namespace, entries := range state {
+				for _, entry := range entries {
+					if !s.names[AllIngressGateways] && !s.names[entry.Name] {
+						continue
+					}
+
+					gateway, err := newIngressGateway(namespace, entry)
+					if err != nil {
+						metrics.Incr("catalog.ingress_gateways.error.decode", nil)
+						select {
+						case errs <- err:
+						case <-s.ctx.Done():
+						}
+						continue
+					}
+					result = append(result, gateway)
+				}
+			}
+
+			sort.Slice(result, func(i, j int) bool {
+				return result[i].Name < result[j].Name
+			})
+
+			metrics.GaugeI("catalog.ingress_gateways.count", len(result), nil)
+
+			select {
+			case gateways <- result:
+			case <-s.ctx.Done():
+			}
+		}
+	}
+}
+
+func (s *IngressStorage) watch(namespace string, send func([]ingressGatewayEntry) bool) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	ctx := s.ctx
+	if namespace != "" {
+		ctx = WithNamespace(ctx, namespace)
+	}
+
+	w := newWatch(ctx, watchName(IngressGatewayKind, namespace, ""))
+	defer w.close()
+
+	for {
+		metrics.Incr("catalog.ingress_gateways.loop", nil)
+		select {
+		case <-ctx.Done():
+			return
+
+		default:
+			var entries []ingressGatewayEntry
+			meta, err := s.finder.Query("/v1/config/"+IngressGatewayKind, &entries, qopts.WithContext(ctx))
+			if err != nil {
+				metrics.Incr("catalog.ingress_gateways.error.fetch", nil)
+				logger.WithError(err).
+					WithField("namespace", namespace).
+					Error("failed to fetch ingress gateways from consul")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.ingress_gateways.noop", nil)
+				break
+			}
+
+			metrics.Incr("catalog.ingress_gateways.updated", nil)
+			if !send(entries) {
+				return
+			}
+		}
+	}
+}
+
+// ingressHosts are the default hosts of a service
+// on an http listener of an ingress gateway.
+func ingressHosts(namespace, service string) []string {
+	if namespace == "" {
+		return []string{service + ".ingress.*"}
+	}
+	return []string{fmt.Sprintf("%s.ingress.%s.*", service, namespace)}
+}
+
+// IngressDefaultHosts are the hosts of the service of a
+// cluster that is exposed by the wildcard service of an http
+// listener.
+func IngressDefaultHosts(c ClusterInfo) []string {
+	namespace := c.Namespace()
+	return ingressHosts(namespace, strings.TrimPrefix(c.Service(), ClusterName(namespace, "")))
+}
+
+func newIngressGateway(namespace string, e ingressGatewayEntry) (*IngressGateway, error) {
+	if e.Namespace != "" {
+		namespace = e.Namespace
+	}
+
+	gateway := &IngressGateway{
+		Name:        ClusterName(namespace, e.Name),
+		CreateIndex: e.CreateIndex,
+	}
+
+	ports := map[int]bool{}
+	for _, l := range e.Listeners {
+		if l.Port <= 0 || l.Port > 65535 {
+			return nil, fmt.Errorf("ingress gateway %q has a listener on the invalid port %d", e.Name, l.Port)
+		}
+
+		if ports[l.Port] {
+			return nil, fmt.Errorf("ingress gateway %q has more than one listener on port %d", e.Name, l.Port)
+		}
+		ports[l.Port] = true
+
+		listener := IngressListener{
+			Port:     l.Port,
+			Protocol: strings.ToLower(l.Protocol),
+			TLS:      e.TLS.Enabled,
+		}
+
+		if l.TLS != nil {
+			listener.TLS = l.TLS.Enabled
+		}
+
+		switch listener.Protocol {
+		case "":
+			listener.Protocol = IngressProtocolTCP
+		case IngressProtocolTCP, IngressProtocolHTTP:
+		default:
+			return nil, fmt.Errorf("listener %d of ingress gateway %q has the unsupported protocol %q", l.Port, e.Name, l.Protocol)
+		}
+
+		if listener.Protocol == IngressProtocolTCP && len(l.Services) != 1 {
+			return nil, fmt.Errorf("tcp listener %d of ingress gateway %q must have exactly one service", l.Port, e.Name)
+		}
+
+		for _, s := range l.Services {
+			if s.Name == "" {
+				return nil, fmt.Errorf("listener %d of ingress gateway %q has a service without name", l.Port, e.Name)
+			}
+
+			ns := namespace
+			if s.Namespace != "" {
+				ns = s.Namespace
+			}
+
+			service := IngressService{
+				Service: ClusterName(ns, s.Name),
+				Hosts:   s.Hosts,
+			}
+
+			switch {
+			case listener.Protocol == IngressProtocolTCP && s.Name == IngressWildcardService:
+				return nil, fmt.Errorf("tcp listener %d of ingress gateway %q can not use the wildcard service", l.Port, e.Name)
+			case listener.Protocol == IngressProtocolTCP && len(s.Hosts) > 0:
+				return nil, fmt.Errorf("tcp listener %d of ingress gateway %q can not have hosts", l.Port, e.Name)
+			case s.Name == IngressWildcardService && len(s.Hosts) > 0:
+				return nil, fmt.Errorf("wildcard service on listener %d of ingress gateway %q can not have hosts", l.Port, e.Name)
+			case s.Name == IngressWildcardService:
+				service.Service = IngressWildcardService
+			case listener.Protocol == IngressProtocolHTTP && len(s.Hosts) == 0:
+				service.Hosts = ingressHosts(ns, s.Name)
+			}
+
+			listener.Services = append(listener.Services, service)
+		}
+
+		gateway.Listeners = append(gateway.Listeners, listener)
+	}
+
+	sort.Slice(gateway.Listeners, func(i, j int) bool {
+		return gateway.Listeners[i].Port < gateway.Listeners[j].Port
+	})
+
+	return gateway, nil
+}
@@ -0,0 +1,176 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/consul/api"
+	"testing"
+	"time"
+)
+
+func TestNewIngressGateway(t *testing.T) {
+	tests := []struct {
+		namespace string
+		entry     string
+		expect    *IngressGateway
+		err       bool
+	}{
+		{
+			entry: `{
+				"Kind": "ingress-gateway",
+				"Name": "edge",
+				"CreateIndex": 7,
+				"TLS": {"Enabled": true},
+				"Listeners": [
+					{"Port": 9000, "Protocol": "tcp", "Services": [{"Name": "db"}]},
+					{"Port": 8080, "Protocol": "http", "TLS": {"Enabled": false}, "Services": [
+						{"Name": "web", "Hosts": ["example.com"]},
+						{"Name": "api"},
+						{"Name": "*"}
+					]}
+				]
+			}`,
+			expect: &IngressGateway{
+				Name:        "edge",
+				CreateIndex: 7,
+				Listeners: []IngressListener{
+					{
+						Port:     8080,
+						Protocol: IngressProtocolHTTP,
+						Services: []IngressService{
+							{Service: "web", Hosts: []string{"example.com"}},
+							{Service: "api", Hosts: []string{"api.ingress.*"}},
+							{Service: IngressWildcardService},
+						},
+					},
+					{
+						Port:     9000,
+						Protocol: IngressProtocolTCP,
+						TLS:      true,
+						Services: []IngressService{{Service: "db"}},
+					},
+				},
+			},
+		},
+		{
+			namespace: "team-a",
+			entry: `{
+				"Kind": "ingress-gateway",
+				"Name": "edge",
+				"Listeners": [
+					{"Port": 8080, "Protocol": "http", "Services": [{"Name": "web"}, {"Name": "api", "Namespace": "team-b"}]}
+				]
+			}`,
+			expect: &IngressGateway{
+				Name: "team-a/edge",
+				Listeners: []IngressListener{
+					{
+						Port:     8080,
+						Protocol: IngressProtocolHTTP,
+						Services: []IngressService{
+							{Service: "team-a/web", Hosts: []string{"web.ingress.team-a.*"}},
+							{Service: "team-b/api", Hosts: []string{"api.ingress.team-b.*"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			// tcp is the default protocol and takes one service
+			entry: `{"Name": "edge", "Listeners": [{"Port": 9000, "Services": [{"Name": "a"}, {"Name": "b"}]}]}`,
+			err:   true,
+		},
+		{
+			entry: `{"Name": "edge", "Listeners": [{"Port": 9000, "Protocol": "grpc", "Services": [{"Name": "a"}]}]}`,
+			err:   true,
+		},
+		{
+			entry: `{"Name": "edge", "Listeners": [{"Port": 0, "Protocol": "http", "Services": [{"Name": "a"}]}]}`,
+			err:   true,
+		},
+		{
+			entry: `{"Name": "edge", "Listeners": [
+				{"Port": 80, "Protocol": "http", "Services": [{"Name": "a"}]},
+				{"Port": 80, "Protocol": "http", "Services": [{"Name": "b"}]}
+			]}`,
+			err: true,
+		},
+		{
+			entry: `{"Name": "edge", "Listeners": [{"Port": 80, "Protocol": "http", "Services": [{"Name": "*", "Hosts": ["a.com"]}]}]}`,
+			err:   true,
+		},
+	}
+
+	for idx, test := range tests {
+		var entry ingressGatewayEntry
+		if err := json.Unmarshal([]byte(test.entry), &entry); err != nil {
+			t.Fatalf("case %d: invalid entry. %s", idx, err)
+		}
+
+		result, err := newIngressGateway(test.namespace, entry)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got none", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestIngressStorage_WatchIngressGateways(t *testing.T) {
+	stack := []IngressResult{
+		{
+			body: `[
+				{"Kind": "ingress-gateway", "Name": "edge", "Listeners": [{"Port": 8080, "Protocol": "http", "Services": [{"Name": "web"}]}]},
+				{"Kind": "ingress-gateway", "Name": "other", "Listeners": []},
+				{"Kind": "ingress-gateway", "Name": "broken", "Listeners": [{"Port": 8080, "Protocol": "udp"}]}
+			]`,
+			meta: &api.QueryMeta{LastIndex: 2},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &IngressStorage{
+		ctx:    ctx,
+		finder: NewIngressFinderMock(ctx, t, stack),
+		names:  map[string]bool{"edge": true, "broken": true},
+	}
+
+	gateways := make(chan []*IngressGateway)
+	errs := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchIngressGateways(gateways, errs)
+		done <- struct{}{}
+	}()
+
+	var result []*IngressGateway
+	var received, failures int
+	for received == 0 || failures == 0 {
+		select {
+		case result = <-gateways:
+			received++
+		case <-errs:
+			failures++
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the ingress gateways")
+		}
+	}
+
+	if len(result) != 1 || result[0].Name != "edge" {
+		t.Errorf("expected only the gateway edge, got %+v", result)
+	}
+
+	cancel()
+	<-done
+}
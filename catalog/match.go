@@ -0,0 +1,244 @@
+package catalog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	methodPattern     = regexp.MustCompile(`^[A-Z]+$`)
+	headerNamePattern = regexp.MustCompile("^:?[A-Za-z0-9!#%&'*+.`|_-]+$")
+)
+
+// RequestMatch holds the conditions of a route on the request
+// other than its path. A request must satisfy all of them.
+type RequestMatch struct {
+	// Methods matches the requests with one of the methods
+	Methods []string
+
+	Headers []HeaderMatch
+	Query   []QueryMatch
+}
+
+// HeaderMatch matches a request header. Exactly one of
+// Present, Exact, Prefix, Suffix and Regex is set.
+type HeaderMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Prefix  string
+	Suffix  string
+	Regex   string
+
+	// Invert matches the requests that do not
+	// satisfy the condition.
+	Invert bool
+}
+
+// QueryMatch matches a query parameter. Exactly one of
+// Present, Exact and Regex is set.
+type QueryMatch struct {
+	Name    string
+	Present bool
+	Exact   string
+	Regex   string
+}
+
+// IsEmpty reports whether the match accepts every request
+func (m RequestMatch) IsEmpty() bool {
+	return len(m.Methods) == 0 && len(m.Headers) == 0 && len(m.Query) == 0
+}
+
+// Conditions is the number of conditions a request must
+// satisfy. Routes with more conditions are more specific.
+func (m RequestMatch) Conditions() int {
+	count := len(m.Headers) + len(m.Query)
+	if len(m.Methods) > 0 {
+		count++
+	}
+	return count
+}
+
+// String describes the conditions in a stable form, e.g.
+// `method=GET|POST header:x-canary=true query:debug`, so
+// that two matches can be compared.
+func (m RequestMatch) String() string {
+	var parts []string
+	if len(m.Methods) > 0 {
+		parts = append(parts, "method="+strings.Join(m.Methods, "|"))
+	}
+
+	for _, h := range m.Headers {
+		parts = append(parts, h.String())
+	}
+
+	for _, q := range m.Query {
+		parts = append(parts, q.String())
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (h HeaderMatch) String() string {
+	invert := ""
+	if h.Invert {
+		invert = "!"
+	}
+
+	switch {
+	case h.Exact != "":
+		return fmt.Sprintf("%sheader:%s=%s", invert, h.Name, h.Exact)
+	case h.Prefix != "":
+		return fmt.Sprintf("%sheader:%s^=%s", invert, h.Name, h.Prefix)
+	case h.Suffix != "":
+		return fmt.Sprintf("%sheader:%s$=%s", invert, h.Name, h.Suffix)
+	case h.Regex != "":
+		return fmt.Sprintf("%sheader:%s~=%s", invert, h.Name, h.Regex)
+	default:
+		return fmt.Sprintf("%sheader:%s", invert, h.Name)
+	}
+}
+
+func (q QueryMatch) String() string {
+	switch {
+	case q.Exact != "":
+		return fmt.Sprintf("query:%s=%s", q.Name, q.Exact)
+	case q.Regex != "":
+		return fmt.Sprintf("query:%s~=%s", q.Name, q.Regex)
+	default:
+		return fmt.Sprintf("query:%s", q.Name)
+	}
+}
+
+// Merge returns the conditions of both matches. The methods are
+// narrowed down to the ones in both matches, the result can not
+// be satisfied when they have none in common.
+func (m RequestMatch) Merge(other RequestMatch) (RequestMatch, bool) {
+	result := RequestMatch{
+		Methods: m.Methods,
+		Headers: append(append([]HeaderMatch{}, m.Headers...), other.Headers...),
+		Query:   append(append([]QueryMatch{}, m.Query...), other.Query...),
+	}
+
+	switch {
+	case len(m.Methods) == 0:
+		result.Methods = other.Methods
+	case len(other.Methods) > 0:
+		allowed := map[string]bool{}
+		for _, method := range other.Methods {
+			allowed[method] = true
+		}
+
+		result.Methods = nil
+		for _, method := range m.Methods {
+			if allowed[method] {
+				result.Methods = append(result.Methods, method)
+			}
+		}
+
+		if len(result.Methods) == 0 {
+			return result, false
+		}
+	}
+
+	return result, true
+}
+
+// splitCondition splits a condition into the name, the operator
+// and the operand, in the form used by HeaderMatch.String, e.g.
+// x-canary=true, user-agent~=.*bot.* or x-debug
+func splitCondition(value string) (string, string, string) {
+	idx := strings.Index(value, "=")
+	if idx == -1 {
+		return value, "", ""
+	}
+
+	if idx > 0 && strings.ContainsAny(value[idx-1:idx], "~^$") {
+		return value[:idx-1], value[idx-1 : idx+1], value[idx+1:]
+	}
+	return value[:idx], "=", value[idx+1:]
+}
+
+// parseMethods parses the methods separated with |, e.g. GET|HEAD
+func parseMethods(value string) ([]string, error) {
+	var methods []string
+	for _, method := range strings.Split(value, "|") {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if !methodPattern.MatchString(method) {
+			return nil, fmt.Errorf("%q is not a valid HTTP method", method)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// parseHeaderMatch parses a header condition. The header must be
+// present, or its value must be equal to (=), start with (^=), end
+// with ($=) or match the regular expression (~=) after the name.
+func parseHeaderMatch(value string, invert bool) (HeaderMatch, error) {
+	name, op, operand := splitCondition(value)
+	header := HeaderMatch{Name: name, Invert: invert}
+
+	if name == "" {
+		return header, fmt.Errorf("header %q has no name", value)
+	}
+
+	if !headerNamePattern.MatchString(name) {
+		return header, fmt.Errorf("%q is not a valid header name", name)
+	}
+
+	if op != "" && operand == "" {
+		return header, fmt.Errorf("header %q has no value after %q", name, op)
+	}
+
+	switch op {
+	case "":
+		header.Present = true
+	case "=":
+		header.Exact = operand
+	case "^=":
+		header.Prefix = operand
+	case "$=":
+		header.Suffix = operand
+	case "~=":
+		if _, err := regexp.Compile(operand); err != nil {
+			return header, fmt.Errorf("regex %q of header %q is invalid. %s", operand, name, err)
+		}
+		header.Regex = operand
+	}
+
+	return header, nil
+}
+
+// parseQueryMatch parses a query parameter condition. The parameter
+// must be present, or its value must be equal to (=) or match the
+// regular expression (~=) after the name.
+func parseQueryMatch(value string) (QueryMatch, error) {
+	name, op, operand := splitCondition(value)
+	query := QueryMatch{Name: name}
+
+	if name == "" {
+		return query, fmt.Errorf("query parameter %q has no name", value)
+	}
+
+	if op != "" && operand == "" {
+		return query, fmt.Errorf("query parameter %q has no value after %q", name, op)
+	}
+
+	switch op {
+	case "":
+		query.Present = true
+	case "=":
+		query.Exact = operand
+	case "~=":
+		if _, err := regexp.Compile(operand); err != nil {
+			return query, fmt.Errorf("regex %q of query parameter %q is invalid. %s", operand, name, err)
+		}
+		query.Regex = operand
+	default:
+		return query, fmt.Errorf("query parameter %q can not be matched with %q", name, op)
+	}
+
+	return query, nil
+}
@@ -0,0 +1,93 @@
+package catalog
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestRequestMatch_String(t *testing.T) {
+	tests := []struct {
+		match      RequestMatch
+		expect     string
+		conditions int
+	}{
+		{
+			match:  RequestMatch{},
+			expect: "",
+		},
+		{
+			match: RequestMatch{
+				Methods: []string{"GET", "POST"},
+				Headers: []HeaderMatch{
+					{Name: "x-canary", Exact: "true"},
+					{Name: "x-debug", Present: true, Invert: true},
+					{Name: "user-agent", Regex: ".*bot.*"},
+				},
+				Query: []QueryMatch{
+					{Name: "debug", Present: true},
+					{Name: "v", Exact: "2"},
+				},
+			},
+			expect:     "method=GET|POST header:x-canary=true !header:x-debug header:user-agent~=.*bot.* query:debug query:v=2",
+			conditions: 6,
+		},
+	}
+
+	for idx, test := range tests {
+		if result := test.match.String(); result != test.expect {
+			t.Errorf("case %d: expected %q, got %q", idx, test.expect, result)
+		}
+
+		if result := test.match.Conditions(); result != test.conditions {
+			t.Errorf("case %d: expected %d conditions, got %d", idx, test.conditions, result)
+		}
+
+		if test.match.IsEmpty() != (test.conditions == 0) {
+			t.Errorf("case %d: unexpected IsEmpty result", idx)
+		}
+	}
+}
+
+func TestRequestMatch_Merge(t *testing.T) {
+	tests := []struct {
+		a, b   RequestMatch
+		expect RequestMatch
+		ok     bool
+	}{
+		{
+			a:      RequestMatch{Methods: []string{"GET"}, Headers: []HeaderMatch{{Name: "x-team", Exact: "web"}}},
+			b:      RequestMatch{Headers: []HeaderMatch{{Name: "x-canary", Present: true}}, Query: []QueryMatch{{Name: "v", Exact: "2"}}},
+			expect: RequestMatch{Methods: []string{"GET"}, Headers: []HeaderMatch{{Name: "x-team", Exact: "web"}, {Name: "x-canary", Present: true}}, Query: []QueryMatch{{Name: "v", Exact: "2"}}},
+			ok:     true,
+		},
+		{
+			a:      RequestMatch{},
+			b:      RequestMatch{Methods: []string{"POST"}},
+			expect: RequestMatch{Methods: []string{"POST"}},
+			ok:     true,
+		},
+		{
+			a:      RequestMatch{Methods: []string{"GET", "HEAD", "POST"}},
+			b:      RequestMatch{Methods: []string{"POST", "GET"}},
+			expect: RequestMatch{Methods: []string{"GET", "POST"}},
+			ok:     true,
+		},
+		{
+			a:  RequestMatch{Methods: []string{"GET"}},
+			b:  RequestMatch{Methods: []string{"POST"}},
+			ok: false,
+		},
+	}
+
+	for idx, test := range tests {
+		result, ok := test.a.Merge(test.b)
+		if ok != test.ok {
+			t.Errorf("case %d: expected %v, got %v", idx, test.ok, ok)
+			continue
+		}
+
+		if ok && result.String() != test.expect.String() {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result.String(), test.expect.String()))
+		}
+	}
+}
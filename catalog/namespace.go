@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// AllNamespaces selects the services in every namespace
+// that the consul token is allowed to read.
+const AllNamespaces = "*"
+
+// hasAllNamespaces reports whether the list of
+// namespaces selects every namespace.
+func hasAllNamespaces(namespaces []string) bool {
+	for _, namespace := range namespaces {
+		if namespace == AllNamespaces {
+			return true
+		}
+	}
+	return false
+}
+
+type namespaceKey struct{}
+
+// WithNamespace scopes the consul queries made with the
+// context to the namespace. The consul client must use the
+// NamespaceTransport for the namespace to take effect.
+func WithNamespace(ctx context.Context, namespace string) context.Context {
+	return context.WithValue(ctx, namespaceKey{}, namespace)
+}
+
+func namespaceFromContext(ctx context.Context) string {
+	namespace, _ := ctx.Value(namespaceKey{}).(string)
+	return namespace
+}
+
+// NamespaceTransport sets the consul enterprise namespace and
+// admin partition on the requests. The version of consul API
+// used by Flightpath does not support them on query options,
+// so they are added as query parameters on the way out.
+//
+// The namespace is read from the request context and falls
+// back to the default namespace of the transport.
+type NamespaceTransport struct {
+	base      http.RoundTripper
+	namespace string
+	partition string
+}
+
+// NewNamespaceTransport wraps the base transport. Empty
+// namespace and partition leave the requests untouched,
+// which is the only valid setting for consul OSS.
+func NewNamespaceTransport(base http.RoundTripper, namespace, partition string) *NamespaceTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &NamespaceTransport{
+		base:      base,
+		namespace: namespace,
+		partition: partition,
+	}
+}
+
+func (t *NamespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	namespace := namespaceFromContext(req.Context())
+	if namespace == "" {
+		namespace = t.namespace
+	}
+
+	if namespace == "" && t.partition == "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	if namespace != "" && query.Get("ns") == "" {
+		query.Set("ns", namespace)
+	}
+	if t.partition != "" && query.Get("partition") == "" {
+		query.Set("partition", t.partition)
+	}
+	req.URL.RawQuery = query.Encode()
+
+	return t.base.RoundTrip(req)
+}
+
+// ClusterName is the name of the cluster for a service
+// in the namespace. Services discovered without a namespace
+// keep their name so that existing routes and policies work
+// unchanged on consul OSS.
+func ClusterName(namespace, service string) string {
+	if namespace == "" {
+		return service
+	}
+	return namespace + "/" + service
+}
+
+// SplitClusterName returns the namespace and the
+// service of a name built by ClusterName.
+func SplitClusterName(name string) (string, string) {
+	idx := strings.Index(name, "/")
+	if idx == -1 {
+		return "", name
+	}
+	return name[:idx], name[idx+1:]
+}
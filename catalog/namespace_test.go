@@ -0,0 +1,86 @@
+package catalog
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestNamespaceTransport(t *testing.T) {
+	tests := []struct {
+		namespace string
+		partition string
+		ctx       context.Context
+		url       string
+		expect    string
+	}{
+		{
+			ctx:    context.Background(),
+			url:    "http://consul/v1/catalog/services?index=1",
+			expect: "index=1",
+		},
+		{
+			namespace: "edge",
+			ctx:       context.Background(),
+			url:       "http://consul/v1/catalog/services",
+			expect:    "ns=edge",
+		},
+		{
+			namespace: "edge",
+			partition: "web",
+			ctx:       WithNamespace(context.Background(), "team-a"),
+			url:       "http://consul/v1/health/service/api?index=1",
+			expect:    "index=1&ns=team-a&partition=web",
+		},
+		{
+			ctx:    WithNamespace(context.Background(), "team-a"),
+			url:    "http://consul/v1/catalog/services?ns=team-b",
+			expect: "ns=team-b",
+		},
+	}
+
+	for idx, test := range tests {
+		var query string
+		base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			query = req.URL.RawQuery
+			return &http.Response{StatusCode: http.StatusOK}, nil
+		})
+
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error. %s", idx, err)
+		}
+		req = req.WithContext(test.ctx)
+		original := req.URL.RawQuery
+
+		_, err = NewNamespaceTransport(base, test.namespace, test.partition).RoundTrip(req)
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+			continue
+		}
+
+		if query != test.expect {
+			t.Errorf("case %d: expected query %q, got %q", idx, test.expect, query)
+		}
+
+		if req.URL.RawQuery != original {
+			t.Errorf("case %d: original request was modified", idx)
+		}
+	}
+}
+
+func TestClusterName(t *testing.T) {
+	if name := ClusterName("", "web"); name != "web" {
+		t.Errorf("expected web, got %q", name)
+	}
+
+	if name := ClusterName("team-a", "web"); name != "team-a/web" {
+		t.Errorf("expected team-a/web, got %q", name)
+	}
+}
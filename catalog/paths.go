@@ -2,17 +2,83 @@ package catalog
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Gufran/flightpath/metrics"
 	"github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+const (
+	RouteMatchPrefix = "prefix"
+	RouteMatchExact  = "exact"
 )
 
 type RouteFinder interface {
 	List(string, *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
 }
 
+// Route is a routing rule managed externally in consul KV
+// instead of the service metadata. Each key under the
+// configured prefix holds exactly one route.
 type Route struct {
-	cluster    string
-	domains    []string
-	pathPrefix []string
+	name          string
+	cluster       string
+	domains       []string
+	pathPrefix    []string
+	match         string
+	caseSensitive bool
+	createIndex   uint64
+}
+
+// routeSpec is the JSON document stored in consul KV
+// for every route, e.g.
+//
+//	{
+//	  "cluster": "web",
+//	  "domains": ["example.com"],
+//	  "paths": ["/api/"],
+//	  "match": "prefix",
+//	  "case_sensitive": false
+//	}
+type routeSpec struct {
+	Cluster       string   `json:"cluster"`
+	Domains       []string `json:"domains"`
+	Paths         []string `json:"paths"`
+	Match         string   `json:"match"`
+	CaseSensitive bool     `json:"case_sensitive"`
+}
+
+func (r *Route) Name() string {
+	return r.name
+}
+
+func (r *Route) Cluster() string {
+	return r.cluster
+}
+
+func (r *Route) Domains() []string {
+	return r.domains
+}
+
+func (r *Route) PathPrefixes() []string {
+	return r.pathPrefix
+}
+
+// MatchType is either RouteMatchPrefix or RouteMatchExact
+func (r *Route) MatchType() string {
+	return r.match
+}
+
+func (r *Route) IsCaseSensitive() bool {
+	return r.caseSensitive
+}
+
+// CreateIndex is the raft index at which the route
+// was first written to consul KV.
+func (r *Route) CreateIndex() uint64 {
+	return r.createIndex
 }
 
 type RouteStorage struct {
@@ -24,13 +90,148 @@ type RouteStorage struct {
 func NewRouteStorage(ctx context.Context, prefix string, client *api.Client) *RouteStorage {
 	return &RouteStorage{
 		ctx:    ctx,
-		prefix: prefix,
+		prefix: strings.TrimRight(prefix, "/") + "/",
 		finder: client.KV(),
 	}
 }
 
-func (i *RouteStorage) WatchRoutes(routes chan <- []Route, errs chan <-error) {
-	// TODO: work in progress
-	//   evaluating the idea of managing the routes externally from consul kv
-	//   rather than relying on the service metadata
+// RouteError is a route in consul KV that can not be decoded
+type RouteError struct {
+	Key string
+	Err error
+}
+
+func (e *RouteError) Error() string {
+	return e.Err.Error()
+}
+
+// WatchRoutes delivers the state-of-the-world list of routes
+// stored under the KV prefix every time something changes.
+// Keys that fail to decode are reported on errs as RouteError
+// once per change and left out of the list, they do not prevent
+// other routes from being delivered.
+func (i *RouteStorage) WatchRoutes(routes chan<- []Route, errs chan<- error) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(i.ctx, "routes")
+	defer w.close()
+
+	// reported is the modify index at which every malformed
+	// route was reported, so that a route is reported once per
+	// change instead of every time any other route changes.
+	reported := map[string]uint64{}
+
+	for {
+		metrics.Incr("catalog.routes.loop", nil)
+		select {
+		case <-i.ctx.Done():
+			logger.Info("route storage watcher loop has shut down")
+			return
+
+		default:
+			pairs, meta, err := i.finder.List(i.prefix, qopts.WithContext(i.ctx))
+			if err != nil {
+				metrics.Incr("catalog.routes.error.fetch", nil)
+				i.report(errs, fmt.Errorf("failed to fetch routes from consul kv prefix %q. %s", i.prefix, err))
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.routes.noop", nil)
+				break
+			}
+
+			var result []Route
+			malformed := map[string]uint64{}
+			for _, pair := range pairs {
+				r, err := decodeRoute(i.prefix, pair)
+				if err != nil {
+					malformed[pair.Key] = pair.ModifyIndex
+					if idx, ok := reported[pair.Key]; !ok || idx != pair.ModifyIndex {
+						metrics.Incr("catalog.routes.error.decode", []string{"prefix:" + i.prefix})
+						i.report(errs, &RouteError{Key: pair.Key, Err: err})
+					}
+					continue
+				}
+
+				if r != nil {
+					result = append(result, *r)
+				}
+			}
+			reported = malformed
+
+			metrics.GaugeI("catalog.routes.count", len(result), nil)
+			metrics.Incr("catalog.routes.updated", nil)
+
+			select {
+			case routes <- result:
+			case <-i.ctx.Done():
+			}
+		}
+	}
+}
+
+func (i *RouteStorage) report(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-i.ctx.Done():
+	}
+}
+
+// decodeRoute parses the route definition stored in KV pair.
+// A nil route without error is returned for the keys that
+// represent a folder.
+func decodeRoute(prefix string, pair *api.KVPair) (*Route, error) {
+	name := strings.TrimPrefix(pair.Key, prefix)
+	if name == "" || strings.HasSuffix(name, "/") {
+		return nil, nil
+	}
+
+	spec := routeSpec{}
+	err := json.Unmarshal(pair.Value, &spec)
+	if err != nil {
+		return nil, fmt.Errorf("route %q is not a valid JSON document. %s", pair.Key, err)
+	}
+
+	if spec.Cluster == "" {
+		return nil, fmt.Errorf("route %q does not name a cluster", pair.Key)
+	}
+
+	switch spec.Match {
+	case "":
+		spec.Match = RouteMatchPrefix
+	case RouteMatchPrefix, RouteMatchExact:
+	default:
+		return nil, fmt.Errorf("route %q has unsupported match type %q. valid options are %q and %q", pair.Key, spec.Match, RouteMatchPrefix, RouteMatchExact)
+	}
+
+	if len(spec.Domains) == 0 {
+		spec.Domains = []string{"*"}
+	}
+
+	if len(spec.Paths) == 0 {
+		spec.Paths = []string{"/"}
+	}
+
+	for _, p := range spec.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("route %q has path %q that does not start with '/'", pair.Key, p)
+		}
+	}
+
+	return &Route{
+		name:          strings.Replace(name, "/", ".", -1),
+		cluster:       spec.Cluster,
+		domains:       spec.Domains,
+		pathPrefix:    spec.Paths,
+		match:         spec.Match,
+		caseSensitive: spec.CaseSensitive,
+		createIndex:   pair.CreateIndex,
+	}, nil
 }
@@ -0,0 +1,169 @@
+package catalog
+
+import (
+	"context"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestDecodeRoute(t *testing.T) {
+	tests := []struct {
+		pair   *api.KVPair
+		expect *Route
+		err    bool
+	}{
+		{
+			pair:   &api.KVPair{Key: "flightpath/routes/"},
+			expect: nil,
+		},
+		{
+			pair: &api.KVPair{
+				Key:         "flightpath/routes/web",
+				Value:       []byte(`{"cluster": "web"}`),
+				CreateIndex: 12,
+			},
+			expect: &Route{
+				name:        "web",
+				cluster:     "web",
+				domains:     []string{"*"},
+				pathPrefix:  []string{"/"},
+				match:       RouteMatchPrefix,
+				createIndex: 12,
+			},
+		},
+		{
+			pair: &api.KVPair{
+				Key:   "flightpath/routes/team/api",
+				Value: []byte(`{"cluster": "api", "domains": ["example.com", "example.org"], "paths": ["/v1", "/v2"], "match": "exact", "case_sensitive": true}`),
+			},
+			expect: &Route{
+				name:          "team.api",
+				cluster:       "api",
+				domains:       []string{"example.com", "example.org"},
+				pathPrefix:    []string{"/v1", "/v2"},
+				match:         RouteMatchExact,
+				caseSensitive: true,
+			},
+		},
+		{
+			pair: &api.KVPair{
+				Key:   "flightpath/routes/broken",
+				Value: []byte(`not json`),
+			},
+			err: true,
+		},
+		{
+			pair: &api.KVPair{
+				Key:   "flightpath/routes/no-cluster",
+				Value: []byte(`{"domains": ["example.com"]}`),
+			},
+			err: true,
+		},
+		{
+			pair: &api.KVPair{
+				Key:   "flightpath/routes/bad-match",
+				Value: []byte(`{"cluster": "web", "match": "regex"}`),
+			},
+			err: true,
+		},
+		{
+			pair: &api.KVPair{
+				Key:   "flightpath/routes/bad-path",
+				Value: []byte(`{"cluster": "web", "paths": ["relative"]}`),
+			},
+			err: true,
+		},
+	}
+
+	for idx, test := range tests {
+		result, err := decodeRoute("flightpath/routes/", test.pair)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error, got none", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+		}
+
+		if !cmp.Equal(result, test.expect, cmp.AllowUnexported(Route{})) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect, cmp.AllowUnexported(Route{})))
+		}
+	}
+}
+
+func TestRouteStorage_WatchRoutes(t *testing.T) {
+	stack := []ListResult{
+		{
+			meta: &api.QueryMeta{LastIndex: 0},
+		},
+		{
+			pairs: api.KVPairs{
+				{Key: "routes/web", Value: []byte(`{"cluster": "web"}`)},
+				{Key: "routes/broken", Value: []byte(`{}`)},
+			},
+			meta: &api.QueryMeta{LastIndex: 2},
+		},
+		{
+			// another route changed, the broken one did not
+			pairs: api.KVPairs{
+				{Key: "routes/web", Value: []byte(`{"cluster": "web"}`)},
+				{Key: "routes/api", Value: []byte(`{"cluster": "api"}`)},
+				{Key: "routes/broken", Value: []byte(`{}`)},
+			},
+			meta: &api.QueryMeta{LastIndex: 3},
+		},
+		{
+			pairs: api.KVPairs{
+				{Key: "routes/web", Value: []byte(`{"cluster": "web"}`)},
+				{Key: "routes/api", Value: []byte(`{"cluster": "api"}`)},
+				{Key: "routes/broken", Value: []byte(`{"cluster": ""}`), ModifyIndex: 4},
+			},
+			meta: &api.QueryMeta{LastIndex: 4},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &RouteStorage{
+		ctx:    ctx,
+		prefix: "routes/",
+		finder: NewRouteFinderMock(ctx, t, stack, true),
+	}
+
+	routes := make(chan []Route)
+	errs := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchRoutes(routes, errs)
+		done <- struct{}{}
+	}()
+
+	if err, ok := (<-errs).(*RouteError); !ok || err.Key != "routes/broken" {
+		t.Errorf("expected an error for the broken route, got %v", err)
+	}
+
+	result := <-routes
+	if len(result) != 1 || result[0].Cluster() != "web" {
+		t.Errorf("unexpected routes %#v", result)
+	}
+
+	// The broken route is not reported again
+	if result := <-routes; len(result) != 2 {
+		t.Errorf("unexpected routes %#v", result)
+	}
+
+	if err, ok := (<-errs).(*RouteError); !ok || err.Key != "routes/broken" {
+		t.Errorf("expected the changed route to be reported again, got %v", err)
+	}
+
+	if result := <-routes; len(result) != 2 {
+		t.Errorf("unexpected routes %#v", result)
+	}
+
+	cancel()
+	<-done
+}
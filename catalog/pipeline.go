@@ -0,0 +1,692 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"github.com/Gufran/flightpath/metrics"
+	"github.com/hashicorp/consul/api"
+	"sync"
+	"time"
+)
+
+// PipelineConfig controls how the service instances are
+// fetched from consul.
+type PipelineConfig struct {
+	// Workers is the number of services fetched concurrently
+	Workers int
+
+	// Debounce delays the fetch after a change so that a
+	// burst of changes to a service causes only one fetch.
+	Debounce time.Duration
+
+	// Resync fetches every service on this interval as a
+	// safety net for changes that were missed, e.g. while a
+	// watch was failing. Zero disables the resync.
+	Resync time.Duration
+
+	// UseCache reads the service instances from the cache
+	// of the local consul agent.
+	UseCache bool
+
+	// AllowStale lets any consul server answer the reads
+	// instead of only the leader.
+	AllowStale bool
+
+	// Subsets are the filters of the service-resolver subsets.
+	// The instances of every subset with a filter are fetched
+	// along with the instances of the service.
+	Subsets *SubsetFilters
+}
+
+// DefaultPipelineConfig returns the settings used when
+// nothing else is configured.
+func DefaultPipelineConfig() *PipelineConfig {
+	return &PipelineConfig{
+		Workers:  8,
+		Debounce: 500 * time.Millisecond,
+		Resync:   time.Minute,
+	}
+}
+
+// serviceState is what the pipeline knows about a service
+// that is selected for discovery.
+type serviceState struct {
+	// instances are the last fetched service instances of
+	// every datacenter, in failover order.
+	instances [][]*api.CatalogService
+	synced    bool
+
+	// members are the instances of the subsets of every
+	// datacenter, in the same order as the instances.
+	members []map[string]map[string]bool
+
+	// nodes where the instances are running, so that a
+	// change to a node check refreshes the service.
+	nodes map[string]bool
+
+	// sidecarFor is the destination service when the
+	// instances are connect sidecar proxies, and proxies
+	// are the destination instances behind the sidecars.
+	sidecarFor string
+	proxies    map[string]bool
+
+	published bool
+
+	// failures is the number of consecutive failed fetches,
+	// the retries back off like the consul watches.
+	failures int
+}
+
+// pipelineEvent is a cluster to publish, or the
+// name of a published cluster to remove.
+type pipelineEvent struct {
+	cluster ClusterInfo
+	removed string
+}
+
+// pipeline fetches the instances of the services in its
+// queue and delivers them as clusters. Services enter the
+// queue when the catalog of their namespace changes in any
+// datacenter, when one of their health checks changes and
+// on resync.
+type pipeline struct {
+	finder   ServiceFinder
+	selector *Selector
+	config   *PipelineConfig
+	queue    *workQueue
+	clusters chan<- ClusterInfo
+	cleanup  chan<- string
+
+	mx       sync.Mutex
+	services map[serviceKey]*serviceState
+
+	// pending are the events collected under the lock in the
+	// order they happened. They are sent by one goroutine at a
+	// time after the lock is released, see deliver.
+	pending    []pipelineEvent
+	delivering bool
+}
+
+func newPipeline(finder ServiceFinder, selector *Selector, config *PipelineConfig, clusters chan<- ClusterInfo, cleanup chan<- string) *pipeline {
+	if config == nil {
+		config = DefaultPipelineConfig()
+	}
+
+	return &pipeline{
+		finder:   finder,
+		selector: selector,
+		config:   config,
+		queue:    newWorkQueue(config.Debounce),
+		clusters: clusters,
+		cleanup:  cleanup,
+		services: map[serviceKey]*serviceState{},
+	}
+}
+
+// run starts the workers and blocks until the context is done
+func (p *pipeline) run(ctx context.Context) {
+	workers := p.config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(ctx)
+		}()
+	}
+
+	var resync <-chan time.Time
+	if p.config.Resync > 0 {
+		ticker := time.NewTicker(p.config.Resync)
+		defer ticker.Stop()
+		resync = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.queue.Close()
+			wg.Wait()
+			logger.Info("service discovery pipeline has shut down")
+			return
+
+		case <-resync:
+			metrics.Incr("catalog.pipeline.resync", nil)
+			p.requeue()
+
+		case <-p.config.Subsets.Changed():
+			logger.Info("service-resolver subsets have changed. fetching all services again")
+			p.requeue()
+		}
+	}
+}
+
+// requeue queues every service to be fetched again
+func (p *pipeline) requeue() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for key := range p.services {
+		p.queue.Add(key)
+	}
+}
+
+func (p *pipeline) work(ctx context.Context) {
+	for {
+		key, ok := p.queue.Get()
+		if !ok {
+			return
+		}
+
+		retry := p.process(ctx, key)
+		p.queue.Done(key)
+
+		if retry {
+			p.queue.AddAfter(key, p.backoff(key))
+		}
+	}
+}
+
+// sync replaces the selected services of the namespace with
+// the services in the catalog, and fetches all of them again.
+// The list does not tell which service changed, but its index
+// moves with every change to an instance, e.g. a new instance,
+// a deregistered instance or new meta attributes. The queue
+// coalesces the fetches. Services that are gone are removed.
+func (p *pipeline) sync(ctx context.Context, namespace string, services map[string][]string) {
+	defer p.deliver(ctx)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	selected := map[serviceKey]bool{}
+	for name, tags := range services {
+		if !p.selector.MatchesTags(tags) {
+			continue
+		}
+
+		key := serviceKey{namespace: namespace, name: name}
+		selected[key] = true
+
+		if _, ok := p.services[key]; !ok {
+			logger.WithField("service", name).WithField("namespace", namespace).Info("found discovery candidate service")
+			p.services[key] = &serviceState{}
+		}
+		p.queue.Add(key)
+	}
+
+	for key, state := range p.services {
+		if key.namespace != namespace || selected[key] {
+			continue
+		}
+
+		logger.WithField("service", key.name).WithField("namespace", namespace).Info("service is no longer selected for discovery")
+		delete(p.services, key)
+		p.unpublish(key, state)
+
+		if state.sidecarFor != "" {
+			// The instances behind the sidecar are routed
+			// through the cluster of the destination again
+			p.refresh(serviceKey{namespace: namespace, name: state.sidecarFor})
+		}
+	}
+
+	metrics.GaugeI("catalog.pipeline.services", len(p.services), nil)
+}
+
+// touch queues the selected services of the namespace after
+// a change to the catalog of a remote datacenter, see sync.
+func (p *pipeline) touch(namespace string) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for key := range p.services {
+		if key.namespace == namespace {
+			p.queue.Add(key)
+		}
+	}
+}
+
+// notify queues the services affected by the changed checks. A
+// node check affects every service with an instance on the node.
+func (p *pipeline) notify(namespace string, checks []*api.HealthCheck) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for _, check := range checks {
+		if check.ServiceName != "" {
+			key := serviceKey{namespace: namespace, name: check.ServiceName}
+			if _, ok := p.services[key]; ok {
+				p.queue.Add(key)
+			}
+			continue
+		}
+
+		for key, state := range p.services {
+			if key.namespace == namespace && state.nodes[check.Node] {
+				p.queue.Add(key)
+			}
+		}
+	}
+}
+
+// process fetches the instances of the service in every
+// datacenter and reports whether the fetch must be retried.
+func (p *pipeline) process(ctx context.Context, key serviceKey) bool {
+	p.mx.Lock()
+	_, tracked := p.services[key]
+	p.mx.Unlock()
+
+	if !tracked {
+		return false
+	}
+
+	datacenters := append([]string{""}, p.selector.Datacenters...)
+	results := make([][]*api.CatalogService, len(datacenters))
+	members := make([]map[string]map[string]bool, len(datacenters))
+	fetched := make([]bool, len(datacenters))
+
+	failed := false
+	for priority, dc := range datacenters {
+		services, err := p.fetch(ctx, key, dc, "")
+		if err == nil {
+			members[priority], err = p.fetchSubsets(ctx, key, dc, services)
+		}
+
+		if err != nil {
+			// The last known instances of the datacenter
+			// are kept until the fetch succeeds again.
+			failed = true
+			continue
+		}
+
+		results[priority] = services
+		fetched[priority] = true
+	}
+
+	p.update(ctx, key, results, members, fetched)
+
+	p.mx.Lock()
+	if state, ok := p.services[key]; ok {
+		if failed {
+			state.failures++
+		} else {
+			state.failures = 0
+		}
+	}
+	p.mx.Unlock()
+
+	return failed
+}
+
+// backoff is the delay before the failed service is fetched again
+func (p *pipeline) backoff(key serviceKey) time.Duration {
+	p.mx.Lock()
+	failures := 1
+	if state, ok := p.services[key]; ok && state.failures > 0 {
+		failures = state.failures
+	}
+	p.mx.Unlock()
+
+	return currentWatchConfig().Backoff(failures)
+}
+
+// queryOptions are the options for reading the instances
+// of a service in the datacenter.
+func (p *pipeline) queryOptions(dc string) *api.QueryOptions {
+	qopts := &api.QueryOptions{
+		Datacenter:        dc,
+		AllowStale:        false,
+		RequireConsistent: true,
+		Filter:            p.selector.Filter,
+	}
+
+	if p.config.AllowStale || p.config.UseCache {
+		qopts.AllowStale = true
+		qopts.RequireConsistent = false
+	}
+
+	qopts.UseCache = p.config.UseCache
+	return qopts
+}
+
+// fetch reads the instances of the service in the datacenter.
+// The filter is applied by consul along with the filter of the
+// selector, e.g. the filter of a service-resolver subset.
+func (p *pipeline) fetch(ctx context.Context, key serviceKey, dc, filter string) ([]*api.CatalogService, error) {
+	tags := []string{"service:" + key.name}
+	if key.namespace != "" {
+		ctx = WithNamespace(ctx, key.namespace)
+		tags = append(tags, "namespace:"+key.namespace)
+	}
+	if dc != "" {
+		tags = append(tags, "dc:"+dc)
+	}
+
+	defer metrics.Timed("catalog.pipeline.fetch_ns", time.Now(), tags)
+	metrics.Incr("catalog.pipeline.fetch", tags)
+
+	qopts := p.queryOptions(dc)
+	if filter != "" {
+		if qopts.Filter != "" {
+			filter = "(" + qopts.Filter + ") and (" + filter + ")"
+		}
+		qopts.Filter = filter
+	}
+
+	entries, _, err := p.finder.HealthService(key.name, "", false, qopts.WithContext(ctx))
+	if err != nil {
+		metrics.Incr("catalog.pipeline.error.fetch", tags)
+		logger.WithError(err).
+			WithField("service", key.name).
+			WithField("namespace", key.namespace).
+			WithField("dc", dc).
+			WithField("filter", qopts.Filter).
+			Error("failed to fetch service definition")
+		return nil, err
+	}
+
+	return p.selector.filterExcluded(catalogServices(entries)), nil
+}
+
+// fetchSubsets reads the instances of every subset with a filter
+// in the service-resolver of the service, and returns the keys of
+// the instances by the name of the subset. The resolver of a
+// sidecar service is the resolver of its destination.
+func (p *pipeline) fetchSubsets(ctx context.Context, key serviceKey, dc string, services []*api.CatalogService) (map[string]map[string]bool, error) {
+	service := ClusterName(key.namespace, key.name)
+	for _, s := range services {
+		if isSidecarProxy(s) {
+			service = ClusterName(key.namespace, s.ServiceProxy.DestinationServiceName)
+			break
+		}
+	}
+
+	filters := p.config.Subsets.Get(service)
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	members := map[string]map[string]bool{}
+	for name, filter := range filters {
+		instances, err := p.fetch(ctx, key, dc, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		members[name] = map[string]bool{}
+		for _, s := range instances {
+			members[name][instanceKey(s.Datacenter, s.Node, s.ServiceID)] = true
+		}
+	}
+	return members, nil
+}
+
+// update stores the fetched instances and publishes the service.
+// A service is not published when none of its instances are
+// selected, or when sidecar proxies take the traffic of all
+// of its instances.
+func (p *pipeline) update(ctx context.Context, key serviceKey, results [][]*api.CatalogService, members []map[string]map[string]bool, fetched []bool) {
+	defer p.deliver(ctx)
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	state, ok := p.services[key]
+	if !ok {
+		return
+	}
+
+	if len(state.instances) != len(results) {
+		state.instances = make([][]*api.CatalogService, len(results))
+		state.members = make([]map[string]map[string]bool, len(results))
+	}
+
+	for idx := range results {
+		if fetched[idx] {
+			state.instances[idx] = results[idx]
+			state.members[idx] = members[idx]
+			state.synced = true
+		}
+	}
+
+	if !state.synced {
+		return
+	}
+
+	p.publish(key, state)
+}
+
+// publish builds the cluster from the last fetched instances
+// of the service. A sidecar service publishes its destination
+// again when the set of instances behind the sidecars changes.
+func (p *pipeline) publish(key serviceKey, state *serviceState) {
+	cluster := &Cluster{
+		name:         key.name,
+		namespace:    key.namespace,
+		partition:    p.selector.Partition,
+		allowWarning: p.selector.AllowWarning,
+		priorities:   map[string]int{},
+	}
+
+	// Instances that have a sidecar are reached through the
+	// connect cluster of the sidecar, the rest of them stay in
+	// this cluster while the service is migrated to connect.
+	proxied := p.proxiedInstances(key)
+
+	nodes := map[string]bool{}
+	proxies := map[string]bool{}
+	sidecarFor := ""
+	skipped := 0
+	for priority, services := range state.instances {
+		for _, service := range services {
+			nodes[service.Node] = true
+
+			if proxied[instanceKey(service.Datacenter, service.Node, service.ServiceID)] {
+				skipped++
+				continue
+			}
+
+			if _, ok := cluster.priorities[service.Datacenter]; !ok {
+				cluster.priorities[service.Datacenter] = priority
+			}
+
+			if isSidecarProxy(service) {
+				cluster.isConnect = true
+				sidecarFor = service.ServiceProxy.DestinationServiceName
+				proxies[instanceKey(service.Datacenter, service.Node, destinationServiceID(service))] = true
+			}
+
+			cluster.services = append(cluster.services, service)
+		}
+	}
+	state.nodes = nodes
+	cluster.destination = sidecarFor
+
+	for _, members := range state.members {
+		for name, keys := range members {
+			if cluster.members == nil {
+				cluster.members = map[string]map[string]bool{}
+			}
+			if cluster.members[name] == nil {
+				cluster.members[name] = map[string]bool{}
+			}
+			for k := range keys {
+				cluster.members[name][k] = true
+			}
+		}
+	}
+
+	var destinations []string
+	if state.sidecarFor != sidecarFor || !sameKeys(state.proxies, proxies) {
+		if sidecarFor != "" && state.sidecarFor != sidecarFor {
+			logger.WithField("service", key.name).
+				WithField("sidecar_destination", sidecarFor).
+				Info("sidecar selected for cluster discovery")
+		}
+
+		if state.sidecarFor != "" {
+			destinations = append(destinations, state.sidecarFor)
+		}
+		if sidecarFor != "" && sidecarFor != state.sidecarFor {
+			destinations = append(destinations, sidecarFor)
+		}
+
+		state.sidecarFor = sidecarFor
+		state.proxies = proxies
+	}
+
+	// The destination publishes the instances that are not
+	// behind one of the sidecars. It is published after the
+	// sidecar so that the sidecar is in place before the
+	// instances leave the cluster of the destination.
+	defer func() {
+		for _, name := range destinations {
+			p.refresh(serviceKey{namespace: key.namespace, name: name})
+		}
+	}()
+
+	if len(cluster.services) == 0 {
+		if skipped > 0 {
+			logger.WithField("service", key.name).Info("all instances of the service are behind a sidecar")
+		} else {
+			// None of the instances are selected by the filter
+			// expression or all of them are excluded.
+			logger.WithField("service", key.name).Info("service is excluded from cluster discovery")
+		}
+
+		p.unpublish(key, state)
+		return
+	}
+
+	cluster.parseRoutes()
+	metrics.Incr("catalog.pipeline.published", []string{"service:" + key.name, fmt.Sprintf("is_sidecar:%v", cluster.isConnect)})
+
+	state.published = true
+	p.pending = append(p.pending, pipelineEvent{cluster: cluster})
+}
+
+// refresh publishes the service again from the
+// instances that were fetched last.
+func (p *pipeline) refresh(key serviceKey) {
+	state, ok := p.services[key]
+	if ok && state.synced {
+		p.publish(key, state)
+	}
+}
+
+// proxiedInstances returns the instances of the service
+// that are behind one of its selected sidecar proxies.
+func (p *pipeline) proxiedInstances(key serviceKey) map[string]bool {
+	result := map[string]bool{}
+	for other, state := range p.services {
+		if other.namespace == key.namespace && state.sidecarFor == key.name {
+			for instance := range state.proxies {
+				result[instance] = true
+			}
+		}
+	}
+	return result
+}
+
+func (p *pipeline) unpublish(key serviceKey, state *serviceState) {
+	if !state.published {
+		return
+	}
+
+	state.published = false
+	metrics.Incr("catalog.pipeline.removed", []string{"service:" + key.name})
+	p.pending = append(p.pending, pipelineEvent{removed: key.String()})
+}
+
+// deliver sends the pending events without holding the lock, so
+// that a slow consumer does not hold back the workers, the health
+// watch and the namespace discovery. Only one goroutine sends at a
+// time to keep the events in order, the others leave their events
+// to it and it sends them before it returns.
+func (p *pipeline) deliver(ctx context.Context) {
+	p.mx.Lock()
+	if p.delivering {
+		p.mx.Unlock()
+		return
+	}
+	p.delivering = true
+
+	for len(p.pending) > 0 {
+		events := p.pending
+		p.pending = nil
+		p.mx.Unlock()
+
+		for _, e := range events {
+			if e.cluster != nil {
+				select {
+				case p.clusters <- e.cluster:
+				case <-ctx.Done():
+				}
+				continue
+			}
+
+			select {
+			case p.cleanup <- e.removed:
+			case <-ctx.Done():
+			}
+		}
+
+		p.mx.Lock()
+	}
+
+	p.delivering = false
+	p.mx.Unlock()
+}
+
+// changedChecks returns the checks that are new, removed or
+// have a different status than in the previous result.
+func changedChecks(previous, current map[string]*api.HealthCheck) []*api.HealthCheck {
+	var changed []*api.HealthCheck
+	for id, check := range current {
+		old, ok := previous[id]
+		if !ok || old.Status != check.Status {
+			changed = append(changed, check)
+		}
+	}
+
+	for id, check := range previous {
+		if _, ok := current[id]; !ok {
+			changed = append(changed, check)
+		}
+	}
+
+	return changed
+}
+
+// instanceKey identifies a service instance on a node
+func instanceKey(dc, node, id string) string {
+	return dc + "/" + node + "/" + id
+}
+
+// destinationServiceID is the ID of the instance behind the
+// sidecar. A sidecar registered without the ID points to the
+// instance that uses the service name as ID.
+func destinationServiceID(service *api.CatalogService) string {
+	if service.ServiceProxy.DestinationServiceID != "" {
+		return service.ServiceProxy.DestinationServiceID
+	}
+	return service.ServiceProxy.DestinationServiceName
+}
+
+func sameKeys(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,504 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hashicorp/consul/api"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPipeline_Process(t *testing.T) {
+	entry := func(id string, status ...string) *api.ServiceEntry {
+		var checks api.HealthChecks
+		for _, s := range status {
+			checks = append(checks, &api.HealthCheck{Status: s})
+		}
+
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: id, Node: "node-" + id},
+			Service: &api.AgentService{ID: id, Service: "web"},
+			Checks:  checks,
+		}
+	}
+
+	ctx := context.TODO()
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web": {
+			{
+				entries: []*api.ServiceEntry{
+					entry("web-1", api.HealthPassing, api.HealthPassing),
+					entry("web-2", api.HealthCritical, api.HealthPassing),
+					entry("web-3", api.HealthPassing, api.HealthWarning),
+				},
+				meta: &api.QueryMeta{LastIndex: 1},
+			},
+			{
+				err: fmt.Errorf("no cluster leader"),
+			},
+		},
+	}, nil, false)
+
+	selector := NewSelector()
+	selector.AllowWarning = true
+
+	clusters := make(chan ClusterInfo, 2)
+	p := newPipeline(finder, selector, nil, clusters, make(chan string, 1))
+
+	key := serviceKey{name: "web"}
+	p.services[key] = &serviceState{}
+
+	if p.process(ctx, key) {
+		t.Errorf("unexpected retry")
+	}
+
+	cluster := <-clusters
+
+	var ids []string
+	for _, e := range cluster.Endpoints() {
+		ids = append(ids, e.Name()+"="+e.Health())
+	}
+
+	expect := []string{"web-1=passing", "web-2=critical", "web-3=passing"}
+	if !cmp.Equal(ids, expect) {
+		t.Errorf("unexpected endpoints. %s", cmp.Diff(ids, expect))
+	}
+
+	// A failed fetch is retried and the last known
+	// instances stay in place
+	if !p.process(ctx, key) {
+		t.Errorf("expected a retry after a failed fetch")
+	}
+
+	cluster = <-clusters
+	if len(cluster.Endpoints()) != 3 {
+		t.Errorf("expected the last known endpoints, got %d", len(cluster.Endpoints()))
+	}
+
+	finder.AssertFulfilled()
+}
+
+func TestPipeline_ProcessDatacenters(t *testing.T) {
+	entry := func(id, dc string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: id, Node: "node-" + id, Datacenter: dc},
+			Service: &api.AgentService{ID: id, Service: "web"},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+
+	ctx := context.TODO()
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web": {
+			{
+				entries: []*api.ServiceEntry{entry("web-1", "dc1")},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+		"web@dc2": {
+			{
+				entries: []*api.ServiceEntry{entry("web-2", "dc2")},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+		"web@dc3": {
+			{
+				entries: []*api.ServiceEntry{entry("web-3", "dc3")},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+	}, nil, false)
+
+	selector := NewSelector()
+	selector.Datacenters = []string{"dc2", "dc3"}
+
+	clusters := make(chan ClusterInfo, 1)
+	p := newPipeline(finder, selector, nil, clusters, make(chan string, 1))
+
+	key := serviceKey{name: "web"}
+	p.services[key] = &serviceState{}
+	p.process(ctx, key)
+
+	cluster := <-clusters
+
+	var ids []string
+	for _, e := range cluster.Endpoints() {
+		ids = append(ids, fmt.Sprintf("%s=%s/%d", e.Name(), e.Datacenter(), e.DatacenterPriority()))
+	}
+
+	expect := []string{"web-1=dc1/0", "web-2=dc2/1", "web-3=dc3/2"}
+	if !cmp.Equal(ids, expect) {
+		t.Errorf("unexpected endpoints. %s", cmp.Diff(ids, expect))
+	}
+
+	finder.AssertFulfilled()
+}
+
+func TestPipeline_ProcessSubsets(t *testing.T) {
+	entry := func(id, version string) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: id, Node: "node-" + id},
+			Service: &api.AgentService{ID: id, Service: "web", Meta: map[string]string{"version": version}},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+
+	ctx := context.TODO()
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web?Service.Meta.team == web": {
+			{
+				entries: []*api.ServiceEntry{entry("web-1", "v1"), entry("web-2", "v2"), entry("web-3", "v2")},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+		"web?(Service.Meta.team == web) and (Service.Meta.version == v2)": {
+			{
+				entries: []*api.ServiceEntry{entry("web-2", "v2"), entry("web-3", "v2")},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+	}, nil, false)
+
+	subsets := NewSubsetFilters()
+	subsets.Set(map[string]*ServiceResolver{
+		"web": {
+			Service: "web",
+			Subsets: map[string]ResolverSubset{
+				"all": {},
+				"v2":  {Filter: "Service.Meta.version == v2"},
+			},
+		},
+	})
+
+	select {
+	case <-subsets.Changed():
+	default:
+		t.Errorf("expected the filters to signal a change")
+	}
+
+	selector := NewSelector()
+	selector.Filter = "Service.Meta.team == web"
+
+	config := DefaultPipelineConfig()
+	config.Subsets = subsets
+
+	clusters := make(chan ClusterInfo, 1)
+	p := newPipeline(finder, selector, config, clusters, make(chan string, 1))
+
+	key := serviceKey{name: "web"}
+	p.services[key] = &serviceState{}
+	if p.process(ctx, key) {
+		t.Errorf("unexpected retry")
+	}
+
+	cluster := <-clusters
+
+	tests := []struct {
+		subset string
+		expect []string
+	}{
+		{subset: "all", expect: []string{"web-1", "web-2", "web-3"}},
+		{subset: "v2", expect: []string{"web-2", "web-3"}},
+	}
+
+	for idx, test := range tests {
+		resolver := subsets.Get("web")
+		result := cluster.Subset(test.subset, ResolverSubset{Filter: resolver[test.subset]})
+
+		var ids []string
+		for _, e := range result.Endpoints() {
+			ids = append(ids, e.Name())
+		}
+
+		if !cmp.Equal(ids, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(ids, test.expect))
+		}
+	}
+
+	finder.AssertFulfilled()
+}
+
+func TestPipeline_ProcessSidecars(t *testing.T) {
+	entry := func(id, service string, proxy *api.AgentServiceConnectProxyConfig) *api.ServiceEntry {
+		return &api.ServiceEntry{
+			Node:    &api.Node{ID: "node-1", Node: "node-1", Datacenter: "dc1"},
+			Service: &api.AgentService{ID: id, Service: service, Proxy: proxy},
+			Checks:  api.HealthChecks{{Status: api.HealthPassing}},
+		}
+	}
+
+	proxy := func(id string) *api.ServiceEntry {
+		return entry(id+"-proxy", "web-sidecar-proxy", &api.AgentServiceConnectProxyConfig{
+			DestinationServiceName: "web",
+			DestinationServiceID:   id,
+		})
+	}
+
+	ctx := context.TODO()
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web": {
+			{
+				entries: []*api.ServiceEntry{entry("web-1", "web", nil), entry("web-2", "web", nil)},
+				meta:    &api.QueryMeta{LastIndex: 1},
+			},
+		},
+		"web-sidecar-proxy": {
+			{entries: []*api.ServiceEntry{proxy("web-1")}, meta: &api.QueryMeta{LastIndex: 1}},
+			{entries: []*api.ServiceEntry{proxy("web-1"), proxy("web-2")}, meta: &api.QueryMeta{LastIndex: 2}},
+			{entries: nil, meta: &api.QueryMeta{LastIndex: 3}},
+		},
+	}, nil, false)
+
+	clusters := make(chan ClusterInfo, 8)
+	cleanup := make(chan string, 8)
+	p := newPipeline(finder, NewSelector(), &PipelineConfig{}, clusters, cleanup)
+
+	web := serviceKey{name: "web"}
+	sidecar := serviceKey{name: "web-sidecar-proxy"}
+	p.services[web] = &serviceState{}
+	p.services[sidecar] = &serviceState{}
+
+	// describe drains the channels into sorted "name:service=count"
+	// for published clusters and "-name" for removed ones
+	describe := func() []string {
+		var result []string
+		for {
+			select {
+			case c := <-clusters:
+				result = append(result, fmt.Sprintf("%s:%s=%d", c.Name(), c.Service(), len(c.Endpoints())))
+			case name := <-cleanup:
+				result = append(result, "-"+name)
+			default:
+				sort.Strings(result)
+				return result
+			}
+		}
+	}
+
+	tests := []struct {
+		key    serviceKey
+		expect []string
+	}{
+		{
+			key:    web,
+			expect: []string{"web:web=2"},
+		},
+		{
+			// one instance is migrated to connect
+			key:    sidecar,
+			expect: []string{"web-sidecar-proxy:web=1", "web:web=1"},
+		},
+		{
+			// every instance is migrated to connect
+			key:    sidecar,
+			expect: []string{"-web", "web-sidecar-proxy:web=2"},
+		},
+		{
+			// sidecars are gone, the instances are
+			// routed through the plain cluster again
+			key:    sidecar,
+			expect: []string{"-web-sidecar-proxy", "web:web=2"},
+		},
+	}
+
+	for idx, test := range tests {
+		p.process(ctx, test.key)
+
+		result := describe()
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+
+	finder.AssertFulfilled()
+}
+
+func TestPipeline_Sync(t *testing.T) {
+	cleanup := make(chan string, 1)
+	p := newPipeline(nil, NewSelector(), &PipelineConfig{}, nil, cleanup)
+
+	p.sync(context.TODO(), "", map[string][]string{
+		"web": {FlightPathTag, "v1"},
+		"api": {FlightPathTag},
+		"db":  {"internal"},
+	})
+
+	if p.queue.Len() != 2 {
+		t.Errorf("expected the selected services to be queued, got %d", p.queue.Len())
+	}
+	drain(p.queue)
+
+	p.services[serviceKey{name: "api"}].published = true
+
+	p.sync(context.TODO(), "", map[string][]string{
+		"web": {"v2", FlightPathTag},
+	})
+
+	if keys := drain(p.queue); !cmp.Equal(keys, []string{"web"}) {
+		t.Errorf("expected the remaining service to be queued, got %v", keys)
+	}
+
+	if name := <-cleanup; name != "api" {
+		t.Errorf("expected the removed service to be cleaned up, got %q", name)
+	}
+
+	// The tags are the same, but the index of the list moved
+	// for a change to an instance, e.g. new meta attributes.
+	p.sync(context.TODO(), "", map[string][]string{
+		"web": {FlightPathTag, "v2"},
+	})
+
+	if keys := drain(p.queue); !cmp.Equal(keys, []string{"web"}) {
+		t.Errorf("expected the service to be queued again, got %v", keys)
+	}
+}
+
+func TestPipeline_Touch(t *testing.T) {
+	p := newPipeline(nil, NewSelector(), &PipelineConfig{}, nil, nil)
+	p.services[serviceKey{name: "web"}] = &serviceState{}
+	p.services[serviceKey{name: "api"}] = &serviceState{}
+	p.services[serviceKey{namespace: "team-a", name: "web"}] = &serviceState{}
+
+	p.touch("")
+	if keys := drain(p.queue); !cmp.Equal(keys, []string{"api", "web"}) {
+		t.Errorf("expected the services of the namespace to be queued, got %v", keys)
+	}
+}
+
+func TestPipeline_Notify(t *testing.T) {
+	p := newPipeline(nil, NewSelector(), &PipelineConfig{}, nil, nil)
+	p.services[serviceKey{name: "web"}] = &serviceState{nodes: map[string]bool{"node-1": true}}
+	p.services[serviceKey{name: "api"}] = &serviceState{nodes: map[string]bool{"node-2": true}}
+	p.services[serviceKey{name: "db"}] = &serviceState{nodes: map[string]bool{"node-1": true}}
+	p.services[serviceKey{namespace: "team-a", name: "web"}] = &serviceState{nodes: map[string]bool{"node-1": true}}
+
+	tests := []struct {
+		checks []*api.HealthCheck
+		expect []string
+	}{
+		{
+			checks: []*api.HealthCheck{{Node: "node-2", ServiceName: "api"}},
+			expect: []string{"api"},
+		},
+		{
+			// node checks refresh every service on the node
+			checks: []*api.HealthCheck{{Node: "node-1", CheckID: "serfHealth"}},
+			expect: []string{"db", "web"},
+		},
+		{
+			// services that are not selected are ignored
+			checks: []*api.HealthCheck{{Node: "node-3", ServiceName: "cache"}},
+			expect: nil,
+		},
+	}
+
+	for idx, test := range tests {
+		p.notify("", test.checks)
+
+		keys := drain(p.queue)
+		if !cmp.Equal(keys, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(keys, test.expect))
+		}
+	}
+}
+
+func TestPipeline_StalledConsumer(t *testing.T) {
+	ctx := context.TODO()
+	finder := NewServiceFinderMock(ctx, t, map[string][]ServiceResult{
+		"web": {
+			{
+				entries: []*api.ServiceEntry{{
+					Node:    &api.Node{Node: "node-1"},
+					Service: &api.AgentService{ID: "web-1", Service: "web"},
+				}},
+				meta: &api.QueryMeta{LastIndex: 1},
+			},
+		},
+	}, nil, false)
+
+	clusters := make(chan ClusterInfo)
+	cleanup := make(chan string)
+	p := newPipeline(finder, NewSelector(), &PipelineConfig{}, clusters, cleanup)
+
+	web := serviceKey{name: "web"}
+	p.services[web] = &serviceState{}
+	p.services[serviceKey{name: "db"}] = &serviceState{published: true}
+
+	// Nobody reads the clusters, the worker gets stuck sending
+	processed := make(chan struct{})
+	go func() {
+		p.process(ctx, web)
+		close(processed)
+	}()
+
+	for stalled := false; !stalled; {
+		time.Sleep(time.Millisecond)
+		p.mx.Lock()
+		stalled = p.delivering
+		p.mx.Unlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.notify("", []*api.HealthCheck{{Node: "node-1", ServiceName: "web"}})
+		p.sync(ctx, "", map[string][]string{"web": {FlightPathTag}})
+		p.backoff(web)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the pipeline to take updates while the consumer is stalled")
+	}
+
+	if c := <-clusters; c.Name() != "web" {
+		t.Errorf("expected web to be published first, got %s", c.Name())
+	}
+
+	if name := <-cleanup; name != "db" {
+		t.Errorf("expected db to be removed, got %s", name)
+	}
+
+	<-processed
+	finder.AssertFulfilled()
+}
+
+func TestChangedChecks(t *testing.T) {
+	previous := map[string]*api.HealthCheck{
+		"node-1/serfHealth": {Node: "node-1", CheckID: "serfHealth", Status: api.HealthPassing},
+		"node-1/web":        {Node: "node-1", CheckID: "web", ServiceName: "web", Status: api.HealthPassing},
+		"node-1/api":        {Node: "node-1", CheckID: "api", ServiceName: "api", Status: api.HealthPassing},
+	}
+
+	current := map[string]*api.HealthCheck{
+		"node-1/serfHealth": {Node: "node-1", CheckID: "serfHealth", Status: api.HealthPassing, Output: "changed"},
+		"node-1/web":        {Node: "node-1", CheckID: "web", ServiceName: "web", Status: api.HealthCritical},
+		"node-2/db":         {Node: "node-2", CheckID: "db", ServiceName: "db", Status: api.HealthPassing},
+	}
+
+	var ids []string
+	for _, check := range changedChecks(previous, current) {
+		ids = append(ids, check.Node+"/"+check.CheckID)
+	}
+	sort.Strings(ids)
+
+	expect := []string{"node-1/api", "node-1/web", "node-2/db"}
+	if !cmp.Equal(ids, expect) {
+		t.Errorf("unexpected changes. %s", cmp.Diff(ids, expect))
+	}
+}
+
+// drain empties the queue and returns the sorted keys
+func drain(q *workQueue) []string {
+	var keys []string
+	for q.Len() > 0 {
+		key, _ := q.Get()
+		q.Done(key)
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
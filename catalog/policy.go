@@ -0,0 +1,233 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Gufran/flightpath/metrics"
+	"github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+type PolicyFinder interface {
+	Get(string, *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+}
+
+// RoutePolicy is an allowlist of domains and path prefixes
+// that services are allowed to claim. A nil policy allows
+// every route, an empty policy rejects every route.
+//
+// The policy is a JSON document, e.g.
+//
+//	{
+//	  "rules": [
+//	    {"service": "auth", "domains": ["login.example.com"]},
+//	    {"service": "web-*", "domains": ["*.example.com"], "paths": ["/app/"]},
+//	    {"namespace": "team-a", "service": "*", "domains": ["a.example.com"]}
+//	  ]
+//	}
+type RoutePolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule allows services with a matching name to route
+// traffic on matching domains and paths. Namespace, service
+// and domain are glob patterns. The namespace and the name of
+// the service are matched separately, a rule without namespace
+// only applies to services that are not in a namespace and a
+// rule must use "*" to apply in every namespace. The service
+// can name both, e.g. "team-a/web-*". Paths are prefixes and
+// default to "/".
+type PolicyRule struct {
+	Namespace string   `json:"namespace"`
+	Service   string   `json:"service"`
+	Domains   []string `json:"domains"`
+	Paths     []string `json:"paths"`
+}
+
+// ParseRoutePolicy decodes and validates a route policy
+func ParseRoutePolicy(data []byte) (*RoutePolicy, error) {
+	policy := &RoutePolicy{}
+	err := json.Unmarshal(data, policy)
+	if err != nil {
+		return nil, fmt.Errorf("route policy is not a valid JSON document. %s", err)
+	}
+
+	for idx := range policy.Rules {
+		rule := &policy.Rules[idx]
+		if rule.Service == "" {
+			return nil, fmt.Errorf("rule %d does not name a service", idx)
+		}
+
+		if strings.Contains(rule.Service, "/") {
+			if rule.Namespace != "" {
+				return nil, fmt.Errorf("rule %d names the namespace of service %q twice", idx, rule.Service)
+			}
+			rule.Namespace, rule.Service = SplitClusterName(rule.Service)
+		}
+
+		if _, err := path.Match(rule.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("rule %d has invalid namespace pattern %q. %s", idx, rule.Namespace, err)
+		}
+
+		if _, err := path.Match(rule.Service, ""); err != nil {
+			return nil, fmt.Errorf("rule %d has invalid service pattern %q. %s", idx, rule.Service, err)
+		}
+
+		if len(rule.Domains) == 0 {
+			return nil, fmt.Errorf("rule %d for service %q does not allow any domain", idx, rule.Service)
+		}
+
+		for _, d := range rule.Domains {
+			if _, err := path.Match(d, ""); err != nil {
+				return nil, fmt.Errorf("rule %d has invalid domain pattern %q. %s", idx, d, err)
+			}
+		}
+
+		if len(rule.Paths) == 0 {
+			rule.Paths = []string{"/"}
+		}
+
+		for _, p := range rule.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return nil, fmt.Errorf("rule %d has path %q that does not start with '/'", idx, p)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// LoadRoutePolicyFile reads the route policy from a file
+func LoadRoutePolicyFile(file string) (*RoutePolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRoutePolicy(data)
+}
+
+// Allows reports whether the service is permitted to receive
+// traffic for the path on the domain. The service is the name
+// of its cluster, prefixed with the namespace when it has one.
+func (p *RoutePolicy) Allows(service, domain, uri string) bool {
+	if p == nil {
+		return true
+	}
+
+	namespace, name := SplitClusterName(service)
+	for _, rule := range p.Rules {
+		if ok, _ := path.Match(rule.Namespace, namespace); !ok {
+			continue
+		}
+
+		if ok, _ := path.Match(rule.Service, name); !ok {
+			continue
+		}
+
+		if !matchesAny(rule.Domains, domain) {
+			continue
+		}
+
+		for _, prefix := range rule.Paths {
+			if strings.HasPrefix(uri, prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type PolicyStorage struct {
+	ctx    context.Context
+	key    string
+	finder PolicyFinder
+}
+
+func NewPolicyStorage(ctx context.Context, key string, client *api.Client) *PolicyStorage {
+	return &PolicyStorage{
+		ctx:    ctx,
+		key:    key,
+		finder: client.KV(),
+	}
+}
+
+// WatchPolicy delivers the route policy stored in consul KV
+// every time it changes. An invalid policy is reported on
+// errs and is not delivered so the last valid policy stays
+// in effect. A missing key is delivered as an empty policy
+// that rejects every route.
+func (s *PolicyStorage) WatchPolicy(policies chan<- *RoutePolicy, errs chan<- error) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(s.ctx, "policy")
+	defer w.close()
+
+	for {
+		metrics.Incr("catalog.policy.loop", nil)
+		select {
+		case <-s.ctx.Done():
+			logger.Info("route policy watcher loop has shut down")
+			return
+
+		default:
+			pair, meta, err := s.finder.Get(s.key, qopts.WithContext(s.ctx))
+			if err != nil {
+				metrics.Incr("catalog.policy.error.fetch", nil)
+				s.report(errs, fmt.Errorf("failed to fetch route policy from consul kv key %q. %s", s.key, err))
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.policy.noop", nil)
+				break
+			}
+
+			policy := &RoutePolicy{}
+			if pair == nil {
+				logger.WithField("key", s.key).Warn("route policy does not exist in consul kv. all routes are rejected")
+			} else {
+				policy, err = ParseRoutePolicy(pair.Value)
+				if err != nil {
+					metrics.Incr("catalog.policy.error.decode", nil)
+					s.report(errs, fmt.Errorf("route policy in consul kv key %q is invalid. %s", s.key, err))
+					break
+				}
+			}
+
+			metrics.Incr("catalog.policy.updated", nil)
+
+			select {
+			case policies <- policy:
+			case <-s.ctx.Done():
+			}
+		}
+	}
+}
+
+func (s *PolicyStorage) report(errs chan<- error, err error) {
+	select {
+	case errs <- err:
+	case <-s.ctx.Done():
+	}
+}
@@ -0,0 +1,141 @@
+package catalog
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestParseRoutePolicy(t *testing.T) {
+	tests := []struct {
+		data string
+		err  bool
+	}{
+		{data: `{"rules": []}`},
+		{data: `{"rules": [{"service": "web-*", "domains": ["*.example.com"]}]}`},
+		{data: `not json`, err: true},
+		{data: `{"rules": [{"domains": ["example.com"]}]}`, err: true},
+		{data: `{"rules": [{"service": "web"}]}`, err: true},
+		{data: `{"rules": [{"service": "web[", "domains": ["example.com"]}]}`, err: true},
+		{data: `{"rules": [{"service": "web", "domains": ["example.com["]}]}`, err: true},
+		{data: `{"rules": [{"service": "web", "domains": ["example.com"], "paths": ["app"]}]}`, err: true},
+		{data: `{"rules": [{"service": "team-a/web", "domains": ["example.com"]}]}`},
+		{data: `{"rules": [{"namespace": "team-*", "service": "web", "domains": ["example.com"]}]}`},
+		{data: `{"rules": [{"namespace": "team-a", "service": "team-a/web", "domains": ["example.com"]}]}`, err: true},
+		{data: `{"rules": [{"namespace": "team[", "service": "web", "domains": ["example.com"]}]}`, err: true},
+	}
+
+	for idx, test := range tests {
+		_, err := ParseRoutePolicy([]byte(test.data))
+		if test.err && err == nil {
+			t.Errorf("case %d: expected an error, got none", idx)
+		}
+
+		if !test.err && err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+		}
+	}
+}
+
+func TestRoutePolicy_Allows(t *testing.T) {
+	policy, err := ParseRoutePolicy([]byte(`{
+		"rules": [
+			{"service": "auth", "domains": ["login.example.com"]},
+			{"service": "web-*", "domains": ["*.example.com"], "paths": ["/app/", "/static/"]},
+			{"service": "catch-all", "domains": ["*"]},
+			{"service": "team-a/api-*", "domains": ["api.example.com"]},
+			{"namespace": "team-*", "service": "*", "domains": ["team.example.com"]},
+			{"namespace": "*", "service": "shared-*", "domains": ["shared.example.com"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("failed to parse policy. %s", err)
+	}
+
+	tests := []struct {
+		policy  *RoutePolicy
+		service string
+		domain  string
+		path    string
+		expect  bool
+	}{
+		{policy: nil, service: "any", domain: "any", path: "/", expect: true},
+		{policy: &RoutePolicy{}, service: "any", domain: "any", path: "/", expect: false},
+		{policy: policy, service: "auth", domain: "login.example.com", path: "/", expect: true},
+		{policy: policy, service: "auth", domain: "www.example.com", path: "/", expect: false},
+		{policy: policy, service: "hijacker", domain: "login.example.com", path: "/", expect: false},
+		{policy: policy, service: "web-shop", domain: "shop.example.com", path: "/app/cart", expect: true},
+		{policy: policy, service: "web-shop", domain: "shop.example.com", path: "/admin", expect: false},
+		{policy: policy, service: "web-shop", domain: "example.org", path: "/app/", expect: false},
+		{policy: policy, service: "catch-all", domain: "*", path: "/", expect: true},
+		{policy: policy, service: "web-shop", domain: "*", path: "/app/", expect: false},
+
+		// the namespace and the service are matched separately
+		{policy: policy, service: "team-b/web-shop", domain: "shop.example.com", path: "/app/", expect: false},
+		{policy: policy, service: "team-x/auth", domain: "login.example.com", path: "/", expect: false},
+		{policy: policy, service: "team-a/api-users", domain: "api.example.com", path: "/", expect: true},
+		{policy: policy, service: "team-b/api-users", domain: "api.example.com", path: "/", expect: false},
+		{policy: policy, service: "api-users", domain: "api.example.com", path: "/", expect: false},
+		{policy: policy, service: "team-c/anything", domain: "team.example.com", path: "/", expect: true},
+		{policy: policy, service: "anything", domain: "team.example.com", path: "/", expect: false},
+		{policy: policy, service: "team-b/shared-assets", domain: "shared.example.com", path: "/", expect: true},
+		{policy: policy, service: "shared-assets", domain: "shared.example.com", path: "/", expect: true},
+	}
+
+	for idx, test := range tests {
+		result := test.policy.Allows(test.service, test.domain, test.path)
+		if result != test.expect {
+			t.Errorf("case %d: result(%v) != expected(%v)", idx, result, test.expect)
+		}
+	}
+}
+
+func TestPolicyStorage_WatchPolicy(t *testing.T) {
+	stack := []GetResult{
+		{
+			pair: &api.KVPair{Key: "policy", Value: []byte(`invalid`)},
+			meta: &api.QueryMeta{LastIndex: 1},
+		},
+		{
+			pair: &api.KVPair{Key: "policy", Value: []byte(`{"rules": [{"service": "web", "domains": ["example.com"]}]}`)},
+			meta: &api.QueryMeta{LastIndex: 2},
+		},
+		{
+			pair: nil,
+			meta: &api.QueryMeta{LastIndex: 3},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	storage := &PolicyStorage{
+		ctx:    ctx,
+		key:    "policy",
+		finder: NewPolicyFinderMock(ctx, t, stack, true),
+	}
+
+	policies := make(chan *RoutePolicy)
+	errs := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		storage.WatchPolicy(policies, errs)
+		done <- struct{}{}
+	}()
+
+	if err := <-errs; err == nil {
+		t.Errorf("expected an error for the invalid policy")
+	}
+
+	policy := <-policies
+	if !policy.Allows("web", "example.com", "/") {
+		t.Errorf("expected policy to allow the web service")
+	}
+
+	policy = <-policies
+	if policy == nil || len(policy.Rules) != 0 {
+		t.Errorf("expected an empty policy for missing key, got %#v", policy)
+	}
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,142 @@
+package catalog
+
+import (
+	"github.com/Gufran/flightpath/metrics"
+	"sync"
+	"time"
+)
+
+// serviceKey identifies a service across namespaces
+type serviceKey struct {
+	namespace string
+	name      string
+}
+
+func (k serviceKey) String() string {
+	return ClusterName(k.namespace, k.name)
+}
+
+// workQueue is a coalescing queue of services to fetch. A service
+// that is added again while it waits in the queue is not queued
+// twice, and a service that is added while a worker fetches it is
+// queued again once the worker is done. Services become ready after
+// the debounce delay so that a burst of events causes one fetch.
+type workQueue struct {
+	mx       sync.Mutex
+	cond     *sync.Cond
+	debounce time.Duration
+
+	ready      []serviceKey
+	pending    map[serviceKey]bool
+	processing map[serviceKey]bool
+	dirty      map[serviceKey]bool
+	closed     bool
+}
+
+func newWorkQueue(debounce time.Duration) *workQueue {
+	q := &workQueue{
+		debounce:   debounce,
+		pending:    map[serviceKey]bool{},
+		processing: map[serviceKey]bool{},
+		dirty:      map[serviceKey]bool{},
+	}
+	q.cond = sync.NewCond(&q.mx)
+	return q
+}
+
+// Add queues the service after the debounce delay
+func (q *workQueue) Add(key serviceKey) {
+	q.AddAfter(key, q.debounce)
+}
+
+// AddAfter queues the service after the delay, unless
+// it is already waiting in the queue.
+func (q *workQueue) AddAfter(key serviceKey, delay time.Duration) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	if q.closed || q.pending[key] {
+		return
+	}
+
+	if q.processing[key] {
+		q.dirty[key] = true
+		return
+	}
+
+	q.pending[key] = true
+	metrics.GaugeI("catalog.queue.depth", len(q.pending), nil)
+
+	if delay <= 0 {
+		q.push(key)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		q.mx.Lock()
+		defer q.mx.Unlock()
+		q.push(key)
+	})
+}
+
+func (q *workQueue) push(key serviceKey) {
+	if q.closed {
+		return
+	}
+
+	q.ready = append(q.ready, key)
+	q.cond.Signal()
+}
+
+// Get blocks until a service is ready. It returns false
+// once the queue is closed.
+func (q *workQueue) Get() (serviceKey, bool) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	for len(q.ready) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		return serviceKey{}, false
+	}
+
+	key := q.ready[0]
+	q.ready = q.ready[1:]
+	delete(q.pending, key)
+	q.processing[key] = true
+
+	metrics.GaugeI("catalog.queue.depth", len(q.pending), nil)
+	return key, true
+}
+
+// Done marks the service as processed. A service that was
+// added while it was processed is queued again.
+func (q *workQueue) Done(key serviceKey) {
+	q.mx.Lock()
+	delete(q.processing, key)
+	again := q.dirty[key]
+	delete(q.dirty, key)
+	q.mx.Unlock()
+
+	if again {
+		q.Add(key)
+	}
+}
+
+// Len is the number of services waiting in the queue
+func (q *workQueue) Len() int {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	return len(q.pending)
+}
+
+// Close wakes up the workers and drops the waiting services
+func (q *workQueue) Close() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,77 @@
+package catalog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkQueue(t *testing.T) {
+	q := newWorkQueue(0)
+	web := serviceKey{name: "web"}
+	api := serviceKey{namespace: "team-a", name: "api"}
+
+	q.Add(web)
+	q.Add(api)
+	q.Add(web)
+
+	if q.Len() != 2 {
+		t.Errorf("expected duplicate keys to be coalesced, got %d keys", q.Len())
+	}
+
+	key, ok := q.Get()
+	if !ok || key != web {
+		t.Fatalf("expected %s, got %s", web, key)
+	}
+
+	// Added while processing, queued again once done
+	q.Add(web)
+	if q.Len() != 1 {
+		t.Errorf("expected a key in process not to be queued, got %d keys", q.Len())
+	}
+	q.Done(web)
+
+	for _, expect := range []serviceKey{api, web} {
+		key, ok := q.Get()
+		if !ok || key != expect {
+			t.Errorf("expected %s, got %s", expect, key)
+		}
+		q.Done(key)
+	}
+
+	closed := make(chan bool)
+	go func() {
+		_, ok := q.Get()
+		closed <- ok
+	}()
+
+	q.Close()
+	if <-closed {
+		t.Errorf("expected Get to return false on a closed queue")
+	}
+}
+
+func TestWorkQueue_Debounce(t *testing.T) {
+	q := newWorkQueue(50 * time.Millisecond)
+	web := serviceKey{name: "web"}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		q.Add(web)
+	}
+
+	key, ok := q.Get()
+	if !ok || key != web {
+		t.Fatalf("expected %s, got %s", web, key)
+	}
+
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected the key to be ready after the debounce delay")
+	}
+
+	q.Done(web)
+	if q.Len() != 0 {
+		t.Errorf("expected the burst to be coalesced into one key, got %d more", q.Len())
+	}
+
+	q.Close()
+}
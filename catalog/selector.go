@@ -0,0 +1,116 @@
+package catalog
+
+import (
+	"github.com/hashicorp/consul/api"
+	"strconv"
+	"strings"
+)
+
+// Selector decides which services in consul catalog
+// are discovered as clusters.
+type Selector struct {
+	// Tags selects the services that carry one of the tags
+	Tags []string
+
+	// TagPrefixes selects the services that carry a tag
+	// starting with one of the prefixes, e.g. "edge:"
+	// selects services tagged with "edge:public".
+	TagPrefixes []string
+
+	// Filter is a consul filter expression applied on the
+	// health API entries, e.g. `Service.Meta.team == "web"`
+	Filter string
+
+	// ExcludeMetaKey excludes the service instances that
+	// set this meta key to a true value.
+	ExcludeMetaKey string
+
+	// ExcludeDatacenters excludes the service instances
+	// registered in these datacenters.
+	ExcludeDatacenters []string
+
+	// AllowWarning treats the service instances with
+	// checks in warning state as healthy.
+	AllowWarning bool
+
+	// Datacenters are the remote datacenters watched in
+	// addition to the local datacenter, in failover order.
+	Datacenters []string
+
+	// Namespaces are the consul enterprise namespaces to
+	// discover the services in. AllNamespaces selects every
+	// namespace and an empty list leaves the namespace to
+	// the consul token.
+	Namespaces []string
+
+	// Partition is the consul enterprise admin partition
+	// of the services. It is only used to build the SPIFFE
+	// identities, the partition of the queries is set on
+	// the consul client.
+	Partition string
+}
+
+// NewSelector returns a selector that matches the
+// services tagged with FlightPathTag.
+func NewSelector() *Selector {
+	return &Selector{
+		Tags:           []string{FlightPathTag},
+		ExcludeMetaKey: "flightpath-exclude",
+	}
+}
+
+// AllNamespaces reports whether the services are
+// discovered in every namespace.
+func (s *Selector) AllNamespaces() bool {
+	return hasAllNamespaces(s.Namespaces)
+}
+
+// MatchesTags reports whether a service with the
+// tags is selected for discovery.
+func (s *Selector) MatchesTags(tags []string) bool {
+	for _, tag := range tags {
+		for _, t := range s.Tags {
+			if tag == t {
+				return true
+			}
+		}
+
+		for _, prefix := range s.TagPrefixes {
+			if strings.HasPrefix(tag, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Excludes reports whether the service instance is
+// left out of the cluster by the exclusion rules.
+func (s *Selector) Excludes(service *api.CatalogService) bool {
+	if s.ExcludeMetaKey != "" {
+		if value, ok := service.ServiceMeta[s.ExcludeMetaKey]; ok {
+			excluded, err := strconv.ParseBool(value)
+			if err == nil && excluded {
+				return true
+			}
+		}
+	}
+
+	for _, dc := range s.ExcludeDatacenters {
+		if service.Datacenter == dc {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Selector) filterExcluded(services []*api.CatalogService) []*api.CatalogService {
+	var result []*api.CatalogService
+	for _, service := range services {
+		if !s.Excludes(service) {
+			result = append(result, service)
+		}
+	}
+	return result
+}
@@ -0,0 +1,85 @@
+package catalog
+
+import (
+	"github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestSelector_MatchesTags(t *testing.T) {
+	tests := []struct {
+		selector *Selector
+		tags     []string
+		result   bool
+	}{
+		{
+			selector: NewSelector(),
+			tags:     []string{"in-flightpath"},
+			result:   true,
+		},
+		{
+			selector: NewSelector(),
+			tags:     []string{"in-flightpath:public"},
+			result:   false,
+		},
+		{
+			selector: &Selector{Tags: []string{"edge"}, TagPrefixes: []string{"edge:"}},
+			tags:     []string{"v2", "edge:public"},
+			result:   true,
+		},
+		{
+			selector: &Selector{TagPrefixes: []string{"edge:"}},
+			tags:     []string{"edge"},
+			result:   false,
+		},
+		{
+			selector: NewSelector(),
+			tags:     nil,
+			result:   false,
+		},
+	}
+
+	for idx, test := range tests {
+		result := test.selector.MatchesTags(test.tags)
+		if result != test.result {
+			t.Errorf("case %d: expected %v, got %v", idx, test.result, result)
+		}
+	}
+}
+
+func TestSelector_Excludes(t *testing.T) {
+	selector := NewSelector()
+	selector.ExcludeDatacenters = []string{"dc2"}
+
+	tests := []struct {
+		service *api.CatalogService
+		result  bool
+	}{
+		{
+			service: &api.CatalogService{Datacenter: "dc1"},
+			result:  false,
+		},
+		{
+			service: &api.CatalogService{Datacenter: "dc1", ServiceMeta: map[string]string{"flightpath-exclude": "true"}},
+			result:  true,
+		},
+		{
+			service: &api.CatalogService{Datacenter: "dc1", ServiceMeta: map[string]string{"flightpath-exclude": "false"}},
+			result:  false,
+		},
+		{
+			service: &api.CatalogService{Datacenter: "dc1", ServiceMeta: map[string]string{"flightpath-exclude": "yes please"}},
+			result:  false,
+		},
+		{
+			service: &api.CatalogService{Datacenter: "dc2"},
+			result:  true,
+		},
+	}
+
+	for idx, test := range tests {
+		result := selector.Excludes(test.service)
+		if result != test.result {
+			t.Errorf("case %d: expected %v, got %v", idx, test.result, result)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package catalog
+
+import (
+	"sync"
+)
+
+// SubsetFilters are the filters of the service-resolver subsets,
+// keyed by the service of the resolver and the name of the subset.
+// The pipeline reads the instances of every subset from consul with
+// the filter of the subset, so the filter is evaluated by consul
+// the same way it is for the rest of the service mesh.
+type SubsetFilters struct {
+	mx      sync.RWMutex
+	filters map[string]map[string]string
+	changed chan struct{}
+}
+
+func NewSubsetFilters() *SubsetFilters {
+	return &SubsetFilters{
+		filters: map[string]map[string]string{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Set replaces the filters with the filters of the subsets of
+// the resolvers. Subsets without a filter hold every instance of
+// the service and are left out. A change is signaled on Changed.
+func (f *SubsetFilters) Set(resolvers map[string]*ServiceResolver) {
+	filters := map[string]map[string]string{}
+	for service, resolver := range resolvers {
+		for name, subset := range resolver.Subsets {
+			if subset.Filter == "" {
+				continue
+			}
+
+			if filters[service] == nil {
+				filters[service] = map[string]string{}
+			}
+			filters[service][name] = subset.Filter
+		}
+	}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	if sameFilters(f.filters, filters) {
+		return
+	}
+	f.filters = filters
+
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the filters of the subsets of the service
+func (f *SubsetFilters) Get(service string) map[string]string {
+	if f == nil {
+		return nil
+	}
+
+	f.mx.RLock()
+	defer f.mx.RUnlock()
+	return f.filters[service]
+}
+
+// Changed receives a value after the filters have changed. The
+// channel of nil filters never receives.
+func (f *SubsetFilters) Changed() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.changed
+}
+
+func sameFilters(a, b map[string]map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for service, filters := range a {
+		other, ok := b[service]
+		if !ok || len(other) != len(filters) {
+			return false
+		}
+
+		for name, filter := range filters {
+			if f, ok := other[name]; !ok || f != filter {
+				return false
+			}
+		}
+	}
+	return true
+}
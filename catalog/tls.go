@@ -4,9 +4,24 @@ import (
 	"github.com/Gufran/flightpath/metrics"
 	"github.com/hashicorp/consul/api"
 	"log"
+	"strings"
 	"time"
 )
 
+// The names of the connect watches, see SetConnectOptional
+const (
+	tlsWatchName     = "tls"
+	caRootsWatchName = "ca_roots"
+)
+
+// SetConnectOptional keeps the failures of the connect watches
+// out of Degraded, e.g. once connect turned out to be disabled
+// in consul. The watches keep running so that connect is picked
+// up when it becomes available.
+func SetConnectOptional(isOptional bool) {
+	setOptional(isOptional, tlsWatchName, caRootsWatchName)
+}
+
 type TLSInfo interface {
 	Serial() string
 	Cert() string
@@ -47,6 +62,9 @@ func (c *Catalog) WatchTLS(service string, cert chan<- TLSInfo) {
 		WaitTime:          30 * time.Second,
 	}
 
+	w := newWatch(c.ctx, tlsWatchName)
+	defer w.close()
+
 	for {
 		metrics.Incr("catalog.tls.loop", nil)
 		select {
@@ -58,23 +76,114 @@ func (c *Catalog) WatchTLS(service string, cert chan<- TLSInfo) {
 			if err != nil {
 				metrics.Incr("catalog.tls.error.fetch", nil)
 				logger.WithError(err).Error("failed to fetch TLS leaf certificates")
+				w.fail(err)
 				break
 			}
 
-			if meta.LastIndex <= qopts.WaitIndex {
+			if !w.next(qopts, meta) {
 				metrics.Incr("catalog.tls.noop", nil)
 				break
 			}
 
-			qopts.WaitIndex = meta.LastIndex
-
 			metrics.Incr("catalog.tls.updated", nil)
 
-			cert <- &tls{
+			select {
+			case cert <- &tls{
 				serial:  resp.SerialNumber,
 				certPem: resp.CertPEM,
 				pkeyPem: resp.PrivateKeyPEM,
 				service: service,
+			}:
+			case <-c.ctx.Done():
+			}
+		}
+	}
+}
+
+// CARootsInfo is the trust bundle used to validate
+// certificates presented by connect enabled upstreams.
+type CARootsInfo interface {
+	TrustDomain() string
+	ActiveRootID() string
+	Bundle() string
+}
+
+var _ CARootsInfo = &caRoots{}
+
+type caRoots struct {
+	trustDomain string
+	activeID    string
+	roots       []string
+}
+
+func (r *caRoots) TrustDomain() string {
+	return r.trustDomain
+}
+
+func (r *caRoots) ActiveRootID() string {
+	return r.activeID
+}
+
+// Bundle returns PEM encoded certificates of all
+// CA roots concatenated together.
+func (r *caRoots) Bundle() string {
+	return strings.Join(r.roots, "\n")
+}
+
+// WatchCARoots delivers the connect CA roots every time
+// the trust bundle changes, e.g. during a CA rotation.
+// An empty list of roots is never delivered.
+func (c *Catalog) WatchCARoots(roots chan<- CARootsInfo) {
+	qopts := &api.QueryOptions{
+		AllowStale:        false,
+		RequireConsistent: true,
+		WaitIndex:         0,
+		WaitTime:          30 * time.Second,
+	}
+
+	w := newWatch(c.ctx, caRootsWatchName)
+	defer w.close()
+
+	for {
+		metrics.Incr("catalog.ca_roots.loop", nil)
+		select {
+		case <-c.ctx.Done():
+			logger.Info("CA roots watcher loop has shut down")
+			return
+		default:
+			resp, meta, err := c.connect.ConnectCARoots(qopts.WithContext(c.ctx))
+			if err != nil {
+				metrics.Incr("catalog.ca_roots.error.fetch", nil)
+				logger.WithError(err).Error("failed to fetch connect CA roots")
+				w.fail(err)
+				break
+			}
+
+			if !w.next(qopts, meta) {
+				metrics.Incr("catalog.ca_roots.noop", nil)
+				break
+			}
+
+			var pems []string
+			for _, root := range resp.Roots {
+				pems = append(pems, strings.TrimSpace(root.RootCertPEM))
+			}
+
+			if len(pems) == 0 {
+				metrics.Incr("catalog.ca_roots.empty", nil)
+				logger.Warn("consul returned an empty list of connect CA roots")
+				break
+			}
+
+			metrics.Incr("catalog.ca_roots.updated", nil)
+
+			select {
+			case roots <- &caRoots{
+				trustDomain: resp.TrustDomain,
+				activeID:    resp.ActiveRootID,
+				roots:       pems,
+			}:
+			case <-c.ctx.Done():
 			}
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/hashicorp/consul/api"
 	"testing"
+	"time"
 )
 
 func TestCatalog_WatchTLS(t *testing.T) {
@@ -66,3 +67,117 @@ func TestCatalog_WatchTLS(t *testing.T) {
 	cancel()
 	<-doneChan
 }
+
+func TestCatalog_WatchCARoots(t *testing.T) {
+	stack := []ConnectCARootsResult{
+		{
+			meta: &api.QueryMeta{
+				LastIndex: 0,
+			},
+		},
+		{
+			roots: &api.CARootList{
+				TrustDomain: "abc.consul",
+			},
+			meta: &api.QueryMeta{
+				LastIndex: 1,
+			},
+		},
+		{
+			roots: &api.CARootList{
+				ActiveRootID: "root-2",
+				TrustDomain:  "abc.consul",
+				Roots: []*api.CARoot{
+					{ID: "root-1", RootCertPEM: "root one\n"},
+					{ID: "root-2", RootCertPEM: "root two\n", Active: true},
+				},
+			},
+			meta: &api.QueryMeta{
+				LastIndex: 2,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	catalog := &Catalog{
+		ctx:     ctx,
+		connect: NewCARootsFinderMock(ctx, t, stack, true),
+	}
+
+	rootsChan := make(chan CARootsInfo)
+	doneChan := make(chan struct{})
+
+	go func() {
+		catalog.WatchCARoots(rootsChan)
+		doneChan <- struct{}{}
+	}()
+
+	roots := <-rootsChan
+	if roots.TrustDomain() != "abc.consul" {
+		t.Errorf("unexpected trust domain %q", roots.TrustDomain())
+	}
+
+	if roots.ActiveRootID() != "root-2" {
+		t.Errorf("unexpected active root %q", roots.ActiveRootID())
+	}
+
+	if roots.Bundle() != "root one\nroot two" {
+		t.Errorf("unexpected trust bundle %q", roots.Bundle())
+	}
+
+	cancel()
+	<-doneChan
+}
+
+// servedRootsFinder tells when the CA roots were read from consul
+type servedRootsFinder struct {
+	CertFinder
+	served chan struct{}
+}
+
+func (f *servedRootsFinder) ConnectCARoots(q *api.QueryOptions) (*api.CARootList, *api.QueryMeta, error) {
+	roots, meta, err := f.CertFinder.ConnectCARoots(q)
+	if roots != nil {
+		close(f.served)
+	}
+	return roots, meta, err
+}
+
+func TestCatalog_WatchCARootsShutdown(t *testing.T) {
+	stack := []ConnectCARootsResult{
+		{
+			roots: &api.CARootList{
+				ActiveRootID: "root-1",
+				Roots:        []*api.CARoot{{ID: "root-1", RootCertPEM: "root one"}},
+			},
+			meta: &api.QueryMeta{LastIndex: 1},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	finder := &servedRootsFinder{
+		CertFinder: NewCARootsFinderMock(ctx, t, stack, true),
+		served:     make(chan struct{}),
+	}
+
+	catalog := &Catalog{
+		ctx:     ctx,
+		connect: finder,
+	}
+
+	// Nobody reads the roots, the consumer has shut down
+	done := make(chan struct{})
+	go func() {
+		catalog.WatchCARoots(make(chan CARootsInfo))
+		close(done)
+	}()
+
+	<-finder.served
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the watcher to shut down while the roots are not read")
+	}
+}
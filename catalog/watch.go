@@ -0,0 +1,288 @@
+package catalog
+
+import (
+	"context"
+	"github.com/Gufran/flightpath/metrics"
+	"github.com/hashicorp/consul/api"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WatchConfig controls how the consul watches retry after
+// a failed query.
+type WatchConfig struct {
+	// MinInterval is the delay after the first failure. The
+	// delay doubles with every consecutive failure.
+	MinInterval time.Duration
+
+	// MaxInterval caps the delay between the retries
+	MaxInterval time.Duration
+
+	// DegradedAfter is the number of consecutive failures
+	// after which the watch is reported as degraded.
+	DegradedAfter int
+}
+
+// DefaultWatchConfig returns the settings used when
+// nothing else is configured.
+func DefaultWatchConfig() WatchConfig {
+	return WatchConfig{
+		MinInterval:   time.Second,
+		MaxInterval:   time.Minute,
+		DegradedAfter: 3,
+	}
+}
+
+// Backoff returns the delay before the retry that follows
+// the number of consecutive failures. The delay is picked
+// at random from the upper half of the exponential interval
+// so that the watches do not retry against a recovering
+// consul all at once.
+func (w WatchConfig) Backoff(failures int) time.Duration {
+	if failures < 1 || w.MinInterval <= 0 {
+		return 0
+	}
+
+	max := w.MaxInterval
+	if max < w.MinInterval {
+		max = w.MinInterval
+	}
+
+	interval := w.MinInterval
+	for i := 1; i < failures && interval < max; i++ {
+		interval *= 2
+	}
+	if interval > max {
+		interval = max
+	}
+
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(interval-half)+1))
+}
+
+var (
+	watchMx     sync.Mutex
+	watchConfig = DefaultWatchConfig()
+	watches     = map[string]*watch{}
+
+	// optional are the names of the watches that do
+	// not count toward Degraded, see setOptional.
+	optional = map[string]bool{}
+)
+
+// SetWatchConfig changes the retry settings of the consul
+// watches. It must be called before the watches start.
+func SetWatchConfig(config WatchConfig) {
+	watchMx.Lock()
+	defer watchMx.Unlock()
+	watchConfig = config
+}
+
+func currentWatchConfig() WatchConfig {
+	watchMx.Lock()
+	defer watchMx.Unlock()
+	return watchConfig
+}
+
+// WatchStatus is the state of a consul watch as reported
+// on the health endpoint of the debug server.
+type WatchStatus struct {
+	Name         string    `json:"name"`
+	Degraded     bool      `json:"degraded"`
+	Optional     bool      `json:"optional,omitempty"`
+	Failures     int       `json:"failures"`
+	LastError    string    `json:"last_error,omitempty"`
+	FailingSince time.Time `json:"failing_since,omitempty"`
+}
+
+// WatchStatuses returns the state of all running watches
+// ordered by name.
+func WatchStatuses() []WatchStatus {
+	watchMx.Lock()
+	defer watchMx.Unlock()
+
+	result := make([]WatchStatus, 0, len(watches))
+	for name, w := range watches {
+		status := w.status()
+		status.Optional = optional[name]
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Degraded reports whether any of the running watches is
+// failing for longer than the configured threshold. The
+// optional watches are left out.
+func Degraded() bool {
+	for _, status := range WatchStatuses() {
+		if status.Degraded && !status.Optional {
+			return true
+		}
+	}
+	return false
+}
+
+// setOptional keeps the failures of the named watches out of
+// Degraded. The watches are still reported by WatchStatuses.
+func setOptional(isOptional bool, names ...string) {
+	watchMx.Lock()
+	defer watchMx.Unlock()
+
+	for _, name := range names {
+		if isOptional {
+			optional[name] = true
+		} else {
+			delete(optional, name)
+		}
+	}
+}
+
+// watch keeps the failure state of a consul watch loop and
+// backs off between the failed queries. The data delivered
+// before the failure stays in effect until the watch is
+// able to query consul again.
+type watch struct {
+	ctx  context.Context
+	name string
+
+	mx           sync.Mutex
+	failures     int
+	lastError    string
+	failingSince time.Time
+	degraded     bool
+}
+
+// newWatch registers the watch so that its state shows up
+// on the health endpoint. The watch must be closed when the
+// loop exits.
+func newWatch(ctx context.Context, name string) *watch {
+	w := &watch{
+		ctx:  ctx,
+		name: name,
+	}
+
+	watchMx.Lock()
+	watches[name] = w
+	watchMx.Unlock()
+
+	return w
+}
+
+// watchName builds the name of a watch that is scoped
+// to a namespace or a remote datacenter.
+func watchName(kind, namespace, dc string) string {
+	name := kind
+	if namespace != "" {
+		name += "/" + namespace
+	}
+	if dc != "" {
+		name += "@" + dc
+	}
+	return name
+}
+
+func (w *watch) close() {
+	watchMx.Lock()
+	if watches[w.name] == w {
+		delete(watches, w.name)
+	}
+	watchMx.Unlock()
+
+	metrics.GaugeI("catalog.watch.degraded", 0, []string{"watch:" + w.name})
+}
+
+// fail records the error and blocks for the backoff interval
+// or until the context is done.
+func (w *watch) fail(err error) {
+	config := currentWatchConfig()
+
+	w.mx.Lock()
+	w.failures++
+	w.lastError = err.Error()
+	if w.failures == 1 {
+		w.failingSince = time.Now()
+	}
+
+	failures := w.failures
+	if config.DegradedAfter > 0 && failures >= config.DegradedAfter && !w.degraded {
+		w.degraded = true
+		logger.WithError(err).
+			WithField("watch", w.name).
+			WithField("failures", failures).
+			Warn("consul watch is degraded. last known state stays in effect")
+	}
+	degraded := w.degraded
+	w.mx.Unlock()
+
+	tags := []string{"watch:" + w.name}
+	metrics.Incr("catalog.watch.retry", tags)
+	if degraded {
+		metrics.GaugeI("catalog.watch.degraded", 1, tags)
+	}
+
+	timer := time.NewTimer(config.Backoff(failures))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-w.ctx.Done():
+	}
+}
+
+// next records a successful query and moves the wait index
+// of the query options. It reports whether the result holds
+// new data. An index that goes backwards means that the
+// consul state was restored or the servers were rebuilt,
+// the result is taken as new data and the watch starts over
+// from the new index.
+func (w *watch) next(qopts *api.QueryOptions, meta *api.QueryMeta) bool {
+	w.mx.Lock()
+	recovered := w.failures > 0
+	w.failures = 0
+	w.lastError = ""
+	w.failingSince = time.Time{}
+	w.degraded = false
+	w.mx.Unlock()
+
+	if recovered {
+		logger.WithField("watch", w.name).Info("consul watch has recovered")
+		metrics.GaugeI("catalog.watch.degraded", 0, []string{"watch:" + w.name})
+	}
+
+	switch {
+	case meta.LastIndex < qopts.WaitIndex:
+		metrics.Incr("catalog.watch.index_reset", []string{"watch:" + w.name})
+		logger.WithField("watch", w.name).
+			WithField("index", meta.LastIndex).
+			WithField("previous_index", qopts.WaitIndex).
+			Warn("consul index went backwards. resetting the watch")
+		qopts.WaitIndex = meta.LastIndex
+		return true
+
+	case meta.LastIndex == qopts.WaitIndex:
+		return false
+
+	default:
+		qopts.WaitIndex = meta.LastIndex
+		return true
+	}
+}
+
+func (w *watch) status() WatchStatus {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	return WatchStatus{
+		Name:         w.name,
+		Degraded:     w.degraded,
+		Failures:     w.failures,
+		LastError:    w.lastError,
+		FailingSince: w.failingSince,
+	}
+}
@@ -0,0 +1,165 @@
+package catalog
+
+import (
+	"context"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig_Backoff(t *testing.T) {
+	config := WatchConfig{
+		MinInterval: time.Second,
+		MaxInterval: 10 * time.Second,
+	}
+
+	tests := []struct {
+		failures int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{failures: 0, min: 0, max: 0},
+		{failures: 1, min: 500 * time.Millisecond, max: time.Second},
+		{failures: 2, min: time.Second, max: 2 * time.Second},
+		{failures: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{failures: 4, min: 4 * time.Second, max: 8 * time.Second},
+		{failures: 5, min: 5 * time.Second, max: 10 * time.Second},
+		{failures: 50, min: 5 * time.Second, max: 10 * time.Second},
+	}
+
+	for idx, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay := config.Backoff(test.failures)
+			if delay < test.min || delay > test.max {
+				t.Errorf("case %d: expected a delay between %s and %s, got %s", idx, test.min, test.max, delay)
+				break
+			}
+		}
+	}
+}
+
+func TestWatch_Next(t *testing.T) {
+	tests := []struct {
+		waitIndex uint64
+		lastIndex uint64
+		changed   bool
+		expect    uint64
+	}{
+		{waitIndex: 0, lastIndex: 10, changed: true, expect: 10},
+		{waitIndex: 10, lastIndex: 10, changed: false, expect: 10},
+		{waitIndex: 10, lastIndex: 12, changed: true, expect: 12},
+		// consul servers were rebuilt or restored from a snapshot
+		{waitIndex: 10, lastIndex: 3, changed: true, expect: 3},
+	}
+
+	w := newWatch(context.TODO(), "test")
+	defer w.close()
+
+	for idx, test := range tests {
+		qopts := &api.QueryOptions{WaitIndex: test.waitIndex}
+		changed := w.next(qopts, &api.QueryMeta{LastIndex: test.lastIndex})
+
+		if changed != test.changed {
+			t.Errorf("case %d: expected changed to be %v, got %v", idx, test.changed, changed)
+		}
+
+		if qopts.WaitIndex != test.expect {
+			t.Errorf("case %d: expected wait index %d, got %d", idx, test.expect, qopts.WaitIndex)
+		}
+	}
+}
+
+func TestWatch_Degraded(t *testing.T) {
+	SetWatchConfig(WatchConfig{DegradedAfter: 2})
+	defer SetWatchConfig(DefaultWatchConfig())
+
+	w := newWatch(context.TODO(), "services")
+	other := newWatch(context.TODO(), "routes")
+	defer other.close()
+
+	status := func() WatchStatus {
+		for _, s := range WatchStatuses() {
+			if s.Name == "services" {
+				return s
+			}
+		}
+		t.Fatalf("watch is not registered")
+		return WatchStatus{}
+	}
+
+	w.fail(fmt.Errorf("connection refused"))
+	if Degraded() || status().Failures != 1 {
+		t.Errorf("expected the watch to be failing but not degraded. %+v", status())
+	}
+
+	w.fail(fmt.Errorf("connection refused"))
+	if !Degraded() || !status().Degraded || status().LastError != "connection refused" {
+		t.Errorf("expected the watch to be degraded. %+v", status())
+	}
+
+	w.next(&api.QueryOptions{}, &api.QueryMeta{LastIndex: 1})
+	if Degraded() || status().Failures != 0 || !status().FailingSince.IsZero() {
+		t.Errorf("expected the watch to recover. %+v", status())
+	}
+
+	w.fail(fmt.Errorf("connection refused"))
+	w.fail(fmt.Errorf("connection refused"))
+	w.close()
+
+	for _, s := range WatchStatuses() {
+		if s.Name == "services" {
+			t.Errorf("expected a closed watch to be forgotten")
+		}
+	}
+}
+
+func TestSetConnectOptional(t *testing.T) {
+	SetWatchConfig(WatchConfig{DegradedAfter: 1})
+	defer SetWatchConfig(DefaultWatchConfig())
+	defer SetConnectOptional(false)
+
+	w := newWatch(context.TODO(), tlsWatchName)
+	defer w.close()
+
+	w.fail(fmt.Errorf("connect is not enabled"))
+	if !Degraded() {
+		t.Errorf("expected the connect watch to be degraded")
+	}
+
+	SetConnectOptional(true)
+	if Degraded() {
+		t.Errorf("expected an optional watch to be left out")
+	}
+
+	for _, s := range WatchStatuses() {
+		if s.Name == tlsWatchName && (!s.Degraded || !s.Optional) {
+			t.Errorf("expected the optional watch to be reported. %+v", s)
+		}
+	}
+
+	SetConnectOptional(false)
+	if !Degraded() {
+		t.Errorf("expected the connect watch to be degraded again")
+	}
+}
+
+func TestWatchName(t *testing.T) {
+	tests := []struct {
+		namespace string
+		dc        string
+		expect    string
+	}{
+		{expect: "health"},
+		{namespace: "team-a", expect: "health/team-a"},
+		{dc: "dc2", expect: "health@dc2"},
+		{namespace: "team-a", dc: "dc2", expect: "health/team-a@dc2"},
+	}
+
+	for idx, test := range tests {
+		name := watchName("health", test.namespace, test.dc)
+		if name != test.expect {
+			t.Errorf("case %d: expected %q, got %q", idx, test.expect, name)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package discovery
 import (
 	"flag"
 	"fmt"
+	"github.com/Gufran/flightpath/catalog"
 	"github.com/Gufran/flightpath/version"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	consul "github.com/hashicorp/consul/api"
 	"os"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -20,8 +23,12 @@ func NewEmptyConfig() *Config {
 		Global: &GlobalConfig{},
 		Consul: &ConsulConfig{},
 		XDS: &XDS{
-			Envoy: &EnvoyConfig{},
-			Debug: &DebugConfig{},
+			Services: &ServicesConfig{},
+			Locality: &LocalityConfig{},
+			Envoy:    &EnvoyConfig{},
+			Connect:  &ConnectConfig{},
+			Debug:    &DebugConfig{},
+			Health:   &HealthConfig{},
 		},
 	}
 }
@@ -37,18 +44,137 @@ type GlobalConfig struct {
 }
 
 type XDS struct {
-	ServiceName string
-	ListenPort  int
-	Consul      *consul.Client
-	Cache       cache.SnapshotCache
+	ServiceName  string
+	ListenPort   int
+	RoutesKVPath string
+	PolicyFile   string
+	PolicyKVPath string
 
-	Envoy *EnvoyConfig
-	Debug *DebugConfig
+	// ConfigEntries applies the service-router and
+	// service-splitter config entries on the routes.
+	ConfigEntries bool
+
+	// IngressGateways is a comma separated list of the
+	// ingress-gateway config entries served next to the
+	// routes of the services, "*" serves all of them.
+	IngressGateways string
+
+	GroupsFile   string
+	GroupKey     string
+	Groups       []*NodeGroup
+	Consul       *consul.Client
+	ConsulConfig *ConsulConfig
+	Cache        cache.SnapshotCache
+	Tracker      *SnapshotTracker
+	Readiness    *Readiness
+
+	Services *ServicesConfig
+	Locality *LocalityConfig
+	Envoy    *EnvoyConfig
+	Connect  *ConnectConfig
+	Debug    *DebugConfig
+	Health   *HealthConfig
 }
 
-func (x *XDS) Init(client *consul.Client, sn cache.SnapshotCache) {
+func (x *XDS) Init(client *consul.Client, cc *ConsulConfig, sn cache.SnapshotCache, tracker *SnapshotTracker, groups []*NodeGroup) {
 	x.Consul = client
+	x.ConsulConfig = cc
 	x.Cache = sn
+	x.Tracker = tracker
+	x.Groups = groups
+}
+
+// NodeGroups returns the node groups configured in the
+// groups file. Without the file all nodes belong to one
+// group named after the node name and every discovered
+// service is selected.
+func (x *XDS) NodeGroups() ([]*NodeGroup, error) {
+	if x.GroupsFile == "" {
+		return []*NodeGroup{
+			{
+				Name:  x.Envoy.NodeName,
+				Envoy: x.Envoy,
+			},
+		}, nil
+	}
+
+	return LoadNodeGroups(x.GroupsFile, x.Envoy)
+}
+
+// Selector builds the catalog selector from the flags. The
+// tags of all node groups are selected along with the tag
+// set with -services.tag. Without -services.namespaces the
+// services are discovered in the namespace of Flightpath.
+func (x *XDS) Selector() *catalog.Selector {
+	// The flags default to the settings of catalog.NewSelector
+	// and an empty tag or exclude meta key turns them off.
+	selector := catalog.NewSelector()
+	selector.Tags = nil
+	selector.TagPrefixes = splitList(x.Services.TagPrefixes)
+	selector.Filter = x.Services.Filter
+	selector.ExcludeMetaKey = x.Services.ExcludeMetaKey
+	selector.ExcludeDatacenters = splitList(x.Services.ExcludeDatacenters)
+	selector.AllowWarning = x.Services.AllowWarning
+	selector.Datacenters = splitList(x.Services.Datacenters)
+	selector.Namespaces = splitList(x.Services.Namespaces)
+
+	if x.ConsulConfig != nil {
+		selector.Partition = x.ConsulConfig.Partition
+		if len(selector.Namespaces) == 0 && x.ConsulConfig.Namespace != "" {
+			selector.Namespaces = []string{x.ConsulConfig.Namespace}
+		}
+	}
+
+	if x.Services.Tag != "" {
+		selector.Tags = append(selector.Tags, x.Services.Tag)
+	}
+
+	selector.Tags = append(selector.Tags, groupTags(x.Groups)...)
+	return selector
+}
+
+// Pipeline builds the settings of the service discovery
+// pipeline from the flags.
+func (x *XDS) Pipeline() *catalog.PipelineConfig {
+	return &catalog.PipelineConfig{
+		Workers:    x.Services.Workers,
+		Debounce:   x.Services.Debounce,
+		Resync:     x.Services.Resync,
+		UseCache:   x.Services.UseCache,
+		AllowStale: x.Services.AllowStale,
+	}
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+type ServicesConfig struct {
+	Tag                string
+	TagPrefixes        string
+	Filter             string
+	ExcludeMetaKey     string
+	ExcludeDatacenters string
+	AllowWarning       bool
+	Datacenters        string
+	Namespaces         string
+
+	// SubsetMetaKey groups the instances of every service
+	// into subset clusters by the value of this meta key.
+	SubsetMetaKey string
+
+	Workers    int
+	Debounce   time.Duration
+	Resync     time.Duration
+	UseCache   bool
+	AllowStale bool
 }
 
 type ConsulConfig struct {
@@ -56,28 +182,57 @@ type ConsulConfig struct {
 	Host  string
 	Port  int
 	Token string
+
+	// Namespace and Partition are the consul enterprise
+	// namespace and admin partition that Flightpath is
+	// registered in. They are set on every consul query.
+	Namespace string
+	Partition string
+
+	// RetryMin and RetryMax bound the backoff of the consul
+	// watches after a failed query. A watch is reported as
+	// degraded after DegradedAfter consecutive failures.
+	RetryMin      time.Duration
+	RetryMax      time.Duration
+	DegradedAfter int
+}
+
+// Watch builds the retry settings of the consul watches
+func (c *ConsulConfig) Watch() catalog.WatchConfig {
+	return catalog.WatchConfig{
+		MinInterval:   c.RetryMin,
+		MaxInterval:   c.RetryMax,
+		DegradedAfter: c.DegradedAfter,
+	}
 }
 
 type EnvoyConfig struct {
-	NodeName string
+	NodeName string `json:"-"`
+
+	ListenerPort                 int    `json:"listen_port"`
+	ListenerDrainType            string `json:"listen_drain_type"`
+	ListenTransparent            bool   `json:"listen_transparent"`
+	ListenTcpFastOpenQueueLength int    `json:"listen_tcp_fast_open_q_length"`
+	ListenerPerConnBufLimitBytes int    `json:"listen_per_conn_buf_limit"`
 
-	ListenerPort                 int
-	ListenerDrainType            string
-	ListenTransparent            bool
-	ListenTcpFastOpenQueueLength int
-	ListenerPerConnBufLimitBytes int
+	HttpAccessLogPath       string `json:"http_access_logs"`
+	HttpIdleTimeout         int64  `json:"http_idle_timeout"`
+	HttpStreamIdleTimeout   int64  `json:"http_stream_idle_timeout"`
+	HttpRequestTimeout      int64  `json:"http_req_timeout"`
+	HttpDrainTimeout        int64  `json:"http_drain_timeout"`
+	HttpDelayedCloseTimeout int64  `json:"http_delayed_close_timeout"`
+	HttpPreserveExtReqId    bool   `json:"http_preserve_req_id"`
 
-	HttpAccessLogPath       string
-	HttpIdleTimeout         int64
-	HttpStreamIdleTimeout   int64
-	HttpRequestTimeout      int64
-	HttpDrainTimeout        int64
-	HttpDelayedCloseTimeout int64
-	HttpPreserveExtReqId    bool
+	EnableTracing  bool   `json:"tracing_enabled"`
+	TracingOpName  string `json:"tracing_op_name"`
+	TracingVerbose bool   `json:"tracing_verbose"`
+}
 
-	EnableTracing  bool
-	TracingOpName  string
-	TracingVerbose bool
+// ConnectConfig decides whether Flightpath waits for a connect
+// leaf certificate before it serves the configuration to Envoy.
+type ConnectConfig struct {
+	Mode        string
+	LeafTimeout time.Duration
 }
 
 type DebugConfig struct {
@@ -85,6 +240,12 @@ type DebugConfig struct {
 	Port   int
 }
 
+// HealthConfig is the port of the health server, which
+// is always started unlike the debug server.
+type HealthConfig struct {
+	Port int
+}
+
 func (c *Config) ParseFlags() {
 	var showVersion bool
 
@@ -100,9 +261,39 @@ func (c *Config) ParseFlags() {
 	flag.IntVar(&c.Consul.Port, "consul.port", 8500, "Port on which the consul agent is listening")
 	flag.StringVar(&c.Consul.Host, "consul.host", "127.0.0.1", "Network address to a consul agent")
 	flag.StringVar(&c.Consul.Token, "consul.token", "", "Consul token to use")
+	flag.StringVar(&c.Consul.Namespace, "consul.namespace", "", "Consul enterprise namespace to register Flightpath in")
+	flag.StringVar(&c.Consul.Partition, "consul.partition", "", "Consul enterprise admin partition to register Flightpath in and discover the services from")
+	flag.DurationVar(&c.Consul.RetryMin, "consul.retry-min", time.Second, "Delay before a failed consul query is retried. The delay doubles with every consecutive failure")
+	flag.DurationVar(&c.Consul.RetryMax, "consul.retry-max", time.Minute, "Maximum delay between the retries of a failed consul query")
+	flag.IntVar(&c.Consul.DegradedAfter, "consul.degraded-after", 3, "Number of consecutive failed queries after which a consul watch is reported as degraded")
 
 	flag.StringVar(&c.XDS.ServiceName, "name", "flightpath", "Name used to register the flightpath service in Consul Catalog")
 	flag.IntVar(&c.XDS.ListenPort, "port", 7171, "Port for XDS listener")
+	flag.StringVar(&c.XDS.RoutesKVPath, "routes.kv-prefix", "", "Consul KV prefix to watch for externally managed routes. Routes are only read from service metadata if this is empty")
+	flag.StringVar(&c.XDS.PolicyFile, "routes.policy-file", "", "Path to the file with domain ownership policy. Every service can claim every domain if neither this nor -routes.policy-kv-key is set")
+	flag.StringVar(&c.XDS.PolicyKVPath, "routes.policy-kv-key", "", "Consul KV key to watch for domain ownership policy. Cannot be used together with -routes.policy-file")
+	flag.StringVar(&c.XDS.IngressGateways, "routes.ingress-gateways", "", "Comma separated list of consul ingress-gateway config entries to serve next to the routes of the services, or '*' for all entries")
+	flag.BoolVar(&c.XDS.ConfigEntries, "routes.config-entries", false, "Apply the service-router, service-splitter and service-resolver config entries of the services on their routes")
+	flag.StringVar(&c.XDS.Services.Tag, "services.tag", catalog.FlightPathTag, "Services with this tag are discovered. Can be empty if services are selected with -services.tag-prefix or node group tags")
+	flag.StringVar(&c.XDS.Services.TagPrefixes, "services.tag-prefix", "", "Comma separated list of tag prefixes. Services with a tag that starts with one of the prefixes are discovered")
+	flag.StringVar(&c.XDS.Services.Filter, "services.filter", "", "Consul filter expression applied on service instances, e.g. 'Service.Meta.team == \"web\"'")
+	flag.StringVar(&c.XDS.Services.ExcludeMetaKey, "services.exclude-meta-key", catalog.NewSelector().ExcludeMetaKey, "Service instances that set this meta key to true are not discovered")
+	flag.StringVar(&c.XDS.Services.ExcludeDatacenters, "services.exclude-dc", "", "Comma separated list of datacenters whose service instances are not discovered")
+	flag.BoolVar(&c.XDS.Services.AllowWarning, "services.allow-warning", false, "Treat service instances with health checks in warning state as healthy")
+	flag.StringVar(&c.XDS.Services.Namespaces, "services.namespaces", "", "Comma separated list of consul enterprise namespaces to discover services in, or '*' for all namespaces. Defaults to the namespace set with -consul.namespace")
+	flag.StringVar(&c.XDS.Services.SubsetMetaKey, "services.subset-meta-key", "", "Service instances are grouped into subset clusters by the value of this meta key, e.g. 'version'. Routes can be pinned to a subset or send a share of their traffic to it")
+	flag.IntVar(&c.XDS.Services.Workers, "services.workers", 8, "Number of services fetched from consul concurrently")
+	flag.DurationVar(&c.XDS.Services.Debounce, "services.debounce", 500*time.Millisecond, "Delay before a changed service is fetched, so that a burst of changes causes only one fetch")
+	flag.DurationVar(&c.XDS.Services.Resync, "services.resync", time.Minute, "Interval at which every service is fetched again in case a change was missed. 0 disables the resync")
+	flag.BoolVar(&c.XDS.Services.UseCache, "services.use-cache", false, "Read the service instances from the cache of the local consul agent")
+	flag.BoolVar(&c.XDS.Services.AllowStale, "services.stale", false, "Allow any consul server to answer the service instance reads instead of only the leader")
+	flag.StringVar(&c.XDS.Services.Datacenters, "services.datacenters", "", "Comma separated list of remote datacenters to discover service instances from, in failover order")
+	flag.StringVar(&c.XDS.Locality.RegionKey, "locality.region-key", "", "Consul node meta key that holds the region of the node")
+	flag.StringVar(&c.XDS.Locality.ZoneKey, "locality.zone-key", "", "Consul node meta key that holds the availability zone of the node, e.g. 'zone' or 'rack'")
+	flag.StringVar(&c.XDS.Locality.SubZoneKey, "locality.subzone-key", "", "Consul node meta key that holds the sub zone of the node")
+	flag.BoolVar(&c.XDS.Locality.PreferLocalZone, "locality.prefer-local-zone", false, "Give the endpoints in the zone of the Envoy node priority 0 and the endpoints in other zones priority 1")
+	flag.StringVar(&c.XDS.GroupsFile, "node-groups.file", "", "Path to the file with Envoy node groups. All nodes share one configuration named after -node-name if this is empty")
+	flag.StringVar(&c.XDS.GroupKey, "node-groups.metadata-key", "", "Envoy node metadata key that holds the name of the node group. The node cluster is used if this is empty")
 
 	flag.IntVar(&c.XDS.Envoy.ListenerPort, "envoy.listen.port", 9292, "Port used by Envoy Listener")
 	flag.StringVar(&c.XDS.Envoy.ListenerDrainType, "envoy.listen.drain-type", "default", "Method used to drain upstream connections. Valid options are 'default' and 'modified'")
@@ -123,8 +314,12 @@ func (c *Config) ParseFlags() {
 	flag.StringVar(&c.XDS.Envoy.TracingOpName, "envoy.tracing.op-name", "egress", "Tracing operation name, valid values are 'ingress' or 'egress'")
 	flag.BoolVar(&c.XDS.Envoy.TracingVerbose, "envoy.tracing.verbose", false, "Add verbose information to traces")
 
+	flag.StringVar(&c.XDS.Connect.Mode, "connect.mode", ConnectAuto, "Valid options are 'auto', 'enabled' and 'disabled'. With 'auto' Flightpath serves only the plain services if no connect leaf certificate arrives within -connect.leaf-timeout, 'enabled' waits for the certificate forever and 'disabled' never asks for one")
+	flag.DurationVar(&c.XDS.Connect.LeafTimeout, "connect.leaf-timeout", 30*time.Second, "Time to wait for the connect leaf certificate before serving the plain services with -connect.mode=auto")
+
 	flag.BoolVar(&c.XDS.Debug.Enable, "debug", false, "Start debug HTTP server on loopback interface")
 	flag.IntVar(&c.XDS.Debug.Port, "debug.port", 7180, "Network port to use for debug HTTP server")
+	flag.IntVar(&c.XDS.Health.Port, "health.port", 7181, "Network port of the HTTP server that serves the health probes on all interfaces")
 
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
 	flag.Parse()
@@ -0,0 +1,40 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestXDS_Selector(t *testing.T) {
+	tests := []struct {
+		services *ServicesConfig
+		expect   *catalog.Selector
+	}{
+		{
+			services: &ServicesConfig{
+				Tag:            catalog.FlightPathTag,
+				ExcludeMetaKey: catalog.NewSelector().ExcludeMetaKey,
+			},
+			expect: catalog.NewSelector(),
+		},
+		{
+			services: &ServicesConfig{
+				TagPrefixes: "edge:",
+				Datacenters: "dc2,dc3",
+			},
+			expect: &catalog.Selector{
+				TagPrefixes: []string{"edge:"},
+				Datacenters: []string{"dc2", "dc3"},
+			},
+		},
+	}
+
+	for idx, test := range tests {
+		x := &XDS{Services: test.services}
+		result := x.Selector()
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/metrics"
+	"sort"
+	"sync"
+)
+
+// RouteClaim is a cluster asking for the traffic
+// on a domain and path.
+type RouteClaim struct {
+	Cluster     string `json:"cluster"`
+	Route       string `json:"route"`
+	Source      string `json:"source"`
+	CreateIndex uint64 `json:"create_index"`
+}
+
+// RouteConflict describes a domain and path that is
+// claimed by more than one cluster. Only the winner
+// receives the traffic, other claims are shadowed.
+// Conditions are the request conditions of the route
+// other than the path, if it has any. Listener is set for
+// the routes of the ingress gateway listeners.
+type RouteConflict struct {
+	Group      string       `json:"group"`
+	Listener   string       `json:"listener,omitempty"`
+	Domain     string       `json:"domain"`
+	Path       string       `json:"path"`
+	Match      string       `json:"match"`
+	Conditions string       `json:"conditions,omitempty"`
+	Winner     RouteClaim   `json:"winner"`
+	Shadowed   []RouteClaim `json:"shadowed"`
+}
+
+// RouteConflicts holds the conflicts found while
+// building the most recent snapshot of every group.
+type RouteConflicts struct {
+	mx     sync.RWMutex
+	groups map[string][]RouteConflict
+}
+
+func NewRouteConflicts() *RouteConflicts {
+	return &RouteConflicts{
+		groups: map[string][]RouteConflict{},
+	}
+}
+
+func (r *RouteConflicts) Set(group string, items []RouteConflict) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for idx := range items {
+		items[idx].Group = group
+	}
+	r.groups[group] = items
+
+	metrics.GaugeI("discovery.route.conflicts", len(items), []string{"group:" + group})
+}
+
+// Get returns the conflicts of all groups ordered by group
+func (r *RouteConflicts) Get() []RouteConflict {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	var names []string
+	for name := range r.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []RouteConflict
+	for _, name := range names {
+		result = append(result, r.groups[name]...)
+	}
+	return result
+}
+
+type claimKey struct {
+	path  string
+	exact bool
+	regex bool
+	match string
+}
+
+func entryClaimKey(entry routeEntry) claimKey {
+	return claimKey{
+		path:  entry.path,
+		exact: entry.exact,
+		regex: entry.regex,
+		match: entry.match.String(),
+	}
+}
+
+// resolveConflicts removes the routes of all but one cluster
+// when multiple clusters claim the same path on a domain.
+//
+// The claim that was registered first wins, i.e. the one
+// with the lowest consul CreateIndex across all instances
+// of the cluster. A service cannot take over the traffic
+// of an existing service by registering the same route.
+// If the index is the same, which can only happen with
+// clusters that share the same KV route, the cluster with
+// alphabetically lower name wins.
+func (v *vhostPool) resolveConflicts() []RouteConflict {
+	var conflicts []RouteConflict
+
+	var domains []string
+	for domain := range v.domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	for _, domain := range domains {
+		claims := map[claimKey]map[string]RouteClaim{}
+		for _, entry := range v.domains[domain] {
+			key := entryClaimKey(entry)
+			if claims[key] == nil {
+				claims[key] = map[string]RouteClaim{}
+			}
+
+			existing, ok := claims[key][entry.clusterName]
+			if !ok || entry.createIndex < existing.CreateIndex {
+				claims[key][entry.clusterName] = RouteClaim{
+					Cluster:     entry.clusterName,
+					Route:       entry.name,
+					Source:      entry.source,
+					CreateIndex: entry.createIndex,
+				}
+			}
+		}
+
+		losers := map[claimKey]map[string]bool{}
+		for key, byCluster := range claims {
+			if len(byCluster) < 2 {
+				continue
+			}
+
+			var ordered []RouteClaim
+			for _, c := range byCluster {
+				ordered = append(ordered, c)
+			}
+
+			sort.Slice(ordered, func(i, j int) bool {
+				if ordered[i].CreateIndex != ordered[j].CreateIndex {
+					return ordered[i].CreateIndex < ordered[j].CreateIndex
+				}
+				return ordered[i].Cluster < ordered[j].Cluster
+			})
+
+			conflict := RouteConflict{
+				Domain:     domain,
+				Path:       key.path,
+				Match:      matchType(key.exact, key.regex),
+				Conditions: key.match,
+				Winner:     ordered[0],
+				Shadowed:   ordered[1:],
+			}
+
+			losers[key] = map[string]bool{}
+			for _, c := range conflict.Shadowed {
+				losers[key][c.Cluster] = true
+
+				metrics.Incr("discovery.route.conflict", []string{"domain:" + domain, "cluster:" + c.Cluster})
+				logger.WithField("domain", domain).
+					WithField("path", key.path).
+					WithField("cluster", c.Cluster).
+					WithField("winner", conflict.Winner.Cluster).
+					Warn("route is shadowed by an older route of another cluster")
+			}
+
+			conflicts = append(conflicts, conflict)
+		}
+
+		if len(losers) == 0 {
+			continue
+		}
+
+		var kept []routeEntry
+		for _, entry := range v.domains[domain] {
+			if losers[entryClaimKey(entry)][entry.clusterName] {
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		v.domains[domain] = kept
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Domain != conflicts[j].Domain {
+			return conflicts[i].Domain < conflicts[j].Domain
+		}
+		if conflicts[i].Path != conflicts[j].Path {
+			return conflicts[i].Path < conflicts[j].Path
+		}
+		if conflicts[i].Match != conflicts[j].Match {
+			return conflicts[i].Match < conflicts[j].Match
+		}
+		return conflicts[i].Conditions < conflicts[j].Conditions
+	})
+
+	return conflicts
+}
@@ -0,0 +1,57 @@
+package discovery
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestVhostPool_ResolveConflicts(t *testing.T) {
+	pool := newVhostPool(nil)
+	pool.domains["example.com"] = []routeEntry{
+		{name: "new.1-0", clusterName: "new", path: "/login", exact: true, createIndex: 30},
+		{name: "old.2-0", clusterName: "old", path: "/login", exact: true, createIndex: 12},
+		{name: "old.1-0", clusterName: "old", path: "/login", exact: true, createIndex: 10},
+		{name: "new.1-1", clusterName: "new", path: "/login/", createIndex: 30},
+		{name: "other.1-0", clusterName: "other", path: "/other", exact: true, createIndex: 5},
+	}
+	pool.domains["*"] = []routeEntry{
+		{name: "b.1-0", clusterName: "b", path: "/", createIndex: 7},
+		{name: "a.1-0", clusterName: "a", path: "/", createIndex: 7},
+	}
+
+	conflicts := pool.resolveConflicts()
+	expect := []RouteConflict{
+		{
+			Domain: "*",
+			Path:   "/",
+			Match:  "prefix",
+			Winner: RouteClaim{Cluster: "a", Route: "a.1-0", CreateIndex: 7},
+			Shadowed: []RouteClaim{
+				{Cluster: "b", Route: "b.1-0", CreateIndex: 7},
+			},
+		},
+		{
+			Domain: "example.com",
+			Path:   "/login",
+			Match:  "exact",
+			Winner: RouteClaim{Cluster: "old", Route: "old.1-0", CreateIndex: 10},
+			Shadowed: []RouteClaim{
+				{Cluster: "new", Route: "new.1-0", CreateIndex: 30},
+			},
+		},
+	}
+
+	if !cmp.Equal(conflicts, expect) {
+		t.Errorf("unexpected conflicts. %s", cmp.Diff(conflicts, expect))
+	}
+
+	var kept []string
+	for _, e := range pool.domains["example.com"] {
+		kept = append(kept, e.name)
+	}
+
+	expectKept := []string{"old.2-0", "old.1-0", "new.1-1", "other.1-0"}
+	if !cmp.Equal(kept, expectKept) {
+		t.Errorf("unexpected routes after conflict resolution. %s", cmp.Diff(kept, expectKept))
+	}
+}
@@ -0,0 +1,96 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"sort"
+)
+
+const datacenterSeparator = "@"
+
+// datacenterClusterName is the name of the cluster that
+// holds only the instances of a service in one datacenter.
+// Routes pinned to a datacenter send the traffic to it.
+func datacenterClusterName(cluster, dc string) string {
+	return cluster + datacenterSeparator + dc
+}
+
+// pinnedDatacenters lists the datacenters that the routes
+// of the cluster are pinned to.
+func pinnedDatacenters(c catalog.ClusterInfo) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, e := range c.Endpoints() {
+		for _, routes := range e.RoutingInfo() {
+			for _, r := range routes {
+				if r.Datacenter != "" && !seen[r.Datacenter] {
+					seen[r.Datacenter] = true
+					result = append(result, r.Datacenter)
+				}
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// servicePinnedDatacenters lists the pinned datacenters of every
+// logical service. A route of the service is split between all of
+// its clusters, so each of them needs the datacenter cluster even
+// when the route comes from the instances of another one.
+func servicePinnedDatacenters(clusters []catalog.ClusterInfo) map[string][]string {
+	seen := map[string]map[string]bool{}
+	result := map[string][]string{}
+	for _, c := range clusters {
+		service := c.Service()
+		if seen[service] == nil {
+			seen[service] = map[string]bool{}
+		}
+
+		for _, dc := range pinnedDatacenters(c) {
+			if !seen[service][dc] {
+				seen[service][dc] = true
+				result[service] = append(result[service], dc)
+			}
+		}
+	}
+
+	for _, dcs := range result {
+		sort.Strings(dcs)
+	}
+	return result
+}
+
+// datacenterEndpoints returns the endpoints in the datacenter
+func datacenterEndpoints(endpoints []catalog.Endpoint, dc string) []catalog.Endpoint {
+	var result []catalog.Endpoint
+	for _, e := range endpoints {
+		if e.Datacenter() == dc {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// compactPriorities renumbers the priorities so that they
+// start at 0 and have no gaps. Envoy expects the priorities
+// of a load assignment to range from 0 to N without skipping.
+func compactPriorities(priorities []uint32) map[uint32]uint32 {
+	distinct := map[uint32]bool{}
+	var ordered []uint32
+	for _, p := range priorities {
+		if !distinct[p] {
+			distinct[p] = true
+			ordered = append(ordered, p)
+		}
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i] < ordered[j]
+	})
+
+	result := make(map[uint32]uint32, len(ordered))
+	for idx, p := range ordered {
+		result[p] = uint32(idx)
+	}
+	return result
+}
@@ -0,0 +1,38 @@
+package discovery
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestCompactPriorities(t *testing.T) {
+	tests := []struct {
+		priorities []uint32
+		expect     map[uint32]uint32
+	}{
+		{
+			priorities: []uint32{0},
+			expect:     map[uint32]uint32{0: 0},
+		},
+		{
+			// local datacenter without instances in the local zone
+			priorities: []uint32{1, 2, 3, 1},
+			expect:     map[uint32]uint32{1: 0, 2: 1, 3: 2},
+		},
+		{
+			priorities: []uint32{4, 0, 2},
+			expect:     map[uint32]uint32{0: 0, 2: 1, 4: 2},
+		},
+		{
+			priorities: nil,
+			expect:     map[uint32]uint32{},
+		},
+	}
+
+	for idx, test := range tests {
+		result := compactPriorities(test.priorities)
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
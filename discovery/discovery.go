@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/Gufran/flightpath/catalog"
 	"github.com/Gufran/flightpath/log"
 	api "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	sd "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
@@ -22,6 +23,16 @@ func getConsulClient(c *ConsulConfig) (*consul.Client, error) {
 	cfg.Address = fmt.Sprintf("%s://%s:%d", c.Proto, c.Host, c.Port)
 	cfg.Token = c.Token
 
+	if c.Namespace != "" || c.Partition != "" {
+		client, err := consul.NewHttpClient(cfg.Transport, cfg.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Transport = catalog.NewNamespaceTransport(client.Transport, c.Namespace, c.Partition)
+		cfg.HttpClient = client
+	}
+
 	return consul.NewClient(cfg)
 }
 
@@ -31,23 +42,40 @@ func Start(ctx context.Context, config *Config) (func(), error) {
 		return nil, fmt.Errorf("failed to create consul client. %s", err)
 	}
 
-	apicache := cache.NewSnapshotCache(false, cache.IDHash{}, log.NewSrvLogger())
-	xds := dss.NewServer(apicache, nil)
+	groups, err := config.XDS.NodeGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load node groups. %s", err)
+	}
+
+	if config.XDS.Locality.PreferLocalZone && config.XDS.Locality.ZoneKey == "" {
+		return nil, fmt.Errorf("-locality.prefer-local-zone requires the zone of the endpoints from -locality.zone-key")
+	}
+
+	hash := NewGroupHash(config.XDS.GroupKey, groups, config.XDS.Locality.PreferLocalZone)
+	apicache := cache.NewSnapshotCache(false, hash, log.NewSrvLogger())
+	tracker := NewSnapshotTracker(apicache, hash)
+	xds := dss.NewServer(apicache, tracker)
 	server := grpc.NewServer()
 
-	sid, err := registerSelf(cc, config.XDS.ServiceName, config.XDS.ListenPort)
+	native := config.XDS.Connect.Mode != ConnectDisabled
+	sid, err := registerSelf(cc, config.XDS.ServiceName, config.XDS.ListenPort, native)
 	if err != nil {
 		return nil, fmt.Errorf("failed to register the service in consul catalog. %s", err)
 	}
 
-	config.XDS.Init(cc, apicache)
-	config.XDS.Start(ctx)
+	catalog.SetWatchConfig(config.Consul.Watch())
+	config.XDS.Init(cc, config.Consul, apicache, tracker, groups)
+	err = config.XDS.Start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start configuration discovery. %s", err)
+	}
 
 	sd.RegisterAggregatedDiscoveryServiceServer(server, xds)
 	api.RegisterEndpointDiscoveryServiceServer(server, xds)
 	api.RegisterClusterDiscoveryServiceServer(server, xds)
 	api.RegisterRouteDiscoveryServiceServer(server, xds)
 	api.RegisterListenerDiscoveryServiceServer(server, xds)
+	sd.RegisterSecretDiscoveryServiceServer(server, xds)
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.XDS.ListenPort))
 	if err != nil {
@@ -75,15 +103,15 @@ func Start(ctx context.Context, config *Config) (func(), error) {
 	}, nil
 }
 
-func registerSelf(cc *consul.Client, name string, port int) (string, error) {
+// registerSelf registers Flightpath in the consul catalog. As a
+// connect native service it is allowed to request the leaf
+// certificate that Envoy presents to the sidecar proxies.
+func registerSelf(cc *consul.Client, name string, port int, native bool) (string, error) {
 	reg := &consul.AgentServiceRegistration{
 		ID:   uuid.New().String(),
 		Name: name,
 		Kind: consul.ServiceKindTypical,
 		Port: port,
-		Connect: &consul.AgentServiceConnect{
-			Native: true,
-		},
 
 		// TODO: register health checks at least for the TCP
 		//  socket connection. Expand the health checks to
@@ -91,6 +119,12 @@ func registerSelf(cc *consul.Client, name string, port int) (string, error) {
 		//  so that failures can be detected early on
 	}
 
+	if native {
+		reg.Connect = &consul.AgentServiceConnect{
+			Native: true,
+		}
+	}
+
 	err := cc.Agent().ServiceRegister(reg)
 	if err != nil {
 		return "", err
@@ -0,0 +1,188 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"io/ioutil"
+	"strings"
+)
+
+// NodeGroup is a set of Envoy nodes that receive the same
+// configuration. Every group has its own listener settings
+// and publishes only the services that carry one of its tags.
+type NodeGroup struct {
+	Name  string
+	Tags  []string
+	Envoy *EnvoyConfig
+}
+
+type nodeGroupSpec struct {
+	Name  string          `json:"name"`
+	Tags  []string        `json:"tags"`
+	Envoy json.RawMessage `json:"envoy"`
+}
+
+// ParseNodeGroups decodes the node groups from a JSON document
+//
+//	{
+//	  "groups": [
+//	    {"name": "public", "tags": ["in-flightpath:public"], "envoy": {"listen_port": 443}},
+//	    {"name": "internal"}
+//	  ]
+//	}
+//
+// Listener settings that are not set for a group are copied
+// from defaults. A group without tags selects the services
+// tagged with "in-flightpath:<name>".
+func ParseNodeGroups(data []byte, defaults *EnvoyConfig) ([]*NodeGroup, error) {
+	var doc struct {
+		Groups []nodeGroupSpec `json:"groups"`
+	}
+
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("node groups file is not a valid JSON document. %s", err)
+	}
+
+	if len(doc.Groups) == 0 {
+		return nil, fmt.Errorf("node groups file does not define any group")
+	}
+
+	seen := map[string]bool{}
+	var groups []*NodeGroup
+	for idx, spec := range doc.Groups {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("group %d does not have a name", idx)
+		}
+
+		if strings.Contains(spec.Name, zoneKeySeparator) {
+			return nil, fmt.Errorf("group name %q cannot contain %q", spec.Name, zoneKeySeparator)
+		}
+
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("group %q is defined more than once", spec.Name)
+		}
+		seen[spec.Name] = true
+
+		envoyConfig := *defaults
+		if len(spec.Envoy) > 0 {
+			err := json.Unmarshal(spec.Envoy, &envoyConfig)
+			if err != nil {
+				return nil, fmt.Errorf("group %q has invalid envoy settings. %s", spec.Name, err)
+			}
+		}
+		envoyConfig.NodeName = spec.Name
+
+		tags := spec.Tags
+		if len(tags) == 0 {
+			tags = []string{GroupTag(spec.Name)}
+		}
+
+		groups = append(groups, &NodeGroup{
+			Name:  spec.Name,
+			Tags:  tags,
+			Envoy: &envoyConfig,
+		})
+	}
+
+	return groups, nil
+}
+
+// LoadNodeGroups reads the node groups from a file
+func LoadNodeGroups(file string, defaults *EnvoyConfig) ([]*NodeGroup, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseNodeGroups(data, defaults)
+}
+
+// GroupTag is the default tag that selects a service
+// for the node group.
+func GroupTag(group string) string {
+	return catalog.FlightPathTag + ":" + group
+}
+
+// Selects reports whether a service with the tags is
+// published to the nodes in the group. A group without
+// tags publishes every discovered service.
+func (g *NodeGroup) Selects(tags []string) bool {
+	if len(g.Tags) == 0 {
+		return true
+	}
+
+	for _, tag := range tags {
+		for _, t := range g.Tags {
+			if tag == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func groupTags(groups []*NodeGroup) []string {
+	seen := map[string]bool{}
+	var tags []string
+	for _, g := range groups {
+		for _, tag := range g.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+var _ cache.NodeHash = GroupHash{}
+
+// GroupHash uses the node group as the snapshot key so that
+// all nodes in a group share one snapshot. The group is read
+// from the node metadata key if set, otherwise from the node
+// cluster. Nodes that do not name a known group fall back to
+// their node ID. With byZone set the nodes of a group share
+// one snapshot per zone.
+type GroupHash struct {
+	key    string
+	groups map[string]bool
+	byZone bool
+}
+
+func NewGroupHash(key string, groups []*NodeGroup, byZone bool) GroupHash {
+	known := make(map[string]bool, len(groups))
+	for _, g := range groups {
+		known[g.Name] = true
+	}
+
+	return GroupHash{
+		key:    key,
+		groups: known,
+		byZone: byZone,
+	}
+}
+
+func (h GroupHash) ID(node *core.Node) string {
+	if node == nil {
+		return ""
+	}
+
+	group := node.Cluster
+	if h.key != "" {
+		group = node.GetMetadata().GetFields()[h.key].GetStringValue()
+	}
+
+	if !h.groups[group] {
+		return node.Id
+	}
+
+	if zone := node.GetLocality().GetZone(); h.byZone && zone != "" {
+		return zoneSnapshotKey(group, zone)
+	}
+
+	return group
+}
@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestParseNodeGroups(t *testing.T) {
+	defaults := &EnvoyConfig{
+		NodeName:          "flightpath-edge",
+		ListenerPort:      9292,
+		ListenTransparent: true,
+		HttpIdleTimeout:   15,
+	}
+
+	tests := []struct {
+		data   string
+		expect []*NodeGroup
+		err    bool
+	}{
+		{
+			data: `{"groups": [
+				{"name": "public", "tags": ["in-flightpath", "in-flightpath:public"], "envoy": {"listen_port": 443, "http_idle_timeout": 60}},
+				{"name": "internal"}
+			]}`,
+			expect: []*NodeGroup{
+				{
+					Name: "public",
+					Tags: []string{"in-flightpath", "in-flightpath:public"},
+					Envoy: &EnvoyConfig{
+						NodeName:          "public",
+						ListenerPort:      443,
+						ListenTransparent: true,
+						HttpIdleTimeout:   60,
+					},
+				},
+				{
+					Name: "internal",
+					Tags: []string{"in-flightpath:internal"},
+					Envoy: &EnvoyConfig{
+						NodeName:          "internal",
+						ListenerPort:      9292,
+						ListenTransparent: true,
+						HttpIdleTimeout:   15,
+					},
+				},
+			},
+		},
+		{
+			data: `{"groups": []}`,
+			err:  true,
+		},
+		{
+			data: `{"groups": [{"tags": ["in-flightpath"]}]}`,
+			err:  true,
+		},
+		{
+			data: `{"groups": [{"name": "public"}, {"name": "public"}]}`,
+			err:  true,
+		},
+		{
+			data: `{"groups": [{"name": "public@us-east-1a"}]}`,
+			err:  true,
+		},
+		{
+			data: `{"groups": [{"name": "public", "envoy": {"listen_port": "443"}}]}`,
+			err:  true,
+		},
+	}
+
+	for idx, test := range tests {
+		groups, err := ParseNodeGroups([]byte(test.data), defaults)
+		if test.err {
+			if err == nil {
+				t.Errorf("case %d: expected an error", idx)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("case %d: unexpected error. %s", idx, err)
+			continue
+		}
+
+		if !cmp.Equal(groups, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(groups, test.expect))
+		}
+	}
+
+	if defaults.ListenerPort != 9292 || defaults.NodeName != "flightpath-edge" {
+		t.Errorf("default settings were modified")
+	}
+}
+
+func TestNodeGroup_Selects(t *testing.T) {
+	group := &NodeGroup{Name: "public", Tags: []string{"in-flightpath:public"}}
+
+	if !group.Selects([]string{"v2", "in-flightpath:public"}) {
+		t.Errorf("expected the service to be selected")
+	}
+
+	if group.Selects([]string{"in-flightpath", "in-flightpath:internal"}) {
+		t.Errorf("expected the service to be ignored")
+	}
+
+	group = &NodeGroup{Name: "flightpath-edge"}
+	if !group.Selects([]string{"in-flightpath:internal"}) {
+		t.Errorf("expected a group without tags to select every service")
+	}
+}
+
+func TestGroupHash_ID(t *testing.T) {
+	groups := []*NodeGroup{{Name: "public"}, {Name: "internal"}}
+
+	meta := func(group string) *structpb.Struct {
+		return &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"group": {Kind: &structpb.Value_StringValue{StringValue: group}},
+			},
+		}
+	}
+
+	tests := []struct {
+		key    string
+		node   *core.Node
+		expect string
+	}{
+		{
+			node:   &core.Node{Id: "edge-1", Cluster: "public"},
+			expect: "public",
+		},
+		{
+			node:   &core.Node{Id: "edge-2", Cluster: "unknown"},
+			expect: "edge-2",
+		},
+		{
+			key:    "group",
+			node:   &core.Node{Id: "edge-3", Cluster: "public", Metadata: meta("internal")},
+			expect: "internal",
+		},
+		{
+			key:    "group",
+			node:   &core.Node{Id: "edge-4", Cluster: "public"},
+			expect: "edge-4",
+		},
+		{
+			node:   nil,
+			expect: "",
+		},
+	}
+
+	for idx, test := range tests {
+		result := NewGroupHash(test.key, groups, false).ID(test.node)
+		if result != test.expect {
+			t.Errorf("case %d: expected %q, got %q", idx, test.expect, result)
+		}
+	}
+}
+
+func TestGroupHash_IDByZone(t *testing.T) {
+	hash := NewGroupHash("", []*NodeGroup{{Name: "public"}}, true)
+
+	tests := []struct {
+		node   *core.Node
+		expect string
+	}{
+		{
+			node:   &core.Node{Id: "edge-1", Cluster: "public", Locality: &core.Locality{Zone: "us-east-1a"}},
+			expect: "public@us-east-1a",
+		},
+		{
+			node:   &core.Node{Id: "edge-2", Cluster: "public"},
+			expect: "public",
+		},
+		{
+			node:   &core.Node{Id: "edge-3", Cluster: "unknown", Locality: &core.Locality{Zone: "us-east-1a"}},
+			expect: "edge-3",
+		},
+	}
+
+	for idx, test := range tests {
+		result := hash.ID(test.node)
+		if result != test.expect {
+			t.Errorf("case %d: expected %q, got %q", idx, test.expect, result)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"net"
+	"net/http"
+)
+
+// HealthServer answers the health probes of the orchestrator.
+// Unlike the debug server it is always started and listens on
+// all interfaces, on -health.port.
+type HealthServer struct {
+	readiness *Readiness
+}
+
+// StartHealthServer binds the port and serves the probes in the
+// background. A port that can not be bound fails the start, the
+// probes would fail without it anyway.
+func StartHealthServer(port int, readiness *Readiness) error {
+	addr := fmt.Sprintf(":%d", port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start health server on port %d. %s", port, err)
+	}
+
+	s := &HealthServer{readiness: readiness}
+	go s.Serve(listener)
+	return nil
+}
+
+func (h *HealthServer) Serve(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", h.health)
+	mux.HandleFunc("/ready", h.ready)
+
+	server := http.Server{
+		Handler: mux,
+	}
+
+	logger.WithField("addr", listener.Addr().String()).Info("starting health server")
+	err := server.Serve(listener)
+	if err != nil {
+		logger.WithError(err).Printf("health http server crashed")
+	}
+}
+
+// health lists the state of the consul watches. The status
+// code is 503 while any of the watches is degraded, Envoy keeps
+// receiving the last known configuration in the meantime.
+func (h *HealthServer) health(resp http.ResponseWriter, _ *http.Request) {
+	if catalog.Degraded() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	h.encode(resp, catalog.WatchStatuses())
+}
+
+// ready responds with 503 until the first configuration is
+// served to Envoy. The connect state does not affect the status
+// code, the plain services are served without it.
+func (h *HealthServer) ready(resp http.ResponseWriter, _ *http.Request) {
+	state := h.readiness.State()
+	if !state.Ready {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	h.encode(resp, state)
+}
+
+func (h *HealthServer) encode(resp http.ResponseWriter, data interface{}) {
+	enc := json.NewEncoder(resp)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(data)
+	if err != nil {
+		logger.WithError(err).Error("health server failed to send response")
+	}
+}
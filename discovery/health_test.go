@@ -0,0 +1,62 @@
+package discovery
+
+import (
+	"context"
+	"github.com/Gufran/flightpath/catalog"
+	consul "github.com/hashicorp/consul/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthServer_ConnectUnavailable(t *testing.T) {
+	catalog.SetWatchConfig(catalog.WatchConfig{MinInterval: time.Millisecond, MaxInterval: time.Millisecond, DegradedAfter: 1})
+	defer catalog.SetWatchConfig(catalog.DefaultWatchConfig())
+	catalog.SetConnectOptional(false)
+	defer catalog.SetConnectOptional(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Nothing listens on the port, every connect query fails
+	// just like it does on a consul with connect disabled.
+	client, err := consul.NewClient(&consul.Config{Address: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatalf("failed to create consul client. %s", err)
+	}
+
+	source := catalog.NewCatalog(ctx, client)
+	certs := make(chan catalog.TLSInfo)
+	go source.WatchTLS("flightpath", certs)
+	go source.WatchCARoots(make(chan catalog.CARootsInfo))
+
+	server := &HealthServer{readiness: NewReadiness()}
+	status := func(handler http.HandlerFunc) int {
+		resp := httptest.NewRecorder()
+		handler(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+		return resp.Code
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !catalog.Degraded() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connect watches to be degraded. %+v", catalog.WatchStatuses())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if code := status(server.health); code != http.StatusServiceUnavailable {
+		t.Errorf("expected /health to fail while waiting for connect, got %d", code)
+	}
+
+	waitForLeaf(ctx, certs, &ConnectConfig{Mode: ConnectAuto, LeafTimeout: time.Millisecond}, server.readiness)
+
+	if code := status(server.health); code != http.StatusOK {
+		t.Errorf("expected /health to pass once connect is given up on, got %d", code)
+	}
+
+	if state := server.readiness.State(); state.Connect != ConnectStateUnavailable {
+		t.Errorf("expected connect to be unavailable on /ready, got %s", state.Connect)
+	}
+}
@@ -3,23 +3,32 @@ package discovery
 import (
 	"encoding/json"
 	"fmt"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
 	"net/http"
 	"strings"
 	"sync"
 )
 
 type DebugServer struct {
-	mx    *sync.Mutex
-	state cache.SnapshotCache
-	node  string
+	mx        *sync.Mutex
+	state     cache.SnapshotCache
+	node      string
+	tracker   *SnapshotTracker
+	conflicts *RouteConflicts
+	sources   *RouteSources
 }
 
-func StartDebugServer(port int, node string, c cache.SnapshotCache) {
+func StartDebugServer(port int, node string, c cache.SnapshotCache, tracker *SnapshotTracker, conflicts *RouteConflicts, sources *RouteSources) {
 	s := &DebugServer{
-		mx:    &sync.Mutex{},
-		state: c,
-		node:  node,
+		mx:        &sync.Mutex{},
+		state:     c,
+		node:      node,
+		tracker:   tracker,
+		conflicts: conflicts,
+		sources:   sources,
 	}
 
 	go s.ListenAndServe(port)
@@ -28,6 +37,9 @@ func StartDebugServer(port int, node string, c cache.SnapshotCache) {
 func (d *DebugServer) ListenAndServe(port int) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", d.dump)
+	mux.HandleFunc("/conflicts", d.listConflicts)
+	mux.HandleFunc("/sources", d.listSources)
+	mux.HandleFunc("/nodes", d.listNodes)
 
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 	server := http.Server{
@@ -42,14 +54,21 @@ func (d *DebugServer) ListenAndServe(port int) {
 	}
 }
 
-func (d *DebugServer) sendResp(resp http.ResponseWriter, kind string) {
-	snap, err := d.state.GetSnapshot(d.node)
+func (d *DebugServer) sendResp(resp http.ResponseWriter, kind, group string) {
+	if group == "" {
+		group = d.node
+	}
+
+	snap, err := d.state.GetSnapshot(group)
 	if err != nil {
 		logger.WithError(err).Error("failed to retrieve snapshot from XDS cache")
 		http.Error(resp, "failed to retrieve state", http.StatusInternalServerError)
 		return
 	}
 
+	// Never let the private key out of the process
+	snap.Secrets = redactSecrets(snap.Secrets)
+
 	var data interface{}
 
 	switch kind {
@@ -61,22 +80,79 @@ func (d *DebugServer) sendResp(resp http.ResponseWriter, kind string) {
 		data = snap.Listeners
 	case "routes":
 		data = snap.Routes
+	case "secrets":
+		data = snap.Secrets
 	case "", "all":
 		data = snap
 	default:
-		http.Error(resp, "configuration type "+kind+" is not understood. only 'clusters', 'endpoints', 'listeners' and 'routes' are supported", http.StatusNotFound)
+		http.Error(resp, "configuration type "+kind+" is not understood. only 'clusters', 'endpoints', 'listeners', 'routes' and 'secrets' are supported", http.StatusNotFound)
 		return
 	}
 
+	d.encode(resp, data)
+}
+
+func (d *DebugServer) listNodes(resp http.ResponseWriter, _ *http.Request) {
+	d.encode(resp, d.tracker.States())
+}
+
+func (d *DebugServer) encode(resp http.ResponseWriter, data interface{}) {
 	enc := json.NewEncoder(resp)
 	enc.SetIndent("", "  ")
-	err = enc.Encode(data)
+	err := enc.Encode(data)
 	if err != nil {
 		logger.WithError(err).Error("Debug server failed to send response")
 	}
 }
 
+func (d *DebugServer) listConflicts(resp http.ResponseWriter, _ *http.Request) {
+	conflicts := d.conflicts.Get()
+	if conflicts == nil {
+		conflicts = []RouteConflict{}
+	}
+	d.encode(resp, conflicts)
+}
+
+// listSources lists the routes served to Envoy along
+// with the source of each, e.g. meta or ingress-gateway.
+func (d *DebugServer) listSources(resp http.ResponseWriter, _ *http.Request) {
+	sources := d.sources.Get()
+	if sources == nil {
+		sources = []RouteSource{}
+	}
+	d.encode(resp, sources)
+}
+
 func (d *DebugServer) dump(resp http.ResponseWriter, req *http.Request) {
 	kind := strings.TrimLeft(req.URL.Path, "/")
-	d.sendResp(resp, kind)
+	d.sendResp(resp, kind, req.URL.Query().Get("group"))
+}
+
+// redactSecrets returns a copy of secret resources with
+// the private key material replaced by a placeholder.
+func redactSecrets(secrets cache.Resources) cache.Resources {
+	result := cache.Resources{
+		Version: secrets.Version,
+		Items:   make(map[string]cache.Resource, len(secrets.Items)),
+	}
+
+	for name, item := range secrets.Items {
+		secret, ok := item.(*auth.Secret)
+		if !ok {
+			continue
+		}
+
+		secret = proto.Clone(secret).(*auth.Secret)
+		if cert := secret.GetTlsCertificate(); cert != nil && cert.PrivateKey != nil {
+			cert.PrivateKey = &core.DataSource{
+				Specifier: &core.DataSource_InlineString{
+					InlineString: "[redacted]",
+				},
+			}
+		}
+
+		result.Items[name] = secret
+	}
+
+	return result
 }
@@ -0,0 +1,273 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/Gufran/flightpath/metrics"
+	envoyapiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	auth "github.com/envoyproxy/go-control-plane/envoy/api/v2/auth"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"sort"
+)
+
+// ingressListener is a listener of the ingress gateways on a
+// port other than the port of the Flightpath listener. An http
+// listener has its own virtual hosts, a tcp listener sends all
+// connections to one service.
+type ingressListener struct {
+	port     int
+	protocol string
+	tls      bool
+	gateway  string
+	vhosts   *vhostPool
+	targets  []weightedCluster
+}
+
+func (l *ingressListener) name() string {
+	return fmt.Sprintf("ingress-%d", l.port)
+}
+
+// fork returns an empty pool that routes to the
+// same clusters under the same policy and entries.
+func (v *vhostPool) fork() *vhostPool {
+	pool := newVhostPool(v.policy)
+	pool.groups = v.groups
+	pool.services = v.services
+	pool.entries = v.entries
+	pool.unknown = v.unknown
+	return pool
+}
+
+// addIngress adds the listeners of the ingress gateways. The http
+// listeners on the port of the Flightpath listener add their routes
+// to its virtual hosts, next to the routes of the services. Other
+// ports get a listener of their own. The gateways are applied in
+// order and a port that is taken by an incompatible listener of an
+// earlier gateway is left to it.
+func addIngress(vhosts *vhostPool, port int, gateways []*catalog.IngressGateway, clusters map[string][]catalog.ClusterInfo) []*ingressListener {
+	byPort := map[int]*ingressListener{}
+	var result []*ingressListener
+
+	for _, gw := range gateways {
+		for _, l := range gw.Listeners {
+			target := &ingressListener{
+				port:     l.Port,
+				protocol: l.Protocol,
+				tls:      l.TLS,
+				gateway:  gw.Name,
+			}
+
+			if l.Port == port {
+				if l.Protocol != catalog.IngressProtocolHTTP || l.TLS {
+					skipIngressListener(gw.Name, l.Port, "ingress listener can not share the port of the flightpath listener")
+					continue
+				}
+				target.vhosts = vhosts
+			} else if existing, ok := byPort[l.Port]; ok {
+				if existing.protocol != catalog.IngressProtocolHTTP || l.Protocol != catalog.IngressProtocolHTTP || existing.tls != l.TLS {
+					skipIngressListener(gw.Name, l.Port, "ingress listener port is already in use by another gateway")
+					continue
+				}
+				target = existing
+			} else {
+				if l.Protocol == catalog.IngressProtocolHTTP {
+					target.vhosts = vhosts.fork()
+				}
+				byPort[l.Port] = target
+				result = append(result, target)
+			}
+
+			if l.Protocol == catalog.IngressProtocolTCP {
+				service := l.Services[0].Service
+				if len(vhosts.services[service]) == 0 {
+					vhosts.unknownIngress(gw.Name, service)
+				}
+				target.targets = vhosts.targets(service, "", 100*splitScale, map[string]bool{})
+				continue
+			}
+
+			for _, s := range l.Services {
+				if s.Service != catalog.IngressWildcardService {
+					target.vhosts.ingress(gw, s.Service, s.Hosts, clusters[s.Service])
+					continue
+				}
+
+				var services []string
+				for service := range clusters {
+					services = append(services, service)
+				}
+				sort.Strings(services)
+
+				for _, service := range services {
+					members := clusters[service]
+					if members[0].SubsetName() != "" {
+						continue
+					}
+					target.vhosts.ingress(gw, service, catalog.IngressDefaultHosts(members[0]), members)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+func skipIngressListener(gateway string, port int, reason string) {
+	metrics.Incr("discovery.ingress.listener.skipped", []string{"gateway:" + gateway, "port:" + fmt.Sprint(port)})
+	logger.WithField("gateway", gateway).
+		WithField("port", port).
+		Warn(reason)
+}
+
+// ingress routes every path of the hosts to the service. The
+// routes go through the config entries like the routes of the
+// service, the same as the consul ingress gateway does.
+func (v *vhostPool) ingress(gw *catalog.IngressGateway, service string, hosts []string, clusters []catalog.ClusterInfo) {
+	settings := &catalog.ClusterSettings{}
+	settings.Canonicalize()
+	if len(clusters) > 0 {
+		if s, err := clusters[0].Settings(); err == nil {
+			settings = s
+		}
+	}
+
+	entry := routeEntry{
+		name:        fmt.Sprintf("ingress.%s.%s", gw.Name, service),
+		clusterName: service,
+		path:        "/",
+		createIndex: gw.CreateIndex,
+		settings:    settings,
+		service:     service,
+		source:      routeSourceIngress + gw.Name,
+	}
+
+	members := v.services[service]
+	switch len(members) {
+	case 0:
+		// Envoy responds with 503 until the service is
+		// discovered, the same as the gateway would.
+		v.unknownIngress(gw.Name, service)
+	case 1:
+		entry.clusterName = members[0].name
+	default:
+		entry.members = members
+	}
+
+	for _, host := range hosts {
+		v.route(host, entry)
+	}
+}
+
+func (v *vhostPool) unknownIngress(gateway, service string) {
+	if v.unknown[service] {
+		return
+	}
+
+	v.unknown[service] = true
+	metrics.Incr("discovery.ingress.unknown_service", []string{"gateway:" + gateway, "service:" + service})
+	logger.WithField("gateway", gateway).
+		WithField("service", service).
+		Warn("ingress gateway refers to a service that is not available in catalog")
+}
+
+// buildIngressListener builds the listener of the ingress gateways
+// on the port. TLS listeners present the connect leaf certificate
+// of Flightpath, they are left out until the certificate is known.
+func buildIngressListener(l *ingressListener, envoyConfig *EnvoyConfig, hasLeaf bool) (*envoyapiv2.Listener, error) {
+	var chains []*listener.FilterChain
+	var err error
+
+	switch l.protocol {
+	case catalog.IngressProtocolHTTP:
+		chains, err = buildFilterChains(envoyConfig, l.name(), l.name())
+	default:
+		chains, err = buildTcpFilterChains(l)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the filter chain of %s. %s", l.name(), err)
+	}
+
+	if l.tls {
+		if !hasLeaf {
+			return nil, nil
+		}
+
+		socket, err := buildDownstreamTransportSocket()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chain := range chains {
+			chain.TransportSocket = socket
+		}
+	}
+
+	return buildListenerOn(l.name(), l.port, chains, envoyConfig), nil
+}
+
+func buildTcpFilterChains(l *ingressListener) ([]*listener.FilterChain, error) {
+	proxy := &tcp.TcpProxy{
+		StatPrefix: l.name(),
+	}
+
+	if len(l.targets) == 1 {
+		proxy.ClusterSpecifier = &tcp.TcpProxy_Cluster{Cluster: l.targets[0].name}
+	} else {
+		weighted := &tcp.TcpProxy_WeightedCluster{}
+		for _, t := range l.targets {
+			weighted.Clusters = append(weighted.Clusters, &tcp.TcpProxy_WeightedCluster_ClusterWeight{
+				Name:   t.name,
+				Weight: t.weight,
+			})
+		}
+		proxy.ClusterSpecifier = &tcp.TcpProxy_WeightedClusters{WeightedClusters: weighted}
+	}
+
+	proxyAny, err := deterministicAny(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*listener.FilterChain{
+		{
+			Filters: []*listener.Filter{
+				{
+					Name: wellknown.TCPProxy,
+					ConfigType: &listener.Filter_TypedConfig{
+						TypedConfig: proxyAny,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// buildDownstreamTransportSocket terminates TLS with the
+// connect leaf certificate served over SDS.
+func buildDownstreamTransportSocket() (*core.TransportSocket, error) {
+	downstreamTls := &auth.DownstreamTlsContext{
+		CommonTlsContext: &auth.CommonTlsContext{
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{
+				{
+					Name:      LeafSecretName,
+					SdsConfig: buildXdsConfigSource(),
+				},
+			},
+		},
+	}
+
+	tlsAny, err := deterministicAny(downstreamTls)
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.TransportSocket{
+		Name: "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: tlsAny,
+		},
+	}, nil
+}
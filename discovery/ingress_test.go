@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestAddIngress(t *testing.T) {
+	gateways := []*catalog.IngressGateway{
+		{
+			Name:        "edge",
+			CreateIndex: 5,
+			Listeners: []catalog.IngressListener{
+				{
+					Port:     9292,
+					Protocol: catalog.IngressProtocolHTTP,
+					Services: []catalog.IngressService{{Service: "web", Hosts: []string{"example.com"}}},
+				},
+				{
+					Port:     8443,
+					Protocol: catalog.IngressProtocolHTTP,
+					TLS:      true,
+					Services: []catalog.IngressService{{Service: "api", Hosts: []string{"api.ingress.*"}}},
+				},
+				{
+					Port:     9000,
+					Protocol: catalog.IngressProtocolTCP,
+					Services: []catalog.IngressService{{Service: "db"}},
+				},
+			},
+		},
+		{
+			Name: "other",
+			Listeners: []catalog.IngressListener{
+				{
+					// the tls setting does not match the listener of edge
+					Port:     8443,
+					Protocol: catalog.IngressProtocolHTTP,
+					Services: []catalog.IngressService{{Service: "web", Hosts: []string{"other.com"}}},
+				},
+				{
+					Port:     9292,
+					Protocol: catalog.IngressProtocolTCP,
+					Services: []catalog.IngressService{{Service: "db"}},
+				},
+			},
+		},
+	}
+
+	vhosts := newVhostPool(nil)
+	vhosts.services = map[string][]weightedCluster{
+		"web": {{name: "web", weight: 1}},
+		"api": {{name: "api", weight: 1}, {name: "api-sidecar-proxy", weight: 1}},
+		"db":  {{name: "db", weight: 1}},
+	}
+	vhosts.groups = serviceGroupsOf(vhosts.services)
+	vhosts.route("example.com", routeEntry{name: "web.1-0", clusterName: "web", service: "web", path: "/", source: routeSourceMeta})
+
+	listeners := addIngress(vhosts, 9292, gateways, nil)
+	if len(listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(listeners))
+	}
+
+	sources := vhosts.sources("upstream")
+	if len(sources) != 1 || sources[0].Source != "ingress-gateway:edge,meta" {
+		t.Errorf("expected the route of web to come from both sources, got %+v", sources)
+	}
+
+	secure := listeners[0]
+	if secure.name() != "ingress-8443" || !secure.tls || secure.vhosts == nil {
+		t.Fatalf("unexpected listener %+v", secure)
+	}
+
+	routes := secure.vhosts.collect(8443)
+	if len(routes) != 1 || !cmp.Equal(routes[0].Domains, []string{"api.ingress.*"}) {
+		t.Errorf("expected the wildcard host of api without port, got %v", routes)
+	}
+
+	if clusters := routes[0].Routes[0].GetRoute().GetWeightedClusters().GetClusters(); len(clusters) != 2 {
+		t.Errorf("expected the route to be split between the clusters of api, got %v", clusters)
+	}
+
+	l, err := buildIngressListener(secure, &EnvoyConfig{}, false)
+	if err != nil || l != nil {
+		t.Errorf("expected the tls listener to be left out without leaf certificate, got %v. %v", l, err)
+	}
+
+	l, err = buildIngressListener(secure, &EnvoyConfig{}, true)
+	if err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	if l.GetFilterChains()[0].GetTransportSocket() == nil {
+		t.Errorf("expected the listener to terminate tls")
+	}
+
+	db := listeners[1]
+	if db.protocol != catalog.IngressProtocolTCP || len(db.targets) != 1 || db.targets[0].name != "db" {
+		t.Errorf("unexpected tcp listener %+v", db)
+	}
+
+	l, err = buildIngressListener(db, &EnvoyConfig{}, false)
+	if err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	if l.GetAddress().GetSocketAddress().GetPortValue() != 9000 {
+		t.Errorf("expected the listener on port 9000, got %v", l.GetAddress())
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect string
+	}{
+		{a: "meta", b: "meta", expect: "meta"},
+		{a: "meta", b: "kv", expect: "kv,meta"},
+		{a: "kv,meta", b: "ingress-gateway:edge", expect: "ingress-gateway:edge,kv,meta"},
+		{a: "", b: "meta", expect: "meta"},
+	}
+
+	for idx, test := range tests {
+		if result := mergeSources(test.a, test.b); result != test.expect {
+			t.Errorf("case %d: expected %s, got %s", idx, test.expect, result)
+		}
+	}
+}
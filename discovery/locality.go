@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"strings"
+)
+
+// LocalityConfig names the consul node meta keys that
+// describe where a service instance is running.
+type LocalityConfig struct {
+	RegionKey  string
+	ZoneKey    string
+	SubZoneKey string
+
+	// PreferLocalZone publishes a separate snapshot for
+	// every zone of the Envoy nodes in which the endpoints
+	// in the zone of the node have priority 0 and the
+	// endpoints in other zones have priority 1.
+	PreferLocalZone bool
+}
+
+// endpointLocality maps the node meta of the endpoint
+// to an Envoy locality.
+func (l *LocalityConfig) endpointLocality(e catalog.Endpoint) *core.Locality {
+	locality := &core.Locality{}
+	if l == nil {
+		return locality
+	}
+
+	meta := e.NodeMeta()
+	if l.RegionKey != "" {
+		locality.Region = meta[l.RegionKey]
+	}
+	if l.ZoneKey != "" {
+		locality.Zone = meta[l.ZoneKey]
+	}
+	if l.SubZoneKey != "" {
+		locality.SubZone = meta[l.SubZoneKey]
+	}
+	return locality
+}
+
+// localityPriority gives the endpoints in the zone of
+// the Envoy node priority 0. The priority is always 0
+// when the zone of the node is not known.
+func localityPriority(locality *core.Locality, localZone string) uint32 {
+	if localZone == "" || locality.Zone == localZone {
+		return 0
+	}
+	return 1
+}
+
+const zoneKeySeparator = "@"
+
+// zoneSnapshotKey is the snapshot key for the nodes of
+// a group in a zone, when the local zone is preferred.
+func zoneSnapshotKey(group, zone string) string {
+	return group + zoneKeySeparator + zone
+}
+
+// splitSnapshotKey returns the group and the zone of
+// a snapshot key.
+func splitSnapshotKey(key string) (string, string) {
+	idx := strings.LastIndex(key, zoneKeySeparator)
+	if idx == -1 {
+		return key, ""
+	}
+	return key[:idx], key[idx+len(zoneKeySeparator):]
+}
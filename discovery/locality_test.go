@@ -0,0 +1,45 @@
+package discovery
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"testing"
+)
+
+func TestLocalityPriority(t *testing.T) {
+	tests := []struct {
+		zone      string
+		localZone string
+		expect    uint32
+	}{
+		{zone: "us-east-1a", localZone: "", expect: 0},
+		{zone: "us-east-1a", localZone: "us-east-1a", expect: 0},
+		{zone: "us-east-1b", localZone: "us-east-1a", expect: 1},
+		{zone: "", localZone: "us-east-1a", expect: 1},
+	}
+
+	for idx, test := range tests {
+		result := localityPriority(&core.Locality{Zone: test.zone}, test.localZone)
+		if result != test.expect {
+			t.Errorf("case %d: expected %d, got %d", idx, test.expect, result)
+		}
+	}
+}
+
+func TestSplitSnapshotKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		group string
+		zone  string
+	}{
+		{key: "public", group: "public"},
+		{key: zoneSnapshotKey("public", "us-east-1a"), group: "public", zone: "us-east-1a"},
+		{key: "edge-1", group: "edge-1"},
+	}
+
+	for idx, test := range tests {
+		group, zone := splitSnapshotKey(test.key)
+		if group != test.group || zone != test.zone {
+			t.Errorf("case %d: expected %q and %q, got %q and %q", idx, test.group, test.zone, group, zone)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/metrics"
+	"sync"
+)
+
+const (
+	// ConnectAuto waits for the connect leaf certificate up to
+	// the timeout and serves the plain clusters if it does not
+	// arrive in time.
+	ConnectAuto = "auto"
+
+	// ConnectEnabled waits for the connect leaf certificate
+	// before anything is served to Envoy.
+	ConnectEnabled = "enabled"
+
+	// ConnectDisabled never asks consul for a certificate and
+	// only serves the clusters of the plain services.
+	ConnectDisabled = "disabled"
+)
+
+const (
+	ConnectStateWaiting     = "waiting"
+	ConnectStateReady       = "ready"
+	ConnectStateUnavailable = "unavailable"
+	ConnectStateDisabled    = "disabled"
+)
+
+// ReadinessState is what the readiness endpoint of the
+// debug server reports.
+type ReadinessState struct {
+	// Ready is true once a configuration has been
+	// served to Envoy.
+	Ready bool `json:"ready"`
+
+	// Connect is the state of the connect enabled clusters,
+	// they are only served when it is ready.
+	Connect string `json:"connect"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Readiness follows whether Flightpath serves a configuration
+// to Envoy and whether the connect enabled clusters are part of
+// it. Every change of the connect state is logged with its reason.
+type Readiness struct {
+	mx    sync.RWMutex
+	state ReadinessState
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{
+		state: ReadinessState{
+			Connect: ConnectStateWaiting,
+			Reason:  "waiting for the connect leaf certificate",
+		},
+	}
+}
+
+// SetReady marks the first configuration as served
+func (r *Readiness) SetReady() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if !r.state.Ready {
+		logger.Info("configuration is served to Envoy")
+	}
+
+	r.state.Ready = true
+	metrics.GaugeI("discovery.ready", 1, nil)
+}
+
+// SetConnect changes the state of the connect enabled clusters
+func (r *Readiness) SetConnect(state, reason string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.state.Connect == state && r.state.Reason == reason {
+		return
+	}
+
+	r.state.Connect = state
+	r.state.Reason = reason
+
+	available := 0
+	entry := logger.WithField("connect", state)
+	switch state {
+	case ConnectStateReady:
+		available = 1
+		entry.Info("connect enabled clusters are available")
+	case ConnectStateWaiting:
+		entry.WithField("reason", reason).Info("connect enabled clusters are not available yet")
+	default:
+		entry.WithField("reason", reason).Warn("connect enabled clusters are not available")
+	}
+
+	metrics.GaugeI("discovery.connect.available", available, nil)
+}
+
+func (r *Readiness) State() ReadinessState {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.state
+}
+
+// connectState derives the state of the connect enabled
+// clusters from the certificates received so far.
+func connectState(certs, roots bool) (string, string) {
+	switch {
+	case !certs:
+		return ConnectStateUnavailable, "connect leaf certificate is not available"
+	case !roots:
+		return ConnectStateWaiting, "waiting for the connect CA roots"
+	default:
+		return ConnectStateReady, ""
+	}
+}
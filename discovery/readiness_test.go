@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"github.com/Gufran/flightpath/catalog"
+	"testing"
+	"time"
+)
+
+func TestConnectState(t *testing.T) {
+	tests := []struct {
+		certs  bool
+		roots  bool
+		expect string
+	}{
+		{certs: false, roots: false, expect: ConnectStateUnavailable},
+		{certs: false, roots: true, expect: ConnectStateUnavailable},
+		{certs: true, roots: false, expect: ConnectStateWaiting},
+		{certs: true, roots: true, expect: ConnectStateReady},
+	}
+
+	for idx, test := range tests {
+		state, _ := connectState(test.certs, test.roots)
+		if state != test.expect {
+			t.Errorf("case %d: expected %s, got %s", idx, test.expect, state)
+		}
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	r := NewReadiness()
+
+	state := r.State()
+	if state.Ready || state.Connect != ConnectStateWaiting {
+		t.Errorf("expected a new readiness to wait, got %+v", state)
+	}
+
+	r.SetConnect(ConnectStateUnavailable, "no certificate")
+	r.SetReady()
+
+	state = r.State()
+	if !state.Ready {
+		t.Errorf("expected to be ready after the configuration is served")
+	}
+	if state.Connect != ConnectStateUnavailable || state.Reason != "no certificate" {
+		t.Errorf("expected connect to be unavailable, got %+v", state)
+	}
+}
+
+type testLeaf struct{}
+
+func (testLeaf) Serial() string      { return "1" }
+func (testLeaf) Cert() string        { return "cert" }
+func (testLeaf) PKey() string        { return "key" }
+func (testLeaf) ServiceName() string { return "flightpath" }
+
+func TestWaitForLeaf(t *testing.T) {
+	defer catalog.SetConnectOptional(false)
+	var leaf catalog.TLSInfo = testLeaf{}
+
+	tests := []struct {
+		mode   string
+		send   bool
+		expect bool
+		state  string
+	}{
+		{mode: ConnectAuto, send: true, expect: true, state: ConnectStateWaiting},
+		{mode: ConnectAuto, send: false, expect: false, state: ConnectStateUnavailable},
+		{mode: ConnectEnabled, send: true, expect: true, state: ConnectStateWaiting},
+		{mode: ConnectDisabled, send: true, expect: false, state: ConnectStateDisabled},
+	}
+
+	for idx, test := range tests {
+		certs := make(chan catalog.TLSInfo, 1)
+		if test.send {
+			certs <- leaf
+		}
+
+		readiness := NewReadiness()
+		config := &ConnectConfig{Mode: test.mode, LeafTimeout: 10 * time.Millisecond}
+
+		result := waitForLeaf(context.Background(), certs, config, readiness)
+		if (result != nil) != test.expect {
+			t.Errorf("case %d: expected certificate %t, got %v", idx, test.expect, result)
+		}
+
+		if state := readiness.State(); state.Connect != test.state {
+			t.Errorf("case %d: expected connect state %s, got %s", idx, test.state, state.Connect)
+		}
+	}
+}
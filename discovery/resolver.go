@@ -0,0 +1,249 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/Gufran/flightpath/metrics"
+	envoyapiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes"
+	"sort"
+)
+
+// subsetName is the name of the subset of a service, or of
+// a cluster, e.g. web:v2. The empty subset is the service.
+func subsetName(service, subset string) string {
+	if subset == "" {
+		return service
+	}
+	return service + catalog.SubsetSeparator + subset
+}
+
+// subsetClusters builds a cluster for every subset of the
+// service-resolvers out of each cluster of the service. The
+// subset clusters do not publish routes of their own, they
+// receive the traffic of the routes that resolve to the subset.
+func subsetClusters(clusters []catalog.ClusterInfo, entries *catalog.ConfigEntries) []catalog.ClusterInfo {
+	var result []catalog.ClusterInfo
+	for _, c := range clusters {
+		resolver := entries.Resolver(c.Service())
+		if resolver == nil {
+			continue
+		}
+
+		var names []string
+		for name := range resolver.Subsets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			result = append(result, c.Subset(name, resolver.Subsets[name]))
+		}
+	}
+	return result
+}
+
+// redirectDatacenters lists the datacenters that the
+// service-resolvers redirect the traffic of a service to.
+func redirectDatacenters(entries *catalog.ConfigEntries) map[string][]string {
+	result := map[string][]string{}
+	if entries == nil {
+		return result
+	}
+
+	for _, resolver := range entries.Resolvers {
+		if r := resolver.Redirect; r != nil && r.Datacenter != "" {
+			result[r.Service] = append(result[r.Service], r.Datacenter)
+		}
+	}
+	return result
+}
+
+// mergeDatacenters adds the datacenters to the pinned
+// datacenters of the services.
+func mergeDatacenters(pinned, extra map[string][]string) {
+	for service, dcs := range extra {
+		seen := map[string]bool{}
+		for _, dc := range pinned[service] {
+			seen[dc] = true
+		}
+
+		for _, dc := range dcs {
+			if !seen[dc] {
+				seen[dc] = true
+				pinned[service] = append(pinned[service], dc)
+			}
+		}
+		sort.Strings(pinned[service])
+	}
+}
+
+// datacenterServiceClusters collects the datacenter clusters of
+// every service like serviceClusters, keyed by the service and the
+// datacenter, e.g. web@dc2.
+func datacenterServiceClusters(clusters []catalog.ClusterInfo, pinned map[string][]string) map[string][]weightedCluster {
+	members := map[string][]catalog.ClusterInfo{}
+	datacenters := map[string]string{}
+	for _, c := range clusters {
+		for _, dc := range pinned[c.Service()] {
+			key := datacenterClusterName(subsetName(c.Service(), c.SubsetName()), dc)
+			members[key] = append(members[key], c)
+			datacenters[key] = dc
+		}
+	}
+
+	result := map[string][]weightedCluster{}
+	for key, group := range members {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Name() < group[j].Name()
+		})
+
+		dc := datacenters[key]
+		names := make([]string, len(group))
+		endpoints := make([][]catalog.Endpoint, len(group))
+		for idx, c := range group {
+			names[idx] = datacenterClusterName(c.Name(), dc)
+			endpoints[idx] = datacenterEndpoints(c.Endpoints(), dc)
+		}
+
+		result[key] = weighClusters(names, endpoints)
+	}
+	return result
+}
+
+// resolve returns the name of the clusters that receive the
+// traffic of the service subset, following the redirect and
+// the default subset of the service-resolver.
+func (v *vhostPool) resolve(service, subset string, seen map[string]bool) string {
+	resolver := v.entries.Resolver(service)
+	if resolver == nil {
+		return subsetName(service, subset)
+	}
+
+	if r := resolver.Redirect; r != nil && !seen[service] {
+		seen[service] = true
+		if r.Datacenter != "" {
+			// The resolver of the remote datacenter is not
+			// known here, the traffic goes to its instances.
+			return datacenterClusterName(subsetName(r.Service, r.Subset), r.Datacenter)
+		}
+		return v.resolve(r.Service, r.Subset, seen)
+	}
+
+	if subset == "" {
+		subset = resolver.DefaultSubset
+	}
+	return subsetName(service, subset)
+}
+
+// redirects reports whether the service-resolver of the service
+// sends its traffic anywhere but the clusters of the service.
+func (v *vhostPool) redirects(service string) bool {
+	resolver := v.entries.Resolver(service)
+	return resolver != nil && (resolver.Redirect != nil || resolver.DefaultSubset != "")
+}
+
+// failover adds the endpoints of the failover targets of the
+// service-resolver to the endpoints of the cluster with a lower
+// priority. Envoy sends the traffic to them when the instances
+// of the cluster are not healthy. Failover datacenters replace
+// the remote datacenters of the cluster in the listed order.
+// The targets must be in the catalog of flightpath and have the
+// same connect mode as the cluster, their identities are returned
+// along with the endpoints to be verified by the transport socket.
+func failover(c catalog.ClusterInfo, entries *catalog.ConfigEntries, services map[string][]catalog.ClusterInfo, trustDomain string) ([]catalog.Endpoint, []string) {
+	endpoints := c.Endpoints()
+
+	resolver := entries.Resolver(c.Service())
+	if resolver == nil {
+		return endpoints, nil
+	}
+
+	f, ok := resolver.Failover[c.SubsetName()]
+	if !ok {
+		f, ok = resolver.Failover["*"]
+	}
+	if !ok {
+		return endpoints, nil
+	}
+
+	var targets []catalog.ClusterInfo
+	for _, t := range services[subsetName(f.Service, f.Subset)] {
+		if t.IsConnectEnabled() == c.IsConnectEnabled() {
+			targets = append(targets, t)
+		}
+	}
+
+	if len(targets) == 0 {
+		metrics.Incr("discovery.config_entry.failover_unavailable", []string{"cluster:" + c.Name()})
+		logger.WithField("cluster", c.Name()).
+			WithField("failover", subsetName(f.Service, f.Subset)).
+			Debug("failover target of service-resolver is not available in catalog")
+		return endpoints, nil
+	}
+
+	var result []catalog.Endpoint
+	var sans []string
+
+	if len(f.Datacenters) > 0 {
+		for idx := range endpoints {
+			if endpoints[idx].DatacenterPriority() == 0 {
+				result = append(result, endpoints[idx])
+			}
+		}
+
+		for priority, dc := range f.Datacenters {
+			for _, t := range targets {
+				for _, e := range datacenterEndpoints(t.Endpoints(), dc) {
+					result = append(result, e.WithDatacenterPriority(priority+1))
+				}
+			}
+		}
+	} else {
+		var base int
+		for idx := range endpoints {
+			if p := endpoints[idx].DatacenterPriority(); p > base {
+				base = p
+			}
+		}
+
+		result = append(result, endpoints...)
+		for _, t := range targets {
+			for _, e := range t.Endpoints() {
+				result = append(result, e.WithDatacenterPriority(base+1+e.DatacenterPriority()))
+			}
+		}
+	}
+
+	if c.IsConnectEnabled() {
+		for _, t := range targets {
+			sans = append(sans, t.SpiffeIDs(trustDomain)...)
+		}
+	}
+
+	return result, sans
+}
+
+// applyResolver sets the connect timeout of the service-resolver
+// on the cluster.
+func applyResolver(cluster *envoyapiv2.Cluster, resolver *catalog.ServiceResolver) {
+	if resolver == nil || resolver.ConnectTimeout <= 0 {
+		return
+	}
+	cluster.ConnectTimeout = ptypes.DurationProto(resolver.ConnectTimeout)
+}
+
+// mergeIdentities appends the identities that are not in the list
+func mergeIdentities(sans []string, extra []string) []string {
+	seen := map[string]bool{}
+	for _, san := range sans {
+		seen[san] = true
+	}
+
+	for _, san := range extra {
+		if !seen[san] {
+			seen[san] = true
+			sans = append(sans, san)
+		}
+	}
+	return sans
+}
@@ -0,0 +1,118 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestVhostPool_Resolve(t *testing.T) {
+	entries := catalog.NewConfigEntries()
+	entries.Resolvers["web"] = &catalog.ServiceResolver{
+		Service:       "web",
+		DefaultSubset: "v1",
+		Subsets:       map[string]catalog.ResolverSubset{"v1": {}, "v2": {}},
+	}
+	entries.Resolvers["legacy"] = &catalog.ServiceResolver{
+		Service:  "legacy",
+		Redirect: &catalog.ResolverTarget{Service: "web", Subset: "v2"},
+	}
+	entries.Resolvers["remote"] = &catalog.ServiceResolver{
+		Service:  "remote",
+		Redirect: &catalog.ResolverTarget{Service: "remote", Datacenter: "dc2"},
+	}
+	entries.Resolvers["loop-a"] = &catalog.ServiceResolver{
+		Service:  "loop-a",
+		Redirect: &catalog.ResolverTarget{Service: "loop-b"},
+	}
+	entries.Resolvers["loop-b"] = &catalog.ServiceResolver{
+		Service:  "loop-b",
+		Redirect: &catalog.ResolverTarget{Service: "loop-a"},
+	}
+
+	tests := []struct {
+		service string
+		subset  string
+		expect  string
+	}{
+		{service: "web", expect: "web:v1"},
+		{service: "web", subset: "v2", expect: "web:v2"},
+		{service: "legacy", expect: "web:v2"},
+		{service: "remote", expect: "remote@dc2"},
+		{service: "api", expect: "api"},
+		{service: "api", subset: "v2", expect: "api:v2"},
+		{service: "loop-a", expect: "loop-a"},
+	}
+
+	pool := newVhostPool(nil)
+	pool.entries = entries
+
+	for idx, test := range tests {
+		result := pool.resolve(test.service, test.subset, map[string]bool{})
+		if result != test.expect {
+			t.Errorf("case %d: expected %s, got %s", idx, test.expect, result)
+		}
+	}
+}
+
+func TestVhostPool_RouteServiceResolver(t *testing.T) {
+	entries := catalog.NewConfigEntries()
+	entries.Resolvers["web"] = &catalog.ServiceResolver{
+		Service:       "web",
+		DefaultSubset: "v1",
+		Subsets:       map[string]catalog.ResolverSubset{"v1": {}, "v2": {}},
+	}
+	entries.Splitters["web"] = &catalog.ServiceSplitter{
+		Service: "web",
+		Splits: []catalog.Split{
+			{Weight: 80, Service: "web"},
+			{Weight: 20, Service: "web", Subset: "v2"},
+		},
+	}
+	entries.Routers["web"] = &catalog.ServiceRouter{
+		Service: "web",
+		Routes: []catalog.RouterRoute{
+			{PathPrefix: "/beta/", Service: "web", Subset: "v2"},
+		},
+	}
+
+	pool := newVhostPool(nil)
+	pool.entries = entries
+	pool.services = map[string][]weightedCluster{
+		"web":    {{name: "web", weight: 1}},
+		"web:v1": {{name: "web:v1", weight: 3}, {name: "web-sidecar-proxy:v1", weight: 1}},
+		"web:v2": {{name: "web:v2", weight: 1}},
+	}
+
+	pool.route("example.com", routeEntry{name: "web.1-0", clusterName: "web", service: "web", path: "/"})
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+
+	if routes[0].GetMatch().GetPrefix() != "/beta/" || routes[0].GetRoute().GetCluster() != "web:v2" {
+		t.Errorf("expected /beta/ to be routed to the subset v2, got %v", routes[0])
+	}
+
+	var result []string
+	for _, c := range routes[1].GetRoute().GetWeightedClusters().GetClusters() {
+		result = append(result, fmt.Sprintf("%s=%d", c.Name, c.Weight.GetValue()))
+	}
+
+	expect := []string{"web-sidecar-proxy:v1=2000", "web:v1=6000", "web:v2=2000"}
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected weighted clusters. %s", cmp.Diff(result, expect))
+	}
+}
+
+func TestMergeDatacenters(t *testing.T) {
+	pinned := map[string][]string{"web": {"dc3"}}
+	mergeDatacenters(pinned, map[string][]string{"web": {"dc2", "dc3"}, "api": {"dc2"}})
+
+	expect := map[string][]string{"web": {"dc2", "dc3"}, "api": {"dc2"}}
+	if !cmp.Equal(pinned, expect) {
+		t.Errorf("unexpected datacenters. %s", cmp.Diff(pinned, expect))
+	}
+}
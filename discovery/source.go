@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// routeSourceMeta marks the routes declared in the
+	// flightpath-route-* meta keys of the services.
+	routeSourceMeta = "meta"
+
+	// routeSourceKV marks the routes read from consul KV
+	routeSourceKV = "kv"
+
+	// routeSourceRouter marks the routes of a service-router
+	routeSourceRouter = "service-router"
+
+	// routeSourceIngress marks the routes of an ingress-gateway,
+	// the source is followed by the name of the gateway.
+	routeSourceIngress = "ingress-gateway:"
+)
+
+// RouteSource tells where a route served to Envoy came from.
+// Routes of different sources that are identical are served
+// once, their sources are listed together.
+type RouteSource struct {
+	Group      string `json:"group"`
+	Listener   string `json:"listener"`
+	Domain     string `json:"domain"`
+	Route      string `json:"route"`
+	Path       string `json:"path"`
+	Match      string `json:"match"`
+	Conditions string `json:"conditions,omitempty"`
+	Cluster    string `json:"cluster"`
+	Source     string `json:"source"`
+}
+
+// RouteSources holds the sources of the routes in the
+// most recent snapshot of every group.
+type RouteSources struct {
+	mx     sync.RWMutex
+	groups map[string][]RouteSource
+}
+
+func NewRouteSources() *RouteSources {
+	return &RouteSources{
+		groups: map[string][]RouteSource{},
+	}
+}
+
+func (r *RouteSources) Set(group string, items []RouteSource) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	for idx := range items {
+		items[idx].Group = group
+	}
+	r.groups[group] = items
+}
+
+// Get returns the sources of all groups ordered by group
+func (r *RouteSources) Get() []RouteSource {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	var names []string
+	for name := range r.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []RouteSource
+	for _, name := range names {
+		result = append(result, r.groups[name]...)
+	}
+	return result
+}
+
+// sources lists the routes of the pool as they are
+// served on the route configuration of the listener.
+func (v *vhostPool) sources(listener string) []RouteSource {
+	var domains []string
+	for domain := range v.domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var result []RouteSource
+	for _, domain := range domains {
+		for _, entry := range sortRouteEntries(v.domains[domain]) {
+			cluster := entry.clusterName
+			if entry.destination != "" {
+				cluster = entry.destination
+			}
+
+			result = append(result, RouteSource{
+				Listener:   listener,
+				Domain:     domain,
+				Route:      entry.name,
+				Path:       entry.path,
+				Match:      matchType(entry.exact, entry.regex),
+				Conditions: entry.match.String(),
+				Cluster:    cluster,
+				Source:     entry.source,
+			})
+		}
+	}
+	return result
+}
+
+// matchType names the way a route matches the path
+func matchType(exact, regex bool) string {
+	switch {
+	case exact:
+		return catalog.RouteMatchExact
+	case regex:
+		return routeMatchRegex
+	}
+	return catalog.RouteMatchPrefix
+}
+
+// mergeSources lists the sources of identical routes
+func mergeSources(a, b string) string {
+	seen := map[string]bool{}
+	var result []string
+	for _, source := range strings.Split(a+","+b, ",") {
+		if source != "" && !seen[source] {
+			seen[source] = true
+			result = append(result, source)
+		}
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
@@ -0,0 +1,167 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/Gufran/flightpath/metrics"
+	"sort"
+)
+
+// metaSubsetClusters builds a cluster for every value of the subset
+// meta key out of each cluster, e.g. web:v1 and web:v2 for the key
+// version. Like the subsets of a service-resolver they only receive
+// the traffic of the routes that are pinned to them or that send a
+// share of their traffic to them. A subset of the service-resolver
+// with the same name takes precedence.
+func metaSubsetClusters(clusters []catalog.ClusterInfo, key string, entries *catalog.ConfigEntries) []catalog.ClusterInfo {
+	if key == "" {
+		return nil
+	}
+
+	var result []catalog.ClusterInfo
+	for _, c := range clusters {
+		resolver := entries.Resolver(c.Service())
+		for _, subset := range c.MetaSubsets(key) {
+			if resolver != nil {
+				if _, ok := resolver.Subsets[subset.SubsetName()]; ok {
+					continue
+				}
+			}
+			result = append(result, subset)
+		}
+	}
+	return result
+}
+
+// canaryClusters builds the cluster that leaves out the instances
+// of the canary subset for every canary of the meta routes, e.g.
+// web:!v2 next to web:v2. The share of the traffic that does not
+// go to the canary is sent to it, so that the canary instances
+// only receive their own share. Every cluster of the service gets
+// one, even the clusters without instances in the subset, so that
+// the share is split between them like the traffic of the service.
+// A canary without a subset cluster is not split off at all.
+func canaryClusters(clusters, subsets []catalog.ClusterInfo) []catalog.ClusterInfo {
+	byName := map[string]catalog.ClusterInfo{}
+	available := map[string]bool{}
+	for _, s := range subsets {
+		byName[s.Name()] = s
+		available[subsetName(s.Service(), s.SubsetName())] = true
+	}
+
+	canaries := map[string]map[string]bool{}
+	for _, c := range clusters {
+		for _, e := range c.Endpoints() {
+			for _, routes := range e.RoutingInfo() {
+				for _, r := range routes {
+					if r.Canary == nil || !available[subsetName(c.Service(), r.Canary.Subset)] {
+						continue
+					}
+
+					if canaries[c.Service()] == nil {
+						canaries[c.Service()] = map[string]bool{}
+					}
+					canaries[c.Service()][r.Canary.Subset] = true
+				}
+			}
+		}
+	}
+
+	var result []catalog.ClusterInfo
+	for _, c := range clusters {
+		var names []string
+		for name := range canaries[c.Service()] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			result = append(result, c.Excluding(name, byName[subsetName(c.Name(), name)]))
+		}
+	}
+	return result
+}
+
+// canaryEntry pins the requests with the header of the canary
+// to its subset. The route is inserted ahead of the route that
+// splits the rest of the traffic.
+func (v *vhostPool) canaryEntry(entry routeEntry) (routeEntry, bool) {
+	c := entry.canary
+	if c == nil || c.Header == nil || !v.hasSubset(entry.service, c.Subset) {
+		return entry, false
+	}
+
+	pinned := entry
+	pinned.name += ".canary"
+	pinned.subset = c.Subset
+	pinned.canary = nil
+	pinned.match.Headers = append(append([]catalog.HeaderMatch{}, entry.match.Headers...), *c.Header)
+	return pinned, true
+}
+
+// canarySplit returns the percentage of the traffic to the service
+// that the canary of the route receives, and the clusters that the
+// rest of the traffic goes to instead of the clusters of the service.
+// The canary only takes its share of the traffic that goes to the
+// service itself, and none while its subset has no instances. The
+// rest only leaves out the canary instances while there are others.
+func (v *vhostPool) canarySplit(entry routeEntry, service, subset string) (uint32, string) {
+	c := entry.canary
+	if c == nil || service != entry.service || subset != "" {
+		return 0, ""
+	}
+
+	if !v.hasSubset(service, c.Subset) {
+		return 0, ""
+	}
+
+	rest := subsetName(service, catalog.SubsetExclusion+c.Subset)
+	var weight uint32
+	for _, m := range v.services[rest] {
+		weight += m.weight
+	}
+
+	if weight == 0 {
+		return c.Weight, ""
+	}
+	return c.Weight, rest
+}
+
+// excludeCanary moves the share of the targets that goes to the
+// clusters of the service over to the clusters of the rest, see
+// canaryClusters.
+func (v *vhostPool) excludeCanary(targets []weightedCluster, service, rest string) []weightedCluster {
+	clusters := map[string]bool{}
+	for _, m := range v.services[service] {
+		clusters[m.name] = true
+	}
+
+	var result []weightedCluster
+	var share uint32
+	for _, t := range targets {
+		if clusters[t.name] {
+			share += t.weight
+			continue
+		}
+		result = append(result, t)
+	}
+
+	if share == 0 {
+		return targets
+	}
+	return append(result, v.clusters(rest, share)...)
+}
+
+// hasSubset reports whether the subset of the service has a
+// cluster. A canary without instances is left out of the route
+// instead of failing its share of the requests.
+func (v *vhostPool) hasSubset(service, subset string) bool {
+	if len(v.services[v.resolve(service, subset, map[string]bool{})]) > 0 {
+		return true
+	}
+
+	metrics.Incr("discovery.route.canary_unavailable", []string{"service:" + service, "subset:" + subset})
+	logger.WithField("service", service).
+		WithField("subset", subset).
+		Debug("canary subset is not available in catalog. route is not split")
+	return false
+}
@@ -0,0 +1,183 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/google/go-cmp/cmp"
+	consul "github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestVhostPool_RouteCanary(t *testing.T) {
+	tests := []struct {
+		entry  routeEntry
+		expect []string
+	}{
+		{
+			entry: routeEntry{subset: "v2"},
+			expect: []string{
+				"/ -> web:v2",
+			},
+		},
+		{
+			entry: routeEntry{canary: &catalog.CanaryRoute{Subset: "v2", Weight: 10}},
+			expect: []string{
+				"/ -> web:!v2=9000,web:v2=1000",
+			},
+		},
+		{
+			entry: routeEntry{canary: &catalog.CanaryRoute{Subset: "v2", Weight: 100}},
+			expect: []string{
+				"/ -> web:v2",
+			},
+		},
+		{
+			entry: routeEntry{canary: &catalog.CanaryRoute{
+				Subset: "v2",
+				Weight: 25,
+				Header: &catalog.HeaderMatch{Name: "x-canary", Exact: "true"},
+			}},
+			expect: []string{
+				"/ header:x-canary=true -> web:v2",
+				"/ -> web:!v2=7500,web:v2=2500",
+			},
+		},
+		{
+			entry: routeEntry{canary: &catalog.CanaryRoute{
+				Subset: "v2",
+				Header: &catalog.HeaderMatch{Name: "x-canary", Exact: "true"},
+			}},
+			expect: []string{
+				"/ header:x-canary=true -> web:v2",
+				"/ -> web:!v2",
+			},
+		},
+		{
+			entry: routeEntry{canary: &catalog.CanaryRoute{
+				Subset: "v3",
+				Weight: 25,
+				Header: &catalog.HeaderMatch{Name: "x-canary", Present: true},
+			}},
+			expect: []string{
+				"/ -> web",
+			},
+		},
+	}
+
+	for idx, test := range tests {
+		pool := newVhostPool(nil)
+		pool.services = map[string][]weightedCluster{
+			"web":     {{name: "web", weight: 3}},
+			"web:v2":  {{name: "web:v2", weight: 1}},
+			"web:!v2": {{name: "web:!v2", weight: 2}},
+		}
+
+		entry := test.entry
+		entry.name = "web.1-0"
+		entry.clusterName = "web"
+		entry.service = "web"
+		entry.path = "/"
+		pool.route("example.com", entry)
+
+		var result []string
+		for _, r := range pool.collect(9292)[0].Routes {
+			result = append(result, describeRoute(r))
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestVhostPool_CanaryShare(t *testing.T) {
+	canary := func(addr, version, attempts string, index uint64) *consul.CatalogService {
+		s := instance(addr, "", "dc1", 1)
+		s.CreateIndex = index
+		s.ServiceMeta = map[string]string{
+			"version":                   version,
+			"flightpath-retry-attempts": attempts,
+			"flightpath-route":          "example.com/;canary=v2;canary-weight=10",
+		}
+		return s
+	}
+
+	// One of four instances is the canary, and the newest.
+	web := catalog.NewCluster("", "web", []*consul.CatalogService{
+		canary("10.0.0.1", "v1", "3", 1),
+		canary("10.0.0.2", "v1", "3", 2),
+		canary("10.0.0.3", "v1", "3", 3),
+		canary("10.0.0.4", "v2", "7", 4),
+	}, map[string]int{})
+
+	published := []catalog.ClusterInfo{web}
+	subsets := metaSubsetClusters(published, "version", nil)
+	subsets = append(subsets, canaryClusters(published, subsets)...)
+	all := append(append([]catalog.ClusterInfo{}, published...), subsets...)
+
+	pool := newVhostPool(nil)
+	pool.services = serviceClusters(all)
+	instances := map[string][]string{}
+	for _, c := range all {
+		for _, e := range c.Endpoints() {
+			instances[c.Name()] = append(instances[c.Name()], e.Name())
+		}
+
+		if c.SubsetName() == catalog.SubsetExclusion+"v2" {
+			pool.canaries[c.Name()] = c
+		}
+	}
+	pool.add(web, nil)
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 1 {
+		t.Fatalf("expected one route, got %d", len(routes))
+	}
+
+	// Every instance of a cluster receives the same share of the
+	// traffic that the cluster receives.
+	share := map[string]float64{}
+	var total float64
+	for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+		total += float64(c.Weight.GetValue())
+	}
+
+	for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+		for _, id := range instances[c.Name] {
+			share[id] += float64(c.Weight.GetValue()) / total / float64(len(instances[c.Name])) * 100
+		}
+	}
+
+	expect := map[string]float64{
+		"10.0.0.1": 30,
+		"10.0.0.2": 30,
+		"10.0.0.3": 30,
+		"10.0.0.4": 10,
+	}
+
+	if !cmp.Equal(share, expect) {
+		t.Errorf("unexpected traffic share. %s", cmp.Diff(share, expect))
+	}
+
+	if attempts := pool.domains["example.com"][0].settings.RetryAttempts; attempts != 3 {
+		t.Errorf("expected the settings of the instances outside of the canary, got %d retry attempts", attempts)
+	}
+}
+
+func describeRoute(r *route.Route) string {
+	path := r.GetMatch().GetPrefix()
+	for _, h := range r.GetMatch().GetHeaders() {
+		path += fmt.Sprintf(" header:%s=%s", h.Name, h.GetExactMatch())
+	}
+
+	target := r.GetRoute().GetCluster()
+	for idx, c := range r.GetRoute().GetWeightedClusters().GetClusters() {
+		if idx > 0 {
+			target += ","
+		}
+		target += fmt.Sprintf("%s=%d", c.Name, c.Weight.GetValue())
+	}
+
+	return path + " -> " + target
+}
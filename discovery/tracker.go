@@ -0,0 +1,446 @@
+package discovery
+
+import (
+	"context"
+	"github.com/Gufran/flightpath/metrics"
+	envoyapiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	dss "github.com/envoyproxy/go-control-plane/pkg/server"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxTrackedVersions is the number of most recent snapshots
+// kept for every snapshot key so that the ACKs can be matched
+// with the snapshot that was sent.
+const maxTrackedVersions = 8
+
+var resourceTypes = []string{
+	cache.EndpointType,
+	cache.ClusterType,
+	cache.RouteType,
+	cache.ListenerType,
+	cache.SecretType,
+}
+
+// TypeState is what Flightpath knows about a resource type
+// delivered to the Envoy nodes behind a snapshot key.
+type TypeState struct {
+	AckedVersion    string    `json:"acked_version"`
+	ServedVersion   string    `json:"served_version"`
+	RejectedVersion string    `json:"rejected_version,omitempty"`
+	ErrorDetail     string    `json:"error_detail,omitempty"`
+	LastAck         time.Time `json:"last_ack,omitempty"`
+	LastNack        time.Time `json:"last_nack,omitempty"`
+	Rejections      int       `json:"rejections"`
+}
+
+// NodeState groups the state of every resource type for
+// a snapshot key along with the connected Envoy node IDs.
+type NodeState struct {
+	Nodes []string              `json:"nodes"`
+	Types map[string]*TypeState `json:"types"`
+
+	desired *cache.Snapshot
+	streams map[int64]string
+
+	// acked is the version of every type that each stream
+	// runs. good is the last snapshot that every stream
+	// accepted, and sent are the most recently served ones.
+	acked map[int64]map[string]string
+	good  *cache.Snapshot
+	sent  []cache.Snapshot
+}
+
+var _ dss.Callbacks = &SnapshotTracker{}
+
+// SnapshotTracker sits between the synchronization loop and
+// the snapshot cache. It follows the ACK and NACK responses
+// from Envoy and when a resource type is rejected it keeps
+// serving the last snapshot that the node accepted, until a
+// new version of the rejected type is available. All types are
+// rolled back together so that the node never mixes resources
+// of two snapshots, e.g. routes that refer to new clusters.
+//
+// The nodes of a group share one snapshot key, so a node that
+// rejects a version rolls back every node of its group.
+type SnapshotTracker struct {
+	mx      sync.Mutex
+	cache   cache.SnapshotCache
+	hash    cache.NodeHash
+	streams map[int64]string
+	nonces  map[int64]*streamNonces
+	nodes   map[string]*NodeState
+	joined  chan struct{}
+}
+
+func NewSnapshotTracker(c cache.SnapshotCache, hash cache.NodeHash) *SnapshotTracker {
+	return &SnapshotTracker{
+		cache:   c,
+		hash:    hash,
+		streams: map[int64]string{},
+		nonces:  map[int64]*streamNonces{},
+		nodes:   map[string]*NodeState{},
+		joined:  make(chan struct{}, 1),
+	}
+}
+
+// Joined is notified when a node connects with a snapshot
+// key that does not have any other connected node.
+func (t *SnapshotTracker) Joined() <-chan struct{} {
+	return t.joined
+}
+
+// Keys returns the snapshot keys of all connected nodes
+func (t *SnapshotTracker) Keys() []string {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	var keys []string
+	for key, state := range t.nodes {
+		if len(state.streams) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (t *SnapshotTracker) node(key string) *NodeState {
+	state, ok := t.nodes[key]
+	if !ok {
+		state = &NodeState{
+			Types:   map[string]*TypeState{},
+			streams: map[int64]string{},
+			acked:   map[int64]map[string]string{},
+		}
+		for _, typ := range resourceTypes {
+			state.Types[typ] = &TypeState{}
+		}
+		t.nodes[key] = state
+	}
+	return state
+}
+
+// SetSnapshot records the desired snapshot for the key and
+// hands it over to the cache. When a resource type of the
+// snapshot was rejected in this exact version, the snapshot
+// that was last accepted is served instead.
+func (t *SnapshotTracker) SetSnapshot(key string, snap cache.Snapshot) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	state := t.node(key)
+	state.desired = &snap
+	return t.apply(key, state)
+}
+
+func (t *SnapshotTracker) apply(key string, state *NodeState) error {
+	if state.desired == nil {
+		return nil
+	}
+
+	effective := *state.desired
+	if rejected := state.rejected(&effective); len(rejected) > 0 && state.good != nil {
+		for _, typ := range rejected {
+			ts := state.Types[typ]
+			metrics.Incr("discovery.xds.rollback", []string{"node:" + key, "type:" + typ})
+			logger.WithField("node", key).
+				WithField("type", typ).
+				WithField("rejected_version", ts.RejectedVersion).
+				WithField("version", snapshotResources(state.good, typ).Version).
+				Warn("serving last accepted version instead of the rejected version")
+		}
+		effective = *state.good
+	}
+
+	for _, typ := range resourceTypes {
+		state.Types[typ].ServedVersion = snapshotResources(&effective, typ).Version
+	}
+	state.remember(effective)
+
+	return t.cache.SetSnapshot(key, effective)
+}
+
+// rejected returns the resource types of the snapshot
+// whose version was rejected by the nodes.
+func (s *NodeState) rejected(snap *cache.Snapshot) []string {
+	var types []string
+	for _, typ := range resourceTypes {
+		ts := s.Types[typ]
+		if ts.RejectedVersion != "" && ts.RejectedVersion == snapshotResources(snap, typ).Version {
+			types = append(types, typ)
+		}
+	}
+	return types
+}
+
+// remember keeps the recently served snapshots so that
+// the snapshot can be looked up when it is acknowledged.
+func (s *NodeState) remember(snap cache.Snapshot) {
+	if n := len(s.sent); n > 0 && sameVersions(&s.sent[n-1], &snap) {
+		return
+	}
+
+	s.sent = append(s.sent, snap)
+	if len(s.sent) > maxTrackedVersions {
+		s.sent = s.sent[len(s.sent)-maxTrackedVersions:]
+	}
+}
+
+// accept records the most recently served snapshot that every
+// stream runs for all the types it requested. The last accepted
+// snapshot is kept while the streams run different snapshots.
+func (s *NodeState) accept() {
+	if len(s.acked) == 0 {
+		return
+	}
+
+	for idx := len(s.sent) - 1; idx >= 0; idx-- {
+		snap := s.sent[idx]
+		if s.acknowledged(&snap) {
+			s.good = &snap
+			return
+		}
+	}
+}
+
+func (s *NodeState) acknowledged(snap *cache.Snapshot) bool {
+	for _, versions := range s.acked {
+		for typ, version := range versions {
+			if version != snapshotResources(snap, typ).Version {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sameVersions(a, b *cache.Snapshot) bool {
+	for _, typ := range resourceTypes {
+		if snapshotResources(a, typ).Version != snapshotResources(b, typ).Version {
+			return false
+		}
+	}
+	return true
+}
+
+func snapshotResources(snap *cache.Snapshot, typ string) *cache.Resources {
+	switch typ {
+	case cache.EndpointType:
+		return &snap.Endpoints
+	case cache.ClusterType:
+		return &snap.Clusters
+	case cache.RouteType:
+		return &snap.Routes
+	case cache.ListenerType:
+		return &snap.Listeners
+	case cache.SecretType:
+		return &snap.Secrets
+	}
+	return nil
+}
+
+func (t *SnapshotTracker) OnStreamOpen(context.Context, int64, string) error {
+	return nil
+}
+
+func (t *SnapshotTracker) OnStreamClosed(id int64) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if key, ok := t.streams[id]; ok {
+		if state, ok := t.nodes[key]; ok {
+			delete(state.streams, id)
+			delete(state.acked, id)
+			state.Nodes = nodeIDs(state.streams)
+			state.accept()
+		}
+	}
+
+	delete(t.streams, id)
+	delete(t.nonces, id)
+}
+
+func (t *SnapshotTracker) OnStreamRequest(id int64, req *envoyapiv2.DiscoveryRequest) error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if req.Node == nil {
+		return nil
+	}
+
+	key := t.hash.ID(req.Node)
+	state := t.node(key)
+	if _, ok := t.streams[id]; !ok {
+		if len(state.streams) == 0 {
+			select {
+			case t.joined <- struct{}{}:
+			default:
+			}
+		}
+
+		t.streams[id] = key
+		state.streams[id] = req.Node.Id
+		state.Nodes = nodeIDs(state.streams)
+	}
+
+	// The first request on a stream does not respond to anything
+	if req.ResponseNonce == "" {
+		return nil
+	}
+
+	ts, ok := state.Types[req.TypeUrl]
+	if !ok {
+		return nil
+	}
+
+	tags := []string{"node:" + key, "type:" + req.TypeUrl}
+
+	// The version in a NACK is the version that the
+	// node keeps running, the last one it accepted.
+	if state.acked[id] == nil {
+		state.acked[id] = map[string]string{}
+	}
+	state.acked[id][req.TypeUrl] = req.VersionInfo
+
+	if req.ErrorDetail == nil {
+		metrics.Incr("discovery.xds.ack", tags)
+		ts.AckedVersion = req.VersionInfo
+		ts.LastAck = time.Now()
+		state.accept()
+		return nil
+	}
+
+	rejected := t.nonces[id].version(req.ResponseNonce)
+	if rejected == "" {
+		// Without the nonce we cannot tell which version
+		// was rejected, the served version is the best guess.
+		rejected = ts.ServedVersion
+	}
+
+	ts.RejectedVersion = rejected
+	ts.ErrorDetail = req.ErrorDetail.GetMessage()
+	ts.LastNack = time.Now()
+	ts.Rejections++
+
+	metrics.Incr("discovery.xds.nack", tags)
+	logger.WithField("node", key).
+		WithField("node_id", req.Node.Id).
+		WithField("type", req.TypeUrl).
+		WithField("rejected_version", rejected).
+		WithField("accepted_version", req.VersionInfo).
+		WithField("error_detail", ts.ErrorDetail).
+		Error("envoy rejected the configuration")
+
+	if state.good == nil {
+		logger.WithField("node", key).
+			WithField("type", req.TypeUrl).
+			Error("there is no accepted version to fall back to")
+		return nil
+	}
+
+	// Setting the snapshot notifies the open watches which
+	// can block while the server is busy with this callback,
+	// so the rollback is applied in the background.
+	go t.rollback(key)
+	return nil
+}
+
+func (t *SnapshotTracker) rollback(key string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	state, ok := t.nodes[key]
+	if !ok {
+		return
+	}
+
+	err := t.apply(key, state)
+	if err != nil {
+		metrics.Incr("discovery.xds.error.rollback", []string{"node:" + key})
+		logger.WithError(err).WithField("node", key).Error("failed to roll back to the last accepted configuration")
+	}
+}
+
+func (t *SnapshotTracker) OnStreamResponse(id int64, _ *envoyapiv2.DiscoveryRequest, resp *envoyapiv2.DiscoveryResponse) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	nonces, ok := t.nonces[id]
+	if !ok {
+		nonces = &streamNonces{
+			versions: map[string]string{},
+		}
+		t.nonces[id] = nonces
+	}
+
+	nonces.add(resp.Nonce, resp.VersionInfo)
+}
+
+// streamNonces maps the nonces of the most recent responses
+// on a stream to the version that was sent with them.
+type streamNonces struct {
+	versions map[string]string
+	order    []string
+}
+
+func (n *streamNonces) add(nonce, version string) {
+	n.versions[nonce] = version
+	n.order = append(n.order, nonce)
+
+	for len(n.order) > len(resourceTypes)*maxTrackedVersions {
+		delete(n.versions, n.order[0])
+		n.order = n.order[1:]
+	}
+}
+
+func (n *streamNonces) version(nonce string) string {
+	if n == nil {
+		return ""
+	}
+	return n.versions[nonce]
+}
+
+func (t *SnapshotTracker) OnFetchRequest(context.Context, *envoyapiv2.DiscoveryRequest) error {
+	return nil
+}
+
+func (t *SnapshotTracker) OnFetchResponse(*envoyapiv2.DiscoveryRequest, *envoyapiv2.DiscoveryResponse) {
+}
+
+// States returns a copy of the state of every snapshot key
+func (t *SnapshotTracker) States() map[string]NodeState {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	result := make(map[string]NodeState, len(t.nodes))
+	for key, state := range t.nodes {
+		types := make(map[string]*TypeState, len(state.Types))
+		for typ, ts := range state.Types {
+			c := *ts
+			types[typ] = &c
+		}
+
+		result[key] = NodeState{
+			Nodes: append([]string{}, state.Nodes...),
+			Types: types,
+		}
+	}
+
+	return result
+}
+
+func nodeIDs(streams map[int64]string) []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, id := range streams {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
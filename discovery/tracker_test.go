@@ -0,0 +1,250 @@
+package discovery
+
+import (
+	envoyapiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"testing"
+	"time"
+)
+
+func TestSnapshotTracker_Rollback(t *testing.T) {
+	snc := cache.NewSnapshotCache(false, cache.IDHash{}, nil)
+	tracker := NewSnapshotTracker(snc, cache.IDHash{})
+	node := &core.Node{Id: "test-node"}
+
+	snapshot := func(limit uint32) cache.Snapshot {
+		snap, err := newVersionedSnapshot(nil, []cache.Resource{
+			&envoyapiv2.Cluster{
+				Name:                     "web",
+				MaxRequestsPerConnection: &wrappers.UInt32Value{Value: limit},
+			},
+		}, nil, nil, nil)
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+		return snap
+	}
+
+	request := func(version, nonce string, detail *status.Status) {
+		err := tracker.OnStreamRequest(1, &envoyapiv2.DiscoveryRequest{
+			Node:          node,
+			TypeUrl:       cache.ClusterType,
+			VersionInfo:   version,
+			ResponseNonce: nonce,
+			ErrorDetail:   detail,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+	}
+
+	respond := func(version, nonce string) {
+		tracker.OnStreamResponse(1, nil, &envoyapiv2.DiscoveryResponse{
+			TypeUrl:     cache.ClusterType,
+			VersionInfo: version,
+			Nonce:       nonce,
+		})
+	}
+
+	served := func() string {
+		snap, err := snc.GetSnapshot(node.Id)
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+		return snap.Clusters.Version
+	}
+
+	good := snapshot(1)
+	bad := snapshot(2)
+
+	request("", "", nil)
+	if err := tracker.SetSnapshot(node.Id, good); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+	respond(good.Clusters.Version, "1")
+	request(good.Clusters.Version, "1", nil)
+
+	if err := tracker.SetSnapshot(node.Id, bad); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+	respond(bad.Clusters.Version, "2")
+	request(good.Clusters.Version, "2", &status.Status{Message: "invalid cluster"})
+
+	deadline := time.Now().Add(time.Second)
+	for served() != good.Clusters.Version && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if served() != good.Clusters.Version {
+		t.Errorf("expected the accepted version %q to be served, got %q", good.Clusters.Version, served())
+	}
+
+	state := tracker.States()[node.Id].Types[cache.ClusterType]
+	if state.RejectedVersion != bad.Clusters.Version {
+		t.Errorf("expected rejected version %q, got %q", bad.Clusters.Version, state.RejectedVersion)
+	}
+
+	if state.ErrorDetail != "invalid cluster" || state.Rejections != 1 {
+		t.Errorf("unexpected rejection state %+v", state)
+	}
+
+	// Setting the rejected version again keeps the accepted one
+	if err := tracker.SetSnapshot(node.Id, bad); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	if served() != good.Clusters.Version {
+		t.Errorf("rejected version %q was served again", served())
+	}
+
+	// A new version replaces the rejected one
+	fixed := snapshot(3)
+	if err := tracker.SetSnapshot(node.Id, fixed); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	if served() != fixed.Clusters.Version {
+		t.Errorf("expected new version %q to be served, got %q", fixed.Clusters.Version, served())
+	}
+}
+
+// groupHash puts every node in the same group
+type groupHash struct{}
+
+func (groupHash) ID(*core.Node) string {
+	return "edge"
+}
+
+func TestSnapshotTracker_RollbackGroup(t *testing.T) {
+	snc := cache.NewSnapshotCache(false, groupHash{}, nil)
+	tracker := NewSnapshotTracker(snc, groupHash{})
+
+	snapshot := func(limit uint32, port uint32) cache.Snapshot {
+		snap, err := newVersionedSnapshot(nil, []cache.Resource{
+			&envoyapiv2.Cluster{
+				Name:                     "web",
+				MaxRequestsPerConnection: &wrappers.UInt32Value{Value: limit},
+			},
+		}, nil, []cache.Resource{
+			buildListenerOn("http", int(port), nil, &EnvoyConfig{}),
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+		return snap
+	}
+
+	request := func(stream int64, node, typ, version, nonce string, detail *status.Status) {
+		err := tracker.OnStreamRequest(stream, &envoyapiv2.DiscoveryRequest{
+			Node:          &core.Node{Id: node},
+			TypeUrl:       typ,
+			VersionInfo:   version,
+			ResponseNonce: nonce,
+			ErrorDetail:   detail,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+	}
+
+	respond := func(stream int64, typ, version, nonce string) {
+		tracker.OnStreamResponse(stream, nil, &envoyapiv2.DiscoveryResponse{
+			TypeUrl:     typ,
+			VersionInfo: version,
+			Nonce:       nonce,
+		})
+	}
+
+	served := func() cache.Snapshot {
+		snap, err := snc.GetSnapshot("edge")
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+		return snap
+	}
+
+	good := snapshot(1, 8080)
+	bad := snapshot(2, 8081)
+
+	request(1, "edge-1", cache.ClusterType, "", "", nil)
+	request(2, "edge-2", cache.ClusterType, "", "", nil)
+	if err := tracker.SetSnapshot("edge", good); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	for stream, node := range map[int64]string{1: "edge-1", 2: "edge-2"} {
+		respond(stream, cache.ClusterType, good.Clusters.Version, "c1")
+		request(stream, node, cache.ClusterType, good.Clusters.Version, "c1", nil)
+		respond(stream, cache.ListenerType, good.Listeners.Version, "l1")
+		request(stream, node, cache.ListenerType, good.Listeners.Version, "l1", nil)
+	}
+
+	if err := tracker.SetSnapshot("edge", bad); err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	// edge-1 accepts both types of the new snapshot
+	respond(1, cache.ClusterType, bad.Clusters.Version, "c2")
+	request(1, "edge-1", cache.ClusterType, bad.Clusters.Version, "c2", nil)
+	respond(1, cache.ListenerType, bad.Listeners.Version, "l2")
+	request(1, "edge-1", cache.ListenerType, bad.Listeners.Version, "l2", nil)
+
+	// edge-2 accepts the clusters and rejects the listeners
+	respond(2, cache.ClusterType, bad.Clusters.Version, "c2")
+	request(2, "edge-2", cache.ClusterType, bad.Clusters.Version, "c2", nil)
+	respond(2, cache.ListenerType, bad.Listeners.Version, "l2")
+	request(2, "edge-2", cache.ListenerType, good.Listeners.Version, "l2", &status.Status{Message: "invalid listener"})
+
+	// The whole group is rolled back, the accepted clusters
+	// included, to the last snapshot accepted in full
+	deadline := time.Now().Add(time.Second)
+	for served().Listeners.Version != good.Listeners.Version && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	snap := served()
+	if snap.Listeners.Version != good.Listeners.Version {
+		t.Errorf("expected the accepted listeners %q to be served, got %q", good.Listeners.Version, snap.Listeners.Version)
+	}
+
+	if snap.Clusters.Version != good.Clusters.Version {
+		t.Errorf("expected the clusters %q of the accepted snapshot to be served, got %q", good.Clusters.Version, snap.Clusters.Version)
+	}
+}
+
+func TestSnapshotTracker_Keys(t *testing.T) {
+	tracker := NewSnapshotTracker(cache.NewSnapshotCache(false, cache.IDHash{}, nil), cache.IDHash{})
+
+	request := func(stream int64, node string) {
+		err := tracker.OnStreamRequest(stream, &envoyapiv2.DiscoveryRequest{
+			Node:    &core.Node{Id: node},
+			TypeUrl: cache.ClusterType,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+	}
+
+	request(1, "one")
+	select {
+	case <-tracker.Joined():
+	default:
+		t.Errorf("expected a notification for the new key")
+	}
+
+	request(2, "one")
+	request(3, "two")
+	tracker.OnStreamClosed(1)
+
+	if keys := tracker.Keys(); len(keys) != 2 || keys[0] != "one" || keys[1] != "two" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	tracker.OnStreamClosed(2)
+	if keys := tracker.Keys(); len(keys) != 1 || keys[0] != "two" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+}
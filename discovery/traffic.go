@@ -0,0 +1,333 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/Gufran/flightpath/metrics"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"sort"
+	"strings"
+)
+
+// routeMatchRegex is the match type of the routes
+// that match the path with a regular expression.
+const routeMatchRegex = "regex"
+
+// splitScale turns the percentages of a service-splitter
+// into cluster weights with a precision of two decimals.
+const splitScale = 100
+
+// route inserts the route of a service along with the routes of
+// its service-router, and sends the traffic of every route through
+// the service-splitter of the destination. A canary with a header
+// gets a route of its own ahead of them. Routes pinned to a
+// datacenter are not affected by the config entries.
+func (v *vhostPool) route(domain string, entry routeEntry) {
+	if entry.datacenter != "" {
+		v.insert(domain, entry)
+		return
+	}
+
+	if pinned, ok := v.canaryEntry(entry); ok {
+		v.insert(domain, v.split(pinned, pinned.service, pinned.subset))
+	}
+
+	if router := v.entries.Router(entry.service); router != nil {
+		for idx := range router.Routes {
+			r := &router.Routes[idx]
+
+			e, ok := routerEntry(entry, r, idx)
+			if !ok {
+				logger.WithField("service", entry.service).
+					WithField("route", idx).
+					WithField("path", entry.path).
+					Debug("service-router route is outside of the route and is not applied")
+				continue
+			}
+
+			v.insert(domain, v.split(e, r.Service, r.Subset))
+
+			// A route that matches everything on the path makes
+			// the following routes and the default unreachable.
+			if e.path == entry.path && e.exact == entry.exact && r.Match.IsEmpty() {
+				return
+			}
+		}
+	}
+
+	v.insert(domain, v.split(entry, entry.service, entry.subset))
+}
+
+// routerEntry narrows the route of a service down to the route of
+// its service-router. The path of the router route must fall under
+// the path of the service route, and the request conditions of both
+// routes apply, so that the router only shapes the traffic that the
+// service receives on the domain. Regular expressions are only
+// applied when the service receives every path.
+func routerEntry(base routeEntry, r *catalog.RouterRoute, idx int) (routeEntry, bool) {
+	entry := base
+	entry.name = fmt.Sprintf("%s.router-%d", base.name, idx)
+	entry.router = r
+	entry.order = idx
+	entry.source = routeSourceRouter
+
+	match, ok := base.match.Merge(r.Match)
+	if !ok {
+		return entry, false
+	}
+	entry.match = match
+
+	switch {
+	case r.PathExact != "":
+		if base.exact && r.PathExact != base.path || !base.exact && !strings.HasPrefix(r.PathExact, base.path) {
+			return entry, false
+		}
+		entry.path = r.PathExact
+		entry.exact = true
+
+	case r.PathPrefix != "":
+		switch {
+		case base.exact && strings.HasPrefix(base.path, r.PathPrefix):
+		case !base.exact && strings.HasPrefix(r.PathPrefix, base.path):
+			entry.path = r.PathPrefix
+		case !base.exact && strings.HasPrefix(base.path, r.PathPrefix):
+		default:
+			return entry, false
+		}
+
+	case r.PathRegex != "":
+		if base.exact || base.path != "/" {
+			return entry, false
+		}
+		entry.path = r.PathRegex
+		entry.regex = true
+	}
+
+	return entry, true
+}
+
+// split points the route to the clusters of the service, through
+// the service-splitter and the service-resolver of the service if
+// it has them. The canary of the route takes its share before the
+// rest is split over the instances outside of the canary subset.
+// The route of a service without a splitter, subset, canary or
+// redirect is left as it is.
+func (v *vhostPool) split(entry routeEntry, service, subset string) routeEntry {
+	canary, rest := v.canarySplit(entry, service, subset)
+	if service == entry.service && subset == "" && canary == 0 && rest == "" && v.entries.Splitter(service) == nil && !v.redirects(service) {
+		return entry
+	}
+
+	var targets []weightedCluster
+	if canary < 100 {
+		targets = v.targets(service, subset, (100-canary)*splitScale, map[string]bool{})
+		if rest != "" {
+			targets = mergeWeights(v.excludeCanary(targets, service, rest))
+		}
+	}
+
+	if canary > 0 {
+		targets = append(targets, v.targets(service, entry.canary.Subset, canary*splitScale, map[string]bool{})...)
+		targets = mergeWeights(targets)
+	}
+
+	if len(targets) == 1 {
+		entry.destination = targets[0].name
+		entry.members = nil
+		return entry
+	}
+
+	entry.destination = ""
+	entry.members = targets
+	return entry
+}
+
+// targets distributes the weight over the clusters of the service.
+// A service-splitter distributes the weight over its splits first,
+// and the splitters of the split services are followed unless the
+// service was already split on the way. A subset skips the splitter
+// and goes straight to the service-resolver.
+func (v *vhostPool) targets(service, subset string, weight uint32, seen map[string]bool) []weightedCluster {
+	if splitter := v.entries.Splitter(service); splitter != nil && subset == "" && !seen[service] {
+		seen[service] = true
+		defer delete(seen, service)
+
+		var result []weightedCluster
+		for _, s := range splitter.Splits {
+			share := uint32(float64(weight) * float64(s.Weight) / 100)
+			if s.Service == service {
+				result = append(result, v.clusters(v.resolve(s.Service, s.Subset, map[string]bool{}), share)...)
+				continue
+			}
+			result = append(result, v.targets(s.Service, s.Subset, share, seen)...)
+		}
+		return mergeWeights(result)
+	}
+
+	return v.clusters(v.resolve(service, subset, map[string]bool{}), weight)
+}
+
+// clusters distributes the weight over the clusters of the
+// service in proportion to their weights.
+func (v *vhostPool) clusters(service string, weight uint32) []weightedCluster {
+	members := v.services[service]
+	if len(members) == 0 {
+		// Envoy responds with 503 on the share of the
+		// traffic that goes to an unknown cluster, just
+		// like the mesh would.
+		if !v.unknown[service] {
+			v.unknown[service] = true
+			metrics.Incr("discovery.config_entry.unknown_service", []string{"service:" + service})
+			logger.WithField("service", service).
+				Warn("config entry refers to a service that is not available in catalog")
+		}
+		return []weightedCluster{{name: service, weight: weight}}
+	}
+
+	var total uint64
+	for _, m := range members {
+		total += uint64(m.weight)
+	}
+
+	result := make([]weightedCluster, len(members))
+	for idx, m := range members {
+		share := weight / uint32(len(members))
+		if total > 0 {
+			share = uint32(uint64(weight) * uint64(m.weight) / total)
+		}
+		result[idx] = weightedCluster{name: m.name, weight: share}
+	}
+	return result
+}
+
+// mergeWeights adds up the weights of the same cluster
+func mergeWeights(clusters []weightedCluster) []weightedCluster {
+	weights := map[string]uint32{}
+	for _, c := range clusters {
+		weights[c.name] += c.weight
+	}
+
+	var result []weightedCluster
+	for name, weight := range weights {
+		result = append(result, weightedCluster{name: name, weight: weight})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+func buildRegexMatcher(regex string) *matcher.RegexMatcher {
+	return &matcher.RegexMatcher{
+		EngineType: &matcher.RegexMatcher_GoogleRe2{
+			GoogleRe2: &matcher.RegexMatcher_GoogleRE2{},
+		},
+		Regex: regex,
+	}
+}
+
+// buildHeaderMatchers translates the method and header
+// conditions. Envoy matches the method on the :method
+// pseudo header.
+func buildHeaderMatchers(match catalog.RequestMatch) []*route.HeaderMatcher {
+	var result []*route.HeaderMatcher
+
+	if len(match.Methods) > 0 {
+		result = append(result, &route.HeaderMatcher{
+			Name: ":method",
+			HeaderMatchSpecifier: &route.HeaderMatcher_SafeRegexMatch{
+				SafeRegexMatch: buildRegexMatcher(strings.Join(match.Methods, "|")),
+			},
+		})
+	}
+
+	for _, h := range match.Headers {
+		m := &route.HeaderMatcher{
+			Name:        h.Name,
+			InvertMatch: h.Invert,
+		}
+
+		switch {
+		case h.Exact != "":
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{ExactMatch: h.Exact}
+		case h.Prefix != "":
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{PrefixMatch: h.Prefix}
+		case h.Suffix != "":
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_SuffixMatch{SuffixMatch: h.Suffix}
+		case h.Regex != "":
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: buildRegexMatcher(h.Regex)}
+		default:
+			m.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{PresentMatch: true}
+		}
+
+		result = append(result, m)
+	}
+
+	return result
+}
+
+func buildQueryMatchers(match catalog.RequestMatch) []*route.QueryParameterMatcher {
+	var result []*route.QueryParameterMatcher
+	for _, q := range match.Query {
+		m := &route.QueryParameterMatcher{
+			Name: q.Name,
+		}
+
+		switch {
+		case q.Exact != "":
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_Exact{Exact: q.Exact},
+				},
+			}
+		case q.Regex != "":
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_StringMatch{
+				StringMatch: &matcher.StringMatcher{
+					MatchPattern: &matcher.StringMatcher_SafeRegex{SafeRegex: buildRegexMatcher(q.Regex)},
+				},
+			}
+		default:
+			m.QueryParameterMatchSpecifier = &route.QueryParameterMatcher_PresentMatch{PresentMatch: true}
+		}
+
+		result = append(result, m)
+	}
+	return result
+}
+
+// applyRouterDestination sets the prefix rewrite, timeout and
+// retries of a service-router route on the route action. The
+// retries replace the retry policy of the service.
+func applyRouterDestination(action *route.RouteAction, r *catalog.RouterRoute) {
+	action.PrefixRewrite = r.PrefixRewrite
+
+	if r.Timeout > 0 {
+		action.Timeout = ptypes.DurationProto(r.Timeout)
+	}
+
+	if !r.HasRetries() {
+		return
+	}
+
+	policy := &route.RetryPolicy{}
+	if r.NumRetries > 0 {
+		policy.NumRetries = &wrappers.UInt32Value{Value: r.NumRetries}
+	}
+
+	var retryOn []string
+	if r.RetryOnConnectFailure {
+		retryOn = append(retryOn, "connect-failure")
+	}
+
+	if len(r.RetryOnStatusCodes) > 0 {
+		retryOn = append(retryOn, "retriable-status-codes")
+		policy.RetriableStatusCodes = r.RetryOnStatusCodes
+	}
+
+	policy.RetryOn = strings.Join(retryOn, ",")
+	action.RetryPolicy = policy
+}
@@ -0,0 +1,290 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+	"time"
+)
+
+func TestRouterEntry(t *testing.T) {
+	tests := []struct {
+		base   routeEntry
+		route  catalog.RouterRoute
+		expect string
+		match  string
+		ok     bool
+	}{
+		{
+			base:   routeEntry{path: "/"},
+			route:  catalog.RouterRoute{},
+			expect: "prefix:/",
+			ok:     true,
+		},
+		{
+			base:   routeEntry{path: "/api/"},
+			route:  catalog.RouterRoute{PathPrefix: "/api/v2/"},
+			expect: "prefix:/api/v2/",
+			ok:     true,
+		},
+		{
+			// a wider prefix is narrowed down to the service
+			base:   routeEntry{path: "/api/"},
+			route:  catalog.RouterRoute{PathPrefix: "/"},
+			expect: "prefix:/api/",
+			ok:     true,
+		},
+		{
+			base:  routeEntry{path: "/api/"},
+			route: catalog.RouterRoute{PathPrefix: "/admin/"},
+		},
+		{
+			base:   routeEntry{path: "/api/"},
+			route:  catalog.RouterRoute{PathExact: "/api/health"},
+			expect: "exact:/api/health",
+			ok:     true,
+		},
+		{
+			base:  routeEntry{path: "/api/health", exact: true},
+			route: catalog.RouterRoute{PathExact: "/api/ready"},
+		},
+		{
+			base:   routeEntry{path: "/api/health", exact: true},
+			route:  catalog.RouterRoute{PathPrefix: "/api/"},
+			expect: "exact:/api/health",
+			ok:     true,
+		},
+		{
+			base:   routeEntry{path: "/"},
+			route:  catalog.RouterRoute{PathRegex: "/users/[0-9]+"},
+			expect: "regex:/users/[0-9]+",
+			ok:     true,
+		},
+		{
+			base:  routeEntry{path: "/api/"},
+			route: catalog.RouterRoute{PathRegex: "/api/[0-9]+"},
+		},
+		{
+			// the conditions of both routes apply
+			base: routeEntry{path: "/api/", match: catalog.RequestMatch{
+				Methods: []string{"GET", "POST"},
+				Headers: []catalog.HeaderMatch{{Name: "x-team", Exact: "web"}},
+			}},
+			route: catalog.RouterRoute{PathPrefix: "/api/v2/", Match: catalog.RequestMatch{
+				Methods: []string{"POST"},
+				Query:   []catalog.QueryMatch{{Name: "debug", Present: true}},
+			}},
+			expect: "prefix:/api/v2/",
+			match:  "method=POST header:x-team=web query:debug",
+			ok:     true,
+		},
+		{
+			base:  routeEntry{path: "/api/", match: catalog.RequestMatch{Methods: []string{"GET"}}},
+			route: catalog.RouterRoute{Match: catalog.RequestMatch{Methods: []string{"POST"}}},
+		},
+	}
+
+	for idx, test := range tests {
+		entry, ok := routerEntry(test.base, &test.route, 0)
+		if ok != test.ok {
+			t.Errorf("case %d: expected %t, got %t", idx, test.ok, ok)
+			continue
+		}
+
+		if !ok {
+			continue
+		}
+
+		match := "prefix"
+		switch {
+		case entry.exact:
+			match = "exact"
+		case entry.regex:
+			match = "regex"
+		}
+
+		if result := match + ":" + entry.path; result != test.expect {
+			t.Errorf("case %d: expected %s, got %s", idx, test.expect, result)
+		}
+
+		if result := entry.match.String(); result != test.match {
+			t.Errorf("case %d: expected conditions %q, got %q", idx, test.match, result)
+		}
+	}
+}
+
+func TestVhostPool_RouteServiceRouter(t *testing.T) {
+	entries := catalog.NewConfigEntries()
+	entries.Routers["web"] = &catalog.ServiceRouter{
+		Service: "web",
+		Routes: []catalog.RouterRoute{
+			{
+				PathPrefix: "/admin/",
+				Match: catalog.RequestMatch{
+					Methods: []string{"GET"},
+					Headers: []catalog.HeaderMatch{{Name: "x-debug", Present: true}},
+				},
+				Service:       "admin",
+				PrefixRewrite: "/",
+			},
+			{
+				Match: catalog.RequestMatch{
+					Query: []catalog.QueryMatch{{Name: "v", Exact: "2"}},
+				},
+				Service: "web",
+				Timeout: 2 * time.Second,
+			},
+		},
+	}
+
+	pool := newVhostPool(nil)
+	pool.entries = entries
+	pool.services = map[string][]weightedCluster{
+		"web":   {{name: "web", weight: 1}},
+		"admin": {{name: "admin", weight: 1}},
+	}
+
+	pool.route("example.com", routeEntry{name: "web.1-0", clusterName: "web", service: "web", path: "/"})
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+
+	admin := routes[0]
+	if admin.GetMatch().GetPrefix() != "/admin/" || admin.GetRoute().GetCluster() != "admin" {
+		t.Errorf("expected /admin/ to be routed to admin first, got %v", admin)
+	}
+
+	if admin.GetRoute().GetPrefixRewrite() != "/" {
+		t.Errorf("expected the prefix to be rewritten, got %q", admin.GetRoute().GetPrefixRewrite())
+	}
+
+	var headers []string
+	for _, h := range admin.GetMatch().GetHeaders() {
+		headers = append(headers, h.Name)
+	}
+	if !cmp.Equal(headers, []string{":method", "x-debug"}) {
+		t.Errorf("unexpected header matchers %v", headers)
+	}
+
+	query := routes[1]
+	if query.GetMatch().GetPrefix() != "/" || len(query.GetMatch().GetQueryParameters()) != 1 {
+		t.Errorf("expected the query route on /, got %v", query.GetMatch())
+	}
+
+	if query.GetRoute().GetTimeout().GetSeconds() != 2 {
+		t.Errorf("expected a timeout of 2s, got %v", query.GetRoute().GetTimeout())
+	}
+
+	if routes[2].GetMatch().GetPrefix() != "/" || routes[2].GetRoute().GetCluster() != "web" {
+		t.Errorf("expected the default route to web last, got %v", routes[2])
+	}
+}
+
+func TestVhostPool_RouteCatchAll(t *testing.T) {
+	entries := catalog.NewConfigEntries()
+	entries.Routers["web"] = &catalog.ServiceRouter{
+		Service: "web",
+		Routes: []catalog.RouterRoute{
+			{Service: "api"},
+			{PathPrefix: "/unreachable/", Service: "admin"},
+		},
+	}
+
+	pool := newVhostPool(nil)
+	pool.entries = entries
+	pool.services = map[string][]weightedCluster{
+		"web": {{name: "web", weight: 1}},
+		"api": {{name: "api", weight: 1}},
+	}
+
+	pool.route("example.com", routeEntry{name: "web.1-0", clusterName: "web", service: "web", path: "/"})
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 1 || routes[0].GetRoute().GetCluster() != "api" {
+		t.Errorf("expected a single route to api, got %v", routes)
+	}
+}
+
+func TestVhostPool_RouteServiceSplitter(t *testing.T) {
+	entries := catalog.NewConfigEntries()
+	entries.Splitters["web"] = &catalog.ServiceSplitter{
+		Service: "web",
+		Splits: []catalog.Split{
+			{Weight: 90, Service: "web"},
+			{Weight: 10, Service: "web-v2"},
+		},
+	}
+	entries.Splitters["web-v2"] = &catalog.ServiceSplitter{
+		Service: "web-v2",
+		Splits: []catalog.Split{
+			{Weight: 50, Service: "web-v2"},
+			{Weight: 50, Service: "unknown"},
+		},
+	}
+
+	pool := newVhostPool(nil)
+	pool.entries = entries
+	pool.services = map[string][]weightedCluster{
+		"web":    {{name: "web", weight: 1}, {name: "web-sidecar-proxy", weight: 3}},
+		"web-v2": {{name: "web-v2", weight: 2}},
+	}
+	pool.groups = serviceGroupsOf(pool.services)
+
+	pool.route("example.com", routeEntry{name: "web.1-0", clusterName: "web", service: "web", path: "/"})
+	pool.route("example.com", routeEntry{name: "web-sidecar-proxy.1-0", clusterName: "web-sidecar-proxy", service: "web", path: "/"})
+
+	if conflicts := pool.resolveConflicts(); len(conflicts) != 0 {
+		t.Errorf("expected the clusters of a service to share the route, got %+v", conflicts)
+	}
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+
+	var result []string
+	for _, c := range routes[0].GetRoute().GetWeightedClusters().GetClusters() {
+		result = append(result, fmt.Sprintf("%s=%d", c.Name, c.Weight.GetValue()))
+	}
+
+	expect := []string{"unknown=500", "web=2250", "web-sidecar-proxy=6750", "web-v2=500"}
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected weighted clusters. %s", cmp.Diff(result, expect))
+	}
+}
+
+func TestApplyRouterDestination(t *testing.T) {
+	action := &route.RouteAction{}
+	applyRouterDestination(action, &catalog.RouterRoute{
+		NumRetries:            3,
+		RetryOnConnectFailure: true,
+		RetryOnStatusCodes:    []uint32{503},
+	})
+
+	policy := action.GetRetryPolicy()
+	if policy.GetRetryOn() != "connect-failure,retriable-status-codes" {
+		t.Errorf("unexpected retry condition %q", policy.GetRetryOn())
+	}
+
+	if policy.GetNumRetries().GetValue() != 3 {
+		t.Errorf("expected 3 retries, got %d", policy.GetNumRetries().GetValue())
+	}
+
+	if !cmp.Equal(policy.GetRetriableStatusCodes(), []uint32{503}) {
+		t.Errorf("unexpected retriable status codes %v", policy.GetRetriableStatusCodes())
+	}
+}
+
+func serviceGroupsOf(services map[string][]weightedCluster) map[string][]weightedCluster {
+	result := map[string][]weightedCluster{}
+	for service, members := range services {
+		if len(members) > 1 {
+			result[service] = members
+		}
+	}
+	return result
+}
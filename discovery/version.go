@@ -0,0 +1,85 @@
+package discovery
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/any"
+	"sort"
+)
+
+// resourceVersion derives the version of a resource type from
+// the serialized content of its resources. Any change in any
+// resource results in a new version, while an unchanged set
+// keeps its version so that Envoy is not bothered with it.
+func resourceVersion(resources []cache.Resource) (string, error) {
+	sorted := make([]cache.Resource, len(resources))
+	copy(sorted, resources)
+	sort.Slice(sorted, func(i, j int) bool {
+		return cache.GetResourceName(sorted[i]) < cache.GetResourceName(sorted[j])
+	})
+
+	hash := sha1.New()
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+
+	for _, r := range sorted {
+		buf.Reset()
+		err := buf.Marshal(r)
+		if err != nil {
+			return "", fmt.Errorf("failed to serialize resource %q. %s", cache.GetResourceName(r), err)
+		}
+
+		// Length prefix keeps the boundaries between the
+		// resources from being ambiguous.
+		_, _ = fmt.Fprintf(hash, "%d:", len(buf.Bytes()))
+		_, _ = hash.Write(buf.Bytes())
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))[:10], nil
+}
+
+// deterministicAny packs the message like ptypes.MarshalAny, but
+// serializes the maps in a stable order. The packed bytes are part
+// of the resource version, so packing the same message twice must
+// produce the same bytes.
+func deterministicAny(msg proto.Message) (*any.Any, error) {
+	buf := proto.NewBuffer(nil)
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(msg); err != nil {
+		return nil, err
+	}
+
+	return &any.Any{
+		TypeUrl: "type.googleapis.com/" + proto.MessageName(msg),
+		Value:   buf.Bytes(),
+	}, nil
+}
+
+// newVersionedSnapshot creates a snapshot in which every
+// resource type carries its own content derived version.
+func newVersionedSnapshot(endpoints, clusters, routes, listeners, secrets []cache.Resource) (cache.Snapshot, error) {
+	var snap cache.Snapshot
+
+	groups := []struct {
+		target    *cache.Resources
+		resources []cache.Resource
+	}{
+		{&snap.Endpoints, endpoints},
+		{&snap.Clusters, clusters},
+		{&snap.Routes, routes},
+		{&snap.Listeners, listeners},
+		{&snap.Secrets, secrets},
+	}
+
+	for _, g := range groups {
+		version, err := resourceVersion(g.resources)
+		if err != nil {
+			return snap, err
+		}
+		*g.target = cache.NewResources(version, g.resources)
+	}
+
+	return snap, nil
+}
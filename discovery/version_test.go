@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	envoyapiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/pkg/cache"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"testing"
+)
+
+func TestResourceVersion(t *testing.T) {
+	one := &envoyapiv2.Cluster{Name: "one"}
+	two := &envoyapiv2.Cluster{Name: "two"}
+	changed := &envoyapiv2.Cluster{
+		Name:                     "two",
+		MaxRequestsPerConnection: &wrappers.UInt32Value{Value: 10},
+	}
+
+	version := func(resources ...cache.Resource) string {
+		v, err := resourceVersion(resources)
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+		return v
+	}
+
+	if version(one, two) != version(two, one) {
+		t.Errorf("version depends on the order of resources")
+	}
+
+	if version(one, two) == version(one, changed) {
+		t.Errorf("version did not change with the content of a resource")
+	}
+
+	if version(one, two) == version(one) {
+		t.Errorf("version did not change when a resource was removed")
+	}
+}
+
+func TestNewVersionedSnapshot(t *testing.T) {
+	clusters := []cache.Resource{&envoyapiv2.Cluster{Name: "one"}}
+	listeners := []cache.Resource{&envoyapiv2.Listener{Name: "flightpath"}}
+
+	first, err := newVersionedSnapshot(nil, clusters, nil, listeners, nil)
+	if err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	second, err := newVersionedSnapshot(nil, []cache.Resource{&envoyapiv2.Cluster{Name: "two"}}, nil, listeners, nil)
+	if err != nil {
+		t.Fatalf("unexpected error. %s", err)
+	}
+
+	if first.Clusters.Version == second.Clusters.Version {
+		t.Errorf("cluster version did not change")
+	}
+
+	if first.Listeners.Version != second.Listeners.Version {
+		t.Errorf("listener version changed without a change in listeners")
+	}
+}
+
+func TestResourceVersion_Listener(t *testing.T) {
+	envoyConfig := &EnvoyConfig{
+		ListenerPort:      9292,
+		HttpAccessLogPath: "/dev/stdout",
+		EnableTracing:     true,
+	}
+
+	var first string
+	for i := 0; i < 20; i++ {
+		l, err := buildListener("flightpath", envoyConfig)
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+
+		version, err := resourceVersion([]cache.Resource{l})
+		if err != nil {
+			t.Fatalf("unexpected error. %s", err)
+		}
+
+		if i == 0 {
+			first = version
+		} else if version != first {
+			t.Fatalf("listener built from the same config has version %s, expected %s", version, first)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/Gufran/flightpath/metrics"
+	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	duration "github.com/golang/protobuf/ptypes/duration"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"sort"
+	"strings"
+)
+
+// routeEntry is a single path match on a domain
+// that sends the traffic to a cluster.
+type routeEntry struct {
+	name          string
+	clusterName   string
+	path          string
+	exact         bool
+	caseSensitive bool
+	createIndex   uint64
+	settings      *catalog.ClusterSettings
+
+	// datacenter pins the route to the instances
+	// of the cluster in one datacenter.
+	datacenter string
+
+	// service is the logical service of the cluster and
+	// members are its clusters when it has more than one.
+	// The route then splits the traffic between them.
+	service string
+	members []weightedCluster
+
+	// regex matches the path as a regular expression
+	// and match holds the conditions on the request
+	// other than the path.
+	regex bool
+	match catalog.RequestMatch
+
+	// destination is the cluster that receives the traffic
+	// when it is not the cluster of the route, e.g. when a
+	// service-router sends the traffic to another service.
+	destination string
+
+	// router is the service-router route that the entry was
+	// built from. order keeps the routes of a service-router
+	// in the order they are declared in.
+	router *catalog.RouterRoute
+	order  int
+
+	// source tells where the route came from, see RouteSource
+	source string
+
+	// subset pins the route to a subset of the service and
+	// canary sends a share of its traffic to one.
+	subset string
+	canary *catalog.CanaryRoute
+}
+
+// vhostPool collects the routes of all clusters and
+// merges them into one virtual host per domain.
+type vhostPool struct {
+	domains map[string][]routeEntry
+	policy  *catalog.RoutePolicy
+
+	// groups are the clusters of the services that
+	// have more than one, see serviceGroups.
+	groups map[string][]weightedCluster
+
+	// services are the clusters of every service and its
+	// subsets, entries are the config entries that shape their
+	// traffic when the config entries are enabled.
+	services map[string][]weightedCluster
+	entries  *catalog.ConfigEntries
+	unknown  map[string]bool
+
+	// canaries are the clusters that leave out the instances
+	// of a canary subset, keyed by name, see canaryClusters.
+	canaries map[string]catalog.ClusterInfo
+}
+
+func newVhostPool(policy *catalog.RoutePolicy) *vhostPool {
+	return &vhostPool{
+		domains:  map[string][]routeEntry{},
+		policy:   policy,
+		groups:   map[string][]weightedCluster{},
+		services: map[string][]weightedCluster{},
+		unknown:  map[string]bool{},
+		canaries: map[string]catalog.ClusterInfo{},
+	}
+}
+
+// insert adds the route to the domain if the route policy
+// allows the cluster to claim the domain and path.
+func (v *vhostPool) insert(domain string, entry routeEntry) {
+	// A regular expression is only applied on the routes of
+	// the services that receive every path of the domain.
+	path := entry.path
+	if entry.regex {
+		path = "/"
+	}
+
+	if !v.policy.Allows(entry.clusterName, domain, path) {
+		metrics.Incr("discovery.route.rejected", []string{"domain:" + domain, "cluster:" + entry.clusterName})
+		logger.WithField("domain", domain).
+			WithField("path", entry.path).
+			WithField("cluster", entry.clusterName).
+			WithField("route", entry.name).
+			Warn("route is not allowed by the route policy")
+		return
+	}
+
+	if len(entry.members) > 1 || len(v.groups[entry.service]) > 1 {
+		// The clusters of the service claim the route
+		// together and are collapsed into one route.
+		entry.clusterName = entry.service
+	}
+
+	v.domains[domain] = append(v.domains[domain], entry)
+}
+
+func (v *vhostPool) add(c catalog.ClusterInfo, routes []catalog.Route) {
+	settings := routeSettings(c)
+	members := v.groups[c.Service()]
+
+	for _, e := range c.Endpoints() {
+		for domain, routes := range e.RoutingInfo() {
+			for idx, r := range routes {
+				// The route of a canary takes the settings of the
+				// instances that are not in the canary subset.
+				s := settings
+				if r.Canary != nil {
+					if rest, ok := v.canaries[subsetName(c.Name(), catalog.SubsetExclusion+r.Canary.Subset)]; ok {
+						s = routeSettings(rest)
+					}
+				}
+
+				v.route(domain, routeEntry{
+					name:        fmt.Sprintf("%s.%s-%d", c.Name(), e.Name(), idx),
+					clusterName: c.Name(),
+					path:        r.Path,
+					exact:       !isPrefixPath(r.Path),
+					createIndex: e.CreateIndex(),
+					settings:    s,
+					datacenter:  r.Datacenter,
+					service:     c.Service(),
+					members:     members,
+					source:      routeSourceMeta,
+					subset:      r.Subset,
+					canary:      r.Canary,
+					match:       r.Match,
+				})
+			}
+		}
+	}
+
+	for _, r := range routes {
+		for _, domain := range r.Domains() {
+			for idx, path := range r.PathPrefixes() {
+				v.route(domain, routeEntry{
+					name:          fmt.Sprintf("%s.kv-%s-%d", c.Name(), r.Name(), idx),
+					clusterName:   c.Name(),
+					path:          path,
+					exact:         r.MatchType() == catalog.RouteMatchExact,
+					caseSensitive: r.IsCaseSensitive(),
+					createIndex:   r.CreateIndex(),
+					settings:      settings,
+					service:       c.Service(),
+					members:       members,
+					source:        routeSourceKV,
+				})
+			}
+		}
+	}
+}
+
+// routeSettings loads the settings of the cluster, or
+// the default settings if they can not be loaded.
+func routeSettings(c catalog.ClusterInfo) *catalog.ClusterSettings {
+	settings, err := c.Settings()
+	if err != nil {
+		logger.WithError(err).WithField("cluster", c.Name()).
+			Error("failed to load cluster settings. using default values for virtualhost")
+		settings = &catalog.ClusterSettings{}
+		settings.Canonicalize()
+	}
+	return settings
+}
+
+func (v *vhostPool) collect(proxyPort int) []*route.VirtualHost {
+	var domains []string
+	for domain := range v.domains {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	var virtualHosts []*route.VirtualHost
+	for _, domain := range domains {
+		target := &route.VirtualHost{
+			Name: "vh-" + domain,
+			// TODO: Envoy fails to match the domain if the client
+			//   sends the Host header with port in it. for the time
+			//   we match on the bare domain as well as on the domain
+			//   with the port number on it, but this should be removed
+			//   when the behaviour is improved in Envoy.
+			// See: https://github.com/envoyproxy/envoy/issues/886
+			Domains:                    []string{domain, fmt.Sprintf("%s:%d", domain, proxyPort)},
+			IncludeRequestAttemptCount: true,
+			Routes:                     []*route.Route{},
+		}
+
+		// A wildcard, e.g. on the hosts of an ingress gateway,
+		// already matches the port and can not be followed by it.
+		if strings.Contains(domain, "*") {
+			target.Domains = []string{domain}
+		}
+
+		for _, entry := range sortRouteEntries(v.domains[domain]) {
+			target.Routes = append(target.Routes, buildRoute(&entry))
+		}
+
+		metrics.GaugeI("discovery.vhost.routes", len(target.Routes), []string{"domain:" + domain})
+		virtualHosts = append(virtualHosts, target)
+	}
+
+	return virtualHosts
+}
+
+// sortRouteEntries orders the routes so that Envoy picks the
+// most specific match first. Exact paths come before regular
+// expressions and prefixes, and longer prefixes come before
+// shorter ones. On the same path the routes with more request
+// conditions come first and the routes of a service-router keep
+// their order. Remaining ties are broken on path, cluster and
+// route name to keep the order stable across snapshots. Every
+// instance of a service carries the same routes so identical
+// entries are collapsed into one.
+func sortRouteEntries(entries []routeEntry) []routeEntry {
+	sorted := make([]routeEntry, len(entries))
+	copy(sorted, entries)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.exact != b.exact {
+			return a.exact
+		}
+
+		if a.regex != b.regex {
+			return a.regex
+		}
+
+		if len(a.path) != len(b.path) {
+			return len(a.path) > len(b.path)
+		}
+
+		if a.path != b.path {
+			return a.path < b.path
+		}
+
+		if a.match.Conditions() != b.match.Conditions() {
+			return a.match.Conditions() > b.match.Conditions()
+		}
+
+		if a.match.String() != b.match.String() {
+			return a.match.String() < b.match.String()
+		}
+
+		if a.order != b.order {
+			return a.order < b.order
+		}
+
+		if a.clusterName != b.clusterName {
+			return a.clusterName < b.clusterName
+		}
+
+		if a.caseSensitive != b.caseSensitive {
+			return a.caseSensitive
+		}
+
+		if a.datacenter != b.datacenter {
+			return a.datacenter < b.datacenter
+		}
+
+		if a.subset != b.subset {
+			return a.subset < b.subset
+		}
+
+		if a.canary.String() != b.canary.String() {
+			return a.canary.String() < b.canary.String()
+		}
+
+		return a.name < b.name
+	})
+
+	var result []routeEntry
+	for _, entry := range sorted {
+		if len(result) > 0 {
+			last := result[len(result)-1]
+			if last.clusterName == entry.clusterName &&
+				last.path == entry.path &&
+				last.exact == entry.exact &&
+				last.regex == entry.regex &&
+				last.match.String() == entry.match.String() &&
+				last.caseSensitive == entry.caseSensitive &&
+				last.datacenter == entry.datacenter &&
+				last.subset == entry.subset &&
+				last.canary.String() == entry.canary.String() {
+				result[len(result)-1].source = mergeSources(last.source, entry.source)
+				continue
+			}
+		}
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+func isPrefixPath(path string) bool {
+	return strings.HasSuffix(path, "/") || strings.HasSuffix(path, "*")
+}
+
+func buildRoute(entry *routeEntry) *route.Route {
+	return &route.Route{
+		Name:   entry.name,
+		Match:  buildRouteMatchSpec(entry),
+		Action: buildClusterRoutingAction(entry),
+	}
+}
+
+func buildRouteMatchSpec(entry *routeEntry) *route.RouteMatch {
+	matcher := &route.RouteMatch{
+		CaseSensitive: &wrappers.BoolValue{
+			Value: entry.caseSensitive,
+		},
+	}
+
+	switch {
+	case entry.exact:
+		matcher.PathSpecifier = &route.RouteMatch_Path{
+			Path: entry.path,
+		}
+	case entry.regex:
+		matcher.PathSpecifier = &route.RouteMatch_SafeRegex{
+			SafeRegex: buildRegexMatcher(entry.path),
+		}
+	default:
+		matcher.PathSpecifier = &route.RouteMatch_Prefix{
+			Prefix: entry.path,
+		}
+	}
+
+	matcher.Headers = buildHeaderMatchers(entry.match)
+	matcher.QueryParameters = buildQueryMatchers(entry.match)
+
+	return matcher
+}
+
+func buildClusterRoutingAction(entry *routeEntry) *route.Route_Route {
+	action := &route.RouteAction{
+		ClusterNotFoundResponseCode: route.RouteAction_SERVICE_UNAVAILABLE,
+		RetryPolicy:                 buildRetryPolicy(entry.settings),
+	}
+
+	if len(entry.members) > 1 {
+		action.ClusterSpecifier = buildWeightedClusters(entry.members, entry.datacenter)
+	} else {
+		cluster := entry.clusterName
+		if entry.destination != "" {
+			cluster = entry.destination
+		}
+
+		if entry.datacenter != "" {
+			cluster = datacenterClusterName(cluster, entry.datacenter)
+		}
+
+		action.ClusterSpecifier = &route.RouteAction_Cluster{
+			Cluster: cluster,
+		}
+	}
+
+	if entry.router != nil {
+		applyRouterDestination(action, entry.router)
+	}
+
+	return &route.Route_Route{
+		Route: action,
+	}
+}
+
+func buildWeightedClusters(members []weightedCluster, dc string) *route.RouteAction_WeightedClusters {
+	weighted := &route.WeightedCluster{}
+
+	var total uint32
+	for _, m := range members {
+		name := m.name
+		if dc != "" {
+			name = datacenterClusterName(name, dc)
+		}
+
+		weighted.Clusters = append(weighted.Clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   name,
+			Weight: &wrappers.UInt32Value{Value: m.weight},
+		})
+		total += m.weight
+	}
+
+	weighted.TotalWeight = &wrappers.UInt32Value{Value: total}
+
+	return &route.RouteAction_WeightedClusters{
+		WeightedClusters: weighted,
+	}
+}
+
+func buildRetryPolicy(settings *catalog.ClusterSettings) *route.RetryPolicy {
+	if settings == nil || settings.RetryOn == "" {
+		return nil
+	}
+
+	return &route.RetryPolicy{
+		RetryOn:                       settings.RetryOn,
+		HostSelectionRetryMaxAttempts: 3,
+		NumRetries:                    &wrappers.UInt32Value{Value: settings.RetryAttempts},
+		PerTryTimeout:                 &duration.Duration{Seconds: settings.RetryAttemptTimeout},
+		RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{
+			{Name: "envoy.retry_host_predicates.previous_hosts"},
+		},
+		RetryBackOff: &route.RetryPolicy_RetryBackOff{
+			BaseInterval: &duration.Duration{Seconds: settings.RetryBackoffBase},
+			MaxInterval:  &duration.Duration{Seconds: settings.RetryBackoffMax},
+		},
+	}
+}
+
+// groupRoutesByCluster indexes the externally managed routes
+// by the name of their target cluster. Routes pointing to a
+// cluster that is not currently known are dropped.
+func groupRoutesByCluster(routes []catalog.Route, clusters []catalog.ClusterInfo) map[string][]catalog.Route {
+	known := make(map[string]bool, len(clusters))
+	for _, c := range clusters {
+		known[c.Name()] = true
+	}
+
+	result := map[string][]catalog.Route{}
+	for _, r := range routes {
+		if !known[r.Cluster()] {
+			metrics.Incr("discovery.routes.unknown_cluster", []string{"cluster:" + r.Cluster()})
+			logger.WithField("route", r.Name()).
+				WithField("cluster", r.Cluster()).
+				Warn("route points to a cluster that is not available in catalog")
+			continue
+		}
+
+		result[r.Cluster()] = append(result[r.Cluster()], r)
+	}
+
+	return result
+}
@@ -0,0 +1,223 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	"github.com/google/go-cmp/cmp"
+	"testing"
+)
+
+func TestSortRouteEntries(t *testing.T) {
+	tests := []struct {
+		entries []routeEntry
+		expect  []string
+	}{
+		{
+			entries: []routeEntry{
+				{name: "a", clusterName: "one", path: "/"},
+				{name: "b", clusterName: "two", path: "/api/"},
+				{name: "c", clusterName: "one", path: "/api/v1/"},
+				{name: "d", clusterName: "two", path: "/health", exact: true},
+				{name: "e", clusterName: "one", path: "/api/users", exact: true},
+			},
+			expect: []string{"e", "d", "c", "b", "a"},
+		},
+		{
+			// identical routes from multiple instances are collapsed
+			entries: []routeEntry{
+				{name: "web.2-0", clusterName: "web", path: "/"},
+				{name: "web.1-0", clusterName: "web", path: "/"},
+				{name: "api.1-0", clusterName: "api", path: "/"},
+			},
+			expect: []string{"api.1-0", "web.1-0"},
+		},
+		{
+			// routes pinned to different datacenters are kept
+			entries: []routeEntry{
+				{name: "web.2-0", clusterName: "web", path: "/", datacenter: "dc2"},
+				{name: "web.1-0", clusterName: "web", path: "/"},
+				{name: "web.3-0", clusterName: "web", path: "/", datacenter: "dc2"},
+			},
+			expect: []string{"web.1-0", "web.2-0"},
+		},
+	}
+
+	for idx, test := range tests {
+		var result []string
+		for _, e := range sortRouteEntries(test.entries) {
+			result = append(result, e.name)
+		}
+
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestVhostPool_Collect(t *testing.T) {
+	settings := &catalog.ClusterSettings{RetryOn: "5xx"}
+	settings.Canonicalize()
+
+	pool := newVhostPool(nil)
+	pool.domains["example.com"] = []routeEntry{
+		{name: "a.1-0", clusterName: "a", path: "/a", exact: true},
+		{name: "b.1-0", clusterName: "b", path: "/b/", settings: settings},
+	}
+	pool.domains["*"] = []routeEntry{
+		{name: "c.1-0", clusterName: "c", path: "/"},
+	}
+
+	vhosts := pool.collect(9292)
+	if len(vhosts) != 2 {
+		t.Fatalf("expected 2 virtual hosts, got %d", len(vhosts))
+	}
+
+	if vhosts[0].Name != "vh-*" || vhosts[1].Name != "vh-example.com" {
+		t.Errorf("unexpected virtual host order %q, %q", vhosts[0].Name, vhosts[1].Name)
+	}
+
+	routes := vhosts[1].Routes
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes on merged virtual host, got %d", len(routes))
+	}
+
+	if routes[0].GetMatch().GetPath() != "/a" {
+		t.Errorf("expected exact match on /a first, got %v", routes[0].GetMatch())
+	}
+
+	if routes[0].GetRoute().GetRetryPolicy() != nil {
+		t.Errorf("unexpected retry policy on route without retry settings")
+	}
+
+	if routes[1].GetMatch().GetPrefix() != "/b/" {
+		t.Errorf("expected prefix match on /b/, got %v", routes[1].GetMatch())
+	}
+
+	if routes[1].GetRoute().GetRetryPolicy().GetRetryOn() != "5xx" {
+		t.Errorf("expected retry policy to be set on the route")
+	}
+}
+
+func TestBuildClusterRoutingAction(t *testing.T) {
+	action := buildClusterRoutingAction(&routeEntry{clusterName: "web"})
+	if action.Route.GetCluster() != "web" {
+		t.Errorf("expected route to cluster web, got %q", action.Route.GetCluster())
+	}
+
+	action = buildClusterRoutingAction(&routeEntry{clusterName: "web", datacenter: "dc2"})
+	if action.Route.GetCluster() != "web@dc2" {
+		t.Errorf("expected route to cluster web@dc2, got %q", action.Route.GetCluster())
+	}
+
+	action = buildClusterRoutingAction(&routeEntry{
+		clusterName: "web",
+		datacenter:  "dc2",
+		members:     []weightedCluster{{name: "web", weight: 1}, {name: "web-sidecar-proxy", weight: 1}},
+	})
+
+	var names []string
+	for _, c := range action.Route.GetWeightedClusters().GetClusters() {
+		names = append(names, c.Name)
+	}
+
+	if !cmp.Equal(names, []string{"web@dc2", "web-sidecar-proxy@dc2"}) {
+		t.Errorf("expected weighted route to the clusters in dc2, got %v", names)
+	}
+}
+
+func TestVhostPool_InsertServiceGroup(t *testing.T) {
+	members := []weightedCluster{
+		{name: "web", weight: 1},
+		{name: "web-sidecar-proxy", weight: 3},
+	}
+
+	pool := newVhostPool(nil)
+	pool.insert("example.com", routeEntry{name: "web.web-2-0", clusterName: "web", service: "web", members: members, path: "/"})
+	pool.insert("example.com", routeEntry{name: "web-sidecar-proxy.web-1-proxy-0", clusterName: "web-sidecar-proxy", service: "web", members: members, path: "/"})
+
+	if conflicts := pool.resolveConflicts(); len(conflicts) != 0 {
+		t.Errorf("expected the clusters of a service to share the route, got %+v", conflicts)
+	}
+
+	routes := pool.collect(9292)[0].Routes
+	if len(routes) != 1 {
+		t.Fatalf("expected 1 route, got %d", len(routes))
+	}
+
+	weighted := routes[0].GetRoute().GetWeightedClusters()
+	if weighted.GetTotalWeight().GetValue() != 4 {
+		t.Errorf("expected total weight 4, got %d", weighted.GetTotalWeight().GetValue())
+	}
+
+	var result []string
+	for _, c := range weighted.GetClusters() {
+		result = append(result, fmt.Sprintf("%s=%d", c.Name, c.Weight.GetValue()))
+	}
+
+	expect := []string{"web=1", "web-sidecar-proxy=3"}
+	if !cmp.Equal(result, expect) {
+		t.Errorf("unexpected weighted clusters. %s", cmp.Diff(result, expect))
+	}
+}
+
+func TestBuildRouteMatchSpec(t *testing.T) {
+	entry := &routeEntry{
+		path: "/api/",
+		match: catalog.RequestMatch{
+			Methods: []string{"GET", "HEAD"},
+			Headers: []catalog.HeaderMatch{
+				{Name: "x-team", Exact: "web"},
+				{Name: "x-debug", Present: true, Invert: true},
+				{Name: "user-agent", Regex: ".*bot.*"},
+			},
+			Query: []catalog.QueryMatch{
+				{Name: "v", Exact: "2"},
+				{Name: "page", Regex: "[0-9]+"},
+				{Name: "debug", Present: true},
+			},
+		},
+	}
+
+	match := buildRouteMatchSpec(entry)
+	if match.GetPrefix() != "/api/" {
+		t.Errorf("expected prefix match on /api/, got %v", match.PathSpecifier)
+	}
+
+	headers := match.GetHeaders()
+	if len(headers) != 4 {
+		t.Fatalf("expected 4 header matchers, got %d", len(headers))
+	}
+
+	if headers[0].Name != ":method" || headers[0].GetSafeRegexMatch().GetRegex() != "GET|HEAD" {
+		t.Errorf("unexpected method matcher %v", headers[0])
+	}
+
+	if headers[1].Name != "x-team" || headers[1].GetExactMatch() != "web" {
+		t.Errorf("unexpected exact header matcher %v", headers[1])
+	}
+
+	if headers[2].Name != "x-debug" || !headers[2].GetPresentMatch() || !headers[2].InvertMatch {
+		t.Errorf("unexpected inverted presence matcher %v", headers[2])
+	}
+
+	if headers[3].Name != "user-agent" || headers[3].GetSafeRegexMatch().GetRegex() != ".*bot.*" {
+		t.Errorf("unexpected regex header matcher %v", headers[3])
+	}
+
+	query := match.GetQueryParameters()
+	if len(query) != 3 {
+		t.Fatalf("expected 3 query parameter matchers, got %d", len(query))
+	}
+
+	if query[0].GetStringMatch().GetExact() != "2" {
+		t.Errorf("unexpected exact query parameter matcher %v", query[0])
+	}
+
+	if query[1].GetStringMatch().GetSafeRegex().GetRegex() != "[0-9]+" {
+		t.Errorf("unexpected regex query parameter matcher %v", query[1])
+	}
+
+	if !query[2].GetPresentMatch() {
+		t.Errorf("unexpected presence query parameter matcher %v", query[2])
+	}
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"github.com/Gufran/flightpath/catalog"
+	consul "github.com/hashicorp/consul/api"
+	"sort"
+)
+
+// weightedCluster is a cluster that receives a share of the
+// traffic of a route proportional to its weight.
+type weightedCluster struct {
+	name   string
+	weight uint32
+}
+
+// serviceGroups collects the clusters that belong to the same
+// logical service, keyed by the service name. While a service is
+// migrated to connect the instances with a sidecar are in the
+// connect cluster of the sidecar and the remaining instances are
+// in the plain cluster of the service. The routes of the service
+// split the traffic between the two clusters in proportion to the
+// healthy instances in each, so every instance keeps receiving
+// its share of the traffic throughout the migration.
+//
+// Only the services with more than one cluster are returned.
+func serviceGroups(clusters []catalog.ClusterInfo) map[string][]weightedCluster {
+	result := map[string][]weightedCluster{}
+	for service, members := range serviceClusters(clusters) {
+		if len(members) > 1 {
+			result[service] = members
+		}
+	}
+	return result
+}
+
+// serviceClusters collects the clusters of every logical service
+// along with their weights, see serviceGroups. The subset clusters
+// of a service-resolver are keyed by the name of the subset, e.g.
+// web:v2, see subsetName.
+func serviceClusters(clusters []catalog.ClusterInfo) map[string][]weightedCluster {
+	members := map[string][]catalog.ClusterInfo{}
+	for _, c := range clusters {
+		key := subsetName(c.Service(), c.SubsetName())
+		members[key] = append(members[key], c)
+	}
+
+	result := map[string][]weightedCluster{}
+	for service, group := range members {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Name() < group[j].Name()
+		})
+
+		names := make([]string, len(group))
+		endpoints := make([][]catalog.Endpoint, len(group))
+		for idx, c := range group {
+			names[idx] = c.Name()
+			endpoints[idx] = c.Endpoints()
+		}
+
+		result[service] = weighClusters(names, endpoints)
+	}
+
+	return result
+}
+
+// weighClusters weighs the clusters by their endpoints
+func weighClusters(names []string, endpoints [][]catalog.Endpoint) []weightedCluster {
+	weights := make([]uint32, len(names))
+	var total uint32
+	for idx := range names {
+		weights[idx] = clusterWeight(endpoints[idx], true)
+		total += weights[idx]
+	}
+
+	// Without a healthy instance anywhere the traffic is
+	// split over all instances, Envoy decides what to do
+	// with the unhealthy ones.
+	if total == 0 {
+		for idx := range names {
+			weights[idx] = clusterWeight(endpoints[idx], false)
+		}
+	}
+
+	result := make([]weightedCluster, len(names))
+	for idx, name := range names {
+		result[idx] = weightedCluster{
+			name:   name,
+			weight: weights[idx],
+		}
+	}
+	return result
+}
+
+// clusterWeight is the sum of the load balancing weights of the
+// endpoints, so that an instance receives the same share of the
+// traffic regardless of the cluster it is in.
+func clusterWeight(endpoints []catalog.Endpoint, healthyOnly bool) uint32 {
+	var weight uint32
+	for _, e := range endpoints {
+		if healthyOnly && e.Health() != consul.HealthPassing && e.Health() != consul.HealthWarning {
+			continue
+		}
+		weight += uint32(e.Weight())
+	}
+	return weight
+}
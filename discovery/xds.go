@@ -10,57 +10,149 @@ import (
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	listener "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
-	route "github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	accesslogconfig "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
 	accesslogfilter "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	"github.com/envoyproxy/go-control-plane/pkg/cache"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
-	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/proto"
 	duration "github.com/golang/protobuf/ptypes/duration"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
+	consul "github.com/hashicorp/consul/api"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
-const XdsClusterName = "xds_cluster"
+const (
+	XdsClusterName = "xds_cluster"
+
+	// LeafSecretName is the name of SDS secret that holds
+	// the connect leaf certificate and private key.
+	LeafSecretName = "flightpath-connect-leaf"
+
+	// RootsSecretName is the name of SDS secret that holds
+	// the connect CA trust bundle.
+	RootsSecretName = "flightpath-connect-ca-roots"
+)
 
 type SyncChans struct {
-	cluster chan catalog.ClusterInfo
-	tls     chan catalog.TLSInfo
-	cleanup chan string
+	cluster   chan catalog.ClusterInfo
+	tls       chan catalog.TLSInfo
+	roots     chan catalog.CARootsInfo
+	cleanup   chan string
+	routes    chan []catalog.Route
+	routeErrs chan error
+	policy    chan *catalog.RoutePolicy
+	policyErr chan error
+	entries   chan *catalog.ConfigEntries
+	entryErrs chan error
+	gateways  chan []*catalog.IngressGateway
+	gwErrs    chan error
 }
 
 func NewSyncChans() *SyncChans {
 	return &SyncChans{
-		cluster: make(chan catalog.ClusterInfo),
-		tls:     make(chan catalog.TLSInfo),
-		cleanup: make(chan string),
+		cluster:   make(chan catalog.ClusterInfo),
+		tls:       make(chan catalog.TLSInfo),
+		roots:     make(chan catalog.CARootsInfo),
+		cleanup:   make(chan string),
+		routes:    make(chan []catalog.Route),
+		routeErrs: make(chan error),
+		policy:    make(chan *catalog.RoutePolicy),
+		policyErr: make(chan error),
+		entries:   make(chan *catalog.ConfigEntries),
+		entryErrs: make(chan error),
+		gateways:  make(chan []*catalog.IngressGateway),
+		gwErrs:    make(chan error),
 	}
 }
 
-func (x *XDS) Start(ctx context.Context) {
+func (x *XDS) Start(ctx context.Context) error {
+	if x.PolicyFile != "" && x.PolicyKVPath != "" {
+		return fmt.Errorf("route policy can be loaded either from a file or from consul kv, not both")
+	}
+
+	switch x.Connect.Mode {
+	case ConnectAuto, ConnectEnabled, ConnectDisabled:
+	default:
+		return fmt.Errorf("connect mode %q is not valid. valid options are 'auto', 'enabled' and 'disabled'", x.Connect.Mode)
+	}
+
+	// A nil policy allows every route. When a policy source
+	// is configured we start with an empty policy so that no
+	// route is published before the policy is loaded.
+	var policy *catalog.RoutePolicy
+	if x.PolicyFile != "" {
+		var err error
+		policy, err = catalog.LoadRoutePolicyFile(x.PolicyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load route policy from %s. %s", x.PolicyFile, err)
+		}
+	}
+
+	if x.PolicyKVPath != "" {
+		policy = &catalog.RoutePolicy{}
+	}
+
 	source := catalog.NewCatalog(ctx, x.Consul)
 
 	ch := NewSyncChans()
 
-	go source.DiscoverClusters(ch.cluster, ch.cleanup)
-	go source.WatchTLS(x.ServiceName, ch.tls)
+	pipeline := x.Pipeline()
+	if x.ConfigEntries {
+		pipeline.Subsets = catalog.NewSubsetFilters()
+	}
+
+	go source.DiscoverClusters(x.Selector(), pipeline, ch.cluster, ch.cleanup)
+	if x.Connect.Mode != ConnectDisabled {
+		go source.WatchTLS(x.ServiceName, ch.tls)
+		go source.WatchCARoots(ch.roots)
+	}
+
+	if x.RoutesKVPath != "" {
+		storage := catalog.NewRouteStorage(ctx, x.RoutesKVPath, x.Consul)
+		go storage.WatchRoutes(ch.routes, ch.routeErrs)
+	}
+
+	if x.PolicyKVPath != "" {
+		storage := catalog.NewPolicyStorage(ctx, x.PolicyKVPath, x.Consul)
+		go storage.WatchPolicy(ch.policy, ch.policyErr)
+	}
+
+	if x.ConfigEntries {
+		storage := catalog.NewConfigEntryStorage(ctx, x.Consul, x.Selector().Namespaces, pipeline.Subsets)
+		go storage.WatchConfigEntries(ch.entries, ch.entryErrs)
+	}
+
+	if gateways := splitList(x.IngressGateways); len(gateways) > 0 {
+		storage := catalog.NewIngressStorage(ctx, x.Consul, x.Selector().Namespaces, gateways)
+		go storage.WatchIngressGateways(ch.gateways, ch.gwErrs)
+	}
+
+	conflicts := NewRouteConflicts()
+	sources := NewRouteSources()
+	x.Readiness = NewReadiness()
+
+	if err := StartHealthServer(x.Health.Port, x.Readiness); err != nil {
+		return err
+	}
 
 	if x.Debug.Enable {
-		StartDebugServer(x.Debug.Port, x.Envoy.NodeName, x.Cache)
+		StartDebugServer(x.Debug.Port, x.Groups[0].Name, x.Cache, x.Tracker, conflicts, sources)
 	}
 
-	go synchronize(ctx, x.Cache, ch, x.Envoy)
+	go synchronize(ctx, x.Tracker, ch, x.Groups, x.Locality, x.Services.SubsetMetaKey, x.Connect, x.Readiness, conflicts, sources, policy)
+	return nil
 }
 
-func synchronize(ctx context.Context, snc cache.SnapshotCache, ch *SyncChans, envoyConfig *EnvoyConfig) {
-	// TLS info is absolutely necessary and since we know that we
-	// are registered as a connect enabled service and guaranteed
-	// to receive a certificate pair, we'll just wait for it to
-	// arrive before setting up the shop.
-	certs := <-ch.tls
+func synchronize(ctx context.Context, snc *SnapshotTracker, ch *SyncChans, groups []*NodeGroup, locality *LocalityConfig, subsetKey string, connect *ConnectConfig, readiness *Readiness, conflicts *RouteConflicts, sources *RouteSources, policy *catalog.RoutePolicy) {
+	// The connect enabled clusters can not be served without
+	// the leaf certificate. It is waited for before setting up
+	// the shop, unless connect is not available at all.
+	certs := waitForLeaf(ctx, ch.tls, connect, readiness)
 
 	tick := 1 * time.Second
 	timer := time.NewTimer(tick)
@@ -69,6 +161,21 @@ func synchronize(ctx context.Context, snc cache.SnapshotCache, ch *SyncChans, en
 	}
 
 	knownClusters := map[string]catalog.ClusterInfo{}
+	var knownRoutes []catalog.Route
+	var knownEntries *catalog.ConfigEntries
+	var knownGateways []*catalog.IngressGateway
+
+	// CA roots are not waited upon. Until they arrive the
+	// connect enabled clusters are simply not published.
+	var roots catalog.CARootsInfo
+
+	updateConnect := func() {
+		readiness.SetConnect(connectState(certs != nil, roots != nil))
+	}
+
+	if certs != nil {
+		updateConnect()
+	}
 
 	for {
 		metrics.Incr("discovery.sync.loop", nil)
@@ -83,9 +190,62 @@ func synchronize(ctx context.Context, snc cache.SnapshotCache, ch *SyncChans, en
 			metrics.GaugeI("discovery.cluster.endpoints.count", len(cluster.Endpoints()), []string{"cluster:" + cluster.Name()})
 			knownClusters[cluster.Name()] = cluster
 
+		case routes := <-ch.routes:
+			resetTimer()
+			logger.WithField("count", len(routes)).Info("updating routes from consul kv")
+			metrics.Incr("discovery.routes.update", nil)
+			knownRoutes = routes
+
+		case err := <-ch.routeErrs:
+			metrics.Incr("discovery.routes.error", nil)
+			entry := logger.WithError(err)
+			if re, ok := err.(*catalog.RouteError); ok {
+				entry = entry.WithField("key", re.Key)
+			}
+			entry.Error("failed to load routes from consul kv")
+
+		case knownEntries = <-ch.entries:
+			resetTimer()
+			logger.WithField("routers", len(knownEntries.Routers)).
+				WithField("splitters", len(knownEntries.Splitters)).
+				Info("updating consul config entries")
+			metrics.Incr("discovery.config_entries.update", nil)
+
+		case err := <-ch.entryErrs:
+			metrics.Incr("discovery.config_entries.error", nil)
+			logger.WithError(err).Error("failed to load consul config entry")
+
+		case knownGateways = <-ch.gateways:
+			resetTimer()
+			logger.WithField("count", len(knownGateways)).Info("updating consul ingress gateways")
+			metrics.Incr("discovery.ingress_gateways.update", nil)
+
+		case err := <-ch.gwErrs:
+			metrics.Incr("discovery.ingress_gateways.error", nil)
+			logger.WithError(err).Error("failed to load consul ingress gateway")
+
+		case policy = <-ch.policy:
+			resetTimer()
+			logger.WithField("rules", len(policy.Rules)).Info("updating route policy")
+			metrics.Incr("discovery.policy.update", nil)
+
+		case err := <-ch.policyErr:
+			metrics.Incr("discovery.policy.error", nil)
+			logger.WithError(err).Error("failed to load route policy. last valid policy stays in effect")
+
 		case certs = <-ch.tls:
 			resetTimer()
 			metrics.Incr("discovery.tls.update", nil)
+			catalog.SetConnectOptional(false)
+			updateConnect()
+
+		case roots = <-ch.roots:
+			resetTimer()
+			logger.WithField("active_root", roots.ActiveRootID()).Info("updating connect CA roots")
+			metrics.Incr("discovery.ca_roots.update", nil)
+			if certs != nil {
+				updateConnect()
+			}
 
 		case name := <-ch.cleanup:
 			resetTimer()
@@ -95,18 +255,107 @@ func synchronize(ctx context.Context, snc cache.SnapshotCache, ch *SyncChans, en
 				delete(knownClusters, name)
 			}
 
+		case <-snc.Joined():
+			// A node in a new zone needs its own snapshot
+			if locality.PreferLocalZone {
+				resetTimer()
+			}
+
 		case <-timer.C:
 			metrics.Incr("discovery.cluster.flush", nil)
 			metrics.GaugeI("discovery.cluster.batch_size", len(knownClusters), nil)
 
 			logger.Info("flushing cluster configuration to xDS server")
-			err := putCache(snc, envoyConfig, clustersList(knownClusters), certs)
-			if err != nil {
-				metrics.Incr("discovery.cluster.error.flush", nil)
-				logger.WithError(err).Error("failed to update cluster information")
+			clusters := clustersList(knownClusters)
+			routesByCluster := groupRoutesByCluster(knownRoutes, clusters)
+
+			failed := false
+			for _, group := range groups {
+				for _, target := range snapshotTargets(snc, group, locality) {
+					err := putCache(snc, group, target, locality, groupClusters(group, clusters), routesByCluster, knownEntries, knownGateways, subsetKey, certs, roots, conflicts, sources, policy)
+					if err != nil {
+						failed = true
+						metrics.Incr("discovery.cluster.error.flush", []string{"group:" + group.Name})
+						logger.WithError(err).WithField("group", group.Name).WithField("key", target.key).
+							Error("failed to update cluster information")
+					}
+				}
 			}
+
+			if !failed {
+				readiness.SetReady()
+			}
+		}
+	}
+}
+
+// waitForLeaf blocks until the connect leaf certificate of
+// Flightpath arrives. In auto mode it gives up after the timeout,
+// e.g. when connect is disabled in consul or the token is not
+// allowed to issue a certificate, and the plain services are
+// served without the connect enabled clusters. The certificate
+// is picked up by the synchronization loop if it arrives later.
+func waitForLeaf(ctx context.Context, certs <-chan catalog.TLSInfo, connect *ConnectConfig, readiness *Readiness) catalog.TLSInfo {
+	switch connect.Mode {
+	case ConnectDisabled:
+		readiness.SetConnect(ConnectStateDisabled, "connect is disabled with -connect.mode")
+		return nil
+
+	case ConnectEnabled:
+		select {
+		case cert := <-certs:
+			return cert
+		case <-ctx.Done():
+			return nil
 		}
 	}
+
+	timeout := time.NewTimer(connect.LeafTimeout)
+	defer timeout.Stop()
+
+	select {
+	case cert := <-certs:
+		return cert
+
+	case <-timeout.C:
+		// The connect watches keep failing when connect is not
+		// available. That is reported on /ready, it does not
+		// make Flightpath unhealthy.
+		metrics.Incr("discovery.connect.leaf_timeout", nil)
+		catalog.SetConnectOptional(true)
+		readiness.SetConnect(ConnectStateUnavailable, fmt.Sprintf("no connect leaf certificate within %s. connect may be disabled in consul "+
+			"or the token is not allowed to issue a certificate", connect.LeafTimeout))
+		return nil
+
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// snapshotTarget is a snapshot key along with the zone
+// of the nodes that use the key.
+type snapshotTarget struct {
+	key  string
+	zone string
+}
+
+// snapshotTargets lists the snapshots to build for the
+// group. When the local zone is preferred there is one
+// snapshot for every zone of the connected nodes, next to
+// the snapshot for nodes that do not report their zone.
+func snapshotTargets(snc *SnapshotTracker, group *NodeGroup, locality *LocalityConfig) []snapshotTarget {
+	targets := []snapshotTarget{{key: group.Name}}
+	if !locality.PreferLocalZone {
+		return targets
+	}
+
+	for _, key := range snc.Keys() {
+		name, zone := splitSnapshotKey(key)
+		if name == group.Name && zone != "" {
+			targets = append(targets, snapshotTarget{key: key, zone: zone})
+		}
+	}
+	return targets
 }
 
 func clustersList(cl map[string]catalog.ClusterInfo) []catalog.ClusterInfo {
@@ -117,7 +366,18 @@ func clustersList(cl map[string]catalog.ClusterInfo) []catalog.ClusterInfo {
 	return result
 }
 
-func putCache(snc cache.SnapshotCache, envoyConfig *EnvoyConfig, clusters []catalog.ClusterInfo, tls catalog.TLSInfo) error {
+// groupClusters returns the clusters selected by the group
+func groupClusters(group *NodeGroup, clusters []catalog.ClusterInfo) []catalog.ClusterInfo {
+	var result []catalog.ClusterInfo
+	for _, c := range clusters {
+		if group.Selects(c.Tags()) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func putCache(snc *SnapshotTracker, group *NodeGroup, target snapshotTarget, locality *LocalityConfig, clusters []catalog.ClusterInfo, routesByCluster map[string][]catalog.Route, entries *catalog.ConfigEntries, gateways []*catalog.IngressGateway, subsetKey string, tls catalog.TLSInfo, roots catalog.CARootsInfo, conflicts *RouteConflicts, sources *RouteSources, policy *catalog.RoutePolicy) error {
 	var (
 		// NOTE: actual type is []envoyapiv2.Cluster
 		clusterResource []cache.Resource
@@ -127,13 +387,16 @@ func putCache(snc cache.SnapshotCache, envoyConfig *EnvoyConfig, clusters []cata
 		listenerResource []cache.Resource
 		// NOTE actual type is []envoyapiv2.ClusterLoadAssignment
 		endpointResource []cache.Resource
+		// NOTE actual type is []auth.Secret
+		secretResource []cache.Resource
 	)
 
-	defer metrics.Timed("discovery.cache.put_ns", time.Now(), nil)
+	envoyConfig := group.Envoy
+	tags := []string{"group:" + group.Name}
 
-	vhosts := vhostPool{
-		vhs: []vhost{},
-	}
+	defer metrics.Timed("discovery.cache.put_ns", time.Now(), tags)
+
+	vhosts := newVhostPool(policy)
 
 	envoyListener, err := buildListener("flightpath", envoyConfig)
 	if err != nil {
@@ -144,25 +407,116 @@ func putCache(snc cache.SnapshotCache, envoyConfig *EnvoyConfig, clusters []cata
 		envoyListener,
 	}
 
+	var published []catalog.ClusterInfo
 	for _, service := range clusters {
+		if service.IsConnectEnabled() && tls == nil {
+			// Envoy has no certificate to present to the sidecar.
+			// The reason is reported once by the readiness state.
+			metrics.Incr("discovery.cluster.error.no_leaf_cert", []string{"cluster:" + service.Name()})
+			logger.WithField("cluster", service.Name()).
+				Debug("connect leaf certificate is not available. cluster will not be published")
+			continue
+		}
+
+		if service.IsConnectEnabled() && roots == nil {
+			// Without a trust bundle there is no way to verify the
+			// upstream identity. Skip the cluster entirely instead
+			// of sending traffic over an unverified connection.
+			metrics.Incr("discovery.cluster.error.no_ca_roots", []string{"cluster:" + service.Name()})
+			logger.WithField("cluster", service.Name()).
+				Error("connect CA roots are not available. cluster will not be published")
+			continue
+		}
+		published = append(published, service)
+	}
+
+	vhosts.groups = serviceGroups(published)
+	pinned := servicePinnedDatacenters(published)
+
+	// The subset clusters of the service-resolvers and of the
+	// subset meta key only receive the traffic that resolves
+	// to their subset.
+	subsets := subsetClusters(published, entries)
+	subsets = append(subsets, metaSubsetClusters(published, subsetKey, entries)...)
+
+	// The rest of the traffic of a canary route goes to the
+	// instances that are not in the canary subset.
+	canaries := canaryClusters(published, subsets)
+	for _, c := range canaries {
+		vhosts.canaries[c.Name()] = c
+	}
+
+	subsets = append(subsets, canaries...)
+	all := append(append([]catalog.ClusterInfo{}, published...), subsets...)
+
+	byService := map[string][]catalog.ClusterInfo{}
+	for _, c := range all {
+		key := subsetName(c.Service(), c.SubsetName())
+		byService[key] = append(byService[key], c)
+	}
+
+	vhosts.services = serviceClusters(all)
+	if entries != nil {
+		mergeDatacenters(pinned, redirectDatacenters(entries))
+
+		vhosts.entries = entries
+		for key, members := range datacenterServiceClusters(all, pinned) {
+			vhosts.services[key] = members
+		}
+	}
+
+	var trustDomain string
+	if roots != nil {
+		trustDomain = roots.TrustDomain()
+	}
+
+	for idx, service := range all {
 		clusterConfig := buildCluster(service)
+		applyResolver(clusterConfig, entries.Resolver(service.Service()))
+
+		endpoints, identities := failover(service, entries, byService, trustDomain)
 
 		if service.IsConnectEnabled() {
-			clusterConfig.TransportSocket, err = buildTransportSocket(tls)
+			sans := mergeIdentities(service.SpiffeIDs(trustDomain), identities)
+			clusterConfig.TransportSocket, err = buildTransportSocket(sans)
 			if err != nil {
 				return err
 			}
 		}
 
-		vhosts.add(service)
+		if idx < len(published) {
+			vhosts.add(service, routesByCluster[service.Name()])
+		}
 
 		clusterResource = append(clusterResource, clusterConfig)
 		endpointResource = append(endpointResource, &envoyapiv2.ClusterLoadAssignment{
 			ClusterName: service.Name(),
-			Endpoints:   buildEndpoints(service.Endpoints()),
+			Endpoints:   buildEndpoints(endpoints, locality, target.zone),
 		})
+
+		// Routes pinned to a datacenter need a cluster that
+		// holds only the instances in that datacenter.
+		for _, dc := range pinned[service.Service()] {
+			name := datacenterClusterName(service.Name(), dc)
+
+			dcConfig := proto.Clone(clusterConfig).(*envoyapiv2.Cluster)
+			dcConfig.Name = name
+			dcConfig.EdsClusterConfig.ServiceName = name
+
+			clusterResource = append(clusterResource, dcConfig)
+			endpointResource = append(endpointResource, &envoyapiv2.ClusterLoadAssignment{
+				ClusterName: name,
+				Endpoints:   buildEndpoints(datacenterEndpoints(service.Endpoints(), dc), locality, target.zone),
+			})
+		}
 	}
 
+	ingress := addIngress(vhosts, envoyConfig.ListenerPort, gateways, byService)
+
+	secretResource = buildSecrets(tls, roots)
+	routeConflicts := vhosts.resolveConflicts()
+	routeSources := vhosts.sources("upstream")
+
 	routeResource = []cache.Resource{
 		&envoyapiv2.RouteConfiguration{
 			Name:         "upstream",
@@ -170,13 +524,54 @@ func putCache(snc cache.SnapshotCache, envoyConfig *EnvoyConfig, clusters []cata
 		},
 	}
 
-	metrics.GaugeI("discovery.cache.put.clusters", len(clusterResource), nil)
-	metrics.GaugeI("discovery.cache.put.endpoints", len(endpointResource), nil)
-	metrics.GaugeI("discovery.cache.put.routes", len(routeResource), nil)
-	metrics.GaugeI("discovery.cache.put.listener", len(listenerResource), nil)
+	for _, l := range ingress {
+		ingressListener, err := buildIngressListener(l, envoyConfig, tls != nil)
+		if err != nil {
+			return err
+		}
+
+		if ingressListener == nil {
+			metrics.Incr("discovery.ingress.error.no_leaf_cert", []string{"gateway:" + l.gateway})
+			logger.WithField("gateway", l.gateway).WithField("listener", l.name()).
+				Debug("connect leaf certificate is not available. tls listener will not be published")
+			continue
+		}
+		listenerResource = append(listenerResource, ingressListener)
+
+		if l.vhosts == nil {
+			continue
+		}
+
+		for _, c := range l.vhosts.resolveConflicts() {
+			c.Listener = l.name()
+			routeConflicts = append(routeConflicts, c)
+		}
+		routeSources = append(routeSources, l.vhosts.sources(l.name())...)
 
-	snap := cache.NewSnapshot(catalog.Hash(clusters), endpointResource, clusterResource, routeResource, listenerResource)
-	return snc.SetSnapshot(envoyConfig.NodeName, snap)
+		routeResource = append(routeResource, &envoyapiv2.RouteConfiguration{
+			Name:         l.name(),
+			VirtualHosts: l.vhosts.collect(l.port),
+		})
+	}
+
+	conflicts.Set(group.Name, routeConflicts)
+	sources.Set(group.Name, routeSources)
+
+	metrics.GaugeI("discovery.cache.put.clusters", len(clusterResource), tags)
+	metrics.GaugeI("discovery.cache.put.endpoints", len(endpointResource), tags)
+	metrics.GaugeI("discovery.cache.put.routes", len(routeResource), tags)
+	metrics.GaugeI("discovery.cache.put.listener", len(listenerResource), tags)
+	metrics.GaugeI("discovery.cache.put.secrets", len(secretResource), tags)
+
+	// Every resource type is versioned on its own content so
+	// that only the types that actually changed are pushed to
+	// Envoy, e.g. a certificate rotation only updates secrets.
+	snap, err := newVersionedSnapshot(endpointResource, clusterResource, routeResource, listenerResource, secretResource)
+	if err != nil {
+		return fmt.Errorf("failed to version the snapshot. %s", err)
+	}
+
+	return snc.SetSnapshot(target.key, snap)
 }
 
 func buildCluster(service catalog.ClusterInfo) *envoyapiv2.Cluster {
@@ -247,11 +642,17 @@ func buildCluster(service catalog.ClusterInfo) *envoyapiv2.Cluster {
 }
 
 func buildListener(name string, envoyConfig *EnvoyConfig) (*envoyapiv2.Listener, error) {
-	filterChain, err := buildFilterChains(envoyConfig)
+	filterChain, err := buildFilterChains(envoyConfig, "upstream", "http")
 	if err != nil {
 		return nil, fmt.Errorf("failed to build ListenerFilterChain. %s", err)
 	}
 
+	return buildListenerOn(name, envoyConfig.ListenerPort, filterChain, envoyConfig), nil
+}
+
+// buildListenerOn builds a listener on the port with the
+// listener settings of the node group.
+func buildListenerOn(name string, port int, filterChain []*listener.FilterChain, envoyConfig *EnvoyConfig) *envoyapiv2.Listener {
 	l := &envoyapiv2.Listener{
 		Name: name,
 		Address: &core.Address{
@@ -260,7 +661,7 @@ func buildListener(name string, envoyConfig *EnvoyConfig) (*envoyapiv2.Listener,
 					Protocol: core.SocketAddress_TCP,
 					Address:  "0.0.0.0",
 					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: uint32(envoyConfig.ListenerPort),
+						PortValue: uint32(port),
 					},
 				},
 			},
@@ -287,20 +688,34 @@ func buildListener(name string, envoyConfig *EnvoyConfig) (*envoyapiv2.Listener,
 		Value: uint32(envoyConfig.ListenerPerConnBufLimitBytes),
 	}
 
-	return l, nil
+	return l
 }
 
-func buildTransportSocket(tls catalog.TLSInfo) (*core.TransportSocket, error) {
+func buildTransportSocket(sans []string) (*core.TransportSocket, error) {
 	upstreamTls := &auth.UpstreamTlsContext{
 		AllowRenegotiation: true,
 		CommonTlsContext: &auth.CommonTlsContext{
-			TlsCertificates: []*auth.TlsCertificate{
-				buildTlsCertChain(tls),
+			TlsCertificateSdsSecretConfigs: []*auth.SdsSecretConfig{
+				{
+					Name:      LeafSecretName,
+					SdsConfig: buildXdsConfigSource(),
+				},
+			},
+			ValidationContextType: &auth.CommonTlsContext_CombinedValidationContext{
+				CombinedValidationContext: &auth.CommonTlsContext_CombinedCertificateValidationContext{
+					DefaultValidationContext: &auth.CertificateValidationContext{
+						VerifySubjectAltName: sans,
+					},
+					ValidationContextSdsSecretConfig: &auth.SdsSecretConfig{
+						Name:      RootsSecretName,
+						SdsConfig: buildXdsConfigSource(),
+					},
+				},
 			},
 		},
 	}
 
-	tlsAny, err := ptypes.MarshalAny(upstreamTls)
+	tlsAny, err := deterministicAny(upstreamTls)
 	if err != nil {
 		return nil, err
 	}
@@ -313,7 +728,7 @@ func buildTransportSocket(tls catalog.TLSInfo) (*core.TransportSocket, error) {
 	}, nil
 }
 
-func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error) {
+func buildFilterChains(envoyConfig *EnvoyConfig, routeConfig, statPrefix string) ([]*listener.FilterChain, error) {
 	serviceTarget := &core.GrpcService{
 		TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
 			EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
@@ -361,7 +776,7 @@ func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error
 		},
 	}
 
-	alPbStr, err := ptypes.MarshalAny(accessLogger)
+	alPbStr, err := deterministicAny(accessLogger)
 	if err != nil {
 		return nil, err
 	}
@@ -369,7 +784,7 @@ func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error
 	manager := &hcm.HttpConnectionManager{
 		ServerName:                "LadyLuck",
 		CodecType:                 hcm.HttpConnectionManager_AUTO,
-		StatPrefix:                "http",
+		StatPrefix:                statPrefix,
 		IdleTimeout:               &duration.Duration{Seconds: envoyConfig.HttpIdleTimeout},
 		StreamIdleTimeout:         &duration.Duration{Seconds: envoyConfig.HttpStreamIdleTimeout},
 		RequestTimeout:            &duration.Duration{Seconds: envoyConfig.HttpRequestTimeout},
@@ -388,7 +803,7 @@ func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error
 		},
 		RouteSpecifier: &hcm.HttpConnectionManager_Rds{
 			Rds: &hcm.Rds{
-				RouteConfigName: "upstream",
+				RouteConfigName: routeConfig,
 				ConfigSource:    rdsSource,
 			},
 		},
@@ -421,7 +836,7 @@ func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error
 		}
 	}
 
-	mgrPbStr, err := ptypes.MarshalAny(manager)
+	mgrPbStr, err := deterministicAny(manager)
 	if err != nil {
 		return nil, err
 	}
@@ -442,178 +857,152 @@ func buildFilterChains(envoyConfig *EnvoyConfig) ([]*listener.FilterChain, error
 	}, nil
 }
 
-func buildEndpoints(endpoints []catalog.Endpoint) []*endpoint.LocalityLbEndpoints {
-	var results []*endpoint.LocalityLbEndpoints
+// buildEndpoints groups the endpoints into one locality
+// per datacenter, region, zone and sub zone. Every endpoint
+// carries the weight registered in consul so that the traffic
+// can be shifted at runtime. Remote datacenters get a lower
+// priority in their failover order, and within a datacenter
+// the localities outside the local zone get a lower priority
+// when the local zone is known.
+func buildEndpoints(endpoints []catalog.Endpoint, locality *LocalityConfig, localZone string) []*endpoint.LocalityLbEndpoints {
+	var keys []string
+	var priorities []uint32
+	byLocality := map[string]*endpoint.LocalityLbEndpoints{}
+
 	for _, e := range endpoints {
-		epdef := &endpoint.LocalityLbEndpoints{
-			// TODO: configure LoadBalancingWeight from consul catalog
-			//    service weight.
-			LbEndpoints: []*endpoint.LbEndpoint{
-				{
-					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-						Endpoint: &endpoint.Endpoint{
-							Address: &core.Address{
-								Address: &core.Address_SocketAddress{
-									SocketAddress: &core.SocketAddress{
-										Protocol: core.SocketAddress_TCP,
-										Address:  e.Addr(),
-										PortSpecifier: &core.SocketAddress_PortValue{
-											PortValue: uint32(e.Port()),
-										},
-									},
+		l := locality.endpointLocality(e)
+		key := strings.Join([]string{e.Datacenter(), l.Region, l.Zone, l.SubZone, strconv.Itoa(e.DatacenterPriority())}, "/")
+
+		group, ok := byLocality[key]
+		if !ok {
+			priority := uint32(e.DatacenterPriority())*2 + localityPriority(l, localZone)
+			group = &endpoint.LocalityLbEndpoints{
+				Locality: l,
+				Priority: priority,
+			}
+			byLocality[key] = group
+			keys = append(keys, key)
+			priorities = append(priorities, priority)
+		}
+
+		group.LbEndpoints = append(group.LbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Protocol: core.SocketAddress_TCP,
+								Address:  e.Addr(),
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: uint32(e.Port()),
 								},
 							},
 						},
 					},
 				},
 			},
-		}
-
-		results = append(results, epdef)
-	}
-	return results
-}
-
-func buildTlsCertChain(tls catalog.TLSInfo) *auth.TlsCertificate {
-	return &auth.TlsCertificate{
-		CertificateChain: &core.DataSource{
-			Specifier: &core.DataSource_InlineString{
-				InlineString: tls.Cert(),
-			},
-		},
-		PrivateKey: &core.DataSource{
-			Specifier: &core.DataSource_InlineString{
-				InlineString: tls.PKey(),
+			HealthStatus: buildHealthStatus(e.Health()),
+			LoadBalancingWeight: &wrappers.UInt32Value{
+				Value: uint32(e.Weight()),
 			},
-		},
+		})
 	}
-}
 
-func buildRouteMatchSpec(r string) *route.RouteMatch {
-	matcher := &route.RouteMatch{
-		CaseSensitive: &wrappers.BoolValue{
-			Value: false,
-		},
-	}
+	sort.Strings(keys)
+	compact := compactPriorities(priorities)
 
-	if strings.HasSuffix(r, "/") || strings.HasSuffix(r, "*") {
-		matcher.PathSpecifier = &route.RouteMatch_Prefix{
-			Prefix: r,
-		}
-	} else {
-		matcher.PathSpecifier = &route.RouteMatch_Path{
-			Path: r,
-		}
+	var results []*endpoint.LocalityLbEndpoints
+	for _, key := range keys {
+		group := byLocality[key]
+		group.Priority = compact[group.Priority]
+		results = append(results, group)
 	}
+	return results
+}
 
-	return matcher
+// buildHealthStatus maps the consul health status of an
+// endpoint to Envoy. Unhealthy and draining endpoints are
+// still published so that Envoy can drain the connections
+// and apply the panic threshold.
+func buildHealthStatus(status string) core.HealthStatus {
+	switch status {
+	case consul.HealthPassing:
+		return core.HealthStatus_HEALTHY
+	case consul.HealthWarning:
+		return core.HealthStatus_DEGRADED
+	case consul.HealthCritical:
+		return core.HealthStatus_UNHEALTHY
+	case consul.HealthMaint:
+		return core.HealthStatus_DRAINING
+	}
+	return core.HealthStatus_UNKNOWN
 }
 
-func buildClusterRoutingAction(config *vhostInfo) *route.Route_Route {
-	return &route.Route_Route{
-		Route: &route.RouteAction{
-			ClusterNotFoundResponseCode: route.RouteAction_SERVICE_UNAVAILABLE,
-			ClusterSpecifier: &route.RouteAction_Cluster{
-				Cluster: config.clusterName,
+// buildXdsConfigSource points Envoy back to Flightpath
+// for dynamically discovered resources.
+func buildXdsConfigSource() *core.ConfigSource {
+	return &core.ConfigSource{
+		ConfigSourceSpecifier: &core.ConfigSource_ApiConfigSource{
+			ApiConfigSource: &core.ApiConfigSource{
+				ApiType: core.ApiConfigSource_GRPC,
+				GrpcServices: []*core.GrpcService{
+					{
+						TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+							EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+								ClusterName: XdsClusterName,
+							},
+						},
+					},
+				},
 			},
 		},
 	}
 }
 
-type vhostInfo struct {
-	clusterName  string
-	endpointName string
-	paths        []string
-}
-
-type vhost struct {
-	routes   map[string][]vhostInfo
-	settings *catalog.ClusterSettings
-}
-
-type vhostPool struct {
-	vhs []vhost
-}
-
-func (v *vhostPool) add(c catalog.ClusterInfo) {
-	settings, err := c.Settings()
-	if err != nil {
-		logger.WithError(err).WithField("cluster", c.Name()).
-			Error("failed to load cluster settings. using default values for virtualhost")
-		settings = &catalog.ClusterSettings{}
-		settings.Canonicalize()
-	}
-
-	vhs := vhost{
-		routes:   map[string][]vhostInfo{},
-		settings: settings,
-	}
-
-	for _, e := range c.Endpoints() {
-		for domain, paths := range e.RoutingInfo() {
-			vhs.routes[domain] = append(vhs.routes[domain], vhostInfo{
-				clusterName:  c.Name(),
-				endpointName: e.Name(),
-				paths:        paths,
-			})
-		}
+// buildSecrets creates the SDS resources referenced by
+// connect enabled clusters. The CA roots secret is left
+// out until the roots are available.
+func buildSecrets(tls catalog.TLSInfo, roots catalog.CARootsInfo) []cache.Resource {
+	var secrets []cache.Resource
+
+	if tls != nil {
+		secrets = append(secrets, &auth.Secret{
+			Name: LeafSecretName,
+			Type: &auth.Secret_TlsCertificate{
+				TlsCertificate: buildTlsCertChain(tls),
+			},
+		})
 	}
 
-	v.vhs = append(v.vhs, vhs)
-}
-
-func (v *vhostPool) collect(proxyPort int) []*route.VirtualHost {
-	var virtualHosts []*route.VirtualHost
-	for _, vh := range v.vhs {
-		for domain, routes := range vh.routes {
-			target := &route.VirtualHost{
-				Name: "vh-" + domain,
-				// TODO: Envoy fails to match the domain if the client
-				//   sends the Host header with port in it. for the time
-				//   we match on the bare domain as well as on the domain
-				//   with the port number on it, but this should be removed
-				//   when the behaviour is improved in Envoy.
-				// See: https://github.com/envoyproxy/envoy/issues/886
-				Domains:                    []string{domain, fmt.Sprintf("%s:%d", domain, proxyPort)},
-				IncludeRequestAttemptCount: true,
-				Routes:                     []*route.Route{},
-			}
-
-			if vh.settings.RetryOn != "" {
-				target.RetryPolicy = &route.RetryPolicy{
-					RetryOn:                       vh.settings.RetryOn,
-					HostSelectionRetryMaxAttempts: 3,
-					NumRetries:                    &wrappers.UInt32Value{Value: vh.settings.RetryAttempts},
-					PerTryTimeout:                 &duration.Duration{Seconds: vh.settings.RetryAttemptTimeout},
-					RetryHostPredicate: []*route.RetryPolicy_RetryHostPredicate{
-						{Name: "envoy.retry_host_predicates.previous_hosts"},
-					},
-					RetryBackOff: &route.RetryPolicy_RetryBackOff{
-						BaseInterval: &duration.Duration{Seconds: vh.settings.RetryBackoffBase},
-						MaxInterval:  &duration.Duration{Seconds: vh.settings.RetryBackoffMax},
+	if roots != nil {
+		secrets = append(secrets, &auth.Secret{
+			Name: RootsSecretName,
+			Type: &auth.Secret_ValidationContext{
+				ValidationContext: &auth.CertificateValidationContext{
+					TrustedCa: &core.DataSource{
+						Specifier: &core.DataSource_InlineString{
+							InlineString: roots.Bundle(),
+						},
 					},
-				}
-			}
-
-			for _, vhinfo := range routes {
-				target.Routes = append(target.Routes, buildVirtualHostRoutes(&vhinfo)...)
-			}
-
-			virtualHosts = append(virtualHosts, target)
-		}
+				},
+			},
+		})
 	}
 
-	return virtualHosts
+	return secrets
 }
 
-func buildVirtualHostRoutes(config *vhostInfo) []*route.Route {
-	var routes []*route.Route
-	for idx, pat := range config.paths {
-		routes = append(routes, &route.Route{
-			Name:   fmt.Sprintf("%s.%s-%d", config.clusterName, config.endpointName, idx),
-			Match:  buildRouteMatchSpec(pat),
-			Action: buildClusterRoutingAction(config),
-		})
+func buildTlsCertChain(tls catalog.TLSInfo) *auth.TlsCertificate {
+	return &auth.TlsCertificate{
+		CertificateChain: &core.DataSource{
+			Specifier: &core.DataSource_InlineString{
+				InlineString: tls.Cert(),
+			},
+		},
+		PrivateKey: &core.DataSource{
+			Specifier: &core.DataSource_InlineString{
+				InlineString: tls.PKey(),
+			},
+		},
 	}
-	return routes
 }
@@ -0,0 +1,207 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/Gufran/flightpath/catalog"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/google/go-cmp/cmp"
+	consul "github.com/hashicorp/consul/api"
+	"testing"
+)
+
+func TestBuildHealthStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		expect core.HealthStatus
+	}{
+		{status: consul.HealthPassing, expect: core.HealthStatus_HEALTHY},
+		{status: consul.HealthWarning, expect: core.HealthStatus_DEGRADED},
+		{status: consul.HealthCritical, expect: core.HealthStatus_UNHEALTHY},
+		{status: consul.HealthMaint, expect: core.HealthStatus_DRAINING},
+		{status: "", expect: core.HealthStatus_UNKNOWN},
+	}
+
+	for idx, test := range tests {
+		result := buildHealthStatus(test.status)
+		if result != test.expect {
+			t.Errorf("case %d: expected %s, got %s", idx, test.expect, result)
+		}
+	}
+}
+
+// instance is a passing service instance on a node in
+// the zone and datacenter, registered with the weight.
+func instance(addr, zone, dc string, weight int) *consul.CatalogService {
+	return &consul.CatalogService{
+		ID:             addr,
+		Address:        addr,
+		Datacenter:     dc,
+		NodeMeta:       map[string]string{"zone": zone},
+		ServiceID:      "web-" + addr,
+		ServiceName:    "web",
+		ServicePort:    8080,
+		ServiceWeights: consul.Weights{Passing: weight, Warning: 1},
+		Checks:         consul.HealthChecks{{Status: consul.HealthPassing}},
+	}
+}
+
+// summarizeEndpoints describes every locality of the load assignment
+// as "<zone>/<priority>: <address>=<weight> ..." in the built order.
+func summarizeEndpoints(endpoints []*endpoint.LocalityLbEndpoints) []string {
+	var result []string
+	for _, group := range endpoints {
+		summary := fmt.Sprintf("%s/%d:", group.GetLocality().GetZone(), group.GetPriority())
+		for _, e := range group.GetLbEndpoints() {
+			addr := e.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()
+			summary += fmt.Sprintf(" %s=%d", addr, e.GetLoadBalancingWeight().GetValue())
+		}
+		result = append(result, summary)
+	}
+	return result
+}
+
+func TestBuildEndpoints(t *testing.T) {
+	locality := &LocalityConfig{ZoneKey: "zone"}
+
+	tests := []struct {
+		instances []*consul.CatalogService
+		locality  *LocalityConfig
+		expect    []string
+	}{
+		{
+			// weights are kept per endpoint
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1a", "", 10),
+				instance("10.0.0.2", "us-east-1a", "", 1),
+				instance("10.0.0.3", "us-east-1a", "", 0),
+			},
+			locality: locality,
+			expect:   []string{"us-east-1a/0: 10.0.0.1=10 10.0.0.2=1 10.0.0.3=1"},
+		},
+		{
+			// one locality per zone, all at the same priority
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1b", "", 3),
+				instance("10.0.0.2", "us-east-1a", "", 2),
+				instance("10.0.0.3", "us-east-1b", "", 1),
+			},
+			locality: locality,
+			expect: []string{
+				"us-east-1a/0: 10.0.0.2=2",
+				"us-east-1b/0: 10.0.0.1=3 10.0.0.3=1",
+			},
+		},
+		{
+			// without a zone key every endpoint is in one locality
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1b", "", 3),
+				instance("10.0.0.2", "us-east-1a", "", 2),
+			},
+			locality: &LocalityConfig{},
+			expect:   []string{"/0: 10.0.0.1=3 10.0.0.2=2"},
+		},
+		{
+			instances: nil,
+			locality:  locality,
+			expect:    nil,
+		},
+	}
+
+	for idx, test := range tests {
+		cluster := catalog.NewCluster("", "web", test.instances, map[string]int{})
+		result := summarizeEndpoints(buildEndpoints(cluster.Endpoints(), test.locality, ""))
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}
+
+func TestBuildEndpoints_Priorities(t *testing.T) {
+	locality := &LocalityConfig{ZoneKey: "zone", PreferLocalZone: true}
+	priorities := map[string]int{"dc1": 0, "dc2": 1, "dc3": 2}
+
+	tests := []struct {
+		instances []*consul.CatalogService
+		localZone string
+		expect    []string
+	}{
+		{
+			// local zone, remote zone and remote datacenter
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1a", "dc1", 1),
+				instance("10.0.0.2", "us-east-1b", "dc1", 1),
+				instance("10.1.0.1", "us-west-2a", "dc2", 1),
+			},
+			localZone: "us-east-1a",
+			expect: []string{
+				"us-east-1a/0: 10.0.0.1=1",
+				"us-east-1b/1: 10.0.0.2=1",
+				"us-west-2a/2: 10.1.0.1=1",
+			},
+		},
+		{
+			// the local datacenter has no instance in the local
+			// zone, priority 0 is taken by the remote zone
+			instances: []*consul.CatalogService{
+				instance("10.0.0.2", "us-east-1b", "dc1", 1),
+				instance("10.1.0.1", "us-west-2a", "dc2", 1),
+			},
+			localZone: "us-east-1a",
+			expect: []string{
+				"us-east-1b/0: 10.0.0.2=1",
+				"us-west-2a/1: 10.1.0.1=1",
+			},
+		},
+		{
+			// the gap left by the datacenter without instances
+			// is closed, dc3 follows the local datacenter
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1a", "dc1", 1),
+				instance("10.2.0.1", "eu-west-1a", "dc3", 1),
+			},
+			localZone: "us-east-1a",
+			expect: []string{
+				"us-east-1a/0: 10.0.0.1=1",
+				"eu-west-1a/1: 10.2.0.1=1",
+			},
+		},
+		{
+			// a remote datacenter with an instance in a zone of
+			// the same name is still behind the local datacenter
+			instances: []*consul.CatalogService{
+				instance("10.0.0.2", "us-east-1b", "dc1", 1),
+				instance("10.1.0.1", "us-east-1a", "dc2", 1),
+				instance("10.2.0.1", "eu-west-1a", "dc3", 1),
+			},
+			localZone: "us-east-1a",
+			expect: []string{
+				"us-east-1b/0: 10.0.0.2=1",
+				"us-east-1a/1: 10.1.0.1=1",
+				"eu-west-1a/2: 10.2.0.1=1",
+			},
+		},
+		{
+			// without the local zone only the datacenters count
+			instances: []*consul.CatalogService{
+				instance("10.0.0.1", "us-east-1a", "dc1", 1),
+				instance("10.0.0.2", "us-east-1b", "dc1", 1),
+				instance("10.2.0.1", "eu-west-1a", "dc3", 1),
+			},
+			localZone: "",
+			expect: []string{
+				"us-east-1a/0: 10.0.0.1=1",
+				"us-east-1b/0: 10.0.0.2=1",
+				"eu-west-1a/1: 10.2.0.1=1",
+			},
+		},
+	}
+
+	for idx, test := range tests {
+		cluster := catalog.NewCluster("", "web", test.instances, priorities)
+		result := summarizeEndpoints(buildEndpoints(cluster.Endpoints(), locality, test.localZone))
+		if !cmp.Equal(result, test.expect) {
+			t.Errorf("case %d: %s", idx, cmp.Diff(result, test.expect))
+		}
+	}
+}